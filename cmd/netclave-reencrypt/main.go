@@ -0,0 +1,102 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Command netclave-reencrypt seals the rows of encrypted tables with the
+// current encryption key. Run it after adding a key version, before removing
+// the old one, or after encrypting a table which already holds rows:
+//
+//	netclave-reencrypt -type postgresql -credentials credentials.json
+//
+// The credentials file is a JSON object of the credentials the services use,
+// including the encryption settings of cryptoutils.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"strings"
+
+	"github.com/netclave/common/cryptoutils"
+	"github.com/netclave/common/storage"
+)
+
+func main() {
+	storageType := flag.String("type", "", "storage type, such as redis or postgresql")
+	credentialsFile := flag.String("credentials", "", "JSON file with the storage credentials")
+	tables := flag.String("tables", "", "comma separated tables, by default those of the credentials")
+
+	flag.Parse()
+
+	if *storageType == "" || *credentialsFile == "" {
+		flag.Usage()
+		log.Fatal("-type and -credentials are required")
+	}
+
+	data, err := ioutil.ReadFile(*credentialsFile)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	credentials := map[string]string{}
+
+	err = json.Unmarshal(data, &credentials)
+
+	if err != nil {
+		log.Fatalf("Can not read %s: %v", *credentialsFile, err)
+	}
+
+	if *tables != "" {
+		credentials[cryptoutils.ENCRYPTED_TABLES] = *tables
+	}
+
+	keys, err := cryptoutils.LoadKeyRing(credentials)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if keys == nil {
+		log.Fatalf("The credentials set neither %s nor %s", cryptoutils.ENCRYPTION_KEYS_FILE, cryptoutils.ENCRYPTION_KEYS_ENV)
+	}
+
+	backend, err := storage.CreateStorage(credentials, *storageType, false)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer backend.Destroy()
+
+	encryptedTables := cryptoutils.EncryptedTables(credentials)
+	encryptedStorage := cryptoutils.NewEncryptedStorage(backend, keys, encryptedTables)
+
+	for _, table := range encryptedTables {
+		count, err := encryptedStorage.Reencrypt(context.Background(), table)
+
+		if err != nil {
+			backend.Destroy()
+			log.Fatalf("Table %s: %v after sealing %d values", table, err, count)
+		}
+
+		log.Printf("Table %s: sealed %d values", table, count)
+	}
+
+	log.Printf("Done with %s", strings.Join(encryptedTables, ", "))
+}
@@ -0,0 +1,234 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Command netclave-storage-migrate copies every table from one storage to
+// another, for example from sqlite to PostgreSQL:
+//
+//	netclave-storage-migrate -from-type sqlite -from-credentials old.json \
+//		-to-type postgresql -to-credentials new.json -state migrate.state
+//
+// Credentials files are JSON objects of the credentials the services use. The
+// destination schema is created or migrated first. Tables are copied one at a
+// time through the storage export format, and those copied are appended to the
+// -state file, so a run which was interrupted resumes with the first table it
+// did not finish. Copying a table again is harmless, keys and fields are
+// replaced. Afterwards every table is compared with the source, unless
+// -verify=false, and the command fails if they differ.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/netclave/common/storage"
+)
+
+func readCredentials(file string) map[string]string {
+	data, err := ioutil.ReadFile(file)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	credentials := map[string]string{}
+
+	err = json.Unmarshal(data, &credentials)
+
+	if err != nil {
+		log.Fatalf("Can not read %s: %v", file, err)
+	}
+
+	return credentials
+}
+
+// readState returns the tables a previous run finished.
+func readState(file string) map[string]bool {
+	done := map[string]bool{}
+
+	if file == "" {
+		return done
+	}
+
+	data, err := ioutil.ReadFile(file)
+
+	if os.IsNotExist(err) {
+		return done
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, table := range strings.Split(string(data), "\n") {
+		if table != "" {
+			done[table] = true
+		}
+	}
+
+	return done
+}
+
+func markDone(file string, table string) error {
+	if file == "" {
+		return nil
+	}
+
+	state, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = state.WriteString(table + "\n")
+
+	if err != nil {
+		state.Close()
+		return err
+	}
+
+	return state.Close()
+}
+
+// copyTable streams the export of table from src straight into dst.
+func copyTable(ctx context.Context, src storage.Storage, dst storage.Storage, table string) error {
+	reader, writer := io.Pipe()
+
+	go func() {
+		writer.CloseWithError(storage.ExportContext(ctx, src, writer, table))
+	}()
+
+	err := storage.ImportContext(ctx, dst, reader)
+
+	reader.CloseWithError(err)
+
+	return err
+}
+
+func main() {
+	fromType := flag.String("from-type", "", "source storage type, such as sqlite")
+	fromCredentials := flag.String("from-credentials", "", "JSON file with the source credentials")
+	toType := flag.String("to-type", "", "destination storage type, such as postgresql")
+	toCredentials := flag.String("to-credentials", "", "JSON file with the destination credentials")
+	tables := flag.String("tables", "", "comma separated tables, by default every table of the source")
+	stateFile := flag.String("state", "", "file recording the tables copied, to resume an interrupted run")
+	verify := flag.Bool("verify", true, "compare every table with the source after copying")
+
+	flag.Parse()
+
+	if *fromType == "" || *fromCredentials == "" || *toType == "" || *toCredentials == "" {
+		flag.Usage()
+		log.Fatal("-from-type, -from-credentials, -to-type and -to-credentials are required")
+	}
+
+	ctx := context.Background()
+
+	src, err := storage.CreateStorage(readCredentials(*fromCredentials), *fromType, false)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer src.Destroy()
+
+	dst, err := storage.CreateStorage(readCredentials(*toCredentials), *toType, true)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer dst.Destroy()
+
+	err = dst.Init()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var names []string
+
+	if *tables != "" {
+		names = strings.Split(*tables, ",")
+	} else {
+		names, err = src.Tables(ctx)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	done := readState(*stateFile)
+	failed := false
+
+	for _, table := range names {
+		if done[table] {
+			log.Printf("Table %s: copied by a previous run", table)
+			continue
+		}
+
+		err = copyTable(ctx, src, dst, table)
+
+		if err != nil {
+			log.Printf("Table %s: %v", table, err)
+			failed = true
+			break
+		}
+
+		err = markDone(*stateFile, table)
+
+		if err != nil {
+			log.Printf("Table %s: copied, but %v", table, err)
+			failed = true
+			break
+		}
+
+		log.Printf("Table %s: copied", table)
+	}
+
+	if !failed && *verify {
+		for _, table := range names {
+			different, err := storage.Diff(ctx, src, dst, table)
+
+			if err != nil {
+				log.Printf("Table %s: can not verify: %v", table, err)
+				failed = true
+				continue
+			}
+
+			for _, key := range different {
+				log.Printf("Table %s: %s differs", table, key)
+			}
+
+			if len(different) > 0 {
+				failed = true
+				continue
+			}
+
+			log.Printf("Table %s: verified", table)
+		}
+	}
+
+	if failed {
+		src.Destroy()
+		dst.Destroy()
+		os.Exit(1)
+	}
+}
@@ -17,6 +17,11 @@
 package cryptoutils
 
 import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
 	"github.com/netclave/common/storage"
 )
 
@@ -38,136 +43,252 @@ var IDENTIFICATOR_TYPE_WALLET = "wallet"
 var IDENTIFICATOR_TYPE_OPENER = "opener"
 var IDENTIFICATOR_TYPE_PROXY = "proxy"
 
+// CryptoStorage encrypts the tables named by ENCRYPTED_TABLES when its
+// credentials set ENCRYPTION_KEYS_FILE or ENCRYPTION_KEYS_ENV. It builds its
+// storage.GenericStorage on first use, from the fields as they are then, and
+// holds on to the pooled backend until Close.
 type CryptoStorage struct {
 	Credentials map[string]string
 	StorageType string
+	// Middlewares are passed on to storage.GenericStorage.
+	Middlewares []storage.Middleware
+
+	once    sync.Once
+	storage *storage.GenericStorage
+	err     error
 }
 
+// createStorage returns the storage of cs, built once.
 func (cs *CryptoStorage) createStorage() (*storage.GenericStorage, error) {
-	return &storage.GenericStorage{
+	cs.once.Do(func() {
+		cs.storage, cs.err = cs.newStorage()
+	})
+
+	return cs.storage, cs.err
+}
+
+// Close releases the pooled backend of cs, see storage.GenericStorage.Close.
+func (cs *CryptoStorage) Close() error {
+	// Waits for a concurrent first use, and keeps a later one from building
+	// a storage which would never be closed.
+	cs.once.Do(func() {})
+
+	if cs.storage == nil {
+		return nil
+	}
+
+	return cs.storage.Close()
+}
+
+func (cs *CryptoStorage) newStorage() (*storage.GenericStorage, error) {
+	keys, err := LoadKeyRing(cs.Credentials)
+
+	if err != nil {
+		return nil, err
+	}
+
+	genericStorage := &storage.GenericStorage{
 		Credentials: cs.Credentials,
 		StorageType: cs.StorageType,
-	}, nil
+		Middlewares: cs.Middlewares,
+	}
+
+	if keys != nil {
+		tables := EncryptedTables(cs.Credentials)
+
+		allowPlaintext := false
+
+		if value := cs.Credentials[ENCRYPTION_ALLOW_PLAINTEXT]; value != "" {
+			allowPlaintext, err = strconv.ParseBool(value)
+
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s %q: %w", ENCRYPTION_ALLOW_PLAINTEXT, value, err)
+			}
+		}
+
+		genericStorage.Wrap = func(backend storage.Storage) storage.Storage {
+			encryptedStorage := NewEncryptedStorage(backend, keys, tables)
+			encryptedStorage.AllowPlaintext = allowPlaintext
+
+			return encryptedStorage
+		}
+	}
+
+	return genericStorage, nil
 }
 
 func (cs *CryptoStorage) StorePublicKey(label string, pubKey string) error {
+	return cs.StorePublicKeyContext(context.Background(), label, pubKey)
+}
+
+func (cs *CryptoStorage) StorePublicKeyContext(ctx context.Context, label string, pubKey string) error {
 	storage, err := cs.createStorage()
 
 	if err != nil {
 		return err
 	}
 
-	return storage.SetKey(PUBLIC_KEYS, label, pubKey, 0)
+	return storage.SetKeyContext(ctx, PUBLIC_KEYS, label, pubKey, 0)
 }
 
+// RetrievePublicKey returns storage.ErrNotFound if there is no key for
+// label, so that a missing key is never mistaken for an empty one.
 func (cs *CryptoStorage) RetrievePublicKey(label string) (string, error) {
+	return cs.RetrievePublicKeyContext(context.Background(), label)
+}
+
+func (cs *CryptoStorage) RetrievePublicKeyContext(ctx context.Context, label string) (string, error) {
 	storage, err := cs.createStorage()
 
 	if err != nil {
 		return "", err
 	}
 
-	return storage.GetKey(PUBLIC_KEYS, label)
+	return storage.LookupKeyContext(ctx, PUBLIC_KEYS, label)
 }
 
 func (cs *CryptoStorage) DeletePublicKey(label string) (int64, error) {
+	return cs.DeletePublicKeyContext(context.Background(), label)
+}
+
+func (cs *CryptoStorage) DeletePublicKeyContext(ctx context.Context, label string) (int64, error) {
 	storage, err := cs.createStorage()
 
 	if err != nil {
 		return -1, err
 	}
 
-	return storage.DelKey(PUBLIC_KEYS, label)
+	return storage.DelKeyContext(ctx, PUBLIC_KEYS, label)
 }
 
 func (cs *CryptoStorage) StoreTempPublicKey(label string, pubKey string) error {
+	return cs.StoreTempPublicKeyContext(context.Background(), label, pubKey)
+}
+
+func (cs *CryptoStorage) StoreTempPublicKeyContext(ctx context.Context, label string, pubKey string) error {
 	storage, err := cs.createStorage()
 
 	if err != nil {
 		return err
 	}
 
-	return storage.SetKey(PUBLIC_KEYS_TEMP, label, pubKey, 0)
+	return storage.SetKeyContext(ctx, PUBLIC_KEYS_TEMP, label, pubKey, 0)
 }
 
+// RetrieveTempPublicKey returns storage.ErrNotFound for an unknown label, like
+// RetrievePublicKey.
 func (cs *CryptoStorage) RetrieveTempPublicKey(label string) (string, error) {
+	return cs.RetrieveTempPublicKeyContext(context.Background(), label)
+}
+
+func (cs *CryptoStorage) RetrieveTempPublicKeyContext(ctx context.Context, label string) (string, error) {
 	storage, err := cs.createStorage()
 
 	if err != nil {
 		return "", err
 	}
 
-	return storage.GetKey(PUBLIC_KEYS_TEMP, label)
+	return storage.LookupKeyContext(ctx, PUBLIC_KEYS_TEMP, label)
 }
 
 func (cs *CryptoStorage) DeleteTempPublicKey(label string) (int64, error) {
+	return cs.DeleteTempPublicKeyContext(context.Background(), label)
+}
+
+func (cs *CryptoStorage) DeleteTempPublicKeyContext(ctx context.Context, label string) (int64, error) {
 	storage, err := cs.createStorage()
 
 	if err != nil {
 		return 0, err
 	}
 
-	return storage.DelKey(PUBLIC_KEYS_TEMP, label)
+	return storage.DelKeyContext(ctx, PUBLIC_KEYS_TEMP, label)
 }
 
 func (cs *CryptoStorage) StorePrivateKey(label string, priKey string) error {
+	return cs.StorePrivateKeyContext(context.Background(), label, priKey)
+}
+
+func (cs *CryptoStorage) StorePrivateKeyContext(ctx context.Context, label string, priKey string) error {
 	storage, err := cs.createStorage()
 
 	if err != nil {
 		return err
 	}
 
-	return storage.SetKey(PRIVATE_KEYS, label, priKey, 0)
+	return storage.SetKeyContext(ctx, PRIVATE_KEYS, label, priKey, 0)
 }
 
+// RetrievePrivateKey returns storage.ErrNotFound for an unknown label, like
+// RetrievePublicKey.
 func (cs *CryptoStorage) RetrievePrivateKey(label string) (string, error) {
+	return cs.RetrievePrivateKeyContext(context.Background(), label)
+}
+
+func (cs *CryptoStorage) RetrievePrivateKeyContext(ctx context.Context, label string) (string, error) {
 	storage, err := cs.createStorage()
 
 	if err != nil {
 		return "", err
 	}
 
-	return storage.GetKey(PRIVATE_KEYS, label)
+	return storage.LookupKeyContext(ctx, PRIVATE_KEYS, label)
 }
 
 func (cs *CryptoStorage) DeletePrivateKey(label string) (int64, error) {
+	return cs.DeletePrivateKeyContext(context.Background(), label)
+}
+
+func (cs *CryptoStorage) DeletePrivateKeyContext(ctx context.Context, label string) (int64, error) {
 	storage, err := cs.createStorage()
 
 	if err != nil {
 		return 0, err
 	}
 
-	return storage.DelKey(PRIVATE_KEYS, label)
+	return storage.DelKeyContext(ctx, PRIVATE_KEYS, label)
 }
 
 func (cs *CryptoStorage) SetIdentificatorByLabel(label string, identificatorID string) error {
+	return cs.SetIdentificatorByLabelContext(context.Background(), label, identificatorID)
+}
+
+func (cs *CryptoStorage) SetIdentificatorByLabelContext(ctx context.Context, label string, identificatorID string) error {
 	storage, err := cs.createStorage()
 
 	if err != nil {
 		return err
 	}
 
-	return storage.SetKey(LABEL_TO_IDENTIFICATOR_ID, label, identificatorID, 0)
+	return storage.SetKeyContext(ctx, LABEL_TO_IDENTIFICATOR_ID, label, identificatorID, 0)
 }
 
 func (cs *CryptoStorage) GetIdentificatorByLabel(label string) (string, error) {
+	return cs.GetIdentificatorByLabelContext(context.Background(), label)
+}
+
+func (cs *CryptoStorage) GetIdentificatorByLabelContext(ctx context.Context, label string) (string, error) {
 	storage, err := cs.createStorage()
 
 	if err != nil {
 		return "", err
 	}
 
-	return storage.GetKey(LABEL_TO_IDENTIFICATOR_ID, label)
+	return storage.GetKeyContext(ctx, LABEL_TO_IDENTIFICATOR_ID, label)
 }
 
 func (cs *CryptoStorage) DeleteIdentificatorByLabel(label string) (int64, error) {
+	return cs.DeleteIdentificatorByLabelContext(context.Background(), label)
+}
+
+func (cs *CryptoStorage) DeleteIdentificatorByLabelContext(ctx context.Context, label string) (int64, error) {
 	storage, err := cs.createStorage()
 
 	if err != nil {
 		return 0, err
 	}
 
-	return storage.DelKey(LABEL_TO_IDENTIFICATOR_ID, label)
+	return storage.DelKeyContext(ctx, LABEL_TO_IDENTIFICATOR_ID, label)
 }
 
 type Identificator struct {
@@ -178,26 +299,38 @@ type Identificator struct {
 }
 
 func (cs *CryptoStorage) AddIdentificator(identificator *Identificator) error {
+	return cs.AddIdentificatorContext(context.Background(), identificator)
+}
+
+func (cs *CryptoStorage) AddIdentificatorContext(ctx context.Context, identificator *Identificator) error {
 	storage, err := cs.createStorage()
 
 	if err != nil {
 		return err
 	}
 
-	return storage.AddToMap(IDENTIFICATORS, "", identificator.IdentificatorID, *identificator)
+	return storage.AddToMapContext(ctx, IDENTIFICATORS, "", identificator.IdentificatorID, *identificator)
 }
 
 func (cs *CryptoStorage) DeleteIdentificator(identificatorID string) error {
+	return cs.DeleteIdentificatorContext(context.Background(), identificatorID)
+}
+
+func (cs *CryptoStorage) DeleteIdentificatorContext(ctx context.Context, identificatorID string) error {
 	storage, err := cs.createStorage()
 
 	if err != nil {
 		return err
 	}
 
-	return storage.DelFromMap(IDENTIFICATORS, "", identificatorID)
+	return storage.DelFromMapContext(ctx, IDENTIFICATORS, "", identificatorID)
 }
 
 func (cs *CryptoStorage) GetIdentificators() (map[string]*Identificator, error) {
+	return cs.GetIdentificatorsContext(context.Background())
+}
+
+func (cs *CryptoStorage) GetIdentificatorsContext(ctx context.Context) (map[string]*Identificator, error) {
 	storage, err := cs.createStorage()
 
 	if err != nil {
@@ -206,7 +339,7 @@ func (cs *CryptoStorage) GetIdentificators() (map[string]*Identificator, error)
 
 	var result map[string]*Identificator
 
-	err = storage.GetMap(IDENTIFICATORS, "", &result)
+	err = storage.GetMapContext(ctx, IDENTIFICATORS, "", &result)
 
 	if err != nil {
 		return nil, err
@@ -216,26 +349,38 @@ func (cs *CryptoStorage) GetIdentificators() (map[string]*Identificator, error)
 }
 
 func (cs *CryptoStorage) AddPublicKeyLabelToIdentificator(identificatorID string, label string) error {
+	return cs.AddPublicKeyLabelToIdentificatorContext(context.Background(), identificatorID, label)
+}
+
+func (cs *CryptoStorage) AddPublicKeyLabelToIdentificatorContext(ctx context.Context, identificatorID string, label string) error {
 	storage, err := cs.createStorage()
 
 	if err != nil {
 		return err
 	}
 
-	return storage.AddToMap(IDENTIFICATOR_TO_PUBLIC_KEY_LABELS, identificatorID, label, label)
+	return storage.AddToMapContext(ctx, IDENTIFICATOR_TO_PUBLIC_KEY_LABELS, identificatorID, label, label)
 }
 
 func (cs *CryptoStorage) DelPublicKeyLabelToIdentificator(identificatorID string, label string) error {
+	return cs.DelPublicKeyLabelToIdentificatorContext(context.Background(), identificatorID, label)
+}
+
+func (cs *CryptoStorage) DelPublicKeyLabelToIdentificatorContext(ctx context.Context, identificatorID string, label string) error {
 	storage, err := cs.createStorage()
 
 	if err != nil {
 		return err
 	}
 
-	return storage.DelFromMap(IDENTIFICATOR_TO_PUBLIC_KEY_LABELS, identificatorID, label)
+	return storage.DelFromMapContext(ctx, IDENTIFICATOR_TO_PUBLIC_KEY_LABELS, identificatorID, label)
 }
 
 func (cs *CryptoStorage) GetPublicKeyLabelsForIdentificator(identificatorID string) (map[string]string, error) {
+	return cs.GetPublicKeyLabelsForIdentificatorContext(context.Background(), identificatorID)
+}
+
+func (cs *CryptoStorage) GetPublicKeyLabelsForIdentificatorContext(ctx context.Context, identificatorID string) (map[string]string, error) {
 	storage, err := cs.createStorage()
 
 	if err != nil {
@@ -244,7 +389,7 @@ func (cs *CryptoStorage) GetPublicKeyLabelsForIdentificator(identificatorID stri
 
 	var labels map[string]*string
 
-	err = storage.GetMap(IDENTIFICATOR_TO_PUBLIC_KEY_LABELS, identificatorID, &labels)
+	err = storage.GetMapContext(ctx, IDENTIFICATOR_TO_PUBLIC_KEY_LABELS, identificatorID, &labels)
 
 	if err != nil {
 		return nil, err
@@ -260,26 +405,38 @@ func (cs *CryptoStorage) GetPublicKeyLabelsForIdentificator(identificatorID stri
 }
 
 func (cs *CryptoStorage) AddIdentificatorToIdentificator(identificator1 *Identificator, identificator2 *Identificator) error {
+	return cs.AddIdentificatorToIdentificatorContext(context.Background(), identificator1, identificator2)
+}
+
+func (cs *CryptoStorage) AddIdentificatorToIdentificatorContext(ctx context.Context, identificator1 *Identificator, identificator2 *Identificator) error {
 	storage, err := cs.createStorage()
 
 	if err != nil {
 		return err
 	}
 
-	return storage.AddToMap(IDENTIFICATOR_TO_IDENTIFICATOR, identificator1.IdentificatorID, identificator2.IdentificatorID, *identificator2)
+	return storage.AddToMapContext(ctx, IDENTIFICATOR_TO_IDENTIFICATOR, identificator1.IdentificatorID, identificator2.IdentificatorID, *identificator2)
 }
 
 func (cs *CryptoStorage) DelIdentificatorToIdentificator(identificator1 *Identificator, identificator2 *Identificator) error {
+	return cs.DelIdentificatorToIdentificatorContext(context.Background(), identificator1, identificator2)
+}
+
+func (cs *CryptoStorage) DelIdentificatorToIdentificatorContext(ctx context.Context, identificator1 *Identificator, identificator2 *Identificator) error {
 	storage, err := cs.createStorage()
 
 	if err != nil {
 		return err
 	}
 
-	return storage.DelFromMap(IDENTIFICATOR_TO_IDENTIFICATOR, identificator1.IdentificatorID, identificator2.IdentificatorID)
+	return storage.DelFromMapContext(ctx, IDENTIFICATOR_TO_IDENTIFICATOR, identificator1.IdentificatorID, identificator2.IdentificatorID)
 }
 
 func (cs *CryptoStorage) GetIdentificatorToIdentificatorMap(identificator1 *Identificator, identificatorType string) (map[string]*Identificator, error) {
+	return cs.GetIdentificatorToIdentificatorMapContext(context.Background(), identificator1, identificatorType)
+}
+
+func (cs *CryptoStorage) GetIdentificatorToIdentificatorMapContext(ctx context.Context, identificator1 *Identificator, identificatorType string) (map[string]*Identificator, error) {
 	storage, err := cs.createStorage()
 
 	if err != nil {
@@ -288,7 +445,7 @@ func (cs *CryptoStorage) GetIdentificatorToIdentificatorMap(identificator1 *Iden
 
 	var result map[string]*Identificator
 
-	err = storage.GetMap(IDENTIFICATOR_TO_IDENTIFICATOR, identificator1.IdentificatorID, &result)
+	err = storage.GetMapContext(ctx, IDENTIFICATOR_TO_IDENTIFICATOR, identificator1.IdentificatorID, &result)
 
 	if err != nil {
 		return nil, err
@@ -306,86 +463,122 @@ func (cs *CryptoStorage) GetIdentificatorToIdentificatorMap(identificator1 *Iden
 }
 
 func (cs *CryptoStorage) SetIdentityIDForIdentificator(identificatorID string, identityID string) error {
+	return cs.SetIdentityIDForIdentificatorContext(context.Background(), identificatorID, identityID)
+}
+
+func (cs *CryptoStorage) SetIdentityIDForIdentificatorContext(ctx context.Context, identificatorID string, identityID string) error {
 	storage, err := cs.createStorage()
 
 	if err != nil {
 		return err
 	}
 
-	return storage.SetKey(IDENTIFICATOR_TO_IDENTITY_ID, identificatorID, identityID, 0)
+	return storage.SetKeyContext(ctx, IDENTIFICATOR_TO_IDENTITY_ID, identificatorID, identityID, 0)
 }
 
 func (cs *CryptoStorage) GetIdentityIDForIdentificator(identificatorID string) (string, error) {
+	return cs.GetIdentityIDForIdentificatorContext(context.Background(), identificatorID)
+}
+
+func (cs *CryptoStorage) GetIdentityIDForIdentificatorContext(ctx context.Context, identificatorID string) (string, error) {
 	storage, err := cs.createStorage()
 
 	if err != nil {
 		return "", err
 	}
 
-	return storage.GetKey(IDENTIFICATOR_TO_IDENTITY_ID, identificatorID)
+	return storage.GetKeyContext(ctx, IDENTIFICATOR_TO_IDENTITY_ID, identificatorID)
 }
 
 func (cs *CryptoStorage) DelIdentityIDForIdentificator(identificatorID string) (int64, error) {
+	return cs.DelIdentityIDForIdentificatorContext(context.Background(), identificatorID)
+}
+
+func (cs *CryptoStorage) DelIdentityIDForIdentificatorContext(ctx context.Context, identificatorID string) (int64, error) {
 	storage, err := cs.createStorage()
 
 	if err != nil {
 		return 0, err
 	}
 
-	return storage.DelKey(IDENTIFICATOR_TO_IDENTITY_ID, identificatorID)
+	return storage.DelKeyContext(ctx, IDENTIFICATOR_TO_IDENTITY_ID, identificatorID)
 }
 
 func (cs *CryptoStorage) SetTempIdentityIDForIdentificator(identificatorID string, identityID string) error {
+	return cs.SetTempIdentityIDForIdentificatorContext(context.Background(), identificatorID, identityID)
+}
+
+func (cs *CryptoStorage) SetTempIdentityIDForIdentificatorContext(ctx context.Context, identificatorID string, identityID string) error {
 	storage, err := cs.createStorage()
 
 	if err != nil {
 		return err
 	}
 
-	return storage.SetKey(IDENTIFICATOR_TO_IDENTITY_ID_TEMP, identificatorID, identityID, 0)
+	return storage.SetKeyContext(ctx, IDENTIFICATOR_TO_IDENTITY_ID_TEMP, identificatorID, identityID, 0)
 }
 
 func (cs *CryptoStorage) GetTempIdentityIDForIdentificator(identificatorID string) (string, error) {
+	return cs.GetTempIdentityIDForIdentificatorContext(context.Background(), identificatorID)
+}
+
+func (cs *CryptoStorage) GetTempIdentityIDForIdentificatorContext(ctx context.Context, identificatorID string) (string, error) {
 	storage, err := cs.createStorage()
 
 	if err != nil {
 		return "", err
 	}
 
-	return storage.GetKey(IDENTIFICATOR_TO_IDENTITY_ID_TEMP, identificatorID)
+	return storage.GetKeyContext(ctx, IDENTIFICATOR_TO_IDENTITY_ID_TEMP, identificatorID)
 }
 
 func (cs *CryptoStorage) DelTempIdentityIDForIdentificator(identificatorID string) (int64, error) {
+	return cs.DelTempIdentityIDForIdentificatorContext(context.Background(), identificatorID)
+}
+
+func (cs *CryptoStorage) DelTempIdentityIDForIdentificatorContext(ctx context.Context, identificatorID string) (int64, error) {
 	storage, err := cs.createStorage()
 
 	if err != nil {
 		return 0, err
 	}
 
-	return storage.DelKey(IDENTIFICATOR_TO_IDENTITY_ID_TEMP, identificatorID)
+	return storage.DelKeyContext(ctx, IDENTIFICATOR_TO_IDENTITY_ID_TEMP, identificatorID)
 }
 
 func (cs *CryptoStorage) AddIdentificatorToIdentityID(identificatorID string, identityID string) error {
+	return cs.AddIdentificatorToIdentityIDContext(context.Background(), identificatorID, identityID)
+}
+
+func (cs *CryptoStorage) AddIdentificatorToIdentityIDContext(ctx context.Context, identificatorID string, identityID string) error {
 	storage, err := cs.createStorage()
 
 	if err != nil {
 		return err
 	}
 
-	return storage.AddToMap(IDENTITY_ID_TO_IDENTIFICATORS, identityID, identificatorID, identificatorID)
+	return storage.AddToMapContext(ctx, IDENTITY_ID_TO_IDENTIFICATORS, identityID, identificatorID, identificatorID)
 }
 
 func (cs *CryptoStorage) DelIdentificatorFromIdentityID(identificatorID string, identityID string) error {
+	return cs.DelIdentificatorFromIdentityIDContext(context.Background(), identificatorID, identityID)
+}
+
+func (cs *CryptoStorage) DelIdentificatorFromIdentityIDContext(ctx context.Context, identificatorID string, identityID string) error {
 	storage, err := cs.createStorage()
 
 	if err != nil {
 		return err
 	}
 
-	return storage.DelFromMap(IDENTITY_ID_TO_IDENTIFICATORS, identityID, identificatorID)
+	return storage.DelFromMapContext(ctx, IDENTITY_ID_TO_IDENTIFICATORS, identityID, identificatorID)
 }
 
 func (cs *CryptoStorage) GetIdentificatorsByIdentityID(identityID string) (map[string]string, error) {
+	return cs.GetIdentificatorsByIdentityIDContext(context.Background(), identityID)
+}
+
+func (cs *CryptoStorage) GetIdentificatorsByIdentityIDContext(ctx context.Context, identityID string) (map[string]string, error) {
 	storage, err := cs.createStorage()
 
 	if err != nil {
@@ -394,7 +587,7 @@ func (cs *CryptoStorage) GetIdentificatorsByIdentityID(identityID string) (map[s
 
 	var tmp map[string]*string
 
-	err = storage.GetMap(IDENTITY_ID_TO_IDENTIFICATORS, identityID, &tmp)
+	err = storage.GetMapContext(ctx, IDENTITY_ID_TO_IDENTIFICATORS, identityID, &tmp)
 
 	if err != nil {
 		return nil, err
@@ -408,3 +601,51 @@ func (cs *CryptoStorage) GetIdentificatorsByIdentityID(identityID string) (map[s
 
 	return result, nil
 }
+
+// LinkIdentificatorToIdentityID stores the identity of an identificator and
+// adds the identificator to the identity in a single transaction.
+func (cs *CryptoStorage) LinkIdentificatorToIdentityID(identificatorID string, identityID string) error {
+	return cs.LinkIdentificatorToIdentityIDContext(context.Background(), identificatorID, identityID)
+}
+
+func (cs *CryptoStorage) LinkIdentificatorToIdentityIDContext(ctx context.Context, identificatorID string, identityID string) error {
+	dataStorage, err := cs.createStorage()
+
+	if err != nil {
+		return err
+	}
+
+	return dataStorage.WithTxContext(ctx, func(tx *storage.GenericTx) error {
+		err := tx.SetKey(IDENTIFICATOR_TO_IDENTITY_ID, identificatorID, identityID, 0)
+
+		if err != nil {
+			return err
+		}
+
+		return tx.AddToMap(IDENTITY_ID_TO_IDENTIFICATORS, identityID, identificatorID, identificatorID)
+	})
+}
+
+// UnlinkIdentificatorFromIdentityID reverts LinkIdentificatorToIdentityID in
+// a single transaction.
+func (cs *CryptoStorage) UnlinkIdentificatorFromIdentityID(identificatorID string, identityID string) error {
+	return cs.UnlinkIdentificatorFromIdentityIDContext(context.Background(), identificatorID, identityID)
+}
+
+func (cs *CryptoStorage) UnlinkIdentificatorFromIdentityIDContext(ctx context.Context, identificatorID string, identityID string) error {
+	dataStorage, err := cs.createStorage()
+
+	if err != nil {
+		return err
+	}
+
+	return dataStorage.WithTxContext(ctx, func(tx *storage.GenericTx) error {
+		err := tx.DelKey(IDENTIFICATOR_TO_IDENTITY_ID, identificatorID)
+
+		if err != nil {
+			return err
+		}
+
+		return tx.DelFromMap(IDENTITY_ID_TO_IDENTIFICATORS, identityID, identificatorID)
+	})
+}
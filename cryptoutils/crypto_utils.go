@@ -189,6 +189,12 @@ func GenerateAesKey() (string, error) {
 }
 
 func EncryptAES(plaintext string, keyBase64 string) (string, string, error) {
+	return EncryptAESWithData(plaintext, keyBase64, "")
+}
+
+// EncryptAESWithData is EncryptAES binding the ciphertext to additionalData,
+// which is authenticated but not encrypted. Decrypting takes the same data.
+func EncryptAESWithData(plaintext string, keyBase64 string, additionalData string) (string, string, error) {
 	key, err := base64.StdEncoding.DecodeString(keyBase64)
 	if err != nil {
 		return "", "", err
@@ -210,7 +216,7 @@ func EncryptAES(plaintext string, keyBase64 string) (string, string, error) {
 		return "", "", err
 	}
 
-	ciphertext := aesgcm.Seal(nil, iv, []byte(plaintext), nil)
+	ciphertext := aesgcm.Seal(nil, iv, []byte(plaintext), []byte(additionalData))
 
 	ciphertextBase64 := base64.StdEncoding.EncodeToString(ciphertext)
 	ivBase64 := base64.StdEncoding.EncodeToString(iv)
@@ -219,6 +225,12 @@ func EncryptAES(plaintext string, keyBase64 string) (string, string, error) {
 }
 
 func DecryptAes(ciphertextBase64 string, ivBase64 string, keyBase64 string) (string, error) {
+	return DecryptAESWithData(ciphertextBase64, ivBase64, keyBase64, "")
+}
+
+// DecryptAESWithData decrypts a ciphertext of EncryptAESWithData, failing
+// unless additionalData is the data it was encrypted with.
+func DecryptAESWithData(ciphertextBase64 string, ivBase64 string, keyBase64 string, additionalData string) (string, error) {
 
 	key, err := base64.StdEncoding.DecodeString(keyBase64)
 
@@ -246,7 +258,7 @@ func DecryptAes(ciphertextBase64 string, ivBase64 string, keyBase64 string) (str
 		return "", err
 	}
 
-	plaintext, err := aesgcm.Open(nil, iv, ciphertext, nil)
+	plaintext, err := aesgcm.Open(nil, iv, ciphertext, []byte(additionalData))
 	if err != nil {
 		return "", err
 	}
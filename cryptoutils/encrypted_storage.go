@@ -0,0 +1,823 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cryptoutils
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netclave/common/storage"
+)
+
+// Credentials keys which turn on the encryption of tables at rest. The keys
+// are read from the file ENCRYPTION_KEYS_FILE names or else from the
+// environment variable ENCRYPTION_KEYS_ENV names, ENCRYPTED_TABLES is a comma
+// separated list of tables and defaults to PRIVATE_KEYS.
+var ENCRYPTION_KEYS_FILE = "encryptionkeysfile"
+var ENCRYPTION_KEYS_ENV = "encryptionkeysenv"
+var ENCRYPTED_TABLES = "encryptedtables"
+
+// ENCRYPTION_ALLOW_PLAINTEXT is "true" to read the values of encrypted tables
+// which are not sealed as they are, while migrating a table which held values
+// before it was encrypted. Turn it off once Reencrypt has sealed them.
+var ENCRYPTION_ALLOW_PLAINTEXT = "encryptionallowplaintext"
+
+// ErrEncryptedIncr is returned by Incr on an encrypted table.
+var ErrEncryptedIncr = errors.New("Can not increment a key of an encrypted table")
+
+// ErrNotSealed is returned for a value of an encrypted table which is not
+// sealed, unless plaintext values are allowed.
+var ErrNotSealed = errors.New("Value of an encrypted table is not sealed")
+
+var sealedPrefix = "enc:"
+
+// KeyRing holds the versions of the key encryption key. Values are sealed with
+// the latest version and opened with the version they were sealed with, so a
+// new key is rolled out by adding a version, running Reencrypt over the
+// encrypted tables and only then removing the old version.
+type KeyRing struct {
+	keys    map[int]string
+	current int
+}
+
+// ParseKeyRing reads one "<version>:<base64 AES key>" per line, versions
+// being positive integers. Blank lines and lines starting with '#' are
+// skipped.
+func ParseKeyRing(data string) (*KeyRing, error) {
+	keyRing := &KeyRing{
+		keys: map[int]string{},
+	}
+
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+
+		if len(parts) != 2 {
+			return nil, errors.New("Encryption keys must be written as <version>:<key>")
+		}
+
+		version, err := strconv.Atoi(parts[0])
+
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("Invalid encryption key version %q", parts[0])
+		}
+
+		if _, ok := keyRing.keys[version]; ok {
+			return nil, fmt.Errorf("Encryption key version %d is given twice", version)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+
+		if err != nil || (len(key) != 16 && len(key) != 24 && len(key) != 32) {
+			return nil, fmt.Errorf("Encryption key version %d is not a base64 AES key", version)
+		}
+
+		keyRing.keys[version] = parts[1]
+
+		if version > keyRing.current {
+			keyRing.current = version
+		}
+	}
+
+	if len(keyRing.keys) == 0 {
+		return nil, errors.New("No encryption keys")
+	}
+
+	return keyRing, nil
+}
+
+type keyRingCache struct {
+	mutex    sync.Mutex
+	keyRings map[string]*KeyRing
+}
+
+var keyRings = &keyRingCache{
+	keyRings: map[string]*KeyRing{},
+}
+
+// LoadKeyRing reads the keys configured in credentials, or returns nil if
+// encryption is not configured. Key rings are read once per process, so
+// rotating the key takes a restart.
+func LoadKeyRing(credentials map[string]string) (*KeyRing, error) {
+	file := credentials[ENCRYPTION_KEYS_FILE]
+	env := credentials[ENCRYPTION_KEYS_ENV]
+
+	if file == "" && env == "" {
+		return nil, nil
+	}
+
+	source := "file:" + file
+
+	if file == "" {
+		source = "env:" + env
+	}
+
+	keyRings.mutex.Lock()
+	defer keyRings.mutex.Unlock()
+
+	if keyRing, ok := keyRings.keyRings[source]; ok {
+		return keyRing, nil
+	}
+
+	var data string
+
+	if file != "" {
+		bytes, err := ioutil.ReadFile(file)
+
+		if err != nil {
+			return nil, err
+		}
+
+		data = string(bytes)
+	} else {
+		var ok bool
+
+		data, ok = os.LookupEnv(env)
+
+		if !ok {
+			return nil, fmt.Errorf("Environment variable %s is not set", env)
+		}
+	}
+
+	keyRing, err := ParseKeyRing(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	keyRings.keyRings[source] = keyRing
+
+	return keyRing, nil
+}
+
+// EncryptedTables returns the tables credentials asks to encrypt.
+func EncryptedTables(credentials map[string]string) []string {
+	value := credentials[ENCRYPTED_TABLES]
+
+	if value == "" {
+		return []string{PRIVATE_KEYS}
+	}
+
+	tables := []string{}
+
+	for _, table := range strings.Split(value, ",") {
+		table = strings.TrimSpace(table)
+
+		if table != "" {
+			tables = append(tables, table)
+		}
+	}
+
+	return tables
+}
+
+// Seal encrypts plaintext with EncryptAESWithData under the current key into
+// "enc:<version>:<iv>:<ciphertext>". additionalData binds the value to where
+// it is stored, so that it can not be moved elsewhere.
+func (kr *KeyRing) Seal(plaintext string, additionalData string) (string, error) {
+	ciphertext, iv, err := EncryptAESWithData(plaintext, kr.keys[kr.current], additionalData)
+
+	if err != nil {
+		return "", err
+	}
+
+	return sealedPrefix + strconv.Itoa(kr.current) + ":" + iv + ":" + ciphertext, nil
+}
+
+// Open decrypts a value of Seal sealed with the same additionalData. Values
+// which were not sealed fail with ErrNotSealed.
+func (kr *KeyRing) Open(value string, additionalData string) (string, error) {
+	if !IsSealed(value) {
+		return "", ErrNotSealed
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(value, sealedPrefix), ":", 3)
+
+	if len(parts) != 3 {
+		return "", errors.New("Malformed encrypted value")
+	}
+
+	version, err := strconv.Atoi(parts[0])
+
+	if err != nil {
+		return "", errors.New("Malformed encrypted value")
+	}
+
+	key, ok := kr.keys[version]
+
+	if !ok {
+		return "", fmt.Errorf("Unknown encryption key version %d", version)
+	}
+
+	return DecryptAESWithData(parts[2], parts[1], key, additionalData)
+}
+
+// IsSealed reports whether value was sealed by a KeyRing.
+func IsSealed(value string) bool {
+	return strings.HasPrefix(value, sealedPrefix)
+}
+
+// IsCurrent reports whether value is sealed with the current key.
+func (kr *KeyRing) IsCurrent(value string) bool {
+	return strings.HasPrefix(value, sealedPrefix+strconv.Itoa(kr.current)+":")
+}
+
+// EncryptedStorage seals the values of keys and map fields of some tables
+// before they reach the backend it wraps. Keys, map fields and expirations
+// are stored in the clear, and each value is sealed along with the table, key
+// and field it is stored under.
+//
+// Every method of storage.Storage is implemented here, so that none reaches
+// the backend without going through the encryption.
+type EncryptedStorage struct {
+	// AllowPlaintext reads values which are not sealed as they are, see
+	// ENCRYPTION_ALLOW_PLAINTEXT.
+	AllowPlaintext bool
+	backend        storage.Storage
+	keys           *KeyRing
+	tables         map[string]bool
+}
+
+func NewEncryptedStorage(backend storage.Storage, keys *KeyRing, tables []string) *EncryptedStorage {
+	es := &EncryptedStorage{
+		backend: backend,
+		keys:    keys,
+		tables:  map[string]bool{},
+	}
+
+	for _, table := range tables {
+		es.tables[table] = true
+	}
+
+	return es
+}
+
+// keyData is the additional data of the value of a key.
+func keyData(table string, key string) string {
+	return additionalData("k\x00", table, key)
+}
+
+// fieldData is the additional data of the value of a map field.
+func fieldData(table string, key string, objectKey string) string {
+	return additionalData("f\x00", table, key, objectKey)
+}
+
+// additionalData prefixes the names of a value with the domain of the value,
+// and each name with its length, so that no two values share their data
+// whatever bytes the names hold.
+func additionalData(domain string, names ...string) string {
+	var builder strings.Builder
+
+	builder.WriteString(domain)
+
+	for _, name := range names {
+		builder.WriteString(strconv.Itoa(len(name)) + ":" + name)
+	}
+
+	return builder.String()
+}
+
+func (es *EncryptedStorage) seal(table string, value string, additionalData string) (string, error) {
+	if !es.tables[table] {
+		return value, nil
+	}
+
+	return es.keys.Seal(value, additionalData)
+}
+
+func (es *EncryptedStorage) open(table string, value string, additionalData string, err error) (string, error) {
+	if err != nil || !es.tables[table] {
+		return value, err
+	}
+
+	return es.openSealed(value, additionalData, es.AllowPlaintext)
+}
+
+// openSealed opens a value of an encrypted table. A value which is not
+// sealed is returned as it is if allowPlaintext is set, or when it is empty,
+// which is how backends report a missing key or field.
+func (es *EncryptedStorage) openSealed(value string, additionalData string, allowPlaintext bool) (string, error) {
+	if !IsSealed(value) && (allowPlaintext || value == "") {
+		return value, nil
+	}
+
+	return es.keys.Open(value, additionalData)
+}
+
+func (es *EncryptedStorage) Setup(credentials map[string]string) error {
+	return es.backend.Setup(credentials)
+}
+
+func (es *EncryptedStorage) Init() error {
+	return es.backend.Init()
+}
+
+func (es *EncryptedStorage) Create(credentials map[string]string) error {
+	return es.backend.Create(credentials)
+}
+
+func (es *EncryptedStorage) Destroy() error {
+	return es.backend.Destroy()
+}
+
+func (es *EncryptedStorage) GetKeys(table string, pattern string) ([]string, error) {
+	return es.GetKeysContext(context.Background(), table, pattern)
+}
+
+func (es *EncryptedStorage) GetKeysContext(ctx context.Context, table string, pattern string) ([]string, error) {
+	return es.backend.GetKeysContext(ctx, table, pattern)
+}
+
+func (es *EncryptedStorage) ScanKeys(ctx context.Context, table string, pattern string, batchSize int) (storage.KeyIterator, error) {
+	return es.backend.ScanKeys(ctx, table, pattern, batchSize)
+}
+
+func (es *EncryptedStorage) Tables(ctx context.Context) ([]string, error) {
+	return es.backend.Tables(ctx)
+}
+
+// Watch reports which keys changed, never their values.
+func (es *EncryptedStorage) Watch(ctx context.Context, table string, pattern string) (<-chan storage.Event, error) {
+	return es.backend.Watch(ctx, table, pattern)
+}
+
+func (es *EncryptedStorage) SetKey(table string, key string, value string, expiration time.Duration) error {
+	return es.SetKeyContext(context.Background(), table, key, value, expiration)
+}
+
+func (es *EncryptedStorage) SetKeyContext(ctx context.Context, table string, key string, value string, expiration time.Duration) error {
+	value, err := es.seal(table, value, keyData(table, key))
+
+	if err != nil {
+		return err
+	}
+
+	return es.backend.SetKeyContext(ctx, table, key, value, expiration)
+}
+
+func (es *EncryptedStorage) GetFullKey(key string) (string, error) {
+	return es.GetFullKeyContext(context.Background(), key)
+}
+
+func (es *EncryptedStorage) GetFullKeyContext(ctx context.Context, key string) (string, error) {
+	value, err := es.backend.GetFullKeyContext(ctx, key)
+
+	parts := strings.SplitN(key, "/", 2)
+	parts = append(parts, "")
+
+	return es.open(parts[0], value, keyData(parts[0], parts[1]), err)
+}
+
+func (es *EncryptedStorage) GetKey(table string, key string) (string, error) {
+	return es.GetKeyContext(context.Background(), table, key)
+}
+
+func (es *EncryptedStorage) GetKeyContext(ctx context.Context, table string, key string) (string, error) {
+	value, err := es.backend.GetKeyContext(ctx, table, key)
+
+	return es.open(table, value, keyData(table, key), err)
+}
+
+func (es *EncryptedStorage) LookupKey(table string, key string) (string, error) {
+	return es.LookupKeyContext(context.Background(), table, key)
+}
+
+func (es *EncryptedStorage) LookupKeyContext(ctx context.Context, table string, key string) (string, error) {
+	value, err := es.backend.LookupKeyContext(ctx, table, key)
+
+	return es.open(table, value, keyData(table, key), err)
+}
+
+func (es *EncryptedStorage) Exists(table string, key string) (bool, error) {
+	return es.ExistsContext(context.Background(), table, key)
+}
+
+func (es *EncryptedStorage) ExistsContext(ctx context.Context, table string, key string) (bool, error) {
+	return es.backend.ExistsContext(ctx, table, key)
+}
+
+func (es *EncryptedStorage) TTL(table string, key string) (time.Duration, error) {
+	return es.TTLContext(context.Background(), table, key)
+}
+
+func (es *EncryptedStorage) TTLContext(ctx context.Context, table string, key string) (time.Duration, error) {
+	return es.backend.TTLContext(ctx, table, key)
+}
+
+func (es *EncryptedStorage) Expire(table string, key string, expiration time.Duration) (bool, error) {
+	return es.ExpireContext(context.Background(), table, key, expiration)
+}
+
+func (es *EncryptedStorage) ExpireContext(ctx context.Context, table string, key string, expiration time.Duration) (bool, error) {
+	return es.backend.ExpireContext(ctx, table, key, expiration)
+}
+
+func (es *EncryptedStorage) Persist(table string, key string) (bool, error) {
+	return es.PersistContext(context.Background(), table, key)
+}
+
+func (es *EncryptedStorage) PersistContext(ctx context.Context, table string, key string) (bool, error) {
+	return es.backend.PersistContext(ctx, table, key)
+}
+
+func (es *EncryptedStorage) DelKey(table string, key string) (int64, error) {
+	return es.DelKeyContext(context.Background(), table, key)
+}
+
+func (es *EncryptedStorage) DelKeyContext(ctx context.Context, table string, key string) (int64, error) {
+	return es.backend.DelKeyContext(ctx, table, key)
+}
+
+func (es *EncryptedStorage) Incr(table string, key string, delta int64, expiration time.Duration) (int64, error) {
+	return es.IncrContext(context.Background(), table, key, delta, expiration)
+}
+
+func (es *EncryptedStorage) IncrContext(ctx context.Context, table string, key string, delta int64, expiration time.Duration) (int64, error) {
+	if es.tables[table] {
+		return 0, ErrEncryptedIncr
+	}
+
+	return es.backend.IncrContext(ctx, table, key, delta, expiration)
+}
+
+func (es *EncryptedStorage) SetNX(table string, key string, value string, expiration time.Duration) (bool, error) {
+	return es.SetNXContext(context.Background(), table, key, value, expiration)
+}
+
+func (es *EncryptedStorage) SetNXContext(ctx context.Context, table string, key string, value string, expiration time.Duration) (bool, error) {
+	value, err := es.seal(table, value, keyData(table, key))
+
+	if err != nil {
+		return false, err
+	}
+
+	return es.backend.SetNXContext(ctx, table, key, value, expiration)
+}
+
+func (es *EncryptedStorage) CompareAndSwap(table string, key string, old string, new string) (bool, error) {
+	return es.CompareAndSwapContext(context.Background(), table, key, old, new)
+}
+
+// CompareAndSwapContext compares old with the decrypted value, as sealing the
+// same value twice never gives the same ciphertext, and then swaps the
+// ciphertext it read, so that a concurrent write still makes it fail.
+func (es *EncryptedStorage) CompareAndSwapContext(ctx context.Context, table string, key string, old string, new string) (bool, error) {
+	if !es.tables[table] {
+		return es.backend.CompareAndSwapContext(ctx, table, key, old, new)
+	}
+
+	sealed, err := es.backend.LookupKeyContext(ctx, table, key)
+
+	if err == storage.ErrNotFound {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	value, err := es.openSealed(sealed, keyData(table, key), es.AllowPlaintext)
+
+	if err != nil {
+		return false, err
+	}
+
+	if value != old {
+		return false, nil
+	}
+
+	new, err = es.keys.Seal(new, keyData(table, key))
+
+	if err != nil {
+		return false, err
+	}
+
+	return es.backend.CompareAndSwapContext(ctx, table, key, sealed, new)
+}
+
+func (es *EncryptedStorage) AddToMap(table string, key string, objectKey string, object string) error {
+	return es.AddToMapContext(context.Background(), table, key, objectKey, object)
+}
+
+func (es *EncryptedStorage) AddToMapContext(ctx context.Context, table string, key string, objectKey string, object string) error {
+	object, err := es.seal(table, object, fieldData(table, key, objectKey))
+
+	if err != nil {
+		return err
+	}
+
+	return es.backend.AddToMapContext(ctx, table, key, objectKey, object)
+}
+
+func (es *EncryptedStorage) AddToMapWithTTL(table string, key string, objectKey string, object string, expiration time.Duration) error {
+	return es.AddToMapWithTTLContext(context.Background(), table, key, objectKey, object, expiration)
+}
+
+func (es *EncryptedStorage) AddToMapWithTTLContext(ctx context.Context, table string, key string, objectKey string, object string, expiration time.Duration) error {
+	object, err := es.seal(table, object, fieldData(table, key, objectKey))
+
+	if err != nil {
+		return err
+	}
+
+	return es.backend.AddToMapWithTTLContext(ctx, table, key, objectKey, object, expiration)
+}
+
+func (es *EncryptedStorage) CompareAndSwapInMap(table string, key string, objectKey string, old string, new string) (bool, error) {
+	return es.CompareAndSwapInMapContext(context.Background(), table, key, objectKey, old, new)
+}
+
+// CompareAndSwapInMapContext compares old with the decrypted field and swaps
+// the ciphertext it read, as CompareAndSwapContext does for keys.
+func (es *EncryptedStorage) CompareAndSwapInMapContext(ctx context.Context, table string, key string, objectKey string, old string, new string) (bool, error) {
+	if !es.tables[table] {
+		return es.backend.CompareAndSwapInMapContext(ctx, table, key, objectKey, old, new)
+	}
+
+	sealed, err := es.backend.GetFromMapContext(ctx, table, key, objectKey)
+
+	if err != nil {
+		return false, err
+	}
+
+	value, err := es.openSealed(sealed, fieldData(table, key, objectKey), es.AllowPlaintext)
+
+	if err != nil {
+		return false, err
+	}
+
+	if value != old {
+		return false, nil
+	}
+
+	new, err = es.keys.Seal(new, fieldData(table, key, objectKey))
+
+	if err != nil {
+		return false, err
+	}
+
+	return es.backend.CompareAndSwapInMapContext(ctx, table, key, objectKey, sealed, new)
+}
+
+func (es *EncryptedStorage) ExpireMap(table string, key string, expiration time.Duration) error {
+	return es.ExpireMapContext(context.Background(), table, key, expiration)
+}
+
+func (es *EncryptedStorage) ExpireMapContext(ctx context.Context, table string, key string, expiration time.Duration) error {
+	return es.backend.ExpireMapContext(ctx, table, key, expiration)
+}
+
+func (es *EncryptedStorage) MapTTL(table string, key string) (map[string]time.Duration, time.Duration, error) {
+	return es.MapTTLContext(context.Background(), table, key)
+}
+
+func (es *EncryptedStorage) MapTTLContext(ctx context.Context, table string, key string) (map[string]time.Duration, time.Duration, error) {
+	return es.backend.MapTTLContext(ctx, table, key)
+}
+
+func (es *EncryptedStorage) DelFromMap(table string, key string, objectKey string) error {
+	return es.DelFromMapContext(context.Background(), table, key, objectKey)
+}
+
+func (es *EncryptedStorage) DelFromMapContext(ctx context.Context, table string, key string, objectKey string) error {
+	return es.backend.DelFromMapContext(ctx, table, key, objectKey)
+}
+
+func (es *EncryptedStorage) GetFromMap(table string, key string, objectKey string) (string, error) {
+	return es.GetFromMapContext(context.Background(), table, key, objectKey)
+}
+
+func (es *EncryptedStorage) GetFromMapContext(ctx context.Context, table string, key string, objectKey string) (string, error) {
+	value, err := es.backend.GetFromMapContext(ctx, table, key, objectKey)
+
+	return es.open(table, value, fieldData(table, key, objectKey), err)
+}
+
+func (es *EncryptedStorage) GetMap(table string, key string) (map[string]string, error) {
+	return es.GetMapContext(context.Background(), table, key)
+}
+
+func (es *EncryptedStorage) GetMapContext(ctx context.Context, table string, key string) (map[string]string, error) {
+	fields, err := es.backend.GetMapContext(ctx, table, key)
+
+	if err != nil || !es.tables[table] {
+		return fields, err
+	}
+
+	for objectKey, value := range fields {
+		fields[objectKey], err = es.openSealed(value, fieldData(table, key, objectKey), es.AllowPlaintext)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return fields, nil
+}
+
+func (es *EncryptedStorage) Begin() (storage.Tx, error) {
+	return es.BeginContext(context.Background())
+}
+
+func (es *EncryptedStorage) BeginContext(ctx context.Context) (storage.Tx, error) {
+	tx, err := es.backend.BeginContext(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptedTx{tx: tx, es: es}, nil
+}
+
+// Reencrypt seals every key and map field of table which is not sealed with
+// the current key, including those stored before the table was encrypted,
+// and returns how many it sealed. Values are swapped with CompareAndSwap and
+// CompareAndSwapInMap, so a key or field written meanwhile is left alone and
+// expirations are kept.
+func (es *EncryptedStorage) Reencrypt(ctx context.Context, table string) (int64, error) {
+	if !es.tables[table] {
+		return 0, fmt.Errorf("Table %s is not encrypted", table)
+	}
+
+	it, err := es.backend.ScanKeys(ctx, table, "**", 0)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer it.Close()
+
+	var count int64
+
+	for it.Next() {
+		key := strings.TrimPrefix(it.Key(), table+"/")
+
+		sealed, err := es.reencryptKey(ctx, table, key)
+
+		if err != nil {
+			return count, err
+		}
+
+		count += sealed
+
+		sealed, err = es.reencryptMap(ctx, table, key)
+
+		if err != nil {
+			return count, err
+		}
+
+		count += sealed
+	}
+
+	return count, it.Err()
+}
+
+func (es *EncryptedStorage) reencryptKey(ctx context.Context, table string, key string) (int64, error) {
+	value, err := es.backend.LookupKeyContext(ctx, table, key)
+
+	if err == storage.ErrNotFound || (err == nil && es.keys.IsCurrent(value)) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	plaintext, err := es.openSealed(value, keyData(table, key), true)
+
+	if err != nil {
+		return 0, err
+	}
+
+	sealed, err := es.keys.Seal(plaintext, keyData(table, key))
+
+	if err != nil {
+		return 0, err
+	}
+
+	swapped, err := es.backend.CompareAndSwapContext(ctx, table, key, value, sealed)
+
+	if err != nil || !swapped {
+		return 0, err
+	}
+
+	return 1, nil
+}
+
+func (es *EncryptedStorage) reencryptMap(ctx context.Context, table string, key string) (int64, error) {
+	fields, err := es.backend.GetMapContext(ctx, table, key)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+
+	for objectKey, value := range fields {
+		if es.keys.IsCurrent(value) {
+			continue
+		}
+
+		plaintext, err := es.openSealed(value, fieldData(table, key, objectKey), true)
+
+		if err != nil {
+			return count, err
+		}
+
+		sealed, err := es.keys.Seal(plaintext, fieldData(table, key, objectKey))
+
+		if err != nil {
+			return count, err
+		}
+
+		swapped, err := es.backend.CompareAndSwapInMapContext(ctx, table, key, objectKey, value, sealed)
+
+		if err != nil {
+			return count, err
+		}
+
+		if swapped {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+type encryptedTx struct {
+	tx storage.Tx
+	es *EncryptedStorage
+}
+
+func (et *encryptedTx) SetKey(table string, key string, value string, expiration time.Duration) error {
+	value, err := et.es.seal(table, value, keyData(table, key))
+
+	if err != nil {
+		return err
+	}
+
+	return et.tx.SetKey(table, key, value, expiration)
+}
+
+func (et *encryptedTx) AddToMap(table string, key string, objectKey string, object string) error {
+	object, err := et.es.seal(table, object, fieldData(table, key, objectKey))
+
+	if err != nil {
+		return err
+	}
+
+	return et.tx.AddToMap(table, key, objectKey, object)
+}
+
+func (et *encryptedTx) AddToMapWithTTL(table string, key string, objectKey string, object string, expiration time.Duration) error {
+	object, err := et.es.seal(table, object, fieldData(table, key, objectKey))
+
+	if err != nil {
+		return err
+	}
+
+	return et.tx.AddToMapWithTTL(table, key, objectKey, object, expiration)
+}
+
+func (et *encryptedTx) DelKey(table string, key string) error {
+	return et.tx.DelKey(table, key)
+}
+
+func (et *encryptedTx) DelFromMap(table string, key string, objectKey string) error {
+	return et.tx.DelFromMap(table, key, objectKey)
+}
+
+func (et *encryptedTx) Commit() error {
+	return et.tx.Commit()
+}
+
+func (et *encryptedTx) Rollback() error {
+	return et.tx.Rollback()
+}
@@ -0,0 +1,475 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cryptoutils
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/netclave/common/storage"
+)
+
+func newTestKeyRing(t *testing.T, versions ...int) (*KeyRing, string) {
+	lines := []string{}
+
+	for _, version := range versions {
+		key, err := GenerateAesKey()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lines = append(lines, strconv.Itoa(version)+":"+key)
+	}
+
+	data := strings.Join(lines, "\n")
+
+	keyRing, err := ParseKeyRing(data)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return keyRing, data
+}
+
+func newTestBackend(t *testing.T) storage.Storage {
+	backend, err := storage.CreateStorage(map[string]string{"name": t.Name()}, storage.MEMORY_STORAGE, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		backend.Destroy()
+	})
+
+	return backend
+}
+
+func TestParseKeyRing(t *testing.T) {
+	key, _ := GenerateAesKey()
+
+	invalid := []string{
+		"",
+		"# only a comment",
+		key,
+		"0:" + key,
+		"one:" + key,
+		"1:not base64",
+		"1:" + key + "\n1:" + key,
+	}
+
+	for _, data := range invalid {
+		_, err := ParseKeyRing(data)
+
+		if err == nil {
+			t.Errorf("ParseKeyRing(%q) succeeded", data)
+		}
+	}
+
+	keyRing, err := ParseKeyRing("# keys\n2:" + key + "\n\n1:" + key + "\n")
+
+	if err != nil || keyRing.current != 2 || len(keyRing.keys) != 2 {
+		t.Errorf("ParseKeyRing = %+v, %v", keyRing, err)
+	}
+}
+
+func TestKeyRingSealAndOpen(t *testing.T) {
+	keyRing, _ := newTestKeyRing(t, 1)
+
+	sealed, err := keyRing.Seal("secret", "table\x00key")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(sealed, "enc:1:") || strings.Contains(sealed, "secret") || !keyRing.IsCurrent(sealed) {
+		t.Errorf("Seal = %q", sealed)
+	}
+
+	value, err := keyRing.Open(sealed, "table\x00key")
+
+	if err != nil || value != "secret" {
+		t.Errorf("Open = %q, %v", value, err)
+	}
+
+	_, err = keyRing.Open(sealed, "table\x00other")
+
+	if err == nil {
+		t.Error("Open with other additional data succeeded")
+	}
+
+	_, err = keyRing.Open("plaintext", "table\x00key")
+
+	if err != ErrNotSealed {
+		t.Errorf("Open of a value which is not sealed: %v", err)
+	}
+
+	other, _ := newTestKeyRing(t, 2)
+
+	_, err = other.Open(sealed, "table\x00key")
+
+	if err == nil || !strings.Contains(err.Error(), "version 1") {
+		t.Errorf("Open with an unknown version: %v", err)
+	}
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	keyRing, _ := newTestKeyRing(t, 1)
+	backend := newTestBackend(t)
+	es := NewEncryptedStorage(backend, keyRing, []string{PRIVATE_KEYS})
+
+	err := es.SetKey(PRIVATE_KEYS, "label", "private", 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = es.SetKey(PUBLIC_KEYS, "label", "public", 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, _ := backend.GetKey(PRIVATE_KEYS, "label")
+
+	if !strings.HasPrefix(raw, "enc:1:") {
+		t.Errorf("Stored value of an encrypted table = %q", raw)
+	}
+
+	raw, _ = backend.GetKey(PUBLIC_KEYS, "label")
+
+	if raw != "public" {
+		t.Errorf("Stored value of a plain table = %q", raw)
+	}
+
+	value, err := es.LookupKey(PRIVATE_KEYS, "label")
+
+	if err != nil || value != "private" {
+		t.Errorf("LookupKey = %q, %v", value, err)
+	}
+
+	value, err = es.GetFullKey(PRIVATE_KEYS + "/label")
+
+	if err != nil || value != "private" {
+		t.Errorf("GetFullKey = %q, %v", value, err)
+	}
+
+	swapped, err := es.CompareAndSwap(PRIVATE_KEYS, "label", "private", "rotated")
+
+	if err != nil || !swapped {
+		t.Errorf("CompareAndSwap = %v, %v", swapped, err)
+	}
+
+	swapped, err = es.CompareAndSwap(PRIVATE_KEYS, "label", "private", "other")
+
+	if err != nil || swapped {
+		t.Errorf("CompareAndSwap of a stale value = %v, %v", swapped, err)
+	}
+
+	value, _ = es.GetKey(PRIVATE_KEYS, "label")
+
+	if value != "rotated" {
+		t.Errorf("GetKey after CompareAndSwap = %q", value)
+	}
+
+	_, err = es.Incr(PRIVATE_KEYS, "counter", 1, 0)
+
+	if err != ErrEncryptedIncr {
+		t.Errorf("Incr on an encrypted table: %v", err)
+	}
+
+	tx, err := es.Begin()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx.AddToMap(PRIVATE_KEYS, "map", "field", "in a map")
+
+	err = tx.Commit()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, _ = backend.GetFromMap(PRIVATE_KEYS, "map", "field")
+
+	if !strings.HasPrefix(raw, "enc:1:") {
+		t.Errorf("Stored field of an encrypted table = %q", raw)
+	}
+
+	fields, err := es.GetMap(PRIVATE_KEYS, "map")
+
+	if err != nil || fields["field"] != "in a map" {
+		t.Errorf("GetMap = %v, %v", fields, err)
+	}
+}
+
+func TestEncryptedStorageBindsValuesToKeys(t *testing.T) {
+	keyRing, _ := newTestKeyRing(t, 1)
+	backend := newTestBackend(t)
+	es := NewEncryptedStorage(backend, keyRing, []string{PRIVATE_KEYS})
+
+	err := es.SetKey(PRIVATE_KEYS, "alice", "alice's key", 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = es.AddToMap(PRIVATE_KEYS, "map", "alice", "alice's field")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone with write access to the backend copies the ciphertexts.
+	raw, _ := backend.GetKey(PRIVATE_KEYS, "alice")
+	backend.SetKey(PRIVATE_KEYS, "mallory", raw, 0)
+
+	raw, _ = backend.GetFromMap(PRIVATE_KEYS, "map", "alice")
+	backend.AddToMap(PRIVATE_KEYS, "map", "mallory", raw)
+
+	_, err = es.GetKey(PRIVATE_KEYS, "mallory")
+
+	if err == nil {
+		t.Error("GetKey of a value sealed for another key succeeded")
+	}
+
+	_, err = es.GetFromMap(PRIVATE_KEYS, "map", "mallory")
+
+	if err == nil {
+		t.Error("GetFromMap of a value sealed for another field succeeded")
+	}
+}
+
+// Values of keys and of fields whose names only differ by where the NUL
+// bytes fall are bound to different data.
+func TestAdditionalDataIsUnambiguous(t *testing.T) {
+	data := []string{
+		keyData("table", "key\x00field"),
+		keyData("table\x00key", "field"),
+		fieldData("table", "key", "field"),
+		fieldData("table", "key\x00field", ""),
+		fieldData("table\x00key", "field", ""),
+		fieldData("table", "", "key\x00field"),
+	}
+
+	seen := map[string]int{}
+
+	for i, value := range data {
+		if j, ok := seen[value]; ok {
+			t.Errorf("Additional data %d and %d are both %q", j, i, value)
+		}
+
+		seen[value] = i
+	}
+}
+
+func TestEncryptedStorageAllowPlaintext(t *testing.T) {
+	keyRing, _ := newTestKeyRing(t, 1)
+	backend := newTestBackend(t)
+	es := NewEncryptedStorage(backend, keyRing, []string{PRIVATE_KEYS})
+
+	backend.SetKey(PRIVATE_KEYS, "plaintext", "stored before encryption", 0)
+
+	_, err := es.GetKey(PRIVATE_KEYS, "plaintext")
+
+	if err != ErrNotSealed {
+		t.Errorf("GetKey of a value which is not sealed: %v", err)
+	}
+
+	value, err := es.GetKey(PRIVATE_KEYS, "missing")
+
+	if err != nil || value != "" {
+		t.Errorf("GetKey of a missing key = %q, %v", value, err)
+	}
+
+	es.AllowPlaintext = true
+
+	value, err = es.GetKey(PRIVATE_KEYS, "plaintext")
+
+	if err != nil || value != "stored before encryption" {
+		t.Errorf("GetKey while migrating = %q, %v", value, err)
+	}
+}
+
+func TestEncryptedStorageReencrypt(t *testing.T) {
+	oldKeys, oldData := newTestKeyRing(t, 1)
+	backend := newTestBackend(t)
+
+	backend.SetKey(PRIVATE_KEYS, "plaintext", "stored before encryption", 0)
+	backend.AddToMap(PRIVATE_KEYS, "map", "field", "field before encryption")
+
+	es := NewEncryptedStorage(backend, oldKeys, []string{PRIVATE_KEYS})
+	es.SetKey(PRIVATE_KEYS, "old", "sealed with version 1", 0)
+
+	newKeys, newData := newTestKeyRing(t, 2)
+
+	// Both versions, as during a rotation.
+	keys, err := ParseKeyRing(oldData + "\n" + newData)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	es = NewEncryptedStorage(backend, keys, []string{PRIVATE_KEYS})
+
+	count, err := es.Reencrypt(context.Background(), PRIVATE_KEYS)
+
+	if err != nil || count != 3 {
+		t.Fatalf("Reencrypt = %d, %v", count, err)
+	}
+
+	count, err = es.Reencrypt(context.Background(), PRIVATE_KEYS)
+
+	if err != nil || count != 0 {
+		t.Errorf("Reencrypt again = %d, %v", count, err)
+	}
+
+	_, err = es.Reencrypt(context.Background(), PUBLIC_KEYS)
+
+	if err == nil {
+		t.Error("Reencrypt of a table which is not encrypted succeeded")
+	}
+
+	// The old version is no longer needed.
+	es = NewEncryptedStorage(backend, newKeys, []string{PRIVATE_KEYS})
+
+	expected := map[string]string{
+		"plaintext": "stored before encryption",
+		"old":       "sealed with version 1",
+	}
+
+	for key, expectedValue := range expected {
+		value, err := es.GetKey(PRIVATE_KEYS, key)
+
+		if err != nil || value != expectedValue {
+			t.Errorf("GetKey(%q) = %q, %v", key, value, err)
+		}
+	}
+
+	value, err := es.GetFromMap(PRIVATE_KEYS, "map", "field")
+
+	if err != nil || value != "field before encryption" {
+		t.Errorf("GetFromMap = %q, %v", value, err)
+	}
+}
+
+func TestEncryptedStorageReencryptKeepsExpirations(t *testing.T) {
+	oldKeys, oldData := newTestKeyRing(t, 1)
+	backend := newTestBackend(t)
+
+	es := NewEncryptedStorage(backend, oldKeys, []string{PRIVATE_KEYS})
+	es.AddToMapWithTTL(PRIVATE_KEYS, "map", "short", "short", 50*time.Millisecond)
+	es.AddToMap(PRIVATE_KEYS, "map", "long", "long")
+	es.AddToMap(PRIVATE_KEYS, "expiring", "field", "field")
+	es.ExpireMap(PRIVATE_KEYS, "expiring", 50*time.Millisecond)
+
+	_, newData := newTestKeyRing(t, 2)
+
+	keys, err := ParseKeyRing(oldData + "\n" + newData)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	es = NewEncryptedStorage(backend, keys, []string{PRIVATE_KEYS})
+
+	count, err := es.Reencrypt(context.Background(), PRIVATE_KEYS)
+
+	if err != nil || count != 3 {
+		t.Fatalf("Reencrypt = %d, %v", count, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	fields, err := es.GetMap(PRIVATE_KEYS, "map")
+
+	if err != nil || len(fields) != 1 || fields["long"] != "long" {
+		t.Errorf("GetMap after the field expired = %v, %v", fields, err)
+	}
+
+	fields, err = es.GetMap(PRIVATE_KEYS, "expiring")
+
+	if err != nil || len(fields) != 0 {
+		t.Errorf("GetMap after the map expired = %v, %v", fields, err)
+	}
+}
+
+func TestCryptoStorageEncryptsPrivateKeys(t *testing.T) {
+	_, data := newTestKeyRing(t, 1)
+
+	os.Setenv("NETCLAVE_TEST_ENCRYPTION_KEYS", data)
+
+	t.Cleanup(func() {
+		os.Unsetenv("NETCLAVE_TEST_ENCRYPTION_KEYS")
+	})
+
+	credentials := map[string]string{
+		"name":              t.Name(),
+		ENCRYPTION_KEYS_ENV: "NETCLAVE_TEST_ENCRYPTION_KEYS",
+	}
+
+	cs := &CryptoStorage{
+		Credentials: credentials,
+		StorageType: storage.MEMORY_STORAGE,
+	}
+
+	t.Cleanup(func() {
+		cs.Close()
+	})
+
+	gs := &storage.GenericStorage{
+		Credentials: credentials,
+		StorageType: storage.MEMORY_STORAGE,
+	}
+
+	t.Cleanup(func() {
+		gs.Close()
+	})
+
+	err := cs.StorePrivateKey("label", "private")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, _ := gs.GetKey(PRIVATE_KEYS, "label")
+
+	if !strings.HasPrefix(raw, "enc:1:") {
+		t.Errorf("Stored private key = %q", raw)
+	}
+
+	value, err := cs.RetrievePrivateKey("label")
+
+	if err != nil || value != "private" {
+		t.Errorf("RetrievePrivateKey = %q, %v", value, err)
+	}
+
+	first, _ := cs.createStorage()
+	second, _ := cs.createStorage()
+
+	if first != second {
+		t.Error("CryptoStorage built its storage more than once")
+	}
+}
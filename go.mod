@@ -3,10 +3,12 @@ module github.com/netclave/common
 go 1.14
 
 require (
-	github.com/go-redis/redis v6.15.8+incompatible
+	github.com/alicebob/miniredis/v2 v2.30.0
+	github.com/fxamacker/cbor/v2 v2.2.0
+	github.com/go-redis/redis/v8 v8.11.0
 	github.com/go-sql-driver/mysql v1.5.0
 	github.com/google/uuid v1.1.2
 	github.com/lib/pq v1.9.0
 	github.com/mattn/go-sqlite3 v1.14.0
-	github.com/onsi/ginkgo v1.14.0 // indirect
+	google.golang.org/protobuf v1.23.0
 )
@@ -29,6 +29,7 @@ import (
 	"github.com/netclave/common/utils"
 
 	"github.com/netclave/common/cryptoutils"
+	"github.com/netclave/common/storage"
 )
 
 type Request struct {
@@ -247,11 +248,11 @@ func VerifyAndDecrypt(request *Request, recipientPrivateKeyPem string, cryptoSto
 
 	if senderPublicKeyPem == "" {
 		senderPublicKeyPem, err = cryptoStorage.RetrievePublicKey(id)
-		if err != nil || senderPublicKeyPem == "" {
+		if err == storage.ErrNotFound {
 			senderPublicKeyPem, err = cryptoStorage.RetrieveTempPublicKey(id)
-			if err != nil || senderPublicKeyPem == "" {
-				return "", "", err
-			}
+		}
+		if err != nil {
+			return "", "", err
 		}
 	}
 
@@ -0,0 +1,737 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credentials keys of the read-through cache GenericStorage puts in front of
+// a backend when CACHE_SIZE is above zero. CACHE_TABLE_TTLS lists how long
+// the reads of each table are cached, as in "publickeys=10m,identificators=1m",
+// and CACHE_TTL is the one of the other tables, which are not cached if it is
+// zero. CACHE_NEGATIVE_TTL is how long missing keys, fields and maps are
+// remembered, zero for not at all. CACHE_WATCH is "false" to rely on the TTLs
+// alone, without watching the cached tables for the writes of other
+// processes.
+var CACHE_SIZE = "cachesize"
+var CACHE_MAX_BYTES = "cachemaxbytes"
+var CACHE_TTL = "cachettl"
+var CACHE_TABLE_TTLS = "cachetablettls"
+var CACHE_NEGATIVE_TTL = "cachenegativettl"
+var CACHE_WATCH = "cachewatch"
+
+type CacheOptions struct {
+	// MaxEntries and MaxBytes bound the cache, which drops the least
+	// recently used entries beyond either. Zero means no bound, but a
+	// GenericStorage only caches if MaxEntries is set.
+	MaxEntries  int
+	MaxBytes    int
+	TTL         time.Duration
+	TableTTLs   map[string]time.Duration
+	NegativeTTL time.Duration
+	Watch       bool
+}
+
+// ParseCacheOptions reads the cache settings from credentials.
+func ParseCacheOptions(credentials map[string]string) (*CacheOptions, error) {
+	options := &CacheOptions{
+		TableTTLs: map[string]time.Duration{},
+		Watch:     true,
+	}
+
+	var err error
+
+	if value := credentials[CACHE_SIZE]; value != "" {
+		options.MaxEntries, err = strconv.Atoi(value)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if value := credentials[CACHE_MAX_BYTES]; value != "" {
+		options.MaxBytes, err = strconv.Atoi(value)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if value := credentials[CACHE_TTL]; value != "" {
+		options.TTL, err = time.ParseDuration(value)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if value := credentials[CACHE_NEGATIVE_TTL]; value != "" {
+		options.NegativeTTL, err = time.ParseDuration(value)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if value := credentials[CACHE_WATCH]; value != "" {
+		options.Watch, err = strconv.ParseBool(value)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if value := credentials[CACHE_TABLE_TTLS]; value != "" {
+		for _, item := range strings.Split(value, ",") {
+			parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+
+			if len(parts) != 2 || parts[0] == "" {
+				return nil, errors.New("Invalid " + CACHE_TABLE_TTLS + " entry " + strconv.Quote(item) + ", expected table=duration")
+			}
+
+			options.TableTTLs[parts[0]], err = time.ParseDuration(parts[1])
+
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return options, nil
+}
+
+// cacheWatchRetry is how long the cache waits before watching a table again
+// after Watch failed.
+var cacheWatchRetry = time.Minute
+
+// cacheEntryOverhead roughly accounts for the bookkeeping of an entry in
+// CacheOptions.MaxBytes.
+var cacheEntryOverhead = 64
+
+type cacheName struct {
+	table string
+	key   string
+}
+
+type cacheKind int
+
+const (
+	cacheKindKey cacheKind = iota
+	cacheKindField
+	cacheKindMap
+)
+
+type cacheKey struct {
+	cacheName
+	kind  cacheKind
+	field string
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	value   string
+	fields  map[string]string
+	found   bool
+	expires time.Time
+	size    int
+}
+
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+	Bytes     int
+}
+
+// CachedStorage caches the reads of keys, map fields and maps of a backend
+// in an LRU. Its own writes drop what they change from the cache, and it
+// watches the cached tables, see Storage.Watch, for the writes of others.
+// Without a working Watch, or while one reconnects, the TTL of a table is how
+// long such writes may go unnoticed. Keys which expire in the backend may be
+// served for as long too, so the cached tables should hold long lived data.
+// Exists, TTL, MapTTL, GetKeys, ScanKeys and Tables are not cached.
+type CachedStorage struct {
+	Storage
+	options *CacheOptions
+
+	mutex   sync.Mutex
+	entries *list.List
+	index   map[cacheKey]*list.Element
+	names   map[cacheName]map[cacheKey]bool
+	bytes   int
+	stats   CacheStats
+	// invalidations counts the changes seen, so that a read racing with one
+	// does not cache what it read before.
+	invalidations uint64
+	// watched holds when watching a table last failed, or the zero time
+	// while it is watched.
+	watched map[string]time.Time
+	// unwatchable is set once the backend reports that Watch is disabled,
+	// which no retry changes.
+	unwatchable  bool
+	watchCtx     context.Context
+	stopWatching context.CancelFunc
+}
+
+func NewCachedStorage(backend Storage, options *CacheOptions) *CachedStorage {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &CachedStorage{
+		Storage:      backend,
+		options:      options,
+		entries:      list.New(),
+		index:        map[cacheKey]*list.Element{},
+		names:        map[cacheName]map[cacheKey]bool{},
+		watched:      map[string]time.Time{},
+		watchCtx:     ctx,
+		stopWatching: cancel,
+	}
+}
+
+// Destroy stops watching the backend and destroys it.
+func (cs *CachedStorage) Destroy() error {
+	cs.stopWatching()
+	cs.Flush()
+
+	return cs.Storage.Destroy()
+}
+
+// Flush empties the cache.
+func (cs *CachedStorage) Flush() {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	cs.invalidations++
+	cs.entries.Init()
+	cs.index = map[cacheKey]*list.Element{}
+	cs.names = map[cacheName]map[cacheKey]bool{}
+	cs.bytes = 0
+}
+
+func (cs *CachedStorage) Stats() CacheStats {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	stats := cs.stats
+	stats.Entries = cs.entries.Len()
+	stats.Bytes = cs.bytes
+
+	return stats
+}
+
+func (cs *CachedStorage) tableTTL(table string) time.Duration {
+	if ttl, ok := cs.options.TableTTLs[table]; ok {
+		return ttl
+	}
+
+	return cs.options.TTL
+}
+
+// load returns the cached entry of key, or caches the one fetch returns.
+func (cs *CachedStorage) load(key cacheKey, fetch func() (*cacheEntry, error)) (*cacheEntry, error) {
+	ttl := cs.tableTTL(key.table)
+
+	if ttl <= 0 {
+		return fetch()
+	}
+
+	cs.mutex.Lock()
+
+	if element, ok := cs.index[key]; ok {
+		entry := element.Value.(*cacheEntry)
+
+		if time.Now().Before(entry.expires) {
+			cs.entries.MoveToFront(element)
+			cs.stats.Hits++
+			cs.mutex.Unlock()
+
+			return entry, nil
+		}
+
+		cs.remove(element)
+	}
+
+	cs.stats.Misses++
+	invalidations := cs.invalidations
+
+	cs.mutex.Unlock()
+
+	cs.watch(key.table)
+
+	entry, err := fetch()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !entry.found {
+		ttl = cs.options.NegativeTTL
+	}
+
+	if ttl <= 0 {
+		return entry, nil
+	}
+
+	entry.key = key
+	entry.expires = time.Now().Add(ttl)
+	entry.size = cacheEntryOverhead + len(key.table) + len(key.key) + len(key.field) + len(entry.value)
+
+	for name, value := range entry.fields {
+		entry.size += len(name) + len(value)
+	}
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	if invalidations == cs.invalidations {
+		cs.add(entry)
+	}
+
+	return entry, nil
+}
+
+// add stores entry, which must not be cached yet, and evicts the least
+// recently used entries beyond the bounds.
+func (cs *CachedStorage) add(entry *cacheEntry) {
+	cs.index[entry.key] = cs.entries.PushFront(entry)
+	cs.bytes += entry.size
+
+	keys, ok := cs.names[entry.key.cacheName]
+
+	if !ok {
+		keys = map[cacheKey]bool{}
+		cs.names[entry.key.cacheName] = keys
+	}
+
+	keys[entry.key] = true
+
+	for cs.entries.Len() > 0 && ((cs.options.MaxEntries > 0 && cs.entries.Len() > cs.options.MaxEntries) ||
+		(cs.options.MaxBytes > 0 && cs.bytes > cs.options.MaxBytes)) {
+		cs.remove(cs.entries.Back())
+		cs.stats.Evictions++
+	}
+}
+
+func (cs *CachedStorage) remove(element *list.Element) {
+	entry := cs.entries.Remove(element).(*cacheEntry)
+
+	delete(cs.index, entry.key)
+	cs.bytes -= entry.size
+
+	keys := cs.names[entry.key.cacheName]
+	delete(keys, entry.key)
+
+	if len(keys) == 0 {
+		delete(cs.names, entry.key.cacheName)
+	}
+}
+
+// invalidate drops the key or map of table named key, with its fields.
+func (cs *CachedStorage) invalidate(table string, key string) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	cs.invalidations++
+
+	for cached := range cs.names[cacheName{table: table, key: key}] {
+		cs.remove(cs.index[cached])
+	}
+}
+
+func (cs *CachedStorage) invalidateTable(table string) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	cs.invalidations++
+
+	for name, keys := range cs.names {
+		if name.table != table {
+			continue
+		}
+
+		for cached := range keys {
+			cs.remove(cs.index[cached])
+		}
+	}
+}
+
+// watch starts watching table for changes, unless it is watched already or
+// Watch failed recently. A backend whose credentials disable Watch is not
+// watched at all, quietly. Changes are seen from when Watch returns, so it
+// is called before reading what is cached.
+func (cs *CachedStorage) watch(table string) {
+	if !cs.options.Watch {
+		return
+	}
+
+	cs.mutex.Lock()
+
+	failed, ok := cs.watched[table]
+
+	if cs.unwatchable || ok && (failed.IsZero() || time.Since(failed) < cacheWatchRetry) {
+		cs.mutex.Unlock()
+		return
+	}
+
+	cs.watched[table] = time.Time{}
+	cs.mutex.Unlock()
+
+	events, err := cs.Storage.Watch(cs.watchCtx, table, "**")
+
+	if errors.Is(err, errWatchDisabled) {
+		cs.mutex.Lock()
+		cs.unwatchable = true
+		delete(cs.watched, table)
+		cs.mutex.Unlock()
+
+		return
+	}
+
+	if err != nil {
+		if cs.watchCtx.Err() == nil {
+			log.Println("Can not watch " + table + " for the cache: " + err.Error())
+		}
+
+		cs.mutex.Lock()
+		cs.watched[table] = time.Now()
+		cs.mutex.Unlock()
+
+		return
+	}
+
+	go func() {
+		for event := range events {
+			cs.invalidate(event.Table, event.Key)
+		}
+
+		// Changes may have been missed since the channel was closed.
+		cs.mutex.Lock()
+		delete(cs.watched, table)
+		cs.mutex.Unlock()
+
+		cs.invalidateTable(table)
+	}()
+}
+
+func (cs *CachedStorage) GetFullKey(key string) (string, error) {
+	return cs.GetFullKeyContext(context.Background(), key)
+}
+
+func (cs *CachedStorage) GetFullKeyContext(ctx context.Context, key string) (string, error) {
+	parts := SplitToParts(key)
+
+	if len(parts) < 2 || cs.tableTTL(parts[0]) <= 0 {
+		return cs.Storage.GetFullKeyContext(ctx, key)
+	}
+
+	return cs.GetKeyContext(ctx, parts[0], strings.Join(parts[1:], "/"))
+}
+
+func (cs *CachedStorage) GetKey(table string, key string) (string, error) {
+	return cs.GetKeyContext(context.Background(), table, key)
+}
+
+func (cs *CachedStorage) GetKeyContext(ctx context.Context, table string, key string) (string, error) {
+	value, err := cs.LookupKeyContext(ctx, table, key)
+
+	if err == ErrNotFound {
+		return "", nil
+	}
+
+	return value, err
+}
+
+func (cs *CachedStorage) LookupKey(table string, key string) (string, error) {
+	return cs.LookupKeyContext(context.Background(), table, key)
+}
+
+func (cs *CachedStorage) LookupKeyContext(ctx context.Context, table string, key string) (string, error) {
+	entry, err := cs.load(cacheKey{cacheName: cacheName{table: table, key: key}, kind: cacheKindKey}, func() (*cacheEntry, error) {
+		value, err := cs.Storage.LookupKeyContext(ctx, table, key)
+
+		if err == ErrNotFound {
+			return &cacheEntry{}, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &cacheEntry{value: value, found: true}, nil
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	if !entry.found {
+		return "", ErrNotFound
+	}
+
+	return entry.value, nil
+}
+
+func (cs *CachedStorage) GetFromMap(table string, key string, objectKey string) (string, error) {
+	return cs.GetFromMapContext(context.Background(), table, key, objectKey)
+}
+
+// GetFromMapContext caches missing fields as negative entries, like empty
+// ones, since the backends return "" for both.
+func (cs *CachedStorage) GetFromMapContext(ctx context.Context, table string, key string, objectKey string) (string, error) {
+	entry, err := cs.load(cacheKey{cacheName: cacheName{table: table, key: key}, kind: cacheKindField, field: objectKey}, func() (*cacheEntry, error) {
+		value, err := cs.Storage.GetFromMapContext(ctx, table, key, objectKey)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &cacheEntry{value: value, found: value != ""}, nil
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return entry.value, nil
+}
+
+func (cs *CachedStorage) GetMap(table string, key string) (map[string]string, error) {
+	return cs.GetMapContext(context.Background(), table, key)
+}
+
+func (cs *CachedStorage) GetMapContext(ctx context.Context, table string, key string) (map[string]string, error) {
+	entry, err := cs.load(cacheKey{cacheName: cacheName{table: table, key: key}, kind: cacheKindMap}, func() (*cacheEntry, error) {
+		fields, err := cs.Storage.GetMapContext(ctx, table, key)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &cacheEntry{fields: fields, found: len(fields) > 0}, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The cached map is shared, callers get a copy of their own.
+	fields := make(map[string]string, len(entry.fields))
+
+	for name, value := range entry.fields {
+		fields[name] = value
+	}
+
+	return fields, nil
+}
+
+func (cs *CachedStorage) SetKey(table string, key string, value string, expiration time.Duration) error {
+	return cs.SetKeyContext(context.Background(), table, key, value, expiration)
+}
+
+func (cs *CachedStorage) SetKeyContext(ctx context.Context, table string, key string, value string, expiration time.Duration) error {
+	defer cs.invalidate(table, key)
+
+	return cs.Storage.SetKeyContext(ctx, table, key, value, expiration)
+}
+
+func (cs *CachedStorage) Expire(table string, key string, expiration time.Duration) (bool, error) {
+	return cs.ExpireContext(context.Background(), table, key, expiration)
+}
+
+func (cs *CachedStorage) ExpireContext(ctx context.Context, table string, key string, expiration time.Duration) (bool, error) {
+	defer cs.invalidate(table, key)
+
+	return cs.Storage.ExpireContext(ctx, table, key, expiration)
+}
+
+func (cs *CachedStorage) Persist(table string, key string) (bool, error) {
+	return cs.PersistContext(context.Background(), table, key)
+}
+
+func (cs *CachedStorage) PersistContext(ctx context.Context, table string, key string) (bool, error) {
+	defer cs.invalidate(table, key)
+
+	return cs.Storage.PersistContext(ctx, table, key)
+}
+
+func (cs *CachedStorage) DelKey(table string, key string) (int64, error) {
+	return cs.DelKeyContext(context.Background(), table, key)
+}
+
+func (cs *CachedStorage) DelKeyContext(ctx context.Context, table string, key string) (int64, error) {
+	defer cs.invalidate(table, key)
+
+	return cs.Storage.DelKeyContext(ctx, table, key)
+}
+
+func (cs *CachedStorage) Incr(table string, key string, delta int64, expiration time.Duration) (int64, error) {
+	return cs.IncrContext(context.Background(), table, key, delta, expiration)
+}
+
+func (cs *CachedStorage) IncrContext(ctx context.Context, table string, key string, delta int64, expiration time.Duration) (int64, error) {
+	defer cs.invalidate(table, key)
+
+	return cs.Storage.IncrContext(ctx, table, key, delta, expiration)
+}
+
+func (cs *CachedStorage) SetNX(table string, key string, value string, expiration time.Duration) (bool, error) {
+	return cs.SetNXContext(context.Background(), table, key, value, expiration)
+}
+
+func (cs *CachedStorage) SetNXContext(ctx context.Context, table string, key string, value string, expiration time.Duration) (bool, error) {
+	defer cs.invalidate(table, key)
+
+	return cs.Storage.SetNXContext(ctx, table, key, value, expiration)
+}
+
+func (cs *CachedStorage) CompareAndSwap(table string, key string, old string, new string) (bool, error) {
+	return cs.CompareAndSwapContext(context.Background(), table, key, old, new)
+}
+
+func (cs *CachedStorage) CompareAndSwapContext(ctx context.Context, table string, key string, old string, new string) (bool, error) {
+	defer cs.invalidate(table, key)
+
+	return cs.Storage.CompareAndSwapContext(ctx, table, key, old, new)
+}
+
+func (cs *CachedStorage) AddToMap(table string, key string, objectKey string, object string) error {
+	return cs.AddToMapContext(context.Background(), table, key, objectKey, object)
+}
+
+func (cs *CachedStorage) AddToMapContext(ctx context.Context, table string, key string, objectKey string, object string) error {
+	defer cs.invalidate(table, key)
+
+	return cs.Storage.AddToMapContext(ctx, table, key, objectKey, object)
+}
+
+func (cs *CachedStorage) AddToMapWithTTL(table string, key string, objectKey string, object string, expiration time.Duration) error {
+	return cs.AddToMapWithTTLContext(context.Background(), table, key, objectKey, object, expiration)
+}
+
+func (cs *CachedStorage) AddToMapWithTTLContext(ctx context.Context, table string, key string, objectKey string, object string, expiration time.Duration) error {
+	defer cs.invalidate(table, key)
+
+	return cs.Storage.AddToMapWithTTLContext(ctx, table, key, objectKey, object, expiration)
+}
+
+func (cs *CachedStorage) CompareAndSwapInMap(table string, key string, objectKey string, old string, new string) (bool, error) {
+	return cs.CompareAndSwapInMapContext(context.Background(), table, key, objectKey, old, new)
+}
+
+func (cs *CachedStorage) CompareAndSwapInMapContext(ctx context.Context, table string, key string, objectKey string, old string, new string) (bool, error) {
+	defer cs.invalidate(table, key)
+
+	return cs.Storage.CompareAndSwapInMapContext(ctx, table, key, objectKey, old, new)
+}
+
+func (cs *CachedStorage) ExpireMap(table string, key string, expiration time.Duration) error {
+	return cs.ExpireMapContext(context.Background(), table, key, expiration)
+}
+
+func (cs *CachedStorage) ExpireMapContext(ctx context.Context, table string, key string, expiration time.Duration) error {
+	defer cs.invalidate(table, key)
+
+	return cs.Storage.ExpireMapContext(ctx, table, key, expiration)
+}
+
+func (cs *CachedStorage) DelFromMap(table string, key string, objectKey string) error {
+	return cs.DelFromMapContext(context.Background(), table, key, objectKey)
+}
+
+func (cs *CachedStorage) DelFromMapContext(ctx context.Context, table string, key string, objectKey string) error {
+	defer cs.invalidate(table, key)
+
+	return cs.Storage.DelFromMapContext(ctx, table, key, objectKey)
+}
+
+func (cs *CachedStorage) Begin() (Tx, error) {
+	return cs.BeginContext(context.Background())
+}
+
+func (cs *CachedStorage) BeginContext(ctx context.Context) (Tx, error) {
+	tx, err := cs.Storage.BeginContext(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &cachedTx{
+		tx:      tx,
+		storage: cs,
+	}, nil
+}
+
+// cachedTx drops what the transaction wrote from the cache once it is
+// committed or rolled back.
+type cachedTx struct {
+	tx      Tx
+	storage *CachedStorage
+	names   []cacheName
+}
+
+func (ct *cachedTx) written(table string, key string, err error) error {
+	ct.names = append(ct.names, cacheName{table: table, key: key})
+
+	return err
+}
+
+func (ct *cachedTx) done(err error) error {
+	for _, name := range ct.names {
+		ct.storage.invalidate(name.table, name.key)
+	}
+
+	ct.names = nil
+
+	return err
+}
+
+func (ct *cachedTx) SetKey(table string, key string, value string, expiration time.Duration) error {
+	return ct.written(table, key, ct.tx.SetKey(table, key, value, expiration))
+}
+
+func (ct *cachedTx) DelKey(table string, key string) error {
+	return ct.written(table, key, ct.tx.DelKey(table, key))
+}
+
+func (ct *cachedTx) AddToMap(table string, key string, objectKey string, object string) error {
+	return ct.written(table, key, ct.tx.AddToMap(table, key, objectKey, object))
+}
+
+func (ct *cachedTx) AddToMapWithTTL(table string, key string, objectKey string, object string, expiration time.Duration) error {
+	return ct.written(table, key, ct.tx.AddToMapWithTTL(table, key, objectKey, object, expiration))
+}
+
+func (ct *cachedTx) DelFromMap(table string, key string, objectKey string) error {
+	return ct.written(table, key, ct.tx.DelFromMap(table, key, objectKey))
+}
+
+func (ct *cachedTx) Commit() error {
+	return ct.done(ct.tx.Commit())
+}
+
+func (ct *cachedTx) Rollback() error {
+	return ct.done(ct.tx.Rollback())
+}
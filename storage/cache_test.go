@@ -0,0 +1,297 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseCacheOptions(t *testing.T) {
+	options, err := ParseCacheOptions(map[string]string{
+		CACHE_SIZE:         "100",
+		CACHE_TTL:          "1s",
+		CACHE_TABLE_TTLS:   "publickeys=10m, identificators=0",
+		CACHE_NEGATIVE_TTL: "5s",
+		CACHE_WATCH:        "false",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if options.MaxEntries != 100 || options.TTL != time.Second || options.NegativeTTL != 5*time.Second || options.Watch ||
+		options.TableTTLs["publickeys"] != 10*time.Minute || options.TableTTLs["identificators"] != 0 {
+		t.Errorf("ParseCacheOptions = %+v", options)
+	}
+
+	options, err = ParseCacheOptions(map[string]string{})
+
+	if err != nil || options.MaxEntries != 0 || !options.Watch {
+		t.Errorf("ParseCacheOptions of no credentials = %+v, %v", options, err)
+	}
+
+	invalid := []map[string]string{
+		{CACHE_SIZE: "many"},
+		{CACHE_TTL: "forever"},
+		{CACHE_TABLE_TTLS: "publickeys"},
+		{CACHE_TABLE_TTLS: "publickeys=soon"},
+		{CACHE_WATCH: "maybe"},
+	}
+
+	for _, credentials := range invalid {
+		_, err = ParseCacheOptions(credentials)
+
+		if err == nil {
+			t.Errorf("ParseCacheOptions(%v) succeeded", credentials)
+		}
+	}
+}
+
+// newTestCachedStorage caches the "cached" table of the memory storage of the
+// test, which the returned backend writes to behind the back of the cache.
+func newTestCachedStorage(t *testing.T, options *CacheOptions) (*CachedStorage, *MemoryStorage) {
+	backend := newTestMemoryStorage(t)
+
+	if options.TableTTLs == nil {
+		options.TableTTLs = map[string]time.Duration{"cached": time.Minute}
+	}
+
+	cs := NewCachedStorage(newTestMemoryStorage(t), options)
+
+	t.Cleanup(func() {
+		cs.stopWatching()
+	})
+
+	return cs, backend
+}
+
+func TestCachedStorageReads(t *testing.T) {
+	cs, backend := newTestCachedStorage(t, &CacheOptions{})
+
+	backend.SetKey("cached", "key", "old", 0)
+	backend.AddToMap("cached", "map", "field", "old")
+	backend.SetKey("other", "key", "old", 0)
+
+	for i := 0; i < 2; i++ {
+		cs.GetKey("cached", "key")
+		cs.GetFromMap("cached", "map", "field")
+		cs.GetMap("cached", "map")
+		cs.GetKey("other", "key")
+	}
+
+	if stats := cs.Stats(); stats.Hits != 3 || stats.Misses != 3 || stats.Entries != 3 {
+		t.Errorf("Stats = %+v", stats)
+	}
+
+	backend.SetKey("cached", "key", "new", 0)
+	backend.AddToMap("cached", "map", "field", "new")
+	backend.SetKey("other", "key", "new", 0)
+
+	if value, _ := cs.GetFullKey("cached/key"); value != "old" {
+		t.Errorf("Cached key = %q", value)
+	}
+
+	if value, _ := cs.GetKey("other", "key"); value != "new" {
+		t.Errorf("Uncached key = %q", value)
+	}
+
+	fields, _ := cs.GetMap("cached", "map")
+	fields["field"] = "changed by the caller"
+
+	if fields, _ := cs.GetMap("cached", "map"); fields["field"] != "old" {
+		t.Errorf("Cached map = %v", fields)
+	}
+
+	// Writes through the cache drop what they change.
+	cs.AddToMap("cached", "map", "other", "value")
+
+	if value, _ := cs.GetFromMap("cached", "map", "field"); value != "new" {
+		t.Errorf("Field after a write = %q", value)
+	}
+
+	tx, err := cs.Begin()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx.SetKey("cached", "key", "committed", 0)
+	tx.Commit()
+
+	if value, _ := cs.GetKey("cached", "key"); value != "committed" {
+		t.Errorf("Key after a transaction = %q", value)
+	}
+}
+
+func TestCachedStorageNegative(t *testing.T) {
+	cs, backend := newTestCachedStorage(t, &CacheOptions{NegativeTTL: time.Minute})
+
+	_, err := cs.LookupKey("cached", "key")
+
+	if err != ErrNotFound {
+		t.Fatalf("LookupKey of a missing key = %v", err)
+	}
+
+	backend.SetKey("cached", "key", "value", 0)
+
+	_, err = cs.LookupKey("cached", "key")
+
+	if err != ErrNotFound {
+		t.Errorf("LookupKey of a remembered missing key = %v", err)
+	}
+
+	cs, backend = newTestCachedStorage(t, &CacheOptions{})
+
+	cs.LookupKey("cached", "other")
+	backend.SetKey("cached", "other", "value", 0)
+
+	if value, err := cs.LookupKey("cached", "other"); value != "value" || err != nil {
+		t.Errorf("LookupKey without negative caching = %q, %v", value, err)
+	}
+}
+
+func TestCachedStorageLimits(t *testing.T) {
+	cs, _ := newTestCachedStorage(t, &CacheOptions{MaxEntries: 2, NegativeTTL: time.Minute})
+
+	cs.GetKey("cached", "a")
+	cs.GetKey("cached", "b")
+	cs.GetKey("cached", "a")
+	cs.GetKey("cached", "c")
+
+	if stats := cs.Stats(); stats.Entries != 2 || stats.Evictions != 1 {
+		t.Errorf("Stats = %+v", stats)
+	}
+
+	// b was the least recently used.
+	cs.GetKey("cached", "a")
+
+	if stats := cs.Stats(); stats.Hits != 2 {
+		t.Errorf("Stats after reading a = %+v", stats)
+	}
+
+	cs, _ = newTestCachedStorage(t, &CacheOptions{MaxBytes: 3 * cacheEntryOverhead, NegativeTTL: time.Minute})
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		cs.GetKey("cached", key)
+	}
+
+	if stats := cs.Stats(); stats.Entries != 2 || stats.Bytes > 3*cacheEntryOverhead {
+		t.Errorf("Stats with a byte limit = %+v", stats)
+	}
+
+	cs, backend := newTestCachedStorage(t, &CacheOptions{TableTTLs: map[string]time.Duration{"cached": 10 * time.Millisecond}})
+
+	backend.SetKey("cached", "key", "old", 0)
+	cs.GetKey("cached", "key")
+	backend.SetKey("cached", "key", "new", 0)
+
+	time.Sleep(20 * time.Millisecond)
+
+	if value, _ := cs.GetKey("cached", "key"); value != "new" {
+		t.Errorf("Key after its TTL = %q", value)
+	}
+}
+
+func TestCachedStorageWatch(t *testing.T) {
+	cs, backend := newTestCachedStorage(t, &CacheOptions{Watch: true})
+
+	backend.SetKey("cached", "key", "old", 0)
+	cs.GetKey("cached", "key")
+	backend.SetKey("cached", "key", "new", 0)
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		value, _ := cs.GetKey("cached", "key")
+
+		if value == "new" {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("The change of the backend was not seen")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// A backend whose credentials disable Watch is not watched, and not retried.
+func TestCachedStorageWithoutWatch(t *testing.T) {
+	var output bytes.Buffer
+
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+
+	cs := NewCachedStorage(newTestSQLiteStorage(t), &CacheOptions{
+		TableTTLs: map[string]time.Duration{"cached": time.Minute},
+		Watch:     true,
+	})
+	defer cs.stopWatching()
+
+	for i := 0; i < 2; i++ {
+		cs.GetKey("cached", "key")
+	}
+
+	cs.mutex.Lock()
+	unwatchable, watched := cs.unwatchable, len(cs.watched)
+	cs.mutex.Unlock()
+
+	if !unwatchable || watched != 0 {
+		t.Errorf("Cache of a backend without Watch is unwatchable %v, watches %d tables", unwatchable, watched)
+	}
+
+	if output.Len() > 0 {
+		t.Errorf("Cache of a backend without Watch logged %q", output.String())
+	}
+}
+
+func TestGenericStorageCache(t *testing.T) {
+	gs := newTestGenericStorage(t, map[string]string{
+		CACHE_SIZE: "10",
+		CACHE_TTL:  "1m",
+	})
+
+	err := gs.SetKey("table", "key", "value", 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gs.GetKey("table", "key")
+	gs.GetKey("table", "key")
+
+	storage, err := gs.getStorage()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs, ok := storage.(*CachedStorage)
+
+	if !ok {
+		t.Fatalf("Pooled storage is a %T", storage)
+	}
+
+	if stats := cs.Stats(); stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("Stats = %+v", stats)
+	}
+}
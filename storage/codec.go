@@ -0,0 +1,298 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec turns the objects of GenericStorage into the strings stored by the
+// backends and back.
+//
+// Every value but those of JSONCodec is stored as "<name>:<encoded object>".
+// Values written before codecs existed are base64 JSON, which never contains
+// a ':', so they still decode whatever codec a GenericStorage uses now.
+type Codec interface {
+	// Name tags the values of the codec. It must not contain ':' and only
+	// JSONCodec has an empty one.
+	Name() string
+	Encode(object interface{}) (string, error)
+	// Decode fills reference, a non nil pointer, from a value of Encode
+	// without its tag.
+	Decode(value string, reference interface{}) error
+}
+
+// JSONCodec stores objects as base64 JSON without a tag, the format
+// GenericStorage always had. It is the default.
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string {
+	return ""
+}
+
+func (JSONCodec) Encode(object interface{}) (string, error) {
+	data, err := json.Marshal(object)
+
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+func (JSONCodec) Decode(value string, reference interface{}) error {
+	data, err := base64.StdEncoding.DecodeString(value)
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, reference)
+}
+
+// RawJSONCodec stores objects as plain JSON, which takes less space and can be
+// read with the tools of the backend.
+type RawJSONCodec struct{}
+
+func (RawJSONCodec) Name() string {
+	return "json"
+}
+
+func (RawJSONCodec) Encode(object interface{}) (string, error) {
+	data, err := json.Marshal(object)
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+func (RawJSONCodec) Decode(value string, reference interface{}) error {
+	return json.Unmarshal([]byte(value), reference)
+}
+
+// CBORCodec stores objects as base64 CBOR.
+type CBORCodec struct{}
+
+func (CBORCodec) Name() string {
+	return "cbor"
+}
+
+func (CBORCodec) Encode(object interface{}) (string, error) {
+	data, err := cbor.Marshal(object)
+
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+func (CBORCodec) Decode(value string, reference interface{}) error {
+	data, err := base64.StdEncoding.DecodeString(value)
+
+	if err != nil {
+		return err
+	}
+
+	return cbor.Unmarshal(data, reference)
+}
+
+// GobCodec stores objects as base64 gob. Every value carries its own type
+// description, so it suits large objects better than small ones.
+type GobCodec struct{}
+
+func (GobCodec) Name() string {
+	return "gob"
+}
+
+func (GobCodec) Encode(object interface{}) (string, error) {
+	var buffer bytes.Buffer
+
+	err := gob.NewEncoder(&buffer).Encode(object)
+
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(buffer.Bytes()), nil
+}
+
+func (GobCodec) Decode(value string, reference interface{}) error {
+	data, err := base64.StdEncoding.DecodeString(value)
+
+	if err != nil {
+		return err
+	}
+
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(reference)
+}
+
+// ProtobufCodec stores objects, which must be proto.Message, as base64
+// protobuf.
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) Name() string {
+	return "protobuf"
+}
+
+func (ProtobufCodec) Encode(object interface{}) (string, error) {
+	message, ok := object.(proto.Message)
+
+	if !ok {
+		return "", fmt.Errorf("%T is not a proto.Message", object)
+	}
+
+	data, err := proto.Marshal(message)
+
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+func (ProtobufCodec) Decode(value string, reference interface{}) error {
+	message, ok := reference.(proto.Message)
+
+	if !ok {
+		return fmt.Errorf("%T is not a proto.Message", reference)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(value)
+
+	if err != nil {
+		return err
+	}
+
+	return proto.Unmarshal(data, message)
+}
+
+type codecRegistry struct {
+	mutex  sync.RWMutex
+	codecs map[string]Codec
+}
+
+var codecs = &codecRegistry{
+	codecs: map[string]Codec{
+		JSONCodec{}.Name():     JSONCodec{},
+		RawJSONCodec{}.Name():  RawJSONCodec{},
+		CBORCodec{}.Name():     CBORCodec{},
+		GobCodec{}.Name():      GobCodec{},
+		ProtobufCodec{}.Name(): ProtobufCodec{},
+	},
+}
+
+// RegisterCodec makes the values of a codec other than the built-in ones
+// decodable. Values tagged with a name which was not registered can not be
+// read.
+func RegisterCodec(codec Codec) error {
+	name := codec.Name()
+
+	if name == "" || strings.Contains(name, ":") {
+		return fmt.Errorf("Invalid codec name %q", name)
+	}
+
+	codecs.mutex.Lock()
+	defer codecs.mutex.Unlock()
+
+	if _, ok := codecs.codecs[name]; ok {
+		return fmt.Errorf("Codec %q is already registered", name)
+	}
+
+	codecs.codecs[name] = codec
+
+	return nil
+}
+
+func (cr *codecRegistry) get(name string) (Codec, error) {
+	cr.mutex.RLock()
+	defer cr.mutex.RUnlock()
+
+	codec, ok := cr.codecs[name]
+
+	if !ok {
+		return nil, fmt.Errorf("Unknown codec %q", name)
+	}
+
+	return codec, nil
+}
+
+// encodeObject encodes object with codec, JSONCodec if it is nil, and tags
+// it with the name of the codec.
+func encodeObject(codec Codec, object interface{}) (string, error) {
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+
+	value, err := codec.Encode(object)
+
+	if err != nil {
+		return "", fmt.Errorf("Can not encode %T: %w", object, err)
+	}
+
+	if codec.Name() == "" {
+		return value, nil
+	}
+
+	return codec.Name() + ":" + value, nil
+}
+
+// decodeObject is the reverse of encodeObject for any registered codec, name
+// says what is decoded in errors.
+func decodeObject(name string, value string, reference interface{}) error {
+	target := reflect.ValueOf(reference)
+
+	if target.Kind() != reflect.Ptr || target.IsNil() {
+		return fmt.Errorf("Can not decode %s into %T, it is not a non nil pointer", name, reference)
+	}
+
+	codecName := ""
+
+	if index := strings.IndexByte(value, ':'); index >= 0 {
+		codecName, value = value[:index], value[index+1:]
+
+		if codecName == "" {
+			return fmt.Errorf("Can not decode %s, its codec tag is empty", name)
+		}
+	}
+
+	codec, err := codecs.get(codecName)
+
+	if err != nil {
+		return fmt.Errorf("Can not decode %s: %w", name, err)
+	}
+
+	err = codec.Decode(value, reference)
+
+	if err != nil {
+		return fmt.Errorf("Can not decode %s into %T: %w", name, reference, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,222 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestCodecsRoundTrip(t *testing.T) {
+	gs := newTestGenericStorage(t, nil)
+
+	for _, codec := range []Codec{JSONCodec{}, RawJSONCodec{}, CBORCodec{}, GobCodec{}} {
+		gs.Codec = codec
+
+		err := gs.SetObject("codecs", codec.Name(), &testObject{Name: "object"}, 0)
+
+		if err != nil {
+			t.Fatalf("%T: %v", codec, err)
+		}
+
+		err = gs.AddToMap("codecs", "map", codec.Name(), &testObject{Name: "field"})
+
+		if err != nil {
+			t.Fatalf("%T: %v", codec, err)
+		}
+
+		object := &testObject{}
+
+		err = gs.GetObject("codecs", codec.Name(), object)
+
+		if err != nil || object.Name != "object" {
+			t.Errorf("%T: GetObject = %+v, %v", codec, object, err)
+		}
+
+		err = gs.GetFromMap("codecs", "map", codec.Name(), object)
+
+		if err != nil || object.Name != "field" {
+			t.Errorf("%T: GetFromMap = %+v, %v", codec, object, err)
+		}
+	}
+
+	// Every field was written with another codec.
+	objects := map[string]*testObject{}
+
+	err := gs.GetMap("codecs", "map", &objects)
+
+	if err != nil || len(objects) != 4 {
+		t.Fatalf("GetMap = %v, %v", objects, err)
+	}
+
+	for name, object := range objects {
+		if object.Name != "field" {
+			t.Errorf("GetMap[%q] = %+v", name, object)
+		}
+	}
+}
+
+func TestCodecsTagValues(t *testing.T) {
+	gs := newTestGenericStorage(t, nil)
+
+	err := gs.SetObject("codecs", "legacy", &testObject{Name: "legacy"}, 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gs.Codec = RawJSONCodec{}
+
+	err = gs.SetObject("codecs", "raw", &testObject{Name: "raw"}, 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	legacy, _ := gs.GetKey("codecs", "legacy")
+
+	if legacy != base64.StdEncoding.EncodeToString([]byte(`{"Name":"legacy"}`)) {
+		t.Errorf("JSONCodec value = %q", legacy)
+	}
+
+	raw, _ := gs.GetKey("codecs", "raw")
+
+	if raw != `json:{"Name":"raw"}` {
+		t.Errorf("RawJSONCodec value = %q", raw)
+	}
+
+	object := &testObject{}
+
+	err = gs.GetObject("codecs", "legacy", object)
+
+	if err != nil || object.Name != "legacy" {
+		t.Errorf("GetObject of an untagged value = %+v, %v", object, err)
+	}
+
+	err = gs.SetKey("codecs", "unknown", "unknown:value", 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = gs.GetObject("codecs", "unknown", object)
+
+	if err == nil || !strings.Contains(err.Error(), `Unknown codec "unknown"`) {
+		t.Errorf("GetObject of an unknown codec: %v", err)
+	}
+}
+
+func TestProtobufCodec(t *testing.T) {
+	gs := newTestGenericStorage(t, nil)
+	gs.Codec = ProtobufCodec{}
+
+	err := gs.SetObject("codecs", "message", &wrapperspb.StringValue{Value: "message"}, 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := &wrapperspb.StringValue{}
+
+	err = gs.GetObject("codecs", "message", message)
+
+	if err != nil || message.Value != "message" {
+		t.Errorf("GetObject = %v, %v", message, err)
+	}
+
+	err = gs.SetObject("codecs", "object", &testObject{Name: "object"}, 0)
+
+	if err == nil {
+		t.Error("SetObject of something else than a proto.Message succeeded")
+	}
+}
+
+type reverseCodec struct{}
+
+func (reverseCodec) Name() string {
+	return "reverse"
+}
+
+func (reverseCodec) Encode(object interface{}) (string, error) {
+	value, err := RawJSONCodec{}.Encode(object)
+
+	if err != nil {
+		return "", err
+	}
+
+	return reverse(value), nil
+}
+
+func (reverseCodec) Decode(value string, reference interface{}) error {
+	return RawJSONCodec{}.Decode(reverse(value), reference)
+}
+
+func reverse(value string) string {
+	runes := []rune(value)
+
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+
+	return string(runes)
+}
+
+func TestRegisterCodec(t *testing.T) {
+	err := RegisterCodec(RawJSONCodec{})
+
+	if err == nil {
+		t.Error("RegisterCodec of a built-in codec succeeded")
+	}
+
+	err = RegisterCodec(JSONCodec{})
+
+	if err == nil {
+		t.Error("RegisterCodec of a codec without a name succeeded")
+	}
+
+	err = RegisterCodec(reverseCodec{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		codecs.mutex.Lock()
+		delete(codecs.codecs, reverseCodec{}.Name())
+		codecs.mutex.Unlock()
+	})
+
+	gs := newTestGenericStorage(t, nil)
+	gs.Codec = reverseCodec{}
+
+	err = gs.SetObject("codecs", "reversed", &testObject{Name: "reversed"}, 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	object := &testObject{}
+
+	err = gs.GetObject("codecs", "reversed", object)
+
+	if err != nil || object.Name != "reversed" {
+		t.Errorf("GetObject = %+v, %v", object, err)
+	}
+}
@@ -0,0 +1,374 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The export format is JSON, one object per line. The first line is a header
+// and every other line a key, with its value and the milliseconds it had left
+// when exported, or a map with its fields, the milliseconds those which
+// expire on their own had left and those the whole map had left:
+//
+//	{"format":"netclave-storage","version":2}
+//	{"type":"key","table":"publickeys","key":"label","value":"...","ttl":60000}
+//	{"type":"map","table":"identificators","key":"id","fields":{"a":"...","b":"..."},"field_ttls":{"b":60000},"map_ttl":120000}
+//
+// Keys and fields without a ttl never expire, nor do maps without "map_ttl".
+// Version 1 carried no expirations of maps, its files are still imported.
+var exportFormat = "netclave-storage"
+var exportVersion = 2
+
+var exportRecordKey = "key"
+var exportRecordMap = "map"
+
+type exportHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+}
+
+type exportRecord struct {
+	Type   string            `json:"type"`
+	Table  string            `json:"table"`
+	Key    string            `json:"key"`
+	Value  string            `json:"value,omitempty"`
+	TTL    int64             `json:"ttl,omitempty"`
+	Fields map[string]string `json:"fields,omitempty"`
+	// FieldTTLs and MapTTL are in milliseconds, like TTL.
+	FieldTTLs map[string]int64 `json:"field_ttls,omitempty"`
+	MapTTL    int64            `json:"map_ttl,omitempty"`
+}
+
+func Export(src Storage, w io.Writer) error {
+	return ExportContext(context.Background(), src, w)
+}
+
+// ExportContext writes the live keys and maps of tables, or of every table
+// if none is given, to w. JSON only carries UTF-8, so a table, key, field or
+// value which is not valid UTF-8 stops the export with an error.
+func ExportContext(ctx context.Context, src Storage, w io.Writer, tables ...string) error {
+	var err error
+
+	if len(tables) == 0 {
+		tables, err = src.Tables(ctx)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	encoder := json.NewEncoder(w)
+
+	err = encoder.Encode(exportHeader{Format: exportFormat, Version: exportVersion})
+
+	if err != nil {
+		return err
+	}
+
+	write := func(record exportRecord) error {
+		return writeExportRecord(record, encoder)
+	}
+
+	for _, table := range tables {
+		err = exportTable(ctx, src, table, write)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// exportTable hands every live key and map of table to emit. A name is
+// checked both as a key and as a map, as scanning does not tell them apart.
+func exportTable(ctx context.Context, src Storage, table string, emit func(record exportRecord) error) error {
+	it, err := src.ScanKeys(ctx, table, "**", 0)
+
+	if err != nil {
+		return err
+	}
+
+	defer it.Close()
+
+	for it.Next() {
+		key := strings.TrimPrefix(it.Key(), table+"/")
+
+		value, err := src.LookupKeyContext(ctx, table, key)
+
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+
+		if err == nil {
+			ttl, err := src.TTLContext(ctx, table, key)
+
+			// Expired in between.
+			if err == ErrNotFound {
+				continue
+			}
+
+			if err != nil {
+				return err
+			}
+
+			record := exportRecord{Type: exportRecordKey, Table: table, Key: key, Value: value}
+
+			if ttl != NoExpiration {
+				// A key about to expire must not be imported as one which
+				// never does.
+				record.TTL = ttl.Milliseconds()
+
+				if record.TTL <= 0 {
+					continue
+				}
+			}
+
+			err = emit(record)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		record, err := exportMap(ctx, src, table, key)
+
+		if err != nil {
+			return err
+		}
+
+		if record == nil {
+			continue
+		}
+
+		err = emit(*record)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return it.Err()
+}
+
+// exportMap returns the record of a live map with its expirations, or nil if
+// there is no such map. Fields and maps about to expire are left out, as with
+// keys, and so are fields which expired between reading the values and the
+// expirations.
+func exportMap(ctx context.Context, src Storage, table string, key string) (*exportRecord, error) {
+	values, err := src.GetMapContext(ctx, table, key)
+
+	if err != nil || len(values) == 0 {
+		return nil, err
+	}
+
+	ttls, mapTTL, err := src.MapTTLContext(ctx, table, key)
+
+	if err == ErrNotFound {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	record := &exportRecord{Type: exportRecordMap, Table: table, Key: key, Fields: map[string]string{}}
+
+	if mapTTL != NoExpiration {
+		record.MapTTL = mapTTL.Milliseconds()
+
+		if record.MapTTL <= 0 {
+			return nil, nil
+		}
+	}
+
+	for field, value := range values {
+		ttl, ok := ttls[field]
+
+		if !ok {
+			continue
+		}
+
+		if ttl != NoExpiration {
+			if ttl.Milliseconds() <= 0 {
+				continue
+			}
+
+			if record.FieldTTLs == nil {
+				record.FieldTTLs = map[string]int64{}
+			}
+
+			record.FieldTTLs[field] = ttl.Milliseconds()
+		}
+
+		record.Fields[field] = value
+	}
+
+	if len(record.Fields) == 0 {
+		return nil, nil
+	}
+
+	return record, nil
+}
+
+func writeExportRecord(record exportRecord, encoder *json.Encoder) error {
+	texts := []string{record.Table, record.Key, record.Value}
+
+	for field, value := range record.Fields {
+		texts = append(texts, field, value)
+	}
+
+	for _, text := range texts {
+		if !utf8.ValidString(text) {
+			return fmt.Errorf("Can not export %s/%s, it is not valid UTF-8", record.Table, record.Key)
+		}
+	}
+
+	return encoder.Encode(record)
+}
+
+func Import(dst Storage, r io.Reader) error {
+	return ImportContext(context.Background(), dst, r)
+}
+
+// ImportContext stores the keys and maps read from r, as written by Export,
+// in dst, replacing keys and fields of the same names. Keys, fields and maps
+// expire after the time they had left when they were exported. The
+// expiration of a map applies to the fields dst already had in it too.
+func ImportContext(ctx context.Context, dst Storage, r io.Reader) error {
+	decoder := json.NewDecoder(r)
+
+	var header exportHeader
+
+	err := decoder.Decode(&header)
+
+	if err != nil {
+		return fmt.Errorf("Can not read export header: %w", err)
+	}
+
+	if header.Format != exportFormat || header.Version < 1 || header.Version > exportVersion {
+		return fmt.Errorf("Unsupported export format %q version %d", header.Format, header.Version)
+	}
+
+	for {
+		var record exportRecord
+
+		err = decoder.Decode(&record)
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		err = CheckTableName(record.Table)
+
+		if err != nil {
+			return err
+		}
+
+		switch record.Type {
+		case exportRecordKey:
+			err = dst.SetKeyContext(ctx, record.Table, record.Key, record.Value, time.Duration(record.TTL)*time.Millisecond)
+		case exportRecordMap:
+			err = importMap(ctx, dst, record)
+		default:
+			err = fmt.Errorf("Unknown export record type %q", record.Type)
+		}
+
+		if err != nil {
+			return fmt.Errorf("Can not import %s/%s: %w", record.Table, record.Key, err)
+		}
+	}
+}
+
+// importMap adds the fields of a map in one transaction, then sets the
+// expiration of the map, which transactions can not.
+func importMap(ctx context.Context, dst Storage, record exportRecord) error {
+	tx, err := dst.BeginContext(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	for field, value := range record.Fields {
+		ttl := time.Duration(record.FieldTTLs[field]) * time.Millisecond
+
+		err = tx.AddToMapWithTTL(record.Table, record.Key, field, value, ttl)
+
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	err = tx.Commit()
+
+	if err != nil || record.MapTTL <= 0 {
+		return err
+	}
+
+	return dst.ExpireMapContext(ctx, record.Table, record.Key, time.Duration(record.MapTTL)*time.Millisecond)
+}
+
+// Diff compares the live keys and maps of table in src and dst and returns
+// "table/key" for each one that is missing from dst or holds something else
+// there. Expirations are not compared, and keys only dst has are ignored.
+func Diff(ctx context.Context, src Storage, dst Storage, table string) ([]string, error) {
+	different := []string{}
+
+	err := exportTable(ctx, src, table, func(record exportRecord) error {
+		if record.Type == exportRecordKey {
+			value, err := dst.LookupKeyContext(ctx, table, record.Key)
+
+			if err == ErrNotFound || (err == nil && value != record.Value) {
+				different = append(different, table+"/"+record.Key)
+				return nil
+			}
+
+			return err
+		}
+
+		fields, err := dst.GetMapContext(ctx, table, record.Key)
+
+		if err != nil {
+			return err
+		}
+
+		if !reflect.DeepEqual(fields, record.Fields) {
+			different = append(different, table+"/"+record.Key)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return different, nil
+}
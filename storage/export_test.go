@@ -0,0 +1,223 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportImport(t *testing.T) {
+	src := newTestMemoryStorage(t)
+	dst := newTestSQLiteStorage(t)
+
+	src.SetKey("keys", "a/b", "never expires", 0)
+	src.SetKey("keys", "expiring", "expires", time.Hour)
+	src.SetKey("other", "key", "", 0)
+	src.AddToMap("maps", "map", "first", "1")
+	src.AddToMap("maps", "map", "second", "2")
+
+	var buffer bytes.Buffer
+
+	err := Export(src, &buffer)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+
+	if len(lines) != 5 || lines[0] != `{"format":"netclave-storage","version":2}` {
+		t.Fatalf("Export wrote %q", lines)
+	}
+
+	err = Import(dst, &buffer)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range []string{"keys", "other", "maps"} {
+		different, err := Diff(context.Background(), src, dst, table)
+
+		if err != nil || len(different) != 0 {
+			t.Errorf("Diff of %s after Import = %q, %v", table, different, err)
+		}
+	}
+
+	ttl, err := dst.TTL("keys", "expiring")
+
+	if err != nil || ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Errorf("TTL after Import = %v, %v", ttl, err)
+	}
+
+	ttl, err = dst.TTL("keys", "a/b")
+
+	if err != nil || ttl != NoExpiration {
+		t.Errorf("TTL of a key which never expires after Import = %v, %v", ttl, err)
+	}
+}
+
+func TestExportImportKeepsMapExpirations(t *testing.T) {
+	src := newTestMemoryStorage(t)
+	dst := newTestSQLiteStorage(t)
+
+	src.AddToMap("maps", "expiring", "field", "value")
+	src.AddToMapWithTTL("maps", "expiring", "short", "value", time.Hour)
+	src.ExpireMap("maps", "expiring", 2*time.Hour)
+	src.AddToMap("maps", "persistent", "field", "value")
+	src.AddToMapWithTTL("maps", "persistent", "short", "value", time.Hour)
+	src.AddToMapWithTTL("maps", "gone", "field", "value", time.Millisecond)
+
+	time.Sleep(10 * time.Millisecond)
+
+	var buffer bytes.Buffer
+
+	err := Export(src, &buffer)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Import(dst, &buffer)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	within := func(ttl time.Duration, expected time.Duration) bool {
+		return ttl <= expected && ttl > expected-time.Minute
+	}
+
+	fields, mapTTL, err := dst.MapTTL("maps", "expiring")
+
+	if err != nil || len(fields) != 2 || fields["field"] != NoExpiration || !within(fields["short"], time.Hour) ||
+		!within(mapTTL, 2*time.Hour) {
+		t.Errorf("MapTTL of an expiring map after Import = %v, %v, %v", fields, mapTTL, err)
+	}
+
+	fields, mapTTL, err = dst.MapTTL("maps", "persistent")
+
+	if err != nil || len(fields) != 2 || fields["field"] != NoExpiration || !within(fields["short"], time.Hour) ||
+		mapTTL != NoExpiration {
+		t.Errorf("MapTTL of a persistent map after Import = %v, %v, %v", fields, mapTTL, err)
+	}
+
+	_, _, err = dst.MapTTL("maps", "gone")
+
+	if err != ErrNotFound {
+		t.Errorf("MapTTL of an expired map after Import = %v", err)
+	}
+}
+
+func TestImportVersion1(t *testing.T) {
+	dst := newTestMemoryStorage(t)
+
+	data := `{"format":"netclave-storage","version":1}` + "\n" +
+		`{"type":"map","table":"maps","key":"map","fields":{"field":"value"}}`
+
+	err := Import(dst, strings.NewReader(data))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields, mapTTL, err := dst.MapTTL("maps", "map")
+
+	if err != nil || fields["field"] != NoExpiration || mapTTL != NoExpiration {
+		t.Errorf("MapTTL after Import of version 1 = %v, %v, %v", fields, mapTTL, err)
+	}
+}
+
+func TestExportSelectedTables(t *testing.T) {
+	src := newTestMemoryStorage(t)
+
+	src.SetKey("exported", "key", "value", 0)
+	src.SetKey("skipped", "key", "value", 0)
+
+	var buffer bytes.Buffer
+
+	err := ExportContext(context.Background(), src, &buffer, "exported")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(buffer.String(), "skipped") || !strings.Contains(buffer.String(), "exported") {
+		t.Errorf("Export of one table wrote %q", buffer.String())
+	}
+}
+
+func TestExportRejectsInvalidUTF8(t *testing.T) {
+	src := newTestMemoryStorage(t)
+
+	src.SetKey("table", "key", "\xff", 0)
+
+	err := Export(src, &bytes.Buffer{})
+
+	if err == nil {
+		t.Error("Export of a value which is not UTF-8 succeeded")
+	}
+}
+
+func TestImportRejectsUnknownFormat(t *testing.T) {
+	dst := newTestMemoryStorage(t)
+
+	for _, data := range []string{
+		"",
+		`{"format":"other","version":1}`,
+		`{"format":"netclave-storage","version":3}`,
+		`{"format":"netclave-storage","version":1}` + "\n" + `{"type":"set","table":"t","key":"k"}`,
+		`{"format":"netclave-storage","version":1}` + "\n" + `{"type":"key","table":"t/u","key":"k"}`,
+	} {
+		err := Import(dst, strings.NewReader(data))
+
+		if err == nil {
+			t.Errorf("Import(%q) succeeded", data)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	src := newTestMemoryStorage(t)
+	dst := newTestSQLiteStorage(t)
+
+	src.SetKey("table", "same", "value", 0)
+	src.SetKey("table", "changed", "source", 0)
+	src.SetKey("table", "missing", "value", 0)
+	src.AddToMap("table", "map", "field", "source")
+
+	dst.SetKey("table", "same", "value", 0)
+	dst.SetKey("table", "changed", "destination", 0)
+	dst.SetKey("table", "extra", "value", 0)
+	dst.AddToMap("table", "map", "field", "source")
+	dst.AddToMap("table", "map", "extra", "destination")
+
+	different, err := Diff(context.Background(), src, dst, "table")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(uniqueSorted(different), []string{"table/changed", "table/map", "table/missing"}) {
+		t.Errorf("Diff = %q", different)
+	}
+}
@@ -17,10 +17,8 @@
 package storage
 
 import (
-	"encoding/base64"
-	"encoding/json"
+	"context"
 	"errors"
-	"log"
 	"reflect"
 	"time"
 )
@@ -28,6 +26,42 @@ import (
 type GenericStorage struct {
 	Credentials map[string]string
 	StorageType string
+	// Codec encodes the objects written by gs, JSONCodec if it is nil. Objects
+	// are read with the codec they were written with.
+	Codec Codec
+	// Wrap, if set, is applied to the pooled backend before each call, for
+	// example to encrypt some tables with cryptoutils.EncryptedStorage.
+	Wrap func(Storage) Storage
+	// Middlewares decorate the backend, after Wrap, with Wrap(backend,
+	// Middlewares...), for example Metrics.Middleware and Tracing.
+	Middlewares []Middleware
+
+	// entry is the pooled backend gs holds a reference to, guarded by the
+	// mutex of the pool.
+	entry *poolEntry
+}
+
+// getStorage returns the pooled backend for the credentials and type of gs,
+// creating it on first use.
+func (gs *GenericStorage) getStorage() (Storage, error) {
+	storage, err := pool.get(gs)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if gs.Wrap != nil {
+		storage = gs.Wrap(storage)
+	}
+
+	return Wrap(storage, gs.Middlewares...), nil
+}
+
+// Close releases the pooled backend used by gs, which is destroyed once every
+// GenericStorage sharing it has been closed. Using gs again after Close takes
+// the backend back, reopening it if needed.
+func (gs *GenericStorage) Close() error {
+	return pool.release(gs)
 }
 
 func (gs *GenericStorage) Init() error {
@@ -42,188 +76,501 @@ func (gs *GenericStorage) Init() error {
 	return storage.Init()
 }
 
+// Migrate brings the schema of a SQL backend to the latest version and returns
+// the migrations it applied. Other backends have no schema to migrate.
+func (gs *GenericStorage) Migrate(ctx context.Context) ([]Migration, error) {
+	return gs.migrate(ctx, Migrator.Migrate)
+}
+
+// MigrateDryRun returns the migrations Migrate would apply, with their
+// statements, without changing the database.
+func (gs *GenericStorage) MigrateDryRun(ctx context.Context) ([]Migration, error) {
+	return gs.migrate(ctx, Migrator.MigrateDryRun)
+}
+
+func (gs *GenericStorage) migrate(ctx context.Context, run func(Migrator, context.Context) ([]Migration, error)) ([]Migration, error) {
+	storage, err := CreateStorage(gs.Credentials, gs.StorageType, true)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer storage.Destroy()
+
+	migrator, ok := storage.(Migrator)
+
+	if !ok {
+		return []Migration{}, nil
+	}
+
+	return run(migrator, ctx)
+}
+
 func (gs *GenericStorage) GetKeys(table string, pattern string) ([]string, error) {
+	return gs.GetKeysContext(context.Background(), table, pattern)
+}
+
+func (gs *GenericStorage) GetKeysContext(ctx context.Context, table string, pattern string) ([]string, error) {
 	err := CheckTableName(table)
 
 	if err != nil {
 		return nil, err
 	}
 
-	storage, err := CreateStorage(gs.Credentials, gs.StorageType, false)
+	storage, err := gs.getStorage()
 
 	if err != nil {
 		return nil, err
 	}
 
-	defer storage.Destroy()
+	return storage.GetKeysContext(ctx, table, pattern)
+}
+
+func (gs *GenericStorage) ScanKeys(ctx context.Context, table string, pattern string, batchSize int) (KeyIterator, error) {
+	err := CheckTableName(table)
+
+	if err != nil {
+		return nil, err
+	}
+
+	storage, err := gs.getStorage()
+
+	if err != nil {
+		return nil, err
+	}
 
-	return storage.GetKeys(table, pattern)
+	return storage.ScanKeys(ctx, table, pattern, batchSize)
+}
+
+func (gs *GenericStorage) Tables(ctx context.Context) ([]string, error) {
+	storage, err := gs.getStorage()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return storage.Tables(ctx)
+}
+
+func (gs *GenericStorage) Watch(ctx context.Context, table string, pattern string) (<-chan Event, error) {
+	err := CheckTableName(table)
+
+	if err != nil {
+		return nil, err
+	}
+
+	storage, err := gs.getStorage()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return storage.Watch(ctx, table, pattern)
 }
 
 func (gs *GenericStorage) SetKey(table string, key string, value string, expiration time.Duration) error {
+	return gs.SetKeyContext(context.Background(), table, key, value, expiration)
+}
+
+func (gs *GenericStorage) SetKeyContext(ctx context.Context, table string, key string, value string, expiration time.Duration) error {
 	err := CheckTableName(table)
 
 	if err != nil {
 		return err
 	}
 
-	storage, err := CreateStorage(gs.Credentials, gs.StorageType, false)
+	storage, err := gs.getStorage()
 
 	if err != nil {
 		return err
 	}
 
-	defer storage.Destroy()
-
-	return storage.SetKey(table, key, value, expiration)
+	return storage.SetKeyContext(ctx, table, key, value, expiration)
 }
 
 func (gs *GenericStorage) GetFullKey(key string) (string, error) {
-	storage, err := CreateStorage(gs.Credentials, gs.StorageType, false)
+	return gs.GetFullKeyContext(context.Background(), key)
+}
+
+func (gs *GenericStorage) GetFullKeyContext(ctx context.Context, key string) (string, error) {
+	storage, err := gs.getStorage()
 
 	if err != nil {
 		return "", err
 	}
 
-	defer storage.Destroy()
-
-	return storage.GetFullKey(key)
+	return storage.GetFullKeyContext(ctx, key)
 }
 
 func (gs *GenericStorage) GetKey(table string, key string) (string, error) {
+	return gs.GetKeyContext(context.Background(), table, key)
+}
+
+func (gs *GenericStorage) GetKeyContext(ctx context.Context, table string, key string) (string, error) {
 	err := CheckTableName(table)
 
 	if err != nil {
 		return "", err
 	}
 
-	storage, err := CreateStorage(gs.Credentials, gs.StorageType, false)
+	storage, err := gs.getStorage()
 
 	if err != nil {
 		return "", err
 	}
 
-	defer storage.Destroy()
+	return storage.GetKeyContext(ctx, table, key)
+}
 
-	return storage.GetKey(table, key)
+func (gs *GenericStorage) LookupKey(table string, key string) (string, error) {
+	return gs.LookupKeyContext(context.Background(), table, key)
 }
 
-func (gs *GenericStorage) DelKey(table string, key string) (int64, error) {
+func (gs *GenericStorage) LookupKeyContext(ctx context.Context, table string, key string) (string, error) {
+	err := CheckTableName(table)
+
+	if err != nil {
+		return "", err
+	}
+
+	storage, err := gs.getStorage()
+
+	if err != nil {
+		return "", err
+	}
+
+	return storage.LookupKeyContext(ctx, table, key)
+}
+
+func (gs *GenericStorage) Exists(table string, key string) (bool, error) {
+	return gs.ExistsContext(context.Background(), table, key)
+}
+
+func (gs *GenericStorage) ExistsContext(ctx context.Context, table string, key string) (bool, error) {
+	err := CheckTableName(table)
+
+	if err != nil {
+		return false, err
+	}
+
+	storage, err := gs.getStorage()
+
+	if err != nil {
+		return false, err
+	}
+
+	return storage.ExistsContext(ctx, table, key)
+}
+
+func (gs *GenericStorage) TTL(table string, key string) (time.Duration, error) {
+	return gs.TTLContext(context.Background(), table, key)
+}
+
+func (gs *GenericStorage) TTLContext(ctx context.Context, table string, key string) (time.Duration, error) {
 	err := CheckTableName(table)
 
 	if err != nil {
 		return 0, err
 	}
 
-	storage, err := CreateStorage(gs.Credentials, gs.StorageType, false)
+	storage, err := gs.getStorage()
 
 	if err != nil {
 		return 0, err
 	}
 
-	defer storage.Destroy()
+	return storage.TTLContext(ctx, table, key)
+}
+
+func (gs *GenericStorage) Expire(table string, key string, expiration time.Duration) (bool, error) {
+	return gs.ExpireContext(context.Background(), table, key, expiration)
+}
+
+func (gs *GenericStorage) ExpireContext(ctx context.Context, table string, key string, expiration time.Duration) (bool, error) {
+	err := CheckTableName(table)
+
+	if err != nil {
+		return false, err
+	}
+
+	storage, err := gs.getStorage()
+
+	if err != nil {
+		return false, err
+	}
+
+	return storage.ExpireContext(ctx, table, key, expiration)
+}
+
+func (gs *GenericStorage) Persist(table string, key string) (bool, error) {
+	return gs.PersistContext(context.Background(), table, key)
+}
+
+func (gs *GenericStorage) PersistContext(ctx context.Context, table string, key string) (bool, error) {
+	err := CheckTableName(table)
 
-	return storage.DelKey(table, key)
+	if err != nil {
+		return false, err
+	}
+
+	storage, err := gs.getStorage()
+
+	if err != nil {
+		return false, err
+	}
+
+	return storage.PersistContext(ctx, table, key)
+}
+
+func (gs *GenericStorage) Incr(table string, key string, delta int64, expiration time.Duration) (int64, error) {
+	return gs.IncrContext(context.Background(), table, key, delta, expiration)
+}
+
+func (gs *GenericStorage) IncrContext(ctx context.Context, table string, key string, delta int64, expiration time.Duration) (int64, error) {
+	err := CheckTableName(table)
+
+	if err != nil {
+		return 0, err
+	}
+
+	storage, err := gs.getStorage()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return storage.IncrContext(ctx, table, key, delta, expiration)
+}
+
+func (gs *GenericStorage) SetNX(table string, key string, value string, expiration time.Duration) (bool, error) {
+	return gs.SetNXContext(context.Background(), table, key, value, expiration)
+}
+
+func (gs *GenericStorage) SetNXContext(ctx context.Context, table string, key string, value string, expiration time.Duration) (bool, error) {
+	err := CheckTableName(table)
+
+	if err != nil {
+		return false, err
+	}
+
+	storage, err := gs.getStorage()
+
+	if err != nil {
+		return false, err
+	}
+
+	return storage.SetNXContext(ctx, table, key, value, expiration)
+}
+
+func (gs *GenericStorage) CompareAndSwap(table string, key string, old string, new string) (bool, error) {
+	return gs.CompareAndSwapContext(context.Background(), table, key, old, new)
+}
+
+func (gs *GenericStorage) CompareAndSwapContext(ctx context.Context, table string, key string, old string, new string) (bool, error) {
+	err := CheckTableName(table)
+
+	if err != nil {
+		return false, err
+	}
+
+	storage, err := gs.getStorage()
+
+	if err != nil {
+		return false, err
+	}
+
+	return storage.CompareAndSwapContext(ctx, table, key, old, new)
+}
+
+func (gs *GenericStorage) DelKey(table string, key string) (int64, error) {
+	return gs.DelKeyContext(context.Background(), table, key)
+}
+
+func (gs *GenericStorage) DelKeyContext(ctx context.Context, table string, key string) (int64, error) {
+	err := CheckTableName(table)
+
+	if err != nil {
+		return 0, err
+	}
+
+	storage, err := gs.getStorage()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return storage.DelKeyContext(ctx, table, key)
 }
 
 func (gs *GenericStorage) AddToMap(table string, key string, objectKey string, object interface{}) error {
+	return gs.AddToMapContext(context.Background(), table, key, objectKey, object)
+}
+
+func (gs *GenericStorage) AddToMapContext(ctx context.Context, table string, key string, objectKey string, object interface{}) error {
 	err := CheckTableName(table)
 
 	if err != nil {
 		return err
 	}
 
-	storage, err := CreateStorage(gs.Credentials, gs.StorageType, false)
+	storage, err := gs.getStorage()
 
 	if err != nil {
 		return err
 	}
 
-	defer storage.Destroy()
+	encodedString, err := encodeObject(gs.Codec, object)
+
+	if err != nil {
+		return err
+	}
+
+	return storage.AddToMapContext(ctx, table, key, objectKey, encodedString)
+}
+
+func (gs *GenericStorage) AddToMapWithTTL(table string, key string, objectKey string, object interface{}, expiration time.Duration) error {
+	return gs.AddToMapWithTTLContext(context.Background(), table, key, objectKey, object, expiration)
+}
+
+func (gs *GenericStorage) AddToMapWithTTLContext(ctx context.Context, table string, key string, objectKey string, object interface{}, expiration time.Duration) error {
+	err := CheckTableName(table)
+
+	if err != nil {
+		return err
+	}
+
+	storage, err := gs.getStorage()
 
-	json, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+
+	encodedString, err := encodeObject(gs.Codec, object)
 
 	if err != nil {
-		log.Println("Can not json encode")
 		return err
 	}
 
-	// Encode
-	encodedString := base64.StdEncoding.EncodeToString(json)
+	return storage.AddToMapWithTTLContext(ctx, table, key, objectKey, encodedString, expiration)
+}
 
-	return storage.AddToMap(table, key, objectKey, encodedString)
+func (gs *GenericStorage) ExpireMap(table string, key string, expiration time.Duration) error {
+	return gs.ExpireMapContext(context.Background(), table, key, expiration)
 }
 
-func (gs *GenericStorage) DelFromMap(table string, key string, objectKey string) error {
+func (gs *GenericStorage) ExpireMapContext(ctx context.Context, table string, key string, expiration time.Duration) error {
 	err := CheckTableName(table)
 
 	if err != nil {
 		return err
 	}
 
-	storage, err := CreateStorage(gs.Credentials, gs.StorageType, false)
+	storage, err := gs.getStorage()
 
 	if err != nil {
 		return err
 	}
 
-	defer storage.Destroy()
+	return storage.ExpireMapContext(ctx, table, key, expiration)
+}
 
-	return storage.DelFromMap(table, key, objectKey)
+func (gs *GenericStorage) SetObject(table string, key string, object interface{}, expiration time.Duration) error {
+	return gs.SetObjectContext(context.Background(), table, key, object, expiration)
 }
 
-func (gs *GenericStorage) GetFromMap(table string, key string, objectKey string, reference interface{}) error {
+// SetObjectContext stores object under key encoded the same way as the
+// fields of maps, for GetObject to read back.
+func (gs *GenericStorage) SetObjectContext(ctx context.Context, table string, key string, object interface{}, expiration time.Duration) error {
+	encodedString, err := encodeObject(gs.Codec, object)
+
+	if err != nil {
+		return err
+	}
+
+	return gs.SetKeyContext(ctx, table, key, encodedString, expiration)
+}
+
+func (gs *GenericStorage) GetObject(table string, key string, reference interface{}) error {
+	return gs.GetObjectContext(context.Background(), table, key, reference)
+}
+
+// GetObjectContext decodes the object stored by SetObject into reference,
+// which must be a non nil pointer. It returns ErrNotFound if there is no such
+// key and an error naming the key and type if the object does not fit.
+func (gs *GenericStorage) GetObjectContext(ctx context.Context, table string, key string, reference interface{}) error {
+	value, err := gs.LookupKeyContext(ctx, table, key)
+
+	if err != nil {
+		return err
+	}
+
+	return decodeObject(table+"/"+key, value, reference)
+}
+
+func (gs *GenericStorage) DelFromMap(table string, key string, objectKey string) error {
+	return gs.DelFromMapContext(context.Background(), table, key, objectKey)
+}
+
+func (gs *GenericStorage) DelFromMapContext(ctx context.Context, table string, key string, objectKey string) error {
 	err := CheckTableName(table)
 
 	if err != nil {
 		return err
 	}
 
-	storage, err := CreateStorage(gs.Credentials, gs.StorageType, false)
+	storage, err := gs.getStorage()
 
 	if err != nil {
 		return err
 	}
 
-	defer storage.Destroy()
+	return storage.DelFromMapContext(ctx, table, key, objectKey)
+}
+
+func (gs *GenericStorage) GetFromMap(table string, key string, objectKey string, reference interface{}) error {
+	return gs.GetFromMapContext(context.Background(), table, key, objectKey, reference)
+}
 
-	value, err := storage.GetFromMap(table, key, objectKey)
+func (gs *GenericStorage) GetFromMapContext(ctx context.Context, table string, key string, objectKey string, reference interface{}) error {
+	err := CheckTableName(table)
 
 	if err != nil {
 		return err
 	}
 
-	bytes, err := base64.StdEncoding.DecodeString(value)
+	storage, err := gs.getStorage()
 
 	if err != nil {
 		return err
 	}
 
-	err = json.Unmarshal(bytes, &reference)
+	value, err := storage.GetFromMapContext(ctx, table, key, objectKey)
 
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return decodeObject(table+"/"+key+" field "+objectKey, value, reference)
 }
 
 func (gs *GenericStorage) GetMap(table string, key string, reference interface{}) error {
+	return gs.GetMapContext(context.Background(), table, key, reference)
+}
+
+func (gs *GenericStorage) GetMapContext(ctx context.Context, table string, key string, reference interface{}) error {
 	err := CheckTableName(table)
 
 	if err != nil {
 		return err
 	}
 
-	storage, err := CreateStorage(gs.Credentials, gs.StorageType, false)
+	storage, err := gs.getStorage()
 
 	if err != nil {
 		return err
 	}
 
-	defer storage.Destroy()
-
-	data, err := storage.GetMap(table, key)
+	data, err := storage.GetMapContext(ctx, table, key)
 
 	if err != nil {
 		return err
@@ -252,24 +599,125 @@ func (gs *GenericStorage) GetMap(table string, key string, reference interface{}
 		containerValue.Set(reflect.MakeMapWithSize(reflect.MapOf(containerType.Key(), messageType), len(data)))
 	}
 
-	for key, element := range data {
+	for objectKey, element := range data {
 		messageValue := reflect.New(elementType)
 
-		bytes, err := base64.StdEncoding.DecodeString(element)
+		err := decodeObject(table+"/"+key+" field "+objectKey, element, messageValue.Interface())
 
 		if err != nil {
 			return err
 		}
-
-		err = json.Unmarshal(bytes, messageValue.Interface())
-
-		if err != nil {
-			return err
-		}
-		keyValue := reflect.ValueOf(key)
+		keyValue := reflect.ValueOf(objectKey)
 
 		containerValue.SetMapIndex(keyValue, messageValue)
 	}
 
 	return nil
 }
+
+// WithTx runs fn inside a transaction of the backend. The writes made through
+// tx are committed when fn returns nil and rolled back otherwise.
+func (gs *GenericStorage) WithTx(fn func(tx *GenericTx) error) error {
+	return gs.WithTxContext(context.Background(), fn)
+}
+
+func (gs *GenericStorage) WithTxContext(ctx context.Context, fn func(tx *GenericTx) error) error {
+	storage, err := gs.getStorage()
+
+	if err != nil {
+		return err
+	}
+
+	tx, err := storage.BeginContext(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	err = fn(&GenericTx{tx: tx, codec: gs.Codec})
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GenericTx mirrors the write methods of GenericStorage inside WithTx.
+type GenericTx struct {
+	tx    Tx
+	codec Codec
+}
+
+func (gt *GenericTx) SetKey(table string, key string, value string, expiration time.Duration) error {
+	err := CheckTableName(table)
+
+	if err != nil {
+		return err
+	}
+
+	return gt.tx.SetKey(table, key, value, expiration)
+}
+
+func (gt *GenericTx) SetObject(table string, key string, object interface{}, expiration time.Duration) error {
+	encodedString, err := encodeObject(gt.codec, object)
+
+	if err != nil {
+		return err
+	}
+
+	return gt.SetKey(table, key, encodedString, expiration)
+}
+
+func (gt *GenericTx) DelKey(table string, key string) error {
+	err := CheckTableName(table)
+
+	if err != nil {
+		return err
+	}
+
+	return gt.tx.DelKey(table, key)
+}
+
+func (gt *GenericTx) AddToMap(table string, key string, objectKey string, object interface{}) error {
+	err := CheckTableName(table)
+
+	if err != nil {
+		return err
+	}
+
+	encodedString, err := encodeObject(gt.codec, object)
+
+	if err != nil {
+		return err
+	}
+
+	return gt.tx.AddToMap(table, key, objectKey, encodedString)
+}
+
+func (gt *GenericTx) AddToMapWithTTL(table string, key string, objectKey string, object interface{}, expiration time.Duration) error {
+	err := CheckTableName(table)
+
+	if err != nil {
+		return err
+	}
+
+	encodedString, err := encodeObject(gt.codec, object)
+
+	if err != nil {
+		return err
+	}
+
+	return gt.tx.AddToMapWithTTL(table, key, objectKey, encodedString, expiration)
+}
+
+func (gt *GenericTx) DelFromMap(table string, key string, objectKey string) error {
+	err := CheckTableName(table)
+
+	if err != nil {
+		return err
+	}
+
+	return gt.tx.DelFromMap(table, key, objectKey)
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+type testObject struct {
+	Name string
+}
+
+func TestGenericStorageWithTxCommits(t *testing.T) {
+	gs := newTestGenericStorage(t, nil)
+
+	err := gs.WithTx(func(tx *GenericTx) error {
+		err := tx.SetKey("tx", "key", "value", 0)
+
+		if err != nil {
+			return err
+		}
+
+		return tx.AddToMap("txmap", "key", "field", &testObject{Name: "committed"})
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := gs.GetKey("tx", "key")
+
+	if err != nil || value != "value" {
+		t.Errorf("GetKey = %q, %v", value, err)
+	}
+
+	object := &testObject{}
+
+	err = gs.GetFromMap("txmap", "key", "field", object)
+
+	if err != nil || object.Name != "committed" {
+		t.Errorf("GetFromMap = %+v, %v", object, err)
+	}
+}
+
+func TestGenericStorageWithTxRollsBack(t *testing.T) {
+	gs := newTestGenericStorage(t, nil)
+
+	failure := errors.New("failure")
+
+	err := gs.WithTx(func(tx *GenericTx) error {
+		err := tx.SetKey("tx", "key", "value", 0)
+
+		if err != nil {
+			return err
+		}
+
+		err = tx.AddToMap("txmap", "key", "field", &testObject{Name: "rolled back"})
+
+		if err != nil {
+			return err
+		}
+
+		return failure
+	})
+
+	if err != failure {
+		t.Fatalf("WithTx returned %v", err)
+	}
+
+	value, err := gs.GetKey("tx", "key")
+
+	if err != nil || value != "" {
+		t.Errorf("GetKey after rollback = %q, %v", value, err)
+	}
+
+	var objects map[string]*testObject
+
+	err = gs.GetMap("txmap", "key", &objects)
+
+	if err != nil || len(objects) != 0 {
+		t.Errorf("GetMap after rollback = %v, %v", objects, err)
+	}
+}
+
+func TestGenericTxChecksTableName(t *testing.T) {
+	gs := newTestGenericStorage(t, nil)
+
+	err := gs.WithTx(func(tx *GenericTx) error {
+		return tx.SetKey("bad/table", "key", "value", 0)
+	})
+
+	if err == nil {
+		t.Error("expected an error for a table name containing '/'")
+	}
+}
+
+func TestGenericStorageObjects(t *testing.T) {
+	gs := newTestGenericStorage(t, nil)
+
+	err := gs.SetObject("objects", "key", &testObject{Name: "stored"}, 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	object := &testObject{}
+
+	err = gs.GetObject("objects", "key", object)
+
+	if err != nil || object.Name != "stored" {
+		t.Errorf("GetObject = %+v, %v", object, err)
+	}
+
+	err = gs.GetObject("objects", "missing", object)
+
+	if err != ErrNotFound {
+		t.Errorf("GetObject of a missing key: %v", err)
+	}
+
+	var number int
+
+	err = gs.GetObject("objects", "key", &number)
+
+	var typeError *json.UnmarshalTypeError
+
+	if !errors.As(err, &typeError) || !strings.Contains(err.Error(), "objects/key") {
+		t.Errorf("GetObject into the wrong type: %v", err)
+	}
+
+	err = gs.GetObject("objects", "key", testObject{})
+
+	if err == nil {
+		t.Error("GetObject accepted a non pointer")
+	}
+}
@@ -0,0 +1,118 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+)
+
+// Get returns the object stored by SetObject under key as a T:
+//
+//	identificator, err := storage.Get[Identificator](gs, table, key)
+func Get[T any](gs *GenericStorage, table string, key string) (T, error) {
+	return GetContext[T](context.Background(), gs, table, key)
+}
+
+func GetContext[T any](ctx context.Context, gs *GenericStorage, table string, key string) (T, error) {
+	var object T
+
+	err := gs.GetObjectContext(ctx, table, key, &object)
+
+	return object, err
+}
+
+// GetFromMapOf returns a field of a map as a T, or ErrNotFound.
+func GetFromMapOf[T any](gs *GenericStorage, table string, key string, objectKey string) (T, error) {
+	return GetFromMapOfContext[T](context.Background(), gs, table, key, objectKey)
+}
+
+func GetFromMapOfContext[T any](ctx context.Context, gs *GenericStorage, table string, key string, objectKey string) (T, error) {
+	var object T
+
+	err := CheckTableName(table)
+
+	if err != nil {
+		return object, err
+	}
+
+	storage, err := gs.getStorage()
+
+	if err != nil {
+		return object, err
+	}
+
+	value, err := storage.GetFromMapContext(ctx, table, key, objectKey)
+
+	if err != nil {
+		return object, err
+	}
+
+	// An encoded object is never empty, so this is a missing field.
+	if value == "" {
+		return object, ErrNotFound
+	}
+
+	err = decodeObject(table+"/"+key+" field "+objectKey, value, &object)
+
+	return object, err
+}
+
+// GetMapOf returns every field of a map as a T, without the
+// *map[string]*T parameter GetMap needs. An empty map is returned for a
+// missing one.
+func GetMapOf[T any](gs *GenericStorage, table string, key string) (map[string]T, error) {
+	return GetMapOfContext[T](context.Background(), gs, table, key)
+}
+
+func GetMapOfContext[T any](ctx context.Context, gs *GenericStorage, table string, key string) (map[string]T, error) {
+	err := CheckTableName(table)
+
+	if err != nil {
+		return nil, err
+	}
+
+	storage, err := gs.getStorage()
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := storage.GetMapContext(ctx, table, key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]T, len(data))
+
+	for objectKey, value := range data {
+		var object T
+
+		err = decodeObject(table+"/"+key+" field "+objectKey, value, &object)
+
+		if err != nil {
+			return nil, err
+		}
+
+		result[objectKey] = object
+	}
+
+	return result, nil
+}
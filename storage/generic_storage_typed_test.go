@@ -0,0 +1,101 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGenericGetters(t *testing.T) {
+	gs := newTestGenericStorage(t, nil)
+
+	err := gs.SetObject("objects", "key", testObject{Name: "stored"}, 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	object, err := Get[testObject](gs, "objects", "key")
+
+	if err != nil || object.Name != "stored" {
+		t.Errorf("Get = %+v, %v", object, err)
+	}
+
+	_, err = Get[testObject](gs, "objects", "missing")
+
+	if err != ErrNotFound {
+		t.Errorf("Get of a missing key: %v", err)
+	}
+
+	_, err = Get[[]int](gs, "objects", "key")
+
+	if err == nil {
+		t.Error("Get decoded an object into a slice")
+	}
+
+	for _, name := range []string{"a", "b"} {
+		err = gs.AddToMap("objects", "map", name, testObject{Name: name})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	objects, err := GetMapOf[testObject](gs, "objects", "map")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(objects, map[string]testObject{"a": {Name: "a"}, "b": {Name: "b"}}) {
+		t.Errorf("GetMapOf = %+v", objects)
+	}
+
+	pointers, err := GetMapOf[*testObject](gs, "objects", "map")
+
+	if err != nil || len(pointers) != 2 || pointers["a"].Name != "a" {
+		t.Errorf("GetMapOf pointers = %+v, %v", pointers, err)
+	}
+
+	field, err := GetFromMapOf[testObject](gs, "objects", "map", "b")
+
+	if err != nil || field.Name != "b" {
+		t.Errorf("GetFromMapOf = %+v, %v", field, err)
+	}
+
+	_, err = GetFromMapOf[testObject](gs, "objects", "map", "missing")
+
+	if err != ErrNotFound {
+		t.Errorf("GetFromMapOf of a missing field: %v", err)
+	}
+
+	_, err = GetMapOf[int](gs, "objects", "map")
+
+	if err == nil {
+		t.Error("GetMapOf decoded objects into ints")
+	}
+
+	missing, err := GetMapOf[testObject](gs, "objects", "missing")
+
+	if err != nil || missing == nil || len(missing) != 0 {
+		t.Errorf("GetMapOf of a missing map = %+v, %v", missing, err)
+	}
+}
@@ -0,0 +1,1088 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	value     string
+	expiresAt time.Time
+}
+
+func (me *memoryEntry) expired(now time.Time) bool {
+	return !me.expiresAt.IsZero() && now.After(me.expiresAt)
+}
+
+// memoryExpiry returns when something stored now for expiration expires, or
+// the zero time if it never does.
+func memoryExpiry(expiration time.Duration) time.Time {
+	if expiration.Milliseconds() <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(expiration)
+}
+
+type memoryMap struct {
+	fields    map[string]*memoryEntry
+	expiresAt time.Time
+}
+
+type memoryDatabase struct {
+	mutex    sync.RWMutex
+	keys     map[string]map[string]*memoryEntry
+	maps     map[string]map[string]*memoryMap
+	watchers map[*memoryWatcher]bool
+	// swept is when expired data was last removed.
+	swept time.Time
+}
+
+func newMemoryDatabase() *memoryDatabase {
+	return &memoryDatabase{
+		keys:     map[string]map[string]*memoryEntry{},
+		maps:     map[string]map[string]*memoryMap{},
+		watchers: map[*memoryWatcher]bool{},
+	}
+}
+
+var memoryDatabasesMutex sync.Mutex
+var memoryDatabases = map[string]*memoryDatabase{}
+
+// MemoryStorage keeps everything in process memory. Storages created with the
+// same "name" credential share their data for the lifetime of the process,
+// the same way SQL storages with the same credentials share a database.
+type MemoryStorage struct {
+	db            *memoryDatabase
+	patternSyntax string
+}
+
+func (ms *MemoryStorage) Setup(credentials map[string]string) error {
+	return nil
+}
+
+func (ms *MemoryStorage) Init() error {
+	return nil
+}
+
+func (ms *MemoryStorage) Create(credentials map[string]string) error {
+	var err error
+
+	ms.patternSyntax, err = ParsePatternSyntax(credentials)
+
+	if err != nil {
+		return err
+	}
+
+	name := credentials["name"]
+
+	memoryDatabasesMutex.Lock()
+	defer memoryDatabasesMutex.Unlock()
+
+	db, ok := memoryDatabases[name]
+
+	if !ok {
+		db = newMemoryDatabase()
+		memoryDatabases[name] = db
+	}
+
+	ms.db = db
+
+	return nil
+}
+
+func (ms *MemoryStorage) Destroy() error {
+	return nil
+}
+
+// DropMemoryStorage discards the data of the memory storage called name.
+func DropMemoryStorage(name string) {
+	memoryDatabasesMutex.Lock()
+	defer memoryDatabasesMutex.Unlock()
+
+	delete(memoryDatabases, name)
+}
+
+func (db *memoryDatabase) setKey(table string, key string, value string, expiration time.Duration) {
+	entries, ok := db.keys[table]
+
+	if !ok {
+		entries = map[string]*memoryEntry{}
+		db.keys[table] = entries
+	}
+
+	entries[key] = &memoryEntry{
+		value:     value,
+		expiresAt: memoryExpiry(expiration),
+	}
+
+	db.notify(EventSet, table, key)
+}
+
+func (db *memoryDatabase) delKey(table string, key string) int64 {
+	entry, ok := db.keys[table][key]
+
+	if !ok {
+		return 0
+	}
+
+	delete(db.keys[table], key)
+
+	if entry.expired(time.Now()) {
+		db.notify(EventExpire, table, key)
+
+		return 0
+	}
+
+	db.notify(EventDelete, table, key)
+
+	return 1
+}
+
+// liveMap returns the map stored under key unless it has expired or all of
+// its fields have.
+func (db *memoryDatabase) liveMap(table string, key string, now time.Time) *memoryMap {
+	m, ok := db.maps[table][key]
+
+	if !ok || (!m.expiresAt.IsZero() && now.After(m.expiresAt)) {
+		return nil
+	}
+
+	for _, field := range m.fields {
+		if !field.expired(now) {
+			return m
+		}
+	}
+
+	return nil
+}
+
+func (db *memoryDatabase) addToMap(table string, key string, objectKey string, object string, expiration time.Duration) {
+	m := db.liveMap(table, key, time.Now())
+
+	if m == nil {
+		tableMaps, ok := db.maps[table]
+
+		if !ok {
+			tableMaps = map[string]*memoryMap{}
+			db.maps[table] = tableMaps
+		}
+
+		m = &memoryMap{
+			fields: map[string]*memoryEntry{},
+		}
+
+		tableMaps[key] = m
+	}
+
+	m.fields[objectKey] = &memoryEntry{
+		value:     object,
+		expiresAt: memoryExpiry(expiration),
+	}
+
+	db.notify(EventSet, table, key)
+}
+
+func (db *memoryDatabase) expireMap(table string, key string, expiration time.Duration) {
+	m := db.liveMap(table, key, time.Now())
+
+	if m != nil {
+		m.expiresAt = memoryExpiry(expiration)
+
+		db.notify(EventSet, table, key)
+	}
+}
+
+func (db *memoryDatabase) delFromMap(table string, key string, objectKey string) {
+	m, ok := db.maps[table][key]
+
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	live := db.liveMap(table, key, now) != nil
+
+	_, ok = m.fields[objectKey]
+
+	delete(m.fields, objectKey)
+
+	switch {
+	case !live:
+		delete(db.maps[table], key)
+		db.notify(EventExpire, table, key)
+	case db.liveMap(table, key, now) == nil:
+		delete(db.maps[table], key)
+		db.notify(EventDelete, table, key)
+	case ok:
+		db.notify(EventSet, table, key)
+	}
+}
+
+// memorySweepInterval is how often expired keys and fields are removed, on
+// the next write or, while someone watches, on a timer so that their expiry
+// is reported. Reads skip them anyway.
+var memorySweepInterval = time.Second
+
+// lock locks db for writing, removing what has expired first if db was not
+// swept for memorySweepInterval, so that expired data does not pile up in
+// storages nobody watches.
+func (db *memoryDatabase) lock() {
+	db.mutex.Lock()
+
+	now := time.Now()
+
+	if now.Sub(db.swept) >= memorySweepInterval {
+		db.sweep(now)
+	}
+}
+
+// memoryWatcher queues the events of a Watch. Writers append to the queue
+// under the database lock and never wait for the watcher to catch up.
+type memoryWatcher struct {
+	filter  *watchFilter
+	mutex   sync.Mutex
+	pending []Event
+	wake    chan struct{}
+}
+
+func (mw *memoryWatcher) push(event Event) {
+	mw.mutex.Lock()
+	mw.pending = append(mw.pending, event)
+	mw.mutex.Unlock()
+
+	select {
+	case mw.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (mw *memoryWatcher) take() []Event {
+	mw.mutex.Lock()
+	defer mw.mutex.Unlock()
+
+	pending := mw.pending
+	mw.pending = nil
+
+	return pending
+}
+
+// notify queues an event for the watchers it matches. It is called with the
+// database locked for writing.
+func (db *memoryDatabase) notify(eventType EventType, table string, key string) {
+	event := Event{
+		Type:  eventType,
+		Table: table,
+		Key:   key,
+	}
+
+	for mw := range db.watchers {
+		if mw.filter.match(event) {
+			mw.push(event)
+		}
+	}
+}
+
+// sweep removes the expired keys, maps and map fields.
+func (db *memoryDatabase) sweep(now time.Time) {
+	db.swept = now
+
+	for table, entries := range db.keys {
+		for key, entry := range entries {
+			if entry.expired(now) {
+				delete(entries, key)
+				db.notify(EventExpire, table, key)
+			}
+		}
+	}
+
+	for table, maps := range db.maps {
+		for key, m := range maps {
+			if db.liveMap(table, key, now) == nil {
+				delete(maps, key)
+				db.notify(EventExpire, table, key)
+				continue
+			}
+
+			changed := false
+
+			for objectKey, field := range m.fields {
+				if field.expired(now) {
+					delete(m.fields, objectKey)
+					changed = true
+				}
+			}
+
+			if changed {
+				db.notify(EventSet, table, key)
+			}
+		}
+	}
+}
+
+func (ms *MemoryStorage) GetKeys(table string, pattern string) ([]string, error) {
+	return ms.GetKeysContext(context.Background(), table, pattern)
+}
+
+func (ms *MemoryStorage) GetKeysContext(ctx context.Context, table string, pattern string) ([]string, error) {
+	return collectKeys(ms.ScanKeys(ctx, table, pattern, 0))
+}
+
+// ScanKeys takes a snapshot of the matching keys up front, there is nothing
+// to gain from fetching them from memory in batches.
+func (ms *MemoryStorage) ScanKeys(ctx context.Context, table string, pattern string, batchSize int) (KeyIterator, error) {
+	err := ctx.Err()
+
+	if err != nil {
+		return nil, err
+	}
+
+	compiled, err := CompilePatternSyntax(pattern, ms.patternSyntax)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ms.db.mutex.RLock()
+	defer ms.db.mutex.RUnlock()
+
+	keys := []string{}
+	now := time.Now()
+
+	for key, entry := range ms.db.keys[table] {
+		if !entry.expired(now) && compiled.Match(key) {
+			keys = append(keys, table+"/"+key)
+		}
+	}
+
+	for key := range ms.db.maps[table] {
+		if ms.db.liveMap(table, key, now) != nil && compiled.Match(key) {
+			keys = append(keys, table+"/"+key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	return newBatchIterator(func() ([]string, bool, error) {
+		return keys, false, nil
+	}), nil
+}
+
+func (ms *MemoryStorage) Tables(ctx context.Context) ([]string, error) {
+	err := ctx.Err()
+
+	if err != nil {
+		return nil, err
+	}
+
+	ms.db.mutex.RLock()
+	defer ms.db.mutex.RUnlock()
+
+	found := map[string]bool{}
+	now := time.Now()
+
+	for table, entries := range ms.db.keys {
+		for _, entry := range entries {
+			if !entry.expired(now) {
+				found[table] = true
+				break
+			}
+		}
+	}
+
+	for table, maps := range ms.db.maps {
+		for key := range maps {
+			if ms.db.liveMap(table, key, now) != nil {
+				found[table] = true
+				break
+			}
+		}
+	}
+
+	tables := []string{}
+
+	for table := range found {
+		tables = append(tables, table)
+	}
+
+	sort.Strings(tables)
+
+	return tables, nil
+}
+
+func (ms *MemoryStorage) Watch(ctx context.Context, table string, pattern string) (<-chan Event, error) {
+	err := ctx.Err()
+
+	if err != nil {
+		return nil, err
+	}
+
+	filter, err := newWatchFilter(table, pattern, ms.patternSyntax)
+
+	if err != nil {
+		return nil, err
+	}
+
+	mw := &memoryWatcher{
+		filter: filter,
+		wake:   make(chan struct{}, 1),
+	}
+
+	ms.db.mutex.Lock()
+	ms.db.watchers[mw] = true
+	ms.db.mutex.Unlock()
+
+	events := make(chan Event, watchBufferSize)
+
+	go ms.db.watch(ctx, mw, events)
+
+	return events, nil
+}
+
+// watch hands the events queued for mw to events until ctx is done, sweeping
+// the database meanwhile.
+func (db *memoryDatabase) watch(ctx context.Context, mw *memoryWatcher, events chan<- Event) {
+	defer close(events)
+
+	defer func() {
+		db.mutex.Lock()
+		delete(db.watchers, mw)
+		db.mutex.Unlock()
+	}()
+
+	ticker := time.NewTicker(memorySweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-mw.wake:
+		case now := <-ticker.C:
+			db.mutex.Lock()
+			db.sweep(now)
+			db.mutex.Unlock()
+		}
+
+		for _, event := range mw.take() {
+			if !sendEvent(ctx, events, event) {
+				return
+			}
+		}
+	}
+}
+
+func (ms *MemoryStorage) SetKey(table string, key string, value string, expiration time.Duration) error {
+	return ms.SetKeyContext(context.Background(), table, key, value, expiration)
+}
+
+func (ms *MemoryStorage) SetKeyContext(ctx context.Context, table string, key string, value string, expiration time.Duration) error {
+	err := ctx.Err()
+
+	if err != nil {
+		return err
+	}
+
+	ms.db.lock()
+	defer ms.db.mutex.Unlock()
+
+	ms.db.setKey(table, key, value, expiration)
+
+	return nil
+}
+
+func (ms *MemoryStorage) GetFullKey(key string) (string, error) {
+	return ms.GetFullKeyContext(context.Background(), key)
+}
+
+func (ms *MemoryStorage) GetFullKeyContext(ctx context.Context, key string) (string, error) {
+	parts := SplitToParts(key)
+
+	table := parts[0]
+
+	newKey := ""
+
+	partsLen := len(parts)
+
+	for i := 1; i < partsLen; i++ {
+		newKey = newKey + parts[i]
+
+		if i+1 < partsLen {
+			newKey += "/"
+		}
+	}
+
+	return ms.GetKeyContext(ctx, table, newKey)
+}
+
+func (ms *MemoryStorage) GetKey(table string, key string) (string, error) {
+	return ms.GetKeyContext(context.Background(), table, key)
+}
+
+func (ms *MemoryStorage) GetKeyContext(ctx context.Context, table string, key string) (string, error) {
+	err := ctx.Err()
+
+	if err != nil {
+		return "", err
+	}
+
+	ms.db.mutex.RLock()
+	defer ms.db.mutex.RUnlock()
+
+	entry := ms.db.liveKey(table, key)
+
+	if entry == nil {
+		return "", nil
+	}
+
+	return entry.value, nil
+}
+
+// liveKey returns the entry of a key unless it is missing or has expired.
+func (db *memoryDatabase) liveKey(table string, key string) *memoryEntry {
+	entry, ok := db.keys[table][key]
+
+	if !ok || entry.expired(time.Now()) {
+		return nil
+	}
+
+	return entry
+}
+
+func (ms *MemoryStorage) LookupKey(table string, key string) (string, error) {
+	return ms.LookupKeyContext(context.Background(), table, key)
+}
+
+func (ms *MemoryStorage) LookupKeyContext(ctx context.Context, table string, key string) (string, error) {
+	err := ctx.Err()
+
+	if err != nil {
+		return "", err
+	}
+
+	ms.db.mutex.RLock()
+	defer ms.db.mutex.RUnlock()
+
+	entry := ms.db.liveKey(table, key)
+
+	if entry == nil {
+		return "", ErrNotFound
+	}
+
+	return entry.value, nil
+}
+
+func (ms *MemoryStorage) Exists(table string, key string) (bool, error) {
+	return ms.ExistsContext(context.Background(), table, key)
+}
+
+func (ms *MemoryStorage) ExistsContext(ctx context.Context, table string, key string) (bool, error) {
+	err := ctx.Err()
+
+	if err != nil {
+		return false, err
+	}
+
+	ms.db.mutex.RLock()
+	defer ms.db.mutex.RUnlock()
+
+	return ms.db.liveKey(table, key) != nil, nil
+}
+
+func (ms *MemoryStorage) TTL(table string, key string) (time.Duration, error) {
+	return ms.TTLContext(context.Background(), table, key)
+}
+
+func (ms *MemoryStorage) TTLContext(ctx context.Context, table string, key string) (time.Duration, error) {
+	err := ctx.Err()
+
+	if err != nil {
+		return 0, err
+	}
+
+	ms.db.mutex.RLock()
+	defer ms.db.mutex.RUnlock()
+
+	entry := ms.db.liveKey(table, key)
+
+	if entry == nil {
+		return 0, ErrNotFound
+	}
+
+	if entry.expiresAt.IsZero() {
+		return NoExpiration, nil
+	}
+
+	return time.Until(entry.expiresAt), nil
+}
+
+func (ms *MemoryStorage) Expire(table string, key string, expiration time.Duration) (bool, error) {
+	return ms.ExpireContext(context.Background(), table, key, expiration)
+}
+
+func (ms *MemoryStorage) ExpireContext(ctx context.Context, table string, key string, expiration time.Duration) (bool, error) {
+	err := ctx.Err()
+
+	if err != nil {
+		return false, err
+	}
+
+	ms.db.lock()
+	defer ms.db.mutex.Unlock()
+
+	entry := ms.db.liveKey(table, key)
+
+	if entry == nil {
+		return false, nil
+	}
+
+	entry.expiresAt = memoryExpiry(expiration)
+
+	ms.db.notify(EventSet, table, key)
+
+	return true, nil
+}
+
+func (ms *MemoryStorage) Persist(table string, key string) (bool, error) {
+	return ms.PersistContext(context.Background(), table, key)
+}
+
+func (ms *MemoryStorage) PersistContext(ctx context.Context, table string, key string) (bool, error) {
+	return ms.ExpireContext(ctx, table, key, 0)
+}
+
+func (ms *MemoryStorage) Incr(table string, key string, delta int64, expiration time.Duration) (int64, error) {
+	return ms.IncrContext(context.Background(), table, key, delta, expiration)
+}
+
+func (ms *MemoryStorage) IncrContext(ctx context.Context, table string, key string, delta int64, expiration time.Duration) (int64, error) {
+	err := ctx.Err()
+
+	if err != nil {
+		return 0, err
+	}
+
+	ms.db.lock()
+	defer ms.db.mutex.Unlock()
+
+	entry := ms.db.liveKey(table, key)
+
+	if entry == nil {
+		ms.db.setKey(table, key, strconv.FormatInt(delta, 10), expiration)
+
+		return delta, nil
+	}
+
+	value, err := incrValue(entry.value, delta)
+
+	if err != nil {
+		return 0, err
+	}
+
+	entry.value = strconv.FormatInt(value, 10)
+
+	ms.db.notify(EventSet, table, key)
+
+	return value, nil
+}
+
+func (ms *MemoryStorage) SetNX(table string, key string, value string, expiration time.Duration) (bool, error) {
+	return ms.SetNXContext(context.Background(), table, key, value, expiration)
+}
+
+func (ms *MemoryStorage) SetNXContext(ctx context.Context, table string, key string, value string, expiration time.Duration) (bool, error) {
+	err := ctx.Err()
+
+	if err != nil {
+		return false, err
+	}
+
+	ms.db.lock()
+	defer ms.db.mutex.Unlock()
+
+	if ms.db.liveKey(table, key) != nil {
+		return false, nil
+	}
+
+	ms.db.setKey(table, key, value, expiration)
+
+	return true, nil
+}
+
+func (ms *MemoryStorage) CompareAndSwap(table string, key string, old string, new string) (bool, error) {
+	return ms.CompareAndSwapContext(context.Background(), table, key, old, new)
+}
+
+func (ms *MemoryStorage) CompareAndSwapContext(ctx context.Context, table string, key string, old string, new string) (bool, error) {
+	err := ctx.Err()
+
+	if err != nil {
+		return false, err
+	}
+
+	ms.db.lock()
+	defer ms.db.mutex.Unlock()
+
+	entry := ms.db.liveKey(table, key)
+
+	if entry == nil || entry.value != old {
+		return false, nil
+	}
+
+	entry.value = new
+
+	ms.db.notify(EventSet, table, key)
+
+	return true, nil
+}
+
+func (ms *MemoryStorage) DelKey(table string, key string) (int64, error) {
+	return ms.DelKeyContext(context.Background(), table, key)
+}
+
+func (ms *MemoryStorage) DelKeyContext(ctx context.Context, table string, key string) (int64, error) {
+	err := ctx.Err()
+
+	if err != nil {
+		return -1, err
+	}
+
+	ms.db.lock()
+	defer ms.db.mutex.Unlock()
+
+	return ms.db.delKey(table, key), nil
+}
+
+func (ms *MemoryStorage) AddToMap(table string, key string, objectKey string, object string) error {
+	return ms.AddToMapContext(context.Background(), table, key, objectKey, object)
+}
+
+func (ms *MemoryStorage) AddToMapContext(ctx context.Context, table string, key string, objectKey string, object string) error {
+	err := ctx.Err()
+
+	if err != nil {
+		return err
+	}
+
+	ms.db.lock()
+	defer ms.db.mutex.Unlock()
+
+	ms.db.addToMap(table, key, objectKey, object, 0)
+
+	return nil
+}
+
+func (ms *MemoryStorage) AddToMapWithTTL(table string, key string, objectKey string, object string, expiration time.Duration) error {
+	return ms.AddToMapWithTTLContext(context.Background(), table, key, objectKey, object, expiration)
+}
+
+func (ms *MemoryStorage) AddToMapWithTTLContext(ctx context.Context, table string, key string, objectKey string, object string, expiration time.Duration) error {
+	err := ctx.Err()
+
+	if err != nil {
+		return err
+	}
+
+	ms.db.lock()
+	defer ms.db.mutex.Unlock()
+
+	ms.db.addToMap(table, key, objectKey, object, expiration)
+
+	return nil
+}
+
+func (ms *MemoryStorage) CompareAndSwapInMap(table string, key string, objectKey string, old string, new string) (bool, error) {
+	return ms.CompareAndSwapInMapContext(context.Background(), table, key, objectKey, old, new)
+}
+
+func (ms *MemoryStorage) CompareAndSwapInMapContext(ctx context.Context, table string, key string, objectKey string, old string, new string) (bool, error) {
+	err := ctx.Err()
+
+	if err != nil {
+		return false, err
+	}
+
+	ms.db.lock()
+	defer ms.db.mutex.Unlock()
+
+	now := time.Now()
+	m := ms.db.liveMap(table, key, now)
+
+	if m == nil {
+		return false, nil
+	}
+
+	field, ok := m.fields[objectKey]
+
+	if !ok || field.expired(now) || field.value != old {
+		return false, nil
+	}
+
+	field.value = new
+
+	ms.db.notify(EventSet, table, key)
+
+	return true, nil
+}
+
+func (ms *MemoryStorage) ExpireMap(table string, key string, expiration time.Duration) error {
+	return ms.ExpireMapContext(context.Background(), table, key, expiration)
+}
+
+func (ms *MemoryStorage) ExpireMapContext(ctx context.Context, table string, key string, expiration time.Duration) error {
+	err := ctx.Err()
+
+	if err != nil {
+		return err
+	}
+
+	ms.db.lock()
+	defer ms.db.mutex.Unlock()
+
+	ms.db.expireMap(table, key, expiration)
+
+	return nil
+}
+
+func (ms *MemoryStorage) DelFromMap(table string, key string, objectKey string) error {
+	return ms.DelFromMapContext(context.Background(), table, key, objectKey)
+}
+
+func (ms *MemoryStorage) DelFromMapContext(ctx context.Context, table string, key string, objectKey string) error {
+	err := ctx.Err()
+
+	if err != nil {
+		return err
+	}
+
+	ms.db.lock()
+	defer ms.db.mutex.Unlock()
+
+	ms.db.delFromMap(table, key, objectKey)
+
+	return nil
+}
+
+func (ms *MemoryStorage) GetFromMap(table string, key string, objectKey string) (string, error) {
+	return ms.GetFromMapContext(context.Background(), table, key, objectKey)
+}
+
+func (ms *MemoryStorage) GetFromMapContext(ctx context.Context, table string, key string, objectKey string) (string, error) {
+	err := ctx.Err()
+
+	if err != nil {
+		return "", err
+	}
+
+	ms.db.mutex.RLock()
+	defer ms.db.mutex.RUnlock()
+
+	now := time.Now()
+
+	m := ms.db.liveMap(table, key, now)
+
+	if m == nil {
+		return "", nil
+	}
+
+	field, ok := m.fields[objectKey]
+
+	if !ok || field.expired(now) {
+		return "", nil
+	}
+
+	return field.value, nil
+}
+
+func (ms *MemoryStorage) GetMap(table string, key string) (map[string]string, error) {
+	return ms.GetMapContext(context.Background(), table, key)
+}
+
+func (ms *MemoryStorage) GetMapContext(ctx context.Context, table string, key string) (map[string]string, error) {
+	err := ctx.Err()
+
+	if err != nil {
+		return nil, err
+	}
+
+	ms.db.mutex.RLock()
+	defer ms.db.mutex.RUnlock()
+
+	result := map[string]string{}
+	now := time.Now()
+
+	m := ms.db.liveMap(table, key, now)
+
+	if m == nil {
+		return result, nil
+	}
+
+	for objectKey, field := range m.fields {
+		if !field.expired(now) {
+			result[objectKey] = field.value
+		}
+	}
+
+	return result, nil
+}
+
+func (ms *MemoryStorage) MapTTL(table string, key string) (map[string]time.Duration, time.Duration, error) {
+	return ms.MapTTLContext(context.Background(), table, key)
+}
+
+func (ms *MemoryStorage) MapTTLContext(ctx context.Context, table string, key string) (map[string]time.Duration, time.Duration, error) {
+	err := ctx.Err()
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ms.db.mutex.RLock()
+	defer ms.db.mutex.RUnlock()
+
+	now := time.Now()
+
+	remaining := func(expiresAt time.Time) time.Duration {
+		if expiresAt.IsZero() {
+			return NoExpiration
+		}
+
+		return expiresAt.Sub(now)
+	}
+
+	m := ms.db.liveMap(table, key, now)
+
+	if m == nil {
+		return nil, 0, ErrNotFound
+	}
+
+	fields := map[string]time.Duration{}
+
+	for objectKey, field := range m.fields {
+		if !field.expired(now) {
+			fields[objectKey] = remaining(field.expiresAt)
+		}
+	}
+
+	if len(fields) == 0 {
+		return nil, 0, ErrNotFound
+	}
+
+	return fields, remaining(m.expiresAt), nil
+}
+
+func (ms *MemoryStorage) Begin() (Tx, error) {
+	return ms.BeginContext(context.Background())
+}
+
+func (ms *MemoryStorage) BeginContext(ctx context.Context) (Tx, error) {
+	err := ctx.Err()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &memoryTx{
+		db:  ms.db,
+		ctx: ctx,
+	}, nil
+}
+
+// memoryTx records the writes and replays them under the database lock on
+// Commit, so other readers never observe a partially applied transaction.
+type memoryTx struct {
+	db         *memoryDatabase
+	ctx        context.Context
+	operations []func(db *memoryDatabase)
+	done       bool
+}
+
+func (t *memoryTx) add(operation func(db *memoryDatabase)) error {
+	if t.done {
+		return errors.New("Transaction has already been committed or rolled back")
+	}
+
+	t.operations = append(t.operations, operation)
+
+	return nil
+}
+
+func (t *memoryTx) SetKey(table string, key string, value string, expiration time.Duration) error {
+	return t.add(func(db *memoryDatabase) {
+		db.setKey(table, key, value, expiration)
+	})
+}
+
+func (t *memoryTx) DelKey(table string, key string) error {
+	return t.add(func(db *memoryDatabase) {
+		db.delKey(table, key)
+	})
+}
+
+func (t *memoryTx) AddToMap(table string, key string, objectKey string, object string) error {
+	return t.add(func(db *memoryDatabase) {
+		db.addToMap(table, key, objectKey, object, 0)
+	})
+}
+
+func (t *memoryTx) AddToMapWithTTL(table string, key string, objectKey string, object string, expiration time.Duration) error {
+	return t.add(func(db *memoryDatabase) {
+		db.addToMap(table, key, objectKey, object, expiration)
+	})
+}
+
+func (t *memoryTx) DelFromMap(table string, key string, objectKey string) error {
+	return t.add(func(db *memoryDatabase) {
+		db.delFromMap(table, key, objectKey)
+	})
+}
+
+func (t *memoryTx) Commit() error {
+	if t.done {
+		return errors.New("Transaction has already been committed or rolled back")
+	}
+
+	t.done = true
+
+	err := t.ctx.Err()
+
+	if err != nil {
+		return err
+	}
+
+	t.db.lock()
+	defer t.db.mutex.Unlock()
+
+	for _, operation := range t.operations {
+		operation(t.db)
+	}
+
+	return nil
+}
+
+func (t *memoryTx) Rollback() error {
+	t.done = true
+	t.operations = nil
+
+	return nil
+}
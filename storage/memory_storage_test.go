@@ -0,0 +1,290 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func newTestMemoryStorage(t *testing.T) *MemoryStorage {
+	name := t.Name()
+
+	storage, err := CreateStorage(map[string]string{"name": name}, MEMORY_STORAGE, true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		storage.Destroy()
+		DropMemoryStorage(name)
+	})
+
+	err = storage.Init()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return storage.(*MemoryStorage)
+}
+
+func uniqueSorted(values []string) []string {
+	seen := map[string]struct{}{}
+	result := []string{}
+
+	for _, value := range values {
+		if _, ok := seen[value]; !ok {
+			seen[value] = struct{}{}
+			result = append(result, value)
+		}
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
+func TestMemoryStorageMatchesSQLite(t *testing.T) {
+	backends := map[string]Storage{
+		"memory": newTestMemoryStorage(t),
+		"sqlite": newTestSQLiteStorage(t),
+	}
+
+	results := map[string][]interface{}{}
+
+	for name, storage := range backends {
+		for _, key := range []string{"a", "a/b", "a/b/c", "x/b", "it's/\x00"} {
+			err := storage.SetKey("table", key, "value of "+key, 0)
+
+			if err != nil {
+				t.Fatalf("%s: SetKey(%q): %v", name, key, err)
+			}
+		}
+
+		err := storage.AddToMap("table", "m/1", "field", "value")
+
+		if err != nil {
+			t.Fatalf("%s: AddToMap: %v", name, err)
+		}
+
+		err = storage.AddToMap("table", "m/1", "other", "other value")
+
+		if err != nil {
+			t.Fatalf("%s: AddToMap: %v", name, err)
+		}
+
+		result := []interface{}{}
+
+		for _, pattern := range []string{"*", "**", "a", "a/*", "a/**", "a/*/c", "*/b", "**/b", "m/?", "[am]*/**", "missing"} {
+			keys, err := storage.GetKeys("table", pattern)
+
+			if err != nil {
+				t.Fatalf("%s: GetKeys(%q): %v", name, pattern, err)
+			}
+
+			result = append(result, uniqueSorted(keys))
+		}
+
+		for _, key := range []string{"a/b", "it's/\x00", "missing"} {
+			value, err := storage.GetKey("table", key)
+
+			if err != nil {
+				t.Fatalf("%s: GetKey(%q): %v", name, key, err)
+			}
+
+			result = append(result, value)
+		}
+
+		value, err := storage.GetFullKey("table/a/b/c")
+
+		if err != nil {
+			t.Fatalf("%s: GetFullKey: %v", name, err)
+		}
+
+		result = append(result, value)
+
+		for _, field := range []string{"field", "missing"} {
+			value, err := storage.GetFromMap("table", "m/1", field)
+
+			if err != nil {
+				t.Fatalf("%s: GetFromMap(%q): %v", name, field, err)
+			}
+
+			result = append(result, value)
+		}
+
+		for _, key := range []string{"m/1", "missing"} {
+			fields, err := storage.GetMap("table", key)
+
+			if err != nil {
+				t.Fatalf("%s: GetMap(%q): %v", name, key, err)
+			}
+
+			result = append(result, fields)
+		}
+
+		for _, key := range []string{"x/b", "missing"} {
+			deleted, err := storage.DelKey("table", key)
+
+			if err != nil {
+				t.Fatalf("%s: DelKey(%q): %v", name, key, err)
+			}
+
+			result = append(result, deleted)
+		}
+
+		err = storage.DelFromMap("table", "m/1", "field")
+
+		if err != nil {
+			t.Fatalf("%s: DelFromMap: %v", name, err)
+		}
+
+		fields, err := storage.GetMap("table", "m/1")
+
+		if err != nil {
+			t.Fatalf("%s: GetMap: %v", name, err)
+		}
+
+		result = append(result, fields)
+
+		results[name] = result
+	}
+
+	if !reflect.DeepEqual(results["memory"], results["sqlite"]) {
+		t.Errorf("memory and sqlite disagree:\nmemory: %q\nsqlite: %q", results["memory"], results["sqlite"])
+	}
+}
+
+func TestMemoryStorageExpiresKeys(t *testing.T) {
+	storage := newTestMemoryStorage(t)
+
+	err := storage.SetKey("table", "short", "value", 20*time.Millisecond)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storage.SetKey("table", "long", "value", time.Hour)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	value, err := storage.GetKey("table", "short")
+
+	if err != nil || value != "" {
+		t.Errorf("GetKey of an expired key = %q, %v", value, err)
+	}
+
+	keys, err := storage.GetKeys("table", "*")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(keys, []string{"table/long"}) {
+		t.Errorf("GetKeys = %q", keys)
+	}
+}
+
+func TestMemoryStorageSweepsWithoutWatch(t *testing.T) {
+	interval := memorySweepInterval
+	memorySweepInterval = 10 * time.Millisecond
+
+	defer func() {
+		memorySweepInterval = interval
+	}()
+
+	storage := newTestMemoryStorage(t)
+
+	err := storage.SetKey("table", "short", "value", 20*time.Millisecond)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storage.AddToMapWithTTL("table", "map", "field", "value", 20*time.Millisecond)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	err = storage.SetKey("table", "other", "value", 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage.db.mutex.RLock()
+	_, key := storage.db.keys["table"]["short"]
+	_, m := storage.db.maps["table"]["map"]
+	storage.db.mutex.RUnlock()
+
+	if key || m {
+		t.Errorf("expired data kept after a write, key %v, map %v", key, m)
+	}
+}
+
+func TestMemoryStorageSharedByName(t *testing.T) {
+	gs := &GenericStorage{
+		Credentials: map[string]string{"name": t.Name()},
+		StorageType: MEMORY_STORAGE,
+	}
+
+	t.Cleanup(func() {
+		gs.Close()
+		DropMemoryStorage(t.Name())
+	})
+
+	err := gs.Init()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = gs.AddToMap("objects", "key", "field", &testObject{Name: "memory"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = gs.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var objects map[string]*testObject
+
+	err = gs.GetMap("objects", "key", &objects)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(objects) != 1 || objects["field"].Name != "memory" {
+		t.Errorf("GetMap = %v", objects)
+	}
+}
@@ -0,0 +1,234 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultLatencyBuckets are the upper bounds, in seconds, of the buckets of
+// the latency histograms of Metrics.
+var DefaultLatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// Results of operations in the metrics. ErrNotFound, which LookupKey and TTL
+// return for missing keys, is not counted as an error.
+var resultOK = "ok"
+var resultNotFound = "not_found"
+var resultError = "error"
+
+// Metrics counts the operations of the storages wrapped by its Middleware,
+// per operation and table, and exposes them in the Prometheus text format:
+//   - netclave_storage_operations_total, by operation, table and result,
+//     which is ok, not_found or error
+//   - netclave_storage_operation_duration_seconds, a histogram of the latency
+//     by operation and table
+//   - netclave_storage_rows_total, the rows operations returned or deleted,
+//     see Observer, by operation and table
+//
+// A Metrics is meant to live as long as the process and to be shared by the
+// storages it measures.
+type Metrics struct {
+	mutex      sync.Mutex
+	buckets    []float64
+	operations map[Operation]*operationMetrics
+}
+
+type operationMetrics struct {
+	results map[string]uint64
+	// buckets counts the latencies up to each bound, not cumulated.
+	buckets []uint64
+	count   uint64
+	sum     float64
+	rows    uint64
+}
+
+// NewMetrics returns a Metrics with DefaultLatencyBuckets, or buckets if any
+// are given.
+func NewMetrics(buckets ...float64) *Metrics {
+	if len(buckets) == 0 {
+		buckets = DefaultLatencyBuckets
+	}
+
+	sorted := append([]float64{}, buckets...)
+	sort.Float64s(sorted)
+
+	return &Metrics{
+		buckets:    sorted,
+		operations: map[Operation]*operationMetrics{},
+	}
+}
+
+// Middleware returns the Middleware measuring a storage into m.
+func (m *Metrics) Middleware() Middleware {
+	return Observe(m)
+}
+
+// Start implements Observer.
+func (m *Metrics) Start(ctx context.Context, op Operation) (context.Context, func(rows int, err error)) {
+	started := time.Now()
+
+	return ctx, func(rows int, err error) {
+		m.record(op, time.Since(started), rows, err)
+	}
+}
+
+func (m *Metrics) record(op Operation, latency time.Duration, rows int, err error) {
+	result := resultOK
+
+	if err == ErrNotFound {
+		result = resultNotFound
+	} else if err != nil {
+		result = resultError
+	}
+
+	seconds := latency.Seconds()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	om, ok := m.operations[op]
+
+	if !ok {
+		om = &operationMetrics{
+			results: map[string]uint64{},
+			buckets: make([]uint64, len(m.buckets)),
+		}
+
+		m.operations[op] = om
+	}
+
+	om.results[result]++
+	om.count++
+	om.sum += seconds
+	om.rows += uint64(rows)
+
+	for i, bound := range m.buckets {
+		if seconds <= bound {
+			om.buckets[i]++
+			break
+		}
+	}
+}
+
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func metricsLabels(op Operation, extra ...string) string {
+	labels := `operation="` + metricsLabelEscaper.Replace(op.Name) + `",table="` + metricsLabelEscaper.Replace(op.Table) + `"`
+
+	for i := 0; i+1 < len(extra); i += 2 {
+		labels += "," + extra[i] + `="` + metricsLabelEscaper.Replace(extra[i+1]) + `"`
+	}
+
+	return "{" + labels + "}"
+}
+
+func formatMetricsValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// WritePrometheus writes the metrics in the Prometheus text exposition
+// format, sorted by operation and table.
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	m.mutex.Lock()
+
+	ops := []Operation{}
+	snapshot := map[Operation]operationMetrics{}
+
+	for op, om := range m.operations {
+		ops = append(ops, op)
+
+		copied := *om
+		copied.results = map[string]uint64{}
+		copied.buckets = append([]uint64{}, om.buckets...)
+
+		for result, count := range om.results {
+			copied.results[result] = count
+		}
+
+		snapshot[op] = copied
+	}
+
+	m.mutex.Unlock()
+
+	sort.Slice(ops, func(i, j int) bool {
+		if ops[i].Name != ops[j].Name {
+			return ops[i].Name < ops[j].Name
+		}
+
+		return ops[i].Table < ops[j].Table
+	})
+
+	out := bufio.NewWriter(w)
+
+	out.WriteString("# HELP netclave_storage_operations_total Storage operations by result.\n")
+	out.WriteString("# TYPE netclave_storage_operations_total counter\n")
+
+	for _, op := range ops {
+		for _, result := range []string{resultOK, resultNotFound, resultError} {
+			if count, ok := snapshot[op].results[result]; ok {
+				out.WriteString("netclave_storage_operations_total" + metricsLabels(op, "result", result) + " " +
+					strconv.FormatUint(count, 10) + "\n")
+			}
+		}
+	}
+
+	out.WriteString("# HELP netclave_storage_operation_duration_seconds Latency of storage operations.\n")
+	out.WriteString("# TYPE netclave_storage_operation_duration_seconds histogram\n")
+
+	for _, op := range ops {
+		om := snapshot[op]
+
+		var cumulated uint64
+
+		for i, bound := range m.buckets {
+			cumulated += om.buckets[i]
+
+			out.WriteString("netclave_storage_operation_duration_seconds_bucket" + metricsLabels(op, "le", formatMetricsValue(bound)) + " " +
+				strconv.FormatUint(cumulated, 10) + "\n")
+		}
+
+		out.WriteString("netclave_storage_operation_duration_seconds_bucket" + metricsLabels(op, "le", "+Inf") + " " +
+			strconv.FormatUint(om.count, 10) + "\n")
+		out.WriteString("netclave_storage_operation_duration_seconds_sum" + metricsLabels(op) + " " + formatMetricsValue(om.sum) + "\n")
+		out.WriteString("netclave_storage_operation_duration_seconds_count" + metricsLabels(op) + " " +
+			strconv.FormatUint(om.count, 10) + "\n")
+	}
+
+	out.WriteString("# HELP netclave_storage_rows_total Rows returned or deleted by storage operations.\n")
+	out.WriteString("# TYPE netclave_storage_rows_total counter\n")
+
+	for _, op := range ops {
+		out.WriteString("netclave_storage_rows_total" + metricsLabels(op) + " " + strconv.FormatUint(snapshot[op].rows, 10) + "\n")
+	}
+
+	return out.Flush()
+}
+
+// ServeHTTP serves the metrics to a Prometheus scrape.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	m.WritePrometheus(w)
+}
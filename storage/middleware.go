@@ -0,0 +1,530 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// Middleware decorates a Storage, for instance to measure or trace its calls.
+type Middleware func(Storage) Storage
+
+// Wrap decorates s with middlewares, the first one being the outermost, so
+// that it sees the calls first.
+func Wrap(s Storage, middlewares ...Middleware) Storage {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		s = middlewares[i](s)
+	}
+
+	return s
+}
+
+// Operation describes a call of a Storage or Tx method to an Observer.
+type Operation struct {
+	// Name is the name of the method, without the Context suffix.
+	Name string
+	// Table is the table the call is about, empty for Tables, Begin, Commit
+	// and Rollback.
+	Table string
+}
+
+// Observer is told about the calls of a Storage wrapped by Observe.
+type Observer interface {
+	// Start is called when op begins. It returns the context to run op with
+	// and a function to call once op is done, with its error and the number
+	// of rows it returned or deleted: keys for GetKeys, ScanKeys and DelKey,
+	// tables for Tables and fields for GetMap. Other operations report 0.
+	Start(ctx context.Context, op Operation) (context.Context, func(rows int, err error))
+}
+
+// ObserverFunc lets a function be an Observer.
+type ObserverFunc func(ctx context.Context, op Operation) (context.Context, func(rows int, err error))
+
+func (f ObserverFunc) Start(ctx context.Context, op Operation) (context.Context, func(rows int, err error)) {
+	return f(ctx, op)
+}
+
+// Observe returns a Middleware telling observer about every call of the data
+// methods of a Storage and of its transactions. ScanKeys is done when its
+// iterator is exhausted or closed, Watch once it is subscribed. Setup, Init,
+// Create and Destroy are not observed.
+func Observe(observer Observer) Middleware {
+	return func(s Storage) Storage {
+		return &observedStorage{
+			Storage:  s,
+			observer: observer,
+		}
+	}
+}
+
+type observedStorage struct {
+	Storage
+	observer Observer
+}
+
+func (obs *observedStorage) start(ctx context.Context, name string, table string) (context.Context, func(rows int, err error)) {
+	return obs.observer.Start(ctx, Operation{Name: name, Table: table})
+}
+
+func (obs *observedStorage) GetKeys(table string, pattern string) ([]string, error) {
+	return obs.GetKeysContext(context.Background(), table, pattern)
+}
+
+func (obs *observedStorage) GetKeysContext(ctx context.Context, table string, pattern string) ([]string, error) {
+	ctx, done := obs.start(ctx, "GetKeys", table)
+
+	keys, err := obs.Storage.GetKeysContext(ctx, table, pattern)
+
+	done(len(keys), err)
+
+	return keys, err
+}
+
+func (obs *observedStorage) ScanKeys(ctx context.Context, table string, pattern string, batchSize int) (KeyIterator, error) {
+	ctx, done := obs.start(ctx, "ScanKeys", table)
+
+	it, err := obs.Storage.ScanKeys(ctx, table, pattern, batchSize)
+
+	if err != nil {
+		done(0, err)
+		return nil, err
+	}
+
+	return &observedIterator{
+		KeyIterator: it,
+		done:        done,
+	}, nil
+}
+
+func (obs *observedStorage) Tables(ctx context.Context) ([]string, error) {
+	ctx, done := obs.start(ctx, "Tables", "")
+
+	tables, err := obs.Storage.Tables(ctx)
+
+	done(len(tables), err)
+
+	return tables, err
+}
+
+func (obs *observedStorage) Watch(ctx context.Context, table string, pattern string) (<-chan Event, error) {
+	watchCtx, done := obs.start(ctx, "Watch", table)
+
+	events, err := obs.Storage.Watch(watchCtx, table, pattern)
+
+	done(0, err)
+
+	return events, err
+}
+
+func (obs *observedStorage) SetKey(table string, key string, value string, expiration time.Duration) error {
+	return obs.SetKeyContext(context.Background(), table, key, value, expiration)
+}
+
+func (obs *observedStorage) SetKeyContext(ctx context.Context, table string, key string, value string, expiration time.Duration) error {
+	ctx, done := obs.start(ctx, "SetKey", table)
+
+	err := obs.Storage.SetKeyContext(ctx, table, key, value, expiration)
+
+	done(0, err)
+
+	return err
+}
+
+func (obs *observedStorage) GetFullKey(key string) (string, error) {
+	return obs.GetFullKeyContext(context.Background(), key)
+}
+
+func (obs *observedStorage) GetFullKeyContext(ctx context.Context, key string) (string, error) {
+	ctx, done := obs.start(ctx, "GetFullKey", SplitToParts(key)[0])
+
+	value, err := obs.Storage.GetFullKeyContext(ctx, key)
+
+	done(0, err)
+
+	return value, err
+}
+
+func (obs *observedStorage) GetKey(table string, key string) (string, error) {
+	return obs.GetKeyContext(context.Background(), table, key)
+}
+
+func (obs *observedStorage) GetKeyContext(ctx context.Context, table string, key string) (string, error) {
+	ctx, done := obs.start(ctx, "GetKey", table)
+
+	value, err := obs.Storage.GetKeyContext(ctx, table, key)
+
+	done(0, err)
+
+	return value, err
+}
+
+func (obs *observedStorage) LookupKey(table string, key string) (string, error) {
+	return obs.LookupKeyContext(context.Background(), table, key)
+}
+
+func (obs *observedStorage) LookupKeyContext(ctx context.Context, table string, key string) (string, error) {
+	ctx, done := obs.start(ctx, "LookupKey", table)
+
+	value, err := obs.Storage.LookupKeyContext(ctx, table, key)
+
+	done(0, err)
+
+	return value, err
+}
+
+func (obs *observedStorage) Exists(table string, key string) (bool, error) {
+	return obs.ExistsContext(context.Background(), table, key)
+}
+
+func (obs *observedStorage) ExistsContext(ctx context.Context, table string, key string) (bool, error) {
+	ctx, done := obs.start(ctx, "Exists", table)
+
+	found, err := obs.Storage.ExistsContext(ctx, table, key)
+
+	done(0, err)
+
+	return found, err
+}
+
+func (obs *observedStorage) TTL(table string, key string) (time.Duration, error) {
+	return obs.TTLContext(context.Background(), table, key)
+}
+
+func (obs *observedStorage) TTLContext(ctx context.Context, table string, key string) (time.Duration, error) {
+	ctx, done := obs.start(ctx, "TTL", table)
+
+	ttl, err := obs.Storage.TTLContext(ctx, table, key)
+
+	done(0, err)
+
+	return ttl, err
+}
+
+func (obs *observedStorage) Expire(table string, key string, expiration time.Duration) (bool, error) {
+	return obs.ExpireContext(context.Background(), table, key, expiration)
+}
+
+func (obs *observedStorage) ExpireContext(ctx context.Context, table string, key string, expiration time.Duration) (bool, error) {
+	ctx, done := obs.start(ctx, "Expire", table)
+
+	found, err := obs.Storage.ExpireContext(ctx, table, key, expiration)
+
+	done(0, err)
+
+	return found, err
+}
+
+func (obs *observedStorage) Persist(table string, key string) (bool, error) {
+	return obs.PersistContext(context.Background(), table, key)
+}
+
+func (obs *observedStorage) PersistContext(ctx context.Context, table string, key string) (bool, error) {
+	ctx, done := obs.start(ctx, "Persist", table)
+
+	found, err := obs.Storage.PersistContext(ctx, table, key)
+
+	done(0, err)
+
+	return found, err
+}
+
+func (obs *observedStorage) DelKey(table string, key string) (int64, error) {
+	return obs.DelKeyContext(context.Background(), table, key)
+}
+
+func (obs *observedStorage) DelKeyContext(ctx context.Context, table string, key string) (int64, error) {
+	ctx, done := obs.start(ctx, "DelKey", table)
+
+	deleted, err := obs.Storage.DelKeyContext(ctx, table, key)
+
+	rows := 0
+
+	if deleted > 0 {
+		rows = int(deleted)
+	}
+
+	done(rows, err)
+
+	return deleted, err
+}
+
+func (obs *observedStorage) Incr(table string, key string, delta int64, expiration time.Duration) (int64, error) {
+	return obs.IncrContext(context.Background(), table, key, delta, expiration)
+}
+
+func (obs *observedStorage) IncrContext(ctx context.Context, table string, key string, delta int64, expiration time.Duration) (int64, error) {
+	ctx, done := obs.start(ctx, "Incr", table)
+
+	value, err := obs.Storage.IncrContext(ctx, table, key, delta, expiration)
+
+	done(0, err)
+
+	return value, err
+}
+
+func (obs *observedStorage) SetNX(table string, key string, value string, expiration time.Duration) (bool, error) {
+	return obs.SetNXContext(context.Background(), table, key, value, expiration)
+}
+
+func (obs *observedStorage) SetNXContext(ctx context.Context, table string, key string, value string, expiration time.Duration) (bool, error) {
+	ctx, done := obs.start(ctx, "SetNX", table)
+
+	stored, err := obs.Storage.SetNXContext(ctx, table, key, value, expiration)
+
+	done(0, err)
+
+	return stored, err
+}
+
+func (obs *observedStorage) CompareAndSwap(table string, key string, old string, new string) (bool, error) {
+	return obs.CompareAndSwapContext(context.Background(), table, key, old, new)
+}
+
+func (obs *observedStorage) CompareAndSwapContext(ctx context.Context, table string, key string, old string, new string) (bool, error) {
+	ctx, done := obs.start(ctx, "CompareAndSwap", table)
+
+	swapped, err := obs.Storage.CompareAndSwapContext(ctx, table, key, old, new)
+
+	done(0, err)
+
+	return swapped, err
+}
+
+func (obs *observedStorage) AddToMap(table string, key string, objectKey string, object string) error {
+	return obs.AddToMapContext(context.Background(), table, key, objectKey, object)
+}
+
+func (obs *observedStorage) AddToMapContext(ctx context.Context, table string, key string, objectKey string, object string) error {
+	ctx, done := obs.start(ctx, "AddToMap", table)
+
+	err := obs.Storage.AddToMapContext(ctx, table, key, objectKey, object)
+
+	done(0, err)
+
+	return err
+}
+
+func (obs *observedStorage) AddToMapWithTTL(table string, key string, objectKey string, object string, expiration time.Duration) error {
+	return obs.AddToMapWithTTLContext(context.Background(), table, key, objectKey, object, expiration)
+}
+
+func (obs *observedStorage) AddToMapWithTTLContext(ctx context.Context, table string, key string, objectKey string, object string, expiration time.Duration) error {
+	ctx, done := obs.start(ctx, "AddToMapWithTTL", table)
+
+	err := obs.Storage.AddToMapWithTTLContext(ctx, table, key, objectKey, object, expiration)
+
+	done(0, err)
+
+	return err
+}
+
+func (obs *observedStorage) CompareAndSwapInMap(table string, key string, objectKey string, old string, new string) (bool, error) {
+	return obs.CompareAndSwapInMapContext(context.Background(), table, key, objectKey, old, new)
+}
+
+func (obs *observedStorage) CompareAndSwapInMapContext(ctx context.Context, table string, key string, objectKey string, old string, new string) (bool, error) {
+	ctx, done := obs.start(ctx, "CompareAndSwapInMap", table)
+
+	swapped, err := obs.Storage.CompareAndSwapInMapContext(ctx, table, key, objectKey, old, new)
+
+	done(0, err)
+
+	return swapped, err
+}
+
+func (obs *observedStorage) ExpireMap(table string, key string, expiration time.Duration) error {
+	return obs.ExpireMapContext(context.Background(), table, key, expiration)
+}
+
+func (obs *observedStorage) ExpireMapContext(ctx context.Context, table string, key string, expiration time.Duration) error {
+	ctx, done := obs.start(ctx, "ExpireMap", table)
+
+	err := obs.Storage.ExpireMapContext(ctx, table, key, expiration)
+
+	done(0, err)
+
+	return err
+}
+
+func (obs *observedStorage) MapTTL(table string, key string) (map[string]time.Duration, time.Duration, error) {
+	return obs.MapTTLContext(context.Background(), table, key)
+}
+
+func (obs *observedStorage) MapTTLContext(ctx context.Context, table string, key string) (map[string]time.Duration, time.Duration, error) {
+	ctx, done := obs.start(ctx, "MapTTL", table)
+
+	fields, mapTTL, err := obs.Storage.MapTTLContext(ctx, table, key)
+
+	done(len(fields), err)
+
+	return fields, mapTTL, err
+}
+
+func (obs *observedStorage) DelFromMap(table string, key string, objectKey string) error {
+	return obs.DelFromMapContext(context.Background(), table, key, objectKey)
+}
+
+func (obs *observedStorage) DelFromMapContext(ctx context.Context, table string, key string, objectKey string) error {
+	ctx, done := obs.start(ctx, "DelFromMap", table)
+
+	err := obs.Storage.DelFromMapContext(ctx, table, key, objectKey)
+
+	done(0, err)
+
+	return err
+}
+
+func (obs *observedStorage) GetFromMap(table string, key string, objectKey string) (string, error) {
+	return obs.GetFromMapContext(context.Background(), table, key, objectKey)
+}
+
+func (obs *observedStorage) GetFromMapContext(ctx context.Context, table string, key string, objectKey string) (string, error) {
+	ctx, done := obs.start(ctx, "GetFromMap", table)
+
+	value, err := obs.Storage.GetFromMapContext(ctx, table, key, objectKey)
+
+	done(0, err)
+
+	return value, err
+}
+
+func (obs *observedStorage) GetMap(table string, key string) (map[string]string, error) {
+	return obs.GetMapContext(context.Background(), table, key)
+}
+
+func (obs *observedStorage) GetMapContext(ctx context.Context, table string, key string) (map[string]string, error) {
+	ctx, done := obs.start(ctx, "GetMap", table)
+
+	fields, err := obs.Storage.GetMapContext(ctx, table, key)
+
+	done(len(fields), err)
+
+	return fields, err
+}
+
+func (obs *observedStorage) Begin() (Tx, error) {
+	return obs.BeginContext(context.Background())
+}
+
+// BeginContext observes the start of the transaction, and then every queued
+// write, Commit and Rollback with the context of the transaction.
+func (obs *observedStorage) BeginContext(ctx context.Context) (Tx, error) {
+	beginCtx, done := obs.start(ctx, "Begin", "")
+
+	tx, err := obs.Storage.BeginContext(beginCtx)
+
+	done(0, err)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &observedTx{
+		tx:      tx,
+		storage: obs,
+		ctx:     ctx,
+	}, nil
+}
+
+// observedIterator reports ScanKeys as done once the keys are exhausted or
+// the iterator is closed.
+type observedIterator struct {
+	KeyIterator
+	done func(rows int, err error)
+	rows int
+}
+
+func (oi *observedIterator) finish(err error) {
+	if oi.done != nil {
+		oi.done(oi.rows, err)
+		oi.done = nil
+	}
+}
+
+func (oi *observedIterator) Next() bool {
+	if oi.KeyIterator.Next() {
+		oi.rows++
+		return true
+	}
+
+	oi.finish(oi.KeyIterator.Err())
+
+	return false
+}
+
+func (oi *observedIterator) Close() error {
+	err := oi.KeyIterator.Close()
+
+	oi.finish(err)
+
+	return err
+}
+
+type observedTx struct {
+	tx      Tx
+	storage *observedStorage
+	ctx     context.Context
+}
+
+func (ot *observedTx) observe(name string, table string, call func() error) error {
+	_, done := ot.storage.start(ot.ctx, name, table)
+
+	err := call()
+
+	done(0, err)
+
+	return err
+}
+
+func (ot *observedTx) SetKey(table string, key string, value string, expiration time.Duration) error {
+	return ot.observe("SetKey", table, func() error {
+		return ot.tx.SetKey(table, key, value, expiration)
+	})
+}
+
+func (ot *observedTx) DelKey(table string, key string) error {
+	return ot.observe("DelKey", table, func() error {
+		return ot.tx.DelKey(table, key)
+	})
+}
+
+func (ot *observedTx) AddToMap(table string, key string, objectKey string, object string) error {
+	return ot.observe("AddToMap", table, func() error {
+		return ot.tx.AddToMap(table, key, objectKey, object)
+	})
+}
+
+func (ot *observedTx) AddToMapWithTTL(table string, key string, objectKey string, object string, expiration time.Duration) error {
+	return ot.observe("AddToMapWithTTL", table, func() error {
+		return ot.tx.AddToMapWithTTL(table, key, objectKey, object, expiration)
+	})
+}
+
+func (ot *observedTx) DelFromMap(table string, key string, objectKey string) error {
+	return ot.observe("DelFromMap", table, func() error {
+		return ot.tx.DelFromMap(table, key, objectKey)
+	})
+}
+
+func (ot *observedTx) Commit() error {
+	return ot.observe("Commit", "", ot.tx.Commit)
+}
+
+func (ot *observedTx) Rollback() error {
+	return ot.observe("Rollback", "", ot.tx.Rollback)
+}
@@ -0,0 +1,251 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// recordingObserver records the operations it sees, prefixed with its name.
+func recordingObserver(name string, seen *[]string) Middleware {
+	return Observe(ObserverFunc(func(ctx context.Context, op Operation) (context.Context, func(rows int, err error)) {
+		*seen = append(*seen, name+" "+op.Name+" "+op.Table)
+
+		return ctx, func(rows int, err error) {
+			*seen = append(*seen, name+" done "+op.Name)
+		}
+	}))
+}
+
+func TestWrapOrder(t *testing.T) {
+	seen := []string{}
+
+	s := Wrap(newTestMemoryStorage(t), recordingObserver("outer", &seen), recordingObserver("inner", &seen))
+
+	s.SetKey("table", "key", "value", 0)
+
+	expected := []string{"outer SetKey table", "inner SetKey table", "inner done SetKey", "outer done SetKey"}
+
+	if !reflect.DeepEqual(seen, expected) {
+		t.Errorf("Calls = %v, expected %v", seen, expected)
+	}
+}
+
+func TestObservedRows(t *testing.T) {
+	rows := map[string]int{}
+
+	s := Wrap(newTestMemoryStorage(t), Observe(ObserverFunc(func(ctx context.Context, op Operation) (context.Context, func(rows int, err error)) {
+		return ctx, func(count int, err error) {
+			rows[op.Name] += count
+		}
+	})))
+
+	s.SetKey("table", "a", "value", 0)
+	s.SetKey("table", "b", "value", 0)
+	s.AddToMap("table", "map", "field", "value")
+	s.GetKeys("table", "*")
+	s.GetMap("table", "map")
+	s.DelKey("table", "missing")
+
+	it, err := s.ScanKeys(context.Background(), "table", "*", 1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for it.Next() {
+	}
+
+	it.Close()
+
+	tx, err := s.Begin()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx.DelKey("table", "a")
+	tx.Commit()
+
+	expected := map[string]int{
+		"SetKey": 0, "AddToMap": 0, "GetKeys": 3, "GetMap": 1, "DelKey": 0, "ScanKeys": 3, "Begin": 0, "Commit": 0,
+	}
+
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("Rows = %v, expected %v", rows, expected)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	metrics := NewMetrics(0.5, 0.001)
+
+	s := Wrap(newTestMemoryStorage(t), metrics.Middleware())
+
+	s.SetKey("publickeys", "label", "key", 0)
+	s.LookupKey("publickeys", "label")
+	s.LookupKey("publickeys", "missing")
+	s.Incr("publickeys", "label", 1, 0)
+	s.GetKeys("publickeys", "*")
+
+	var out bytes.Buffer
+
+	err := metrics.WritePrometheus(&out)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"# TYPE netclave_storage_operations_total counter",
+		`netclave_storage_operations_total{operation="LookupKey",table="publickeys",result="ok"} 1`,
+		`netclave_storage_operations_total{operation="LookupKey",table="publickeys",result="not_found"} 1`,
+		`netclave_storage_operations_total{operation="Incr",table="publickeys",result="error"} 1`,
+		"# TYPE netclave_storage_operation_duration_seconds histogram",
+		`netclave_storage_operation_duration_seconds_bucket{operation="SetKey",table="publickeys",le="0.5"} 1`,
+		`netclave_storage_operation_duration_seconds_bucket{operation="SetKey",table="publickeys",le="+Inf"} 1`,
+		`netclave_storage_operation_duration_seconds_count{operation="LookupKey",table="publickeys"} 2`,
+		`netclave_storage_rows_total{operation="GetKeys",table="publickeys"} 1`,
+	}
+
+	for _, line := range expected {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("Metrics lack %s:\n%s", line, out.String())
+		}
+	}
+
+	if strings.Index(out.String(), `le="0.001"`) > strings.Index(out.String(), `le="0.5"`) {
+		t.Error("Buckets are not sorted")
+	}
+}
+
+type recordedSpan struct {
+	name       string
+	attributes map[string]interface{}
+	err        error
+	ended      bool
+}
+
+type recordingTracer struct {
+	spans []*recordedSpan
+}
+
+type spanKey struct{}
+
+func (rt *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	span := &recordedSpan{name: name, attributes: map[string]interface{}{}}
+	rt.spans = append(rt.spans, span)
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (rs *recordedSpan) SetStringAttribute(key string, value string) {
+	rs.attributes[key] = value
+}
+
+func (rs *recordedSpan) SetIntAttribute(key string, value int64) {
+	rs.attributes[key] = value
+}
+
+func (rs *recordedSpan) RecordError(err error) {
+	rs.err = err
+}
+
+func (rs *recordedSpan) End() {
+	rs.ended = true
+}
+
+// spanContextStorage checks that the backend runs with the context of the
+// span.
+type spanContextStorage struct {
+	Storage
+	t *testing.T
+}
+
+func (sc *spanContextStorage) LookupKeyContext(ctx context.Context, table string, key string) (string, error) {
+	if ctx.Value(spanKey{}) == nil {
+		sc.t.Error("The backend runs without the span")
+	}
+
+	return sc.Storage.LookupKeyContext(ctx, table, key)
+}
+
+func TestTracing(t *testing.T) {
+	tracer := &recordingTracer{}
+
+	s := Wrap(&spanContextStorage{Storage: newTestMemoryStorage(t), t: t}, Tracing(tracer))
+
+	s.AddToMap("identificators", "id", "field", "value")
+	s.GetMap("identificators", "id")
+	s.LookupKey("identificators", "missing")
+	s.GetKeys("identificators", "[")
+	s.Tables(context.Background())
+
+	if len(tracer.spans) != 5 {
+		t.Fatalf("Spans = %d, expected 5", len(tracer.spans))
+	}
+
+	for _, span := range tracer.spans {
+		if !span.ended {
+			t.Errorf("Span %s was not ended", span.name)
+		}
+	}
+
+	getMap := tracer.spans[1]
+
+	expected := map[string]interface{}{
+		spanOperationAttribute: "GetMap",
+		spanTableAttribute:     "identificators",
+		spanRowsAttribute:      int64(1),
+	}
+
+	if getMap.name != "GetMap identificators" || !reflect.DeepEqual(getMap.attributes, expected) {
+		t.Errorf("GetMap span = %+v", getMap)
+	}
+
+	if tracer.spans[2].err != nil {
+		t.Errorf("A missing key failed its span: %v", tracer.spans[2].err)
+	}
+
+	if tracer.spans[3].err == nil {
+		t.Error("A malformed pattern did not fail its span")
+	}
+
+	if tracer.spans[4].name != "Tables" {
+		t.Errorf("Tables span = %s", tracer.spans[4].name)
+	}
+}
+
+func TestGenericStorageMiddlewares(t *testing.T) {
+	seen := []string{}
+
+	gs := newTestGenericStorage(t, nil)
+	gs.Middlewares = []Middleware{recordingObserver("generic", &seen)}
+
+	err := gs.SetKey("table", "key", "value", 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(seen) != 2 || seen[0] != "generic SetKey table" {
+		t.Errorf("Calls = %v", seen)
+	}
+}
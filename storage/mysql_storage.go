@@ -17,602 +17,209 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
-	"errors"
 	"fmt"
-	"log"
-	"math"
 	"strconv"
-	"time"
+	"sync/atomic"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 )
 
+// mySQLTLSConfigs numbers the TLS configurations registered with the driver,
+// whose registry is shared by every connection of the process.
+var mySQLTLSConfigs int64
+
+// MySQLStorage connects with TLS when the credentials ask for it, see
+// ParseTLSConfig. The server name defaults to the host of "url".
 type MySQLStorage struct {
-	Connection *sql.DB
+	sqlStorage
+	// tlsConfigNames are the names the TLS configurations of the primary and
+	// the replica are registered under.
+	tlsConfigNames []string
 }
 
 func (mss *MySQLStorage) Setup(credentials map[string]string) error {
 	return nil
 }
 
-func (mss *MySQLStorage) executeSingleQuery(query string) error {
-	statement, err := mss.Connection.Prepare(query) // Prepare SQL Statement
+func (mss *MySQLStorage) Init() error {
+	_, err := mss.Migrate(context.Background())
+
 	if err != nil {
 		return err
 	}
 
-	_, err = statement.Exec() // Execute SQL Statements
-
-	return err
+	return mss.setupWatch(context.Background())
 }
 
-func (mss *MySQLStorage) Init() error {
-	keysTableSQL := `CREATE TABLE IF NOT EXISTS ` + "`" + `keys` + "`" + `(
-		 id BIGINT NOT NULL AUTO_INCREMENT,		
-		 ` + "`" + `table` + "`" + ` LONGTEXT,
-		 table_hash BIGINT,
-		 ` + "`" + `key` + "`" + ` LONGTEXT,
-		 `
-
-	keysUniqueIndexValues := ""
-
-	for i := 1; i <= NumberOfColumns; i++ {
-		keysTableSQL += `column_` + strconv.Itoa(i) + `_hash BIGINT,
-		 `
+// mySQLMigrations lists the schema changes of MySQLStorage, oldest first.
+func mySQLMigrations() []sqlMigration {
+	// Keys are stored as VARBINARY so that the unique indexes, which GetKeys
+	// also scans by prefix, compare them byte by byte.
+	keyColumn := "VARBINARY(" + strconv.Itoa(mySQLDialect{}.MaxKeyLength()) + ") NOT NULL"
 
-		keysUniqueIndexValues = keysUniqueIndexValues + "column_" + strconv.Itoa(i) + "_hash"
-
-		if i != NumberOfColumns {
-			keysUniqueIndexValues = keysUniqueIndexValues + ", "
-		}
-	}
-
-	keysUniqueIndexValues += ", table_hash"
-
-	keysTableSQL += `value LONGTEXT,
+	tables := []string{"CREATE TABLE IF NOT EXISTS `keys` (" + `
+		 id BIGINT NOT NULL AUTO_INCREMENT,
+		 ` + "`table` " + keyColumn + `,
+		 ` + "`key` " + keyColumn + `,
+		 value LONGTEXT,
 		 ttl BIGINT,
 		 PRIMARY KEY (id),
-		CONSTRAINT columns_unique_key UNIQUE(` + keysUniqueIndexValues + `));
-	   ` // SQL Statement for Create Table
-
-	log.Println(keysTableSQL)
-
-	err := mss.executeSingleQuery(keysTableSQL)
-
-	if err != nil {
-		return err
-	}
-
-	keysTableSQL = `CREATE INDEX table_hash_index ON ` + "`" + `keys` + "`" + `(table_hash);`
-
-	err = mss.executeSingleQuery(keysTableSQL)
-
-	if err != nil {
-		log.Println(err.Error())
-	}
-
-	for i := 1; i <= NumberOfColumns; i++ {
-		keysTableSQL = `CREATE INDEX column_` + strconv.Itoa(i) + `_hash_index ON ` + "`" + `keys` + "`" + `(column_` + strconv.Itoa(i) + `_hash);`
-
-		err = mss.executeSingleQuery(keysTableSQL)
-
-		if err != nil {
-			log.Println(err.Error())
-		}
-	}
-
-	keysTableSQL = `CREATE INDEX ttl_index ON ` + "`" + `keys` + "`" + `(ttl);`
-
-	err = mss.executeSingleQuery(keysTableSQL)
-
-	if err != nil {
-		log.Println(err.Error())
-	}
-
-	//og.Println("keys table created")
-
-	mapsTableSQL := `CREATE TABLE IF NOT EXISTS maps (
-		 id BIGINT NOT NULL AUTO_INCREMENT,		
-		 ` + "`" + `table` + "`" + ` LONGTEXT,
-		 table_hash BIGINT,
-		 ` + "`" + `key` + "`" + ` LONGTEXT,
-		 `
-
-	mapKeysUniqueIndexValues := ""
-
-	for i := 1; i <= NumberOfColumns; i++ {
-		mapsTableSQL += `column_` + strconv.Itoa(i) + `_hash BIGINT,
-		 `
-
-		mapKeysUniqueIndexValues = mapKeysUniqueIndexValues + "column_" + strconv.Itoa(i) + "_hash"
-
-		if i != NumberOfColumns {
-			mapKeysUniqueIndexValues = mapKeysUniqueIndexValues + ", "
-		}
-	}
-
-	mapKeysUniqueIndexValues += ", table_hash"
-	mapKeysUniqueIndexValues += ", object_key_hash"
-
-	mapsTableSQL += `value LONGTEXT,
-		 object_key LONGTEXT,		
-		 object_key_hash BIGINT,
-		 PRIMARY KEY (id),	
-		CONSTRAINT map_columns_unique_key UNIQUE(` + mapKeysUniqueIndexValues + `));
-	   ` // SQL Statement for Create Table
-
-	err = mss.executeSingleQuery(mapsTableSQL)
-
-	if err != nil {
-		return err
+		 UNIQUE KEY ` + keysUniqueIndex + " (`table`, `key`)," + `
+		 INDEX ttl_index (ttl))`,
+		`CREATE TABLE IF NOT EXISTS maps (
+		 id BIGINT NOT NULL AUTO_INCREMENT,
+		 ` + "`table` " + keyColumn + `,
+		 ` + "`key` " + keyColumn + `,
+		 object_key ` + keyColumn + `,
+		 value LONGTEXT,
+		 PRIMARY KEY (id),
+		 UNIQUE KEY ` + mapsUniqueIndex + " (`table`, `key`, object_key))",
 	}
 
-	mapsTableSQL = `CREATE INDEX table_hash_index ON maps(table_hash);`
-
-	err = mss.executeSingleQuery(mapsTableSQL)
-
-	if err != nil {
-		log.Println(err.Error())
+	mapExpiry := []sqlColumn{
+		{table: "maps", name: "ttl", definition: "BIGINT NOT NULL DEFAULT " + strconv.FormatInt(neverExpires, 10)},
+		{table: "maps", name: "map_ttl", definition: "BIGINT NOT NULL DEFAULT " + strconv.FormatInt(neverExpires, 10)},
 	}
 
-	for i := 1; i <= NumberOfColumns; i++ {
-		mapsTableSQL = `CREATE INDEX column_` + strconv.Itoa(i) + `_hash_index ON maps(column_` + strconv.Itoa(i) + `_hash);`
-
-		err = mss.executeSingleQuery(mapsTableSQL)
-
-		if err != nil {
-			log.Println(err.Error())
-		}
+	return []sqlMigration{
+		{version: 1, description: "create keys and maps tables", apply: createTables(tables)},
+		{version: 2, description: "add expiration of map fields", apply: addColumns(mapExpiry)},
+		{version: 3, description: "index expiration of map fields", apply: addIndexes(mapExpiryIndexes)},
 	}
+}
 
-	log.Println("Before creating an index for object key hash")
-
-	mapsTableSQL = `CREATE INDEX object_key_hash_index ON maps(object_key_hash);`
-
-	err = mss.executeSingleQuery(mapsTableSQL)
+// mySQLWatchSchema creates the changelog table and the triggers filling it.
+func mySQLWatchSchema() func(ctx context.Context, mt *migrationTx) error {
+	keyColumn := "VARBINARY(" + strconv.Itoa(mySQLDialect{}.MaxKeyLength()) + ") NOT NULL"
 
-	if err != nil {
-		log.Println(err.Error())
+	changelog := []string{"CREATE TABLE IF NOT EXISTS `" + changelogTable + "` (" + `
+		 id BIGINT NOT NULL AUTO_INCREMENT,
+		 ` + "`table` " + keyColumn + `,
+		 ` + "`key` " + keyColumn + `,
+		 event VARCHAR(16) NOT NULL,
+		 created_at BIGINT NOT NULL,
+		 PRIMARY KEY (id),
+		 INDEX changelog_created_index (created_at))`,
 	}
 
-	LastTruncate = 0
-
-	return nil
+	return createWatchSchema(changelog, mySQLDialect{}, func(trigger sqlChangeTrigger) []string {
+		return []string{"CREATE TRIGGER " + trigger.name + " AFTER " + trigger.operation + " ON `" + trigger.table + "` FOR EACH ROW " +
+			trigger.changelogInsert(mySQLDialect{}, " FROM DUAL")}
+	})
 }
 
 func (mss *MySQLStorage) Create(credentials map[string]string) error {
 	var err error
 
-	url := credentials["url"]
-	username := credentials["username"]
-	password := credentials["password"]
-	dbname := credentials["dbname"]
+	mss.dialect = mySQLDialect{}
+	mss.migrations = mySQLMigrations()
+	mss.watchSchema = mySQLWatchSchema()
+
+	mss.watchOptions, err = ParseWatchOptions(credentials)
 
-	mss.Connection, err = sql.Open("mysql", username+":"+password+url+"/"+dbname)
 	if err != nil {
 		return err
 	}
 
-	return nil
-}
+	mss.changelog = mss.watchOptions.Enabled
 
-func (mss *MySQLStorage) Destroy() error {
-	return mss.Connection.Close() // Defer Closing the database
-}
-
-func (mss *MySQLStorage) GetKeys(table string, pattern string) ([]string, error) {
-	err := mss.KeysCleanUp()
+	mss.patternSyntax, err = ParsePatternSyntax(credentials)
 
 	if err != nil {
-		return nil, err
-	}
-
-	keys := []string{}
-
-	columns := SplitToParts(pattern)
-
-	if len(columns) > NumberOfColumns {
-		return nil, errors.New("Too many data columns")
-	}
-
-	hashes := CalculateHashesOfColumns(columns)
-	tableHash := CalculateHash(table)
-
-	clause := CreateWhereClause(columns, hashes)
-
-	sql := "SELECT `table`, `key`, ttl FROM `keys` WHERE table_hash = " + fmt.Sprint(tableHash)
-
-	if clause != "" {
-		sql += " AND " + clause
+		return err
 	}
 
-	now := time.Now().UnixNano() / int64(time.Millisecond)
-
-	row, err := mss.Connection.Query(sql)
+	dataSourceName, err := mss.dataSourceName(credentials)
 
 	if err != nil {
-		return nil, err
-	}
-
-	defer row.Close()
-	for row.Next() { // Iterate and fetch the records from result cursor
-		var table string
-		var key string
-		var ttl int64
-		row.Scan(&table, &key, &ttl)
-
-		if ttl >= now {
-			keys = append(keys, table+"/"+key)
-		}
-	}
-
-	sql = "SELECT `table`, `key` FROM maps WHERE table_hash = " + fmt.Sprint(tableHash)
-
-	if clause != "" {
-		sql += " AND " + clause
+		return err
 	}
 
-	now = time.Now().UnixNano() / int64(time.Millisecond)
-
-	row, err = mss.Connection.Query(sql)
-
+	mss.Connection, err = sql.Open("mysql", dataSourceName)
 	if err != nil {
-		return nil, err
-	}
-
-	defer row.Close()
-	for row.Next() { // Iterate and fetch the records from result cursor
-		var table string
-		var key string
-		row.Scan(&table, &key)
-
-		keys = append(keys, table+"/"+key)
+		mss.deregisterTLSConfigs()
+		return err
 	}
 
-	return keys, nil
-}
-
-func (mss *MySQLStorage) SetKey(table string, key string, value string, expiration time.Duration) error {
-	err := mss.KeysCleanUp()
+	err = mss.configurePool(credentials)
 
 	if err != nil {
+		mss.Connection.Close()
+		mss.deregisterTLSConfigs()
 		return err
 	}
 
-	columns := SplitToParts(key)
-
-	if len(columns) > NumberOfColumns {
-		return errors.New("Too many data columns")
-	}
-
-	hashes := CalculateHashesOfColumns(columns)
-	tableHash := CalculateHash(table)
-
-	sql := "INSERT INTO `keys` (`table`, table_hash, `key`,"
-
-	keysUniqueIndexValues := ""
-
-	for i := 1; i <= NumberOfColumns; i++ {
-		sql += " column_" + strconv.Itoa(i) + "_hash,"
-	}
-
-	sql += " value, ttl) VALUES ('" + table + "', " + fmt.Sprint(tableHash) + ", '" + key + "',"
-
-	hashesLen := len(hashes)
-
-	for i := 1; i <= NumberOfColumns; i++ {
-		if i <= hashesLen {
-			sql += " " + fmt.Sprint(hashes[i-1]) + ","
-		} else {
-			sql += " 0,"
-		}
-
-		keysUniqueIndexValues = keysUniqueIndexValues + "column_" + strconv.Itoa(i) + "_hash"
-
-		if i != NumberOfColumns {
-			keysUniqueIndexValues = keysUniqueIndexValues + ", "
-		}
-	}
-
-	keysUniqueIndexValues += ", table_hash"
-
-	until := time.Now().Add(expiration)
-
-	if expiration.Milliseconds() <= 0 {
-		until = time.Unix(0, int64(math.MaxInt64))
-	}
-
-	untilMilliseconds := until.UnixNano() / int64(time.Millisecond)
-
-	sql += " '" + value + "', " + strconv.FormatInt(untilMilliseconds, 10) + ")"
-
-	sql += " ON DUPLICATE KEY UPDATE value = VALUES(value), ttl = VALUES(ttl)"
-
-	//log.Println(sql)
-
-	_, err = mss.Connection.Exec(sql)
-
-	return err
-}
-
-func (mss *MySQLStorage) GetFullKey(key string) (string, error) {
-	parts := SplitToParts(key)
-
-	table := parts[0]
-
-	newKey := ""
-
-	partsLen := len(parts)
-
-	for i := 1; i < partsLen; i++ {
-		newKey = newKey + parts[i]
-
-		if i+1 < partsLen {
-			newKey += "/"
-		}
-	}
-
-	return mss.GetKey(table, newKey)
-}
-
-func (mss *MySQLStorage) GetKey(table string, key string) (string, error) {
-	err := mss.KeysCleanUp()
+	err = mss.openReplica("mysql", credentials, mss.dataSourceName)
 
 	if err != nil {
-		return "", err
-	}
-
-	columns := SplitToParts(key)
-
-	if len(columns) > NumberOfColumns {
-		return "", errors.New("Too many data columns")
-	}
-
-	hashes := CalculateHashesOfColumns(columns)
-	tableHash := CalculateHash(table)
-
-	clause := CreateWhereClause(columns, hashes)
-
-	sql := "SELECT `value`, `ttl` FROM `keys` WHERE table_hash = " + fmt.Sprint(tableHash)
-
-	if clause != "" {
-		sql += " AND " + clause
+		mss.closeConnections()
+		mss.deregisterTLSConfigs()
+		return err
 	}
 
-	now := time.Now().UnixNano() / int64(time.Millisecond)
-
-	row, err := mss.Connection.Query(sql)
+	err = mss.startReaper(credentials)
 
 	if err != nil {
-		return "", err
-	}
-
-	defer row.Close()
-	for row.Next() { // Iterate and fetch the records from result cursor
-		var value string
-		var ttl int64
-		row.Scan(&value, &ttl)
-
-		if ttl >= now {
-			return value, nil
-		}
-	}
-
-	return "", nil
-}
-
-func (mss *MySQLStorage) KeysCleanUp() error {
-	now := time.Now().UnixNano() / int64(time.Millisecond)
-
-	if (now - LastTruncate) > TruncateInterval {
-		nowStr := fmt.Sprint(now)
-
-		log.Println(nowStr)
-
-		sql := "DELETE FROM `keys` WHERE ttl < " + nowStr
-
-		result, err := mss.Connection.Exec(sql)
-
-		if err != nil {
-			return err
-		}
-
-		truncatedRows, err := result.RowsAffected()
-
-		if err != nil {
-			return err
-		}
-
-		log.Printf("%d rows truncated\n", truncatedRows)
-
-		LastTruncate = now
+		mss.closeConnections()
+		mss.deregisterTLSConfigs()
+		return err
 	}
 
 	return nil
 }
 
-func (mss *MySQLStorage) DelKey(table string, key string) (int64, error) {
-	err := mss.KeysCleanUp()
-
-	if err != nil {
-		return 0, err
-	}
-
-	columns := SplitToParts(key)
-
-	if len(columns) > NumberOfColumns {
-		return -1, errors.New("Too many data columns")
-	}
-
-	hashes := CalculateHashesOfColumns(columns)
-	tableHash := CalculateHash(table)
-
-	clause := CreateWhereClause(columns, hashes)
-
-	sql := "DELETE FROM `keys` WHERE table_hash = " + fmt.Sprint(tableHash)
-
-	if clause != "" {
-		sql += " AND " + clause
-	}
-
-	res, err := mss.Connection.Exec(sql)
-
-	if err != nil {
-		return -1, err
-	}
-
-	return res.RowsAffected()
-}
-
-func (mss *MySQLStorage) AddToMap(table string, key string, objectKey string, object string) error {
-	columns := SplitToParts(key)
-
-	if len(columns) > NumberOfColumns {
-		return errors.New("Too many data columns")
-	}
-
-	hashes := CalculateHashesOfColumns(columns)
-	tableHash := CalculateHash(table)
-	objectKeyHash := CalculateHash(objectKey)
-
-	sql := "INSERT INTO maps (`table`, table_hash, `key`, object_key, object_key_hash,"
-
-	keysUniqueIndexValues := ""
-
-	for i := 1; i <= NumberOfColumns; i++ {
-		sql += " column_" + strconv.Itoa(i) + "_hash,"
-	}
-
-	sql += " value) VALUES ('" + table + "', " + fmt.Sprint(tableHash) + ", '" + key + "', '" + objectKey + "', " + fmt.Sprint(objectKeyHash) + ", "
-
-	hashesLen := len(hashes)
-
-	for i := 1; i <= NumberOfColumns; i++ {
-		if i <= hashesLen {
-			sql += " " + fmt.Sprint(hashes[i-1]) + ","
-		} else {
-			sql += " 0,"
-		}
-
-		keysUniqueIndexValues = keysUniqueIndexValues + "column_" + strconv.Itoa(i) + "_hash"
-
-		if i != NumberOfColumns {
-			keysUniqueIndexValues = keysUniqueIndexValues + ", "
-		}
-	}
-
-	keysUniqueIndexValues += ", table_hash"
-	keysUniqueIndexValues += ", object_key_hash"
-
-	sql += " '" + object + "')"
-
-	sql += " ON DUPLICATE KEY UPDATE value = VALUES(value)"
-
-	//log.Println(sql)
-
-	_, err := mss.Connection.Exec(sql)
-
-	return err
-}
-
-func (mss *MySQLStorage) DelFromMap(table string, key string, objectKey string) error {
-	columns := SplitToParts(key)
-
-	if len(columns) > NumberOfColumns {
-		return errors.New("Too many data columns")
-	}
-
-	hashes := CalculateHashesOfColumns(columns)
-	tableHash := CalculateHash(table)
-	objectKeyHash := CalculateHash(objectKey)
+// dataSourceName builds the data source name of credentials, registering
+// their TLS configuration with the driver if they have one.
+func (mss *MySQLStorage) dataSourceName(credentials map[string]string) (string, error) {
+	url := credentials["url"]
+	username := credentials["username"]
+	password := credentials["password"]
+	dbname := credentials["dbname"]
 
-	clause := CreateWhereClause(columns, hashes)
+	dataSourceName := username + ":" + password + url + "/" + dbname
 
-	sql := "DELETE FROM maps WHERE table_hash = " + fmt.Sprint(tableHash) + " AND object_key_hash = " + fmt.Sprint(objectKeyHash)
+	tlsConfig, err := ParseTLSConfig(credentials)
 
-	if clause != "" {
-		sql += " AND " + clause
+	if err != nil || tlsConfig == nil {
+		return dataSourceName, err
 	}
 
-	_, err := mss.Connection.Exec(sql)
+	config, err := mysql.ParseDSN(dataSourceName)
 
 	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (mss *MySQLStorage) GetFromMap(table string, key string, objectKey string) (string, error) {
-	columns := SplitToParts(key)
-
-	if len(columns) > NumberOfColumns {
-		return "", errors.New("Too many data columns")
+		return "", fmt.Errorf("Invalid MySQL url or dbname: %w", err)
 	}
 
-	hashes := CalculateHashesOfColumns(columns)
-	tableHash := CalculateHash(table)
-	objectKeyHash := CalculateHash(objectKey)
-
-	clause := CreateWhereClause(columns, hashes)
-
-	sql := "SELECT `value` FROM maps WHERE table_hash = " + fmt.Sprint(tableHash) + " AND object_key_hash = " + fmt.Sprint(objectKeyHash)
-
-	if clause != "" {
-		sql += " AND " + clause
-	}
+	name := "netclave-" + strconv.FormatInt(atomic.AddInt64(&mySQLTLSConfigs, 1), 10)
 
-	row, err := mss.Connection.Query(sql)
+	err = mysql.RegisterTLSConfig(name, tlsConfig)
 
 	if err != nil {
 		return "", err
 	}
 
-	defer row.Close()
-	for row.Next() { // Iterate and fetch the records from result cursor
-		var value string
-		row.Scan(&value)
+	mss.tlsConfigNames = append(mss.tlsConfigNames, name)
+	config.TLSConfig = name
 
-		return value, nil
-	}
-
-	return "", nil
+	return config.FormatDSN(), nil
 }
-func (mss *MySQLStorage) GetMap(table string, key string) (map[string]string, error) {
-	result := map[string]string{}
-
-	columns := SplitToParts(key)
-
-	if len(columns) > NumberOfColumns {
-		return nil, errors.New("Too many data columns")
-	}
-
-	hashes := CalculateHashesOfColumns(columns)
-	tableHash := CalculateHash(table)
-
-	clause := CreateWhereClause(columns, hashes)
 
-	sql := "SELECT object_key, `value` FROM maps WHERE table_hash = " + fmt.Sprint(tableHash)
-
-	if clause != "" {
-		sql += " AND " + clause
+func (mss *MySQLStorage) deregisterTLSConfigs() {
+	for _, name := range mss.tlsConfigNames {
+		mysql.DeregisterTLSConfig(name)
 	}
 
-	row, err := mss.Connection.Query(sql)
+	mss.tlsConfigNames = nil
+}
 
-	if err != nil {
-		return nil, err
-	}
+func (mss *MySQLStorage) Destroy() error {
+	mss.stopReaper()
 
-	defer row.Close()
-	for row.Next() { // Iterate and fetch the records from result cursor
-		var value string
-		var objectKey string
-		row.Scan(&objectKey, &value)
+	err := mss.closeConnections() // Defer Closing the database
 
-		result[objectKey] = value
-	}
+	mss.deregisterTLSConfigs()
 
-	return result, nil
+	return err
 }
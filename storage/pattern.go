@@ -0,0 +1,186 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"errors"
+	"path"
+	"strings"
+)
+
+// PATTERN_SYNTAX is the credentials key choosing how GetKeys, ScanKeys and
+// Watch read their patterns.
+//
+// PATTERN_SYNTAX_PREFIX, the default, keeps the meaning patterns always had: a
+// pattern also matches every key below a key it matches, and trailing "*"
+// segments are ignored, so "a" and "a/*" both match "a", "a/b" and "a/b/c",
+// and "*" matches every key.
+//
+// PATTERN_SYNTAX_GLOB matches the whole key, so "a/*" matches "a/b" but
+// neither "a" nor "a/b/c", while "a/**" matches all three, and "**" matches
+// every key.
+var PATTERN_SYNTAX = "patternsyntax"
+var PATTERN_SYNTAX_PREFIX = "prefix"
+var PATTERN_SYNTAX_GLOB = "glob"
+
+// ParsePatternSyntax reads the pattern syntax from credentials.
+func ParsePatternSyntax(credentials map[string]string) (string, error) {
+	syntax := credentials[PATTERN_SYNTAX]
+
+	switch syntax {
+	case "":
+		return PATTERN_SYNTAX_PREFIX, nil
+	case PATTERN_SYNTAX_PREFIX, PATTERN_SYNTAX_GLOB:
+		return syntax, nil
+	default:
+		return "", errors.New("Unknown pattern syntax " + syntax)
+	}
+}
+
+// Pattern is a compiled GetKeys pattern. Patterns are matched segment by
+// segment, with "/" always separating segments:
+//
+//   - "*" matches any run of characters within a segment, as in "user-*"
+//     or "*.pem"
+//   - "?" matches any single character
+//   - "[abc]" matches one of the listed characters, ranges such as "[a-z]"
+//     are allowed and "[^abc]" negates the class
+//   - "\x" matches the character x itself, for a literal "*", "?", "[" or "\"
+//   - "**" as a whole segment matches any number of segments, including none
+//
+// Whether the pattern must match the whole key depends on its syntax, see
+// PATTERN_SYNTAX.
+type Pattern struct {
+	segments []string
+}
+
+var multiSegmentWildcard = "**"
+
+// CompilePattern parses pattern with PATTERN_SYNTAX_PREFIX and reports
+// malformed character classes or escapes.
+func CompilePattern(pattern string) (*Pattern, error) {
+	return CompilePatternSyntax(pattern, PATTERN_SYNTAX_PREFIX)
+}
+
+// CompilePatternSyntax parses pattern with syntax, one of PATTERN_SYNTAX_PREFIX
+// and PATTERN_SYNTAX_GLOB. An empty syntax is PATTERN_SYNTAX_PREFIX.
+func CompilePatternSyntax(pattern string, syntax string) (*Pattern, error) {
+	segments := SplitToParts(pattern)
+
+	switch syntax {
+	case "", PATTERN_SYNTAX_PREFIX:
+		for len(segments) > 0 && segments[len(segments)-1] == "*" {
+			segments = segments[:len(segments)-1]
+		}
+
+		segments = append(segments, multiSegmentWildcard)
+	case PATTERN_SYNTAX_GLOB:
+	default:
+		return nil, errors.New("Unknown pattern syntax " + syntax)
+	}
+
+	for _, segment := range segments {
+		if segment == multiSegmentWildcard {
+			continue
+		}
+
+		_, err := path.Match(segment, "")
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Pattern{
+		segments: segments,
+	}, nil
+}
+
+// Match reports whether key matches the pattern.
+func (p *Pattern) Match(key string) bool {
+	keyParts := SplitToParts(key)
+
+	// The classic wildcard algorithm, with "**" as the star and whole
+	// segments as characters: on a mismatch, let the last "**" swallow one
+	// more segment and retry from there.
+	patternIndex, keyIndex := 0, 0
+	starIndex, starKeyIndex := -1, 0
+
+	for keyIndex < len(keyParts) {
+		if patternIndex < len(p.segments) && p.segments[patternIndex] == multiSegmentWildcard {
+			starIndex = patternIndex
+			starKeyIndex = keyIndex
+			patternIndex++
+			continue
+		}
+
+		if patternIndex < len(p.segments) && matchSegment(p.segments[patternIndex], keyParts[keyIndex]) {
+			patternIndex++
+			keyIndex++
+			continue
+		}
+
+		if starIndex < 0 {
+			return false
+		}
+
+		starKeyIndex++
+		patternIndex = starIndex + 1
+		keyIndex = starKeyIndex
+	}
+
+	for patternIndex < len(p.segments) && p.segments[patternIndex] == multiSegmentWildcard {
+		patternIndex++
+	}
+
+	return patternIndex == len(p.segments)
+}
+
+func matchSegment(pattern string, segment string) bool {
+	matched, err := path.Match(pattern, segment)
+
+	return err == nil && matched
+}
+
+// Prefix returns the leading segments of the pattern that contain no
+// wildcards. Every key matching the pattern is the prefix itself or lies
+// below it, which lets backends narrow their scans.
+func (p *Pattern) Prefix() string {
+	literal := []string{}
+
+	for _, segment := range p.segments {
+		if strings.ContainsAny(segment, `*?[\`) {
+			break
+		}
+
+		literal = append(literal, segment)
+	}
+
+	return strings.Join(literal, "/")
+}
+
+// MatchPattern reports whether key matches pattern, read with
+// PATTERN_SYNTAX_PREFIX. A malformed pattern matches nothing.
+func MatchPattern(pattern string, key string) bool {
+	compiled, err := CompilePattern(pattern)
+
+	if err != nil {
+		return false
+	}
+
+	return compiled.Match(key)
+}
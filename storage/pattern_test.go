@@ -0,0 +1,175 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"testing"
+)
+
+func TestGlobPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		match   bool
+	}{
+		{"*", "a", true},
+		{"*", "a/b", false},
+		{"**", "a", true},
+		{"**", "a/b/c", true},
+		{"a", "a", true},
+		{"a", "a/b", false},
+		{"a", "b", false},
+		{"a/*", "a", false},
+		{"a/*", "a/b", true},
+		{"a/*", "a/b/c", false},
+		{"a/**", "a", true},
+		{"a/**", "a/b/c", true},
+		{"a/**", "ab", false},
+		{"a/*/c", "a/b/c", true},
+		{"a/*/c", "a/b/d", false},
+		{"**/c", "c", true},
+		{"**/c", "a/b/c", true},
+		{"**/c", "a/b/c/d", false},
+		{"a/**/c/**/e", "a/b/c/d/e", true},
+		{"a/**/c/**/e", "a/c/e", true},
+		{"a/**/c/**/e", "a/b/d/e", false},
+		{"user-*", "user-1", true},
+		{"user-*", "user-", true},
+		{"user-*", "admin-1", false},
+		{"*.pem", "key.pem", true},
+		{"*.pem", "dir/key.pem", false},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"a?c", "a/c", false},
+		{"[ab]x", "bx", true},
+		{"[ab]x", "cx", false},
+		{"[a-c]x", "cx", true},
+		{"[^a-c]x", "cx", false},
+		{"[^a-c]x", "dx", true},
+		{`\*`, "*", true},
+		{`\*`, "a", false},
+		{"", "", true},
+		{"", "a", false},
+		{"[", "[", false},
+	}
+
+	for _, test := range tests {
+		compiled, err := CompilePatternSyntax(test.pattern, PATTERN_SYNTAX_GLOB)
+
+		if err != nil {
+			if test.match {
+				t.Errorf("CompilePatternSyntax(%q): %v", test.pattern, err)
+			}
+
+			continue
+		}
+
+		if compiled.Match(test.key) != test.match {
+			t.Errorf("Match(%q, %q) = %v", test.pattern, test.key, !test.match)
+		}
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		match   bool
+	}{
+		{"*", "a", true},
+		{"*", "a/b", true},
+		{"**", "a/b/c", true},
+		{"a", "a", true},
+		{"a", "a/b", true},
+		{"a", "ab", false},
+		{"a", "b", false},
+		{"a/*", "a", true},
+		{"a/*", "a/b", true},
+		{"a/*", "a/b/c", true},
+		{"a/*/*", "a", true},
+		{"a/*/c", "a/b/c", true},
+		{"a/*/c", "a/b/c/d", true},
+		{"a/*/c", "a/b", false},
+		{"user-*", "user-1/key", true},
+		{"*.pem", "dir/key.pem", false},
+		{"", "", true},
+		{"", "a", false},
+		{"[", "[", false},
+	}
+
+	for _, test := range tests {
+		if MatchPattern(test.pattern, test.key) != test.match {
+			t.Errorf("MatchPattern(%q, %q) = %v", test.pattern, test.key, !test.match)
+		}
+	}
+}
+
+func TestParsePatternSyntax(t *testing.T) {
+	syntax, err := ParsePatternSyntax(map[string]string{})
+
+	if err != nil || syntax != PATTERN_SYNTAX_PREFIX {
+		t.Errorf("default syntax = %q, %v", syntax, err)
+	}
+
+	syntax, err = ParsePatternSyntax(map[string]string{PATTERN_SYNTAX: PATTERN_SYNTAX_GLOB})
+
+	if err != nil || syntax != PATTERN_SYNTAX_GLOB {
+		t.Errorf("glob syntax = %q, %v", syntax, err)
+	}
+
+	_, err = ParsePatternSyntax(map[string]string{PATTERN_SYNTAX: "regexp"})
+
+	if err == nil {
+		t.Error("expected an unknown syntax to be rejected")
+	}
+}
+
+func TestCompilePatternRejectsMalformedPatterns(t *testing.T) {
+	for _, pattern := range []string{"[", "a/[b", `a\`, "[a-]"} {
+		_, err := CompilePattern(pattern)
+
+		if err == nil {
+			t.Errorf("CompilePattern(%q) succeeded", pattern)
+		}
+	}
+}
+
+func TestPatternPrefix(t *testing.T) {
+	tests := map[string]string{
+		"**":         "",
+		"a":          "a",
+		"a/b/*":      "a/b",
+		"a/b*/c":     "a",
+		"a/**/c":     "a",
+		"a/[b]/c":    "a",
+		`a/\*/c`:     "a",
+		"a/b?":       "a",
+		"tenant/a/b": "tenant/a/b",
+	}
+
+	for pattern, prefix := range tests {
+		compiled, err := CompilePattern(pattern)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if compiled.Prefix() != prefix {
+			t.Errorf("Prefix of %q = %q, want %q", pattern, compiled.Prefix(), prefix)
+		}
+	}
+}
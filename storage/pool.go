@@ -0,0 +1,233 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credentials keys which tune the connection pool of a backend. They are read
+// by Create, so every storage created with them honours the settings.
+var MAX_OPEN_CONNS = "maxopenconns"
+var MAX_IDLE_CONNS = "maxidleconns"
+var CONN_MAX_LIFETIME = "connmaxlifetime"
+
+type PoolOptions struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// ParsePoolOptions reads the pool settings from credentials. Missing values
+// are left as zero, which keeps the driver defaults.
+func ParsePoolOptions(credentials map[string]string) (*PoolOptions, error) {
+	options := &PoolOptions{}
+
+	var err error
+
+	if value := credentials[MAX_OPEN_CONNS]; value != "" {
+		options.MaxOpenConns, err = strconv.Atoi(value)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if value := credentials[MAX_IDLE_CONNS]; value != "" {
+		options.MaxIdleConns, err = strconv.Atoi(value)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if value := credentials[CONN_MAX_LIFETIME]; value != "" {
+		options.ConnMaxLifetime, err = time.ParseDuration(value)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return options, nil
+}
+
+type storagePool struct {
+	mutex    sync.Mutex
+	storages map[string]*poolEntry
+}
+
+// poolEntry is a pooled backend with the number of GenericStorage values
+// holding it.
+type poolEntry struct {
+	key     string
+	storage Storage
+	refs    int
+}
+
+var pool = &storagePool{
+	storages: map[string]*poolEntry{},
+}
+
+func poolKey(credentials map[string]string, storageType string) string {
+	names := []string{}
+
+	for name := range credentials {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var builder strings.Builder
+
+	builder.WriteString(storageType)
+
+	for _, name := range names {
+		builder.WriteString("\x00" + name + "=" + credentials[name])
+	}
+
+	return builder.String()
+}
+
+// get returns the backend for the credentials and type of gs, creating it on
+// first use, and makes gs hold a reference to it until it is released.
+func (p *storagePool) get(gs *GenericStorage) (Storage, error) {
+	key := poolKey(gs.Credentials, gs.StorageType)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	entry, ok := p.storages[key]
+
+	if !ok {
+		storage, err := p.create(gs.Credentials, gs.StorageType)
+
+		if err != nil {
+			return nil, err
+		}
+
+		entry = &poolEntry{key: key, storage: storage}
+		p.storages[key] = entry
+	}
+
+	// gs may still hold the backend of other credentials, or one ClosePool
+	// dropped.
+	if gs.entry != entry {
+		if gs.entry != nil {
+			if storage := p.unref(gs.entry); storage != nil {
+				storage.Destroy()
+			}
+		}
+
+		entry.refs++
+		gs.entry = entry
+	}
+
+	return entry.storage, nil
+}
+
+func (p *storagePool) create(credentials map[string]string, storageType string) (Storage, error) {
+	cacheOptions, err := ParseCacheOptions(credentials)
+
+	if err != nil {
+		return nil, err
+	}
+
+	storage, err := CreateStorage(credentials, storageType, false)
+
+	if err != nil {
+		// Release whatever was opened before the failure.
+		if storage != nil {
+			storage.Destroy()
+		}
+
+		return nil, err
+	}
+
+	// The cache lives as long as the pooled backend, so that every
+	// GenericStorage with the same credentials shares it.
+	if cacheOptions.MaxEntries > 0 {
+		storage = NewCachedStorage(storage, cacheOptions)
+	}
+
+	return storage, nil
+}
+
+// unref drops a reference to entry and returns its backend if that was the
+// last one and the backend is to be destroyed. p.mutex must be held.
+func (p *storagePool) unref(entry *poolEntry) Storage {
+	entry.refs--
+
+	if entry.refs > 0 || p.storages[entry.key] != entry {
+		return nil
+	}
+
+	delete(p.storages, entry.key)
+
+	return entry.storage
+}
+
+// release drops the reference gs holds, destroying the backend once no
+// GenericStorage holds it anymore.
+func (p *storagePool) release(gs *GenericStorage) error {
+	p.mutex.Lock()
+	entry := gs.entry
+	gs.entry = nil
+
+	var storage Storage
+
+	if entry != nil {
+		storage = p.unref(entry)
+	}
+
+	p.mutex.Unlock()
+
+	if storage == nil {
+		return nil
+	}
+
+	return storage.Destroy()
+}
+
+func (p *storagePool) closeAll() error {
+	p.mutex.Lock()
+	storages := p.storages
+	p.storages = map[string]*poolEntry{}
+	p.mutex.Unlock()
+
+	var result error
+
+	for _, entry := range storages {
+		err := entry.storage.Destroy()
+
+		if err != nil && result == nil {
+			result = err
+		}
+	}
+
+	return result
+}
+
+// ClosePool destroys every backend opened through GenericStorage. Backends
+// are opened again on the next use, so this is meant for process shutdown.
+func ClosePool() error {
+	return pool.closeAll()
+}
@@ -0,0 +1,226 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestGenericStorage(t *testing.T, extra map[string]string) *GenericStorage {
+	dir, err := ioutil.TempDir("", "netclave-pool")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credentials := map[string]string{
+		"filename": filepath.Join(dir, "storage.db"),
+	}
+
+	for key, value := range extra {
+		credentials[key] = value
+	}
+
+	gs := &GenericStorage{
+		Credentials: credentials,
+		StorageType: SQLITE_STORAGE,
+	}
+
+	t.Cleanup(func() {
+		gs.Close()
+		os.RemoveAll(dir)
+	})
+
+	err = gs.Init()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return gs
+}
+
+func TestParsePoolOptions(t *testing.T) {
+	options, err := ParsePoolOptions(map[string]string{
+		MAX_OPEN_CONNS:    "8",
+		MAX_IDLE_CONNS:    "2",
+		CONN_MAX_LIFETIME: "5m",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if options.MaxOpenConns != 8 || options.MaxIdleConns != 2 || options.ConnMaxLifetime != 5*time.Minute {
+		t.Errorf("unexpected options %+v", options)
+	}
+
+	_, err = ParsePoolOptions(map[string]string{MAX_OPEN_CONNS: "many"})
+
+	if err == nil {
+		t.Error("expected an error for a non numeric value")
+	}
+}
+
+func TestGenericStorageReusesBackend(t *testing.T) {
+	gs := newTestGenericStorage(t, map[string]string{MAX_OPEN_CONNS: "3"})
+
+	first, err := gs.getStorage()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := &GenericStorage{
+		Credentials: map[string]string{},
+		StorageType: gs.StorageType,
+	}
+
+	for key, value := range gs.Credentials {
+		other.Credentials[key] = value
+	}
+
+	second, err := other.getStorage()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first != second {
+		t.Error("expected equal credentials to share a backend")
+	}
+
+	stats := first.(*SQLiteStorage).Connection.Stats()
+
+	if stats.MaxOpenConnections != 3 {
+		t.Errorf("MaxOpenConnections = %d, want 3", stats.MaxOpenConnections)
+	}
+
+	err = gs.SetKey("pool", "key", "value", 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = gs.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := other.GetKey("pool", "key")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value != "value" {
+		t.Errorf("GetKey after Close = %q", value)
+	}
+
+	third, err := other.getStorage()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if third != first {
+		t.Error("expected Close to keep the backend other still holds")
+	}
+
+	err = other.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool.mutex.Lock()
+	_, ok := pool.storages[poolKey(gs.Credentials, gs.StorageType)]
+	pool.mutex.Unlock()
+
+	if ok {
+		t.Error("expected the last Close to drop the pooled backend")
+	}
+
+	fourth, err := gs.getStorage()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fourth == first {
+		t.Error("expected a closed GenericStorage to reopen the backend")
+	}
+
+	// Closing twice releases a single reference.
+	gs.Close()
+	gs.Close()
+}
+
+func TestGenericStorageCreateFailure(t *testing.T) {
+	gs := &GenericStorage{
+		Credentials: map[string]string{
+			"filename":     filepath.Join(os.TempDir(), "netclave-pool-failure.db"),
+			MAX_OPEN_CONNS: "many",
+		},
+		StorageType: SQLITE_STORAGE,
+	}
+
+	defer os.Remove(gs.Credentials["filename"])
+
+	_, err := gs.getStorage()
+
+	if err == nil {
+		t.Fatal("expected an invalid pool setting to fail")
+	}
+
+	pool.mutex.Lock()
+	_, ok := pool.storages[poolKey(gs.Credentials, gs.StorageType)]
+	pool.mutex.Unlock()
+
+	if ok || gs.entry != nil {
+		t.Error("expected a failed backend to be left out of the pool")
+	}
+}
+
+func TestClosePool(t *testing.T) {
+	gs := newTestGenericStorage(t, nil)
+
+	err := gs.SetKey("pool", "key", "value", 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ClosePool()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool.mutex.Lock()
+	size := len(pool.storages)
+	pool.mutex.Unlock()
+
+	if size != 0 {
+		t.Errorf("pool still holds %d backends", size)
+	}
+}
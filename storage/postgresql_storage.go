@@ -17,602 +17,319 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
-	"math"
 	"strconv"
+	"strings"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type PostgreSQLStorage struct {
-	Connection *sql.DB
+	sqlStorage
+	// dataSourceName is kept for the connections of Watch, which pq
+	// listeners open themselves.
+	dataSourceName string
 }
 
 func (pss *PostgreSQLStorage) Setup(credentials map[string]string) error {
 	return nil
 }
 
-func (pss *PostgreSQLStorage) executeSingleQuery(query string) error {
-	statement, err := pss.Connection.Prepare(query) // Prepare SQL Statement
+func (pss *PostgreSQLStorage) Init() error {
+	_, err := pss.Migrate(context.Background())
+
 	if err != nil {
 		return err
 	}
 
-	_, err = statement.Exec() // Execute SQL Statements
-
-	return err
+	return pss.setupWatch(context.Background())
 }
 
-func (pss *PostgreSQLStorage) Init() error {
-	keysTableSQL := `CREATE TABLE IF NOT EXISTS keys (
-		 "id" BIGSERIAL NOT NULL PRIMARY KEY,		
-		 "table" TEXT,
-		 "table_hash" BIGINT,
-		 "key" TEXT,
-		 `
-
-	keysUniqueIndexValues := ""
-
-	for i := 1; i <= NumberOfColumns; i++ {
-		keysTableSQL += `"column_` + strconv.Itoa(i) + `_hash" BIGINT,
-		 `
-
-		keysUniqueIndexValues = keysUniqueIndexValues + "column_" + strconv.Itoa(i) + "_hash"
-
-		if i != NumberOfColumns {
-			keysUniqueIndexValues = keysUniqueIndexValues + ", "
-		}
+// postgreSQLMigrations lists the schema changes of PostgreSQLStorage, oldest first.
+func postgreSQLMigrations() []sqlMigration {
+	// The "C" collation compares keys byte by byte, the same way the other
+	// backends do, which GetKeys relies on for its prefix ranges.
+	tables := []string{`CREATE TABLE IF NOT EXISTS keys (
+		 "id" BIGSERIAL NOT NULL PRIMARY KEY,
+		 "table" TEXT COLLATE "C" NOT NULL,
+		 "key" TEXT COLLATE "C" NOT NULL,
+		 "value" TEXT,
+		 "ttl" BIGINT)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS ` + keysUniqueIndex + ` ON keys("table", "key")`,
+		`CREATE INDEX IF NOT EXISTS keys_expiry_index ON keys(ttl)`,
+		`CREATE TABLE IF NOT EXISTS maps (
+		 "id" BIGSERIAL NOT NULL PRIMARY KEY,
+		 "table" TEXT COLLATE "C" NOT NULL,
+		 "key" TEXT COLLATE "C" NOT NULL,
+		 "object_key" TEXT COLLATE "C" NOT NULL,
+		 "value" TEXT)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS ` + mapsUniqueIndex + ` ON maps("table", "key", "object_key")`,
+	}
+
+	mapExpiry := []sqlColumn{
+		{table: "maps", name: "ttl", definition: "BIGINT NOT NULL DEFAULT " + strconv.FormatInt(neverExpires, 10)},
+		{table: "maps", name: "map_ttl", definition: "BIGINT NOT NULL DEFAULT " + strconv.FormatInt(neverExpires, 10)},
+	}
+
+	return []sqlMigration{
+		{version: 1, description: "create keys and maps tables", apply: createTables(tables)},
+		{version: 2, description: "add expiration of map fields", apply: addColumns(mapExpiry)},
+		{version: 3, description: "index expiration of map fields", apply: addIndexes(mapExpiryIndexes)},
 	}
+}
 
-	keysUniqueIndexValues += ", table_hash"
+// postgreSQLWatchSchema creates the triggers sending the changes as
+// notifications. A notification carries at most 8000 bytes, the changes of
+// longer keys are not sent.
+func postgreSQLWatchSchema() func(ctx context.Context, mt *migrationTx) error {
+	return createWatchSchema(nil, postgreSQLDialect{}, func(trigger sqlChangeTrigger) []string {
+		condition := "octet_length(payload) < 8000"
 
-	keysTableSQL += `"value" TEXT,
-		 "ttl" BIGINT,		
-		CONSTRAINT columns_unique_key UNIQUE(` + keysUniqueIndexValues + `));`
+		if trigger.condition != "" {
+			condition += " AND (" + trigger.condition + ")"
+		}
 
-	log.Println(keysTableSQL)
+		return []string{`CREATE OR REPLACE FUNCTION ` + trigger.name + `() RETURNS trigger AS $$
+		BEGIN
+			PERFORM pg_notify('` + watchChannel + `', payload) FROM (SELECT json_build_object(
+				'type', ` + trigger.event + `,
+				'table', ` + trigger.row + `."table",
+				'key', ` + trigger.row + `."key")::TEXT AS payload) AS notification
+			WHERE ` + condition + `;
+			RETURN NULL;
+		END
+		$$ LANGUAGE plpgsql`,
+			"CREATE TRIGGER " + trigger.name + " AFTER " + trigger.operation + " ON " + trigger.table +
+				" FOR EACH ROW EXECUTE PROCEDURE " + trigger.name + "()"}
+	})
+}
 
-	err := pss.executeSingleQuery(keysTableSQL)
+func (pss *PostgreSQLStorage) Create(credentials map[string]string) error {
+	psqlconn, err := postgreSQLDataSourceName(credentials)
 
 	if err != nil {
 		return err
 	}
 
-	keysTableSQL = `CREATE INDEX IF NOT EXISTS table_hash_index ON keys(table_hash);`
+	pss.dialect = postgreSQLDialect{}
+	pss.migrations = postgreSQLMigrations()
+	pss.watchSchema = postgreSQLWatchSchema()
+	pss.dataSourceName = psqlconn
 
-	err = pss.executeSingleQuery(keysTableSQL)
+	pss.watchOptions, err = ParseWatchOptions(credentials)
 
 	if err != nil {
 		return err
 	}
 
-	for i := 1; i <= NumberOfColumns; i++ {
-		keysTableSQL = `CREATE INDEX IF NOT EXISTS column_` + strconv.Itoa(i) + `_hash_index ON keys(column_` + strconv.Itoa(i) + `_hash);`
-
-		err = pss.executeSingleQuery(keysTableSQL)
-
-		if err != nil {
-			return err
-		}
-	}
-
-	keysTableSQL = `CREATE INDEX IF NOT EXISTS ttl_index ON keys(ttl);`
-
-	err = pss.executeSingleQuery(keysTableSQL)
+	pss.patternSyntax, err = ParsePatternSyntax(credentials)
 
 	if err != nil {
 		return err
 	}
 
-	mapsTableSQL := `CREATE TABLE IF NOT EXISTS maps (
-		 "id" BIGSERIAL NOT NULL PRIMARY KEY,		
-		 "table" TEXT,
-		 "table_hash" BIGINT,
-		 "key" TEXT,
-		 `
-
-	mapKeysUniqueIndexValues := ""
-
-	for i := 1; i <= NumberOfColumns; i++ {
-		mapsTableSQL += `"column_` + strconv.Itoa(i) + `_hash" BIGINT,
-		 `
-
-		mapKeysUniqueIndexValues = mapKeysUniqueIndexValues + "column_" + strconv.Itoa(i) + "_hash"
-
-		if i != NumberOfColumns {
-			mapKeysUniqueIndexValues = mapKeysUniqueIndexValues + ", "
-		}
-	}
-
-	mapKeysUniqueIndexValues += ", table_hash"
-	mapKeysUniqueIndexValues += ", object_key_hash"
-
-	mapsTableSQL += `"value" TEXT,
-		 "object_key" TEXT,		
-		 "object_key_hash" BIGINT,		
-		CONSTRAINT map_columns_unique_key UNIQUE(` + mapKeysUniqueIndexValues + `));`
-
-	log.Println(mapsTableSQL)
-
-	err = pss.executeSingleQuery(mapsTableSQL)
-
+	pss.Connection, err = sql.Open("postgres", psqlconn)
 	if err != nil {
 		return err
 	}
 
-	mapsTableSQL = `CREATE INDEX IF NOT EXISTS table_hash_index ON maps(table_hash);`
-
-	err = pss.executeSingleQuery(mapsTableSQL)
+	err = pss.configurePool(credentials)
 
 	if err != nil {
+		pss.Connection.Close()
 		return err
 	}
 
-	for i := 1; i <= NumberOfColumns; i++ {
-		mapsTableSQL = `CREATE INDEX IF NOT EXISTS column_` + strconv.Itoa(i) + `_hash_index ON maps(column_` + strconv.Itoa(i) + `_hash);`
-
-		err = pss.executeSingleQuery(mapsTableSQL)
+	err = pss.openReplica("postgres", credentials, postgreSQLDataSourceName)
 
-		if err != nil {
-			return err
-		}
+	if err != nil {
+		pss.closeConnections()
+		return err
 	}
 
-	log.Println("Before creating an index for object key hash")
-
-	mapsTableSQL = `CREATE INDEX IF NOT EXISTS object_key_hash_index ON maps(object_key_hash);`
-
-	err = pss.executeSingleQuery(mapsTableSQL)
+	err = pss.startReaper(credentials)
 
 	if err != nil {
+		pss.closeConnections()
 		return err
 	}
 
-	LastTruncate = 0
-
 	return nil
 }
 
-func (pss *PostgreSQLStorage) Create(credentials map[string]string) error {
-	var err error
-
+func postgreSQLDataSourceName(credentials map[string]string) (string, error) {
 	host := credentials["host"]
 	port := credentials["port"]
 	user := credentials["user"]
 	password := credentials["password"]
 	dbname := credentials["dbname"]
-	sslmode := credentials["sslmode"]
-
-	psqlconn := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s", host, port, user, password, dbname, sslmode)
-
-	pss.Connection, err = sql.Open("postgres", psqlconn)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (pss *PostgreSQLStorage) Destroy() error {
-	return pss.Connection.Close()
-}
 
-func (pss *PostgreSQLStorage) GetKeys(table string, pattern string) ([]string, error) {
-	err := pss.KeysCleanUp()
+	sslOptions, err := postgreSQLSSLOptions(credentials)
 
 	if err != nil {
-		return nil, err
-	}
-
-	keys := []string{}
-
-	columns := SplitToParts(pattern)
-
-	if len(columns) > NumberOfColumns {
-		return nil, errors.New("Too many data columns")
-	}
-
-	hashes := CalculateHashesOfColumns(columns)
-	tableHash := CalculateHash(table)
-
-	clause := CreateWhereClause(columns, hashes)
-
-	sql := "SELECT \"table\", \"key\", ttl FROM keys WHERE table_hash = " + fmt.Sprint(tableHash)
-
-	if clause != "" {
-		sql += " AND " + clause
-	}
-
-	now := time.Now().UnixNano() / int64(time.Millisecond)
-
-	row, err := pss.Connection.Query(sql)
-
-	if err != nil {
-		return nil, err
-	}
-
-	defer row.Close()
-	for row.Next() {
-		var table string
-		var key string
-		var ttl int64
-		row.Scan(&table, &key, &ttl)
-
-		if ttl >= now {
-			keys = append(keys, table+"/"+key)
-		}
-	}
-
-	sql = "SELECT \"table\", \"key\" FROM maps WHERE table_hash = " + fmt.Sprint(tableHash)
-
-	if clause != "" {
-		sql += " AND " + clause
-	}
-
-	now = time.Now().UnixNano() / int64(time.Millisecond)
-
-	row, err = pss.Connection.Query(sql)
-
-	if err != nil {
-		return nil, err
-	}
-
-	defer row.Close()
-	for row.Next() { // Iterate and fetch the records from result cursor
-		var table string
-		var key string
-		row.Scan(&table, &key)
-
-		keys = append(keys, table+"/"+key)
+		return "", err
 	}
 
-	return keys, nil
+	return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s", host, port, user, password, dbname) + sslOptions, nil
 }
 
-func (pss *PostgreSQLStorage) SetKey(table string, key string, value string, expiration time.Duration) error {
-	err := pss.KeysCleanUp()
-
-	if err != nil {
-		return err
-	}
-
-	columns := SplitToParts(key)
-
-	if len(columns) > NumberOfColumns {
-		return errors.New("Too many data columns")
-	}
-
-	hashes := CalculateHashesOfColumns(columns)
-	tableHash := CalculateHash(table)
-
-	sql := "INSERT INTO keys (\"table\", table_hash, key,"
-
-	keysUniqueIndexValues := ""
-
-	for i := 1; i <= NumberOfColumns; i++ {
-		sql += " column_" + strconv.Itoa(i) + "_hash,"
-	}
-
-	sql += " value, ttl) VALUES ('" + table + "', " + fmt.Sprint(tableHash) + ", '" + key + "',"
-
-	hashesLen := len(hashes)
-
-	for i := 1; i <= NumberOfColumns; i++ {
-		if i <= hashesLen {
-			sql += " " + fmt.Sprint(hashes[i-1]) + ","
-		} else {
-			sql += " 0,"
-		}
-
-		keysUniqueIndexValues = keysUniqueIndexValues + "column_" + strconv.Itoa(i) + "_hash"
-
-		if i != NumberOfColumns {
-			keysUniqueIndexValues = keysUniqueIndexValues + ", "
-		}
-	}
-
-	keysUniqueIndexValues += ", table_hash"
-
-	until := time.Now().Add(expiration)
-
-	if expiration.Milliseconds() <= 0 {
-		until = time.Unix(0, int64(math.MaxInt64))
-	}
-
-	untilMilliseconds := until.UnixNano() / int64(time.Millisecond)
-
-	sql += " '" + value + "', " + strconv.FormatInt(untilMilliseconds, 10) + ")"
-
-	sql += " ON CONFLICT(" + keysUniqueIndexValues + ") DO UPDATE SET value = EXCLUDED.value, ttl = EXCLUDED.ttl"
-
-	//log.Println(sql)
-
-	_, err = pss.Connection.Exec(sql)
-
-	return err
+// postgreSQLSSLModes are the values of "sslmode" pq supports. An empty one
+// stands for require.
+var postgreSQLSSLModes = map[string]bool{
+	"disable":     true,
+	"require":     true,
+	"verify-ca":   true,
+	"verify-full": true,
 }
 
-func (pss *PostgreSQLStorage) GetFullKey(key string) (string, error) {
-	parts := SplitToParts(key)
-
-	table := parts[0]
-
-	newKey := ""
+var postgreSQLQuoter = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
 
-	partsLen := len(parts)
-
-	for i := 1; i < partsLen; i++ {
-		newKey = newKey + parts[i]
+// postgreSQLSSLOptions returns the connection options of "sslmode" and of the
+// TLS credentials, see ParseTLSConfig, which pq takes as the files libpq
+// reads: "sslrootcert", "sslcert" and "sslkey". The key file must not be
+// readable by others. With TLS credentials the mode defaults to verify-full,
+// or to require if verification is skipped, and the server certificate is
+// checked against "host".
+func postgreSQLSSLOptions(credentials map[string]string) (string, error) {
+	sslmode := credentials["sslmode"]
 
-		if i+1 < partsLen {
-			newKey += "/"
-		}
+	if sslmode != "" && !postgreSQLSSLModes[sslmode] {
+		return "", fmt.Errorf("Unsupported PostgreSQL sslmode %q, expected disable, require, verify-ca or verify-full", sslmode)
 	}
 
-	return pss.GetKey(table, newKey)
-}
-
-func (pss *PostgreSQLStorage) GetKey(table string, key string) (string, error) {
-	err := pss.KeysCleanUp()
+	// pq would only read the files when it connects.
+	tlsConfig, err := ParseTLSConfig(credentials)
 
 	if err != nil {
 		return "", err
 	}
 
-	columns := SplitToParts(key)
-
-	if len(columns) > NumberOfColumns {
-		return "", errors.New("Too many data columns")
+	if tlsConfig == nil {
+		return " sslmode=" + sslmode, nil
 	}
 
-	hashes := CalculateHashesOfColumns(columns)
-	tableHash := CalculateHash(table)
-
-	clause := CreateWhereClause(columns, hashes)
-
-	sql := "SELECT \"value\", \"ttl\" FROM keys WHERE table_hash = " + fmt.Sprint(tableHash)
-
-	if clause != "" {
-		sql += " AND " + clause
+	if credentials[TLS_SERVER_NAME] != "" {
+		return "", errors.New("PostgreSQL checks the server certificate against the host, " + TLS_SERVER_NAME + " is not supported")
 	}
 
-	now := time.Now().UnixNano() / int64(time.Millisecond)
-
-	row, err := pss.Connection.Query(sql)
-
-	if err != nil {
-		return "", err
+	switch {
+	case sslmode == "disable":
+		return "", errors.New("PostgreSQL sslmode disable conflicts with the TLS credentials")
+	case sslmode == "" && tlsConfig.InsecureSkipVerify:
+		sslmode = "require"
+	case sslmode == "":
+		sslmode = "verify-full"
+	case tlsConfig.InsecureSkipVerify && sslmode != "require":
+		return "", errors.New("PostgreSQL sslmode " + sslmode + " conflicts with " + TLS_INSECURE_SKIP_VERIFY)
 	}
 
-	defer row.Close()
-	for row.Next() { // Iterate and fetch the records from result cursor
-		var value string
-		var ttl int64
-		row.Scan(&value, &ttl)
+	options := " sslmode=" + sslmode
 
-		if ttl >= now {
-			return value, nil
-		}
+	files := []struct {
+		option string
+		key    string
+	}{
+		{"sslrootcert", TLS_CA_FILE},
+		{"sslcert", TLS_CERT_FILE},
+		{"sslkey", TLS_KEY_FILE},
 	}
 
-	return "", nil
-}
-
-func (pss *PostgreSQLStorage) KeysCleanUp() error {
-	now := time.Now().UnixNano() / int64(time.Millisecond)
-
-	if (now - LastTruncate) > TruncateInterval {
-		nowStr := fmt.Sprint(now)
-
-		log.Println(nowStr)
-
-		sql := "DELETE FROM keys WHERE ttl < " + nowStr
-
-		result, err := pss.Connection.Exec(sql)
-
-		if err != nil {
-			return err
-		}
-
-		truncatedRows, err := result.RowsAffected()
-
-		if err != nil {
-			return err
+	for _, file := range files {
+		if path := credentials[file.key]; path != "" {
+			options += " " + file.option + "='" + postgreSQLQuoter.Replace(path) + "'"
 		}
-
-		log.Printf("%d rows truncated\n", truncatedRows)
-
-		LastTruncate = now
-	}
-
-	return nil
-}
-
-func (pss *PostgreSQLStorage) DelKey(table string, key string) (int64, error) {
-	err := pss.KeysCleanUp()
-
-	if err != nil {
-		return 0, err
-	}
-
-	columns := SplitToParts(key)
-
-	if len(columns) > NumberOfColumns {
-		return -1, errors.New("Too many data columns")
-	}
-
-	hashes := CalculateHashesOfColumns(columns)
-	tableHash := CalculateHash(table)
-
-	clause := CreateWhereClause(columns, hashes)
-
-	sql := "DELETE FROM keys WHERE table_hash = " + fmt.Sprint(tableHash)
-
-	if clause != "" {
-		sql += " AND " + clause
-	}
-
-	res, err := pss.Connection.Exec(sql)
-
-	if err != nil {
-		return -1, err
 	}
 
-	return res.RowsAffected()
+	return options, nil
 }
 
-func (pss *PostgreSQLStorage) AddToMap(table string, key string, objectKey string, object string) error {
-	columns := SplitToParts(key)
-
-	if len(columns) > NumberOfColumns {
-		return errors.New("Too many data columns")
-	}
-
-	hashes := CalculateHashesOfColumns(columns)
-	tableHash := CalculateHash(table)
-	objectKeyHash := CalculateHash(objectKey)
-
-	sql := "INSERT INTO maps (\"table\", table_hash, key, object_key, object_key_hash,"
-
-	keysUniqueIndexValues := ""
-
-	for i := 1; i <= NumberOfColumns; i++ {
-		sql += " column_" + strconv.Itoa(i) + "_hash,"
-	}
-
-	sql += " value) VALUES ('" + table + "', " + fmt.Sprint(tableHash) + ", '" + key + "', '" + objectKey + "', " + fmt.Sprint(objectKeyHash) + ", "
-
-	hashesLen := len(hashes)
-
-	for i := 1; i <= NumberOfColumns; i++ {
-		if i <= hashesLen {
-			sql += " " + fmt.Sprint(hashes[i-1]) + ","
-		} else {
-			sql += " 0,"
-		}
-
-		keysUniqueIndexValues = keysUniqueIndexValues + "column_" + strconv.Itoa(i) + "_hash"
-
-		if i != NumberOfColumns {
-			keysUniqueIndexValues = keysUniqueIndexValues + ", "
-		}
-	}
-
-	keysUniqueIndexValues += ", table_hash"
-	keysUniqueIndexValues += ", object_key_hash"
-
-	sql += " '" + object + "')"
-
-	sql += " ON CONFLICT(" + keysUniqueIndexValues + ") DO UPDATE SET value = EXCLUDED.value"
-
-	//log.Println(sql)
-
-	_, err := pss.Connection.Exec(sql)
+func (pss *PostgreSQLStorage) Destroy() error {
+	pss.stopReaper()
 
-	return err
+	return pss.closeConnections()
 }
 
-func (pss *PostgreSQLStorage) DelFromMap(table string, key string, objectKey string) error {
-	columns := SplitToParts(key)
-
-	if len(columns) > NumberOfColumns {
-		return errors.New("Too many data columns")
-	}
-
-	hashes := CalculateHashesOfColumns(columns)
-	tableHash := CalculateHash(table)
-	objectKeyHash := CalculateHash(objectKey)
-
-	clause := CreateWhereClause(columns, hashes)
-
-	sql := "DELETE FROM maps WHERE table_hash = " + fmt.Sprint(tableHash) + " AND object_key_hash = " + fmt.Sprint(objectKeyHash)
-
-	if clause != "" {
-		sql += " AND " + clause
+// Watch listens for the notifications the triggers of the keys and maps tables
+// send, which WATCH creates, on a connection of its own. Changes made while the listener
+// reconnects are lost.
+func (pss *PostgreSQLStorage) Watch(ctx context.Context, table string, pattern string) (<-chan Event, error) {
+	if !pss.watchOptions.Enabled {
+		return nil, errWatchDisabled
 	}
 
-	_, err := pss.Connection.Exec(sql)
+	filter, err := newWatchFilter(table, pattern, pss.patternSyntax)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
-}
-
-func (pss *PostgreSQLStorage) GetFromMap(table string, key string, objectKey string) (string, error) {
-	columns := SplitToParts(key)
+	// Listen waits for as long as it takes to connect, give up on the first
+	// failure instead.
+	failed := make(chan error, 1)
 
-	if len(columns) > NumberOfColumns {
-		return "", errors.New("Too many data columns")
-	}
-
-	hashes := CalculateHashesOfColumns(columns)
-	tableHash := CalculateHash(table)
-	objectKeyHash := CalculateHash(objectKey)
+	listener := pq.NewListener(pss.dataSourceName, 100*time.Millisecond, 10*time.Second,
+		func(event pq.ListenerEventType, err error) {
+			if event == pq.ListenerEventConnectionAttemptFailed {
+				select {
+				case failed <- err:
+				default:
+				}
+			}
+		})
 
-	clause := CreateWhereClause(columns, hashes)
+	listening := make(chan error, 1)
 
-	sql := "SELECT \"value\" FROM maps WHERE table_hash = " + fmt.Sprint(tableHash) + " AND object_key_hash = " + fmt.Sprint(objectKeyHash)
+	go func() {
+		listening <- listener.Listen(watchChannel)
+	}()
 
-	if clause != "" {
-		sql += " AND " + clause
+	select {
+	case err = <-listening:
+	case err = <-failed:
+	case <-ctx.Done():
+		err = ctx.Err()
 	}
 
-	row, err := pss.Connection.Query(sql)
-
 	if err != nil {
-		return "", err
-	}
-
-	defer row.Close()
-	for row.Next() { // Iterate and fetch the records from result cursor
-		var value string
-		row.Scan(&value)
-
-		return value, nil
+		listener.Close()
+		return nil, err
 	}
 
-	return "", nil
-}
-func (pss *PostgreSQLStorage) GetMap(table string, key string) (map[string]string, error) {
-	result := map[string]string{}
+	events := make(chan Event, watchBufferSize)
 
-	columns := SplitToParts(key)
+	go func() {
+		defer close(events)
+		defer listener.Close()
 
-	if len(columns) > NumberOfColumns {
-		return nil, errors.New("Too many data columns")
-	}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case notification := <-listener.Notify:
+				// nil tells that the connection was established again.
+				if notification == nil {
+					continue
+				}
 
-	hashes := CalculateHashesOfColumns(columns)
-	tableHash := CalculateHash(table)
+				var event Event
 
-	clause := CreateWhereClause(columns, hashes)
+				err := json.Unmarshal([]byte(notification.Extra), &event)
 
-	sql := "SELECT object_key, \"value\" FROM maps WHERE table_hash = " + fmt.Sprint(tableHash)
+				if err != nil {
+					continue
+				}
 
-	if clause != "" {
-		sql += " AND " + clause
-	}
-
-	row, err := pss.Connection.Query(sql)
-
-	if err != nil {
-		return nil, err
-	}
-
-	defer row.Close()
-	for row.Next() { // Iterate and fetch the records from result cursor
-		var value string
-		var objectKey string
-		row.Scan(&objectKey, &value)
-
-		result[objectKey] = value
-	}
+				if filter.match(event) && !sendEvent(ctx, events, event) {
+					return
+				}
+			}
+		}
+	}()
 
-	return result, nil
+	return events, nil
 }
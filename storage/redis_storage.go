@@ -18,18 +18,472 @@ package storage
 
 import (
 	"context"
-	"fmt"
-	"log"
+	"errors"
+	"math"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/go-redis/redis"
+	"github.com/go-redis/redis/v8"
 )
 
+// redisMapSuffix ends the Redis names of maps, which keeps them apart from the
+// keys of the same name, since keys never contain a NUL byte.
+var redisMapSuffix = "\x00map"
+
+// redisMapName returns the Redis name of a map.
+func redisMapName(table string, key string) string {
+	return table + "/" + key + redisMapSuffix
+}
+
+// delKeyScript deletes a plain key but leaves any other type stored under
+// the name alone.
+var delKeyScript = redis.NewScript(`
+if redis.call("TYPE", KEYS[1]).ok == "string" then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// keyTTLScript returns the PTTL of a plain key, or -2 for a missing key or
+// another type.
+var keyTTLScript = redis.NewScript(`
+if redis.call("TYPE", KEYS[1]).ok == "string" then
+	return redis.call("PTTL", KEYS[1])
+end
+return -2
+`)
+
+// expireKeyScript makes a plain key expire after ARGV[1] milliseconds, or
+// never if that is zero, and returns whether there was such a key.
+var expireKeyScript = redis.NewScript(`
+if redis.call("TYPE", KEYS[1]).ok ~= "string" then
+	return 0
+end
+if tonumber(ARGV[1]) > 0 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+else
+	redis.call("PERSIST", KEYS[1])
+end
+return 1
+`)
+
+// redisNotInteger and redisOverflow are the replies of incrScript for the
+// values Incr rejects, which a successful INCRBY, an integer, can never be.
+var redisNotInteger = "not-integer"
+var redisOverflow = "overflow"
+
+// incrScript runs INCRBY ARGV[1] on KEYS[1] and makes a key it creates
+// expire after ARGV[2] milliseconds unless that is zero. Values which are
+// not integers the way INCRBY reads them, without a sign but "-" or leading
+// zeros, or lie outside int64 get redisNotInteger instead, and values outside
+// ARGV[3] to ARGV[4], those the increment would overflow, redisOverflow.
+// Lua numbers are doubles, so the decimal strings are compared instead and
+// the new value is returned as the string GET reads back.
+var incrScript = redis.NewScript(`
+local function compare(a, b)
+	local negative = string.sub(a, 1, 1) == "-"
+	if negative ~= (string.sub(b, 1, 1) == "-") then
+		return negative and -1 or 1
+	end
+	local sign = negative and -1 or 1
+	if #a ~= #b then
+		return #a < #b and -sign or sign
+	end
+	if a == b then
+		return 0
+	end
+	return a < b and -sign or sign
+end
+
+local current = redis.call("GET", KEYS[1])
+if current and current ~= "0" and not string.match(current, "^%-?[1-9]%d*$") then
+	return "` + redisNotInteger + `"
+end
+if current and (compare(current, "-9223372036854775808") < 0 or compare(current, "9223372036854775807") > 0) then
+	return "` + redisNotInteger + `"
+end
+if current and (compare(current, ARGV[3]) < 0 or compare(current, ARGV[4]) > 0) then
+	return "` + redisOverflow + `"
+end
+local created = current == false
+redis.call("INCRBY", KEYS[1], ARGV[1])
+if created and tonumber(ARGV[2]) > 0 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return redis.call("GET", KEYS[1])
+`)
+
+// compareAndSwapScript sets the plain key KEYS[1] to ARGV[2] if it holds
+// ARGV[1], keeping its expiration.
+var compareAndSwapScript = redis.NewScript(`
+if redis.call("TYPE", KEYS[1]).ok ~= "string" or redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+local ttl = redis.call("PTTL", KEYS[1])
+redis.call("SET", KEYS[1], ARGV[2])
+if ttl > 0 then
+	redis.call("PEXPIRE", KEYS[1], ttl)
+end
+return 1
+`)
+
+// Maps with expirations keep them in the hash itself, next to the fields, in
+// entries whose names start with a NUL byte: "\x00ttl\x00<field>" holds when a
+// field expires and "\x00map-ttl" when the whole map does, both in Unix
+// milliseconds of the server clock. "\x00expiring" marks such maps, so that
+// maps without expirations keep O(1) reads and writes. The key itself expires
+// when the map does or its last field, whichever comes first.
+var redisMapPrelude = `
+if redis.replicate_commands then
+	redis.replicate_commands()
+end
+
+local clock = redis.call("TIME")
+local now = tonumber(clock[1]) * 1000 + math.floor(tonumber(clock[2]) / 1000)
+
+local function expiring(key)
+	return redis.call("HEXISTS", key, "\0expiring") == 1
+end
+
+-- refresh drops the expired fields of an expiring map, deletes the map if no
+-- field is left and sets when the key expires. It returns whether the map is
+-- still there.
+local function refresh(key)
+	local entries = redis.call("HGETALL", key)
+	local fields, ttls, mapTTL = {}, {}, nil
+
+	for i = 1, #entries, 2 do
+		local name = entries[i]
+
+		if name == "\0map-ttl" then
+			mapTTL = tonumber(entries[i + 1])
+		elseif string.sub(name, 1, 5) == "\0ttl\0" then
+			ttls[string.sub(name, 6)] = tonumber(entries[i + 1])
+		elseif string.sub(name, 1, 1) ~= "\0" then
+			table.insert(fields, name)
+		end
+	end
+
+	if mapTTL ~= nil and mapTTL < now then
+		redis.call("DEL", key)
+		return false
+	end
+
+	local live, persistent, last, hasTTL = 0, false, 0, false
+
+	for _, name in ipairs(fields) do
+		local ttl = ttls[name]
+
+		if ttl == nil then
+			live = live + 1
+			persistent = true
+		elseif ttl < now then
+			redis.call("HDEL", key, name, "\0ttl\0" .. name)
+		else
+			live = live + 1
+			hasTTL = true
+
+			if ttl > last then
+				last = ttl
+			end
+		end
+	end
+
+	if live == 0 then
+		redis.call("DEL", key)
+		return false
+	end
+
+	local expireAt = nil
+
+	if not persistent then
+		expireAt = last
+	end
+
+	if mapTTL ~= nil and (expireAt == nil or mapTTL < expireAt) then
+		expireAt = mapTTL
+	end
+
+	if expireAt == nil then
+		redis.call("PERSIST", key)
+	else
+		redis.call("PEXPIREAT", key, string.format("%d", expireAt))
+	end
+
+	if mapTTL == nil and not hasTTL then
+		redis.call("HDEL", key, "\0expiring")
+	end
+
+	return true
+end
+`
+
+// addToMapScript stores ARGV[1] = ARGV[2] in the map KEYS[1], expiring after
+// ARGV[3] milliseconds unless that is zero. A map found expired is replaced.
+var addToMapScript = redis.NewScript(redisMapPrelude + `
+local key, field, expiration = KEYS[1], ARGV[1], tonumber(ARGV[3])
+
+if expiring(key) then
+	refresh(key)
+end
+
+redis.call("HSET", key, field, ARGV[2])
+
+if expiration > 0 then
+	redis.call("HSET", key, "\0ttl\0" .. field, string.format("%d", now + expiration), "\0expiring", "1")
+else
+	redis.call("HDEL", key, "\0ttl\0" .. field)
+end
+
+if expiring(key) then
+	refresh(key)
+end
+
+return 1
+`)
+
+// expireMapScript makes the map KEYS[1] expire after ARGV[1] milliseconds, or
+// never if that is zero or less.
+var expireMapScript = redis.NewScript(redisMapPrelude + `
+local key, expiration = KEYS[1], tonumber(ARGV[1])
+
+if redis.call("TYPE", key).ok ~= "hash" then
+	return 0
+end
+
+if expiring(key) and not refresh(key) then
+	return 0
+end
+
+if expiration > 0 then
+	redis.call("HSET", key, "\0map-ttl", string.format("%d", now + expiration), "\0expiring", "1")
+else
+	redis.call("HDEL", key, "\0map-ttl")
+end
+
+if expiring(key) then
+	refresh(key)
+end
+
+return 1
+`)
+
+// compareAndSwapInMapScript sets the field ARGV[1] of the map KEYS[1] to
+// ARGV[3] if it holds ARGV[2], leaving the expiration entries alone.
+var compareAndSwapInMapScript = redis.NewScript(redisMapPrelude + `
+local key, field = KEYS[1], ARGV[1]
+
+if redis.call("TYPE", key).ok ~= "hash" then
+	return 0
+end
+
+if expiring(key) and not refresh(key) then
+	return 0
+end
+
+if redis.call("HGET", key, field) ~= ARGV[2] then
+	return 0
+end
+
+redis.call("HSET", key, field, ARGV[3])
+
+return 1
+`)
+
+// delFromMapScript deletes the field ARGV[1] of the map KEYS[1], and the map
+// with it when only expiration entries would be left.
+var delFromMapScript = redis.NewScript(redisMapPrelude + `
+local key, field = KEYS[1], ARGV[1]
+
+redis.call("HDEL", key, field, "\0ttl\0" .. field)
+
+if expiring(key) then
+	refresh(key)
+end
+
+return 1
+`)
+
+// getMapScript returns the live fields of the map KEYS[1], or only ARGV[1]
+// if it is given, as a flat list of names and values.
+var getMapScript = redis.NewScript(`
+local key, only = KEYS[1], ARGV[1]
+
+if redis.call("HEXISTS", key, "\0expiring") == 0 then
+	if only == nil then
+		return redis.call("HGETALL", key)
+	end
+
+	local value = redis.call("HGET", key, only)
+
+	if value then
+		return {only, value}
+	end
+
+	return {}
+end
+
+local clock = redis.call("TIME")
+local now = tonumber(clock[1]) * 1000 + math.floor(tonumber(clock[2]) / 1000)
+
+local mapTTL = tonumber(redis.call("HGET", key, "\0map-ttl"))
+
+if mapTTL ~= nil and mapTTL < now then
+	return {}
+end
+
+local function live(name)
+	local ttl = tonumber(redis.call("HGET", key, "\0ttl\0" .. name))
+
+	return ttl == nil or ttl >= now
+end
+
+local result = {}
+
+if only ~= nil then
+	local value = redis.call("HGET", key, only)
+
+	if value and live(only) then
+		result = {only, value}
+	end
+
+	return result
+end
+
+local entries = redis.call("HGETALL", key)
+
+for i = 1, #entries, 2 do
+	local name = entries[i]
+
+	if string.sub(name, 1, 1) ~= "\0" and live(name) then
+		table.insert(result, name)
+		table.insert(result, entries[i + 1])
+	end
+end
+
+return result
+`)
+
+// mapTTLScript returns the milliseconds the map KEYS[1] has left, or -1 if it
+// has no expiration of its own, followed by the names of its live fields and
+// the milliseconds each has left, or -1. A missing map, or one without live
+// fields, is an empty list.
+var mapTTLScript = redis.NewScript(`
+local key = KEYS[1]
+
+if redis.call("TYPE", key).ok ~= "hash" then
+	return {}
+end
+
+local clock = redis.call("TIME")
+local now = tonumber(clock[1]) * 1000 + math.floor(tonumber(clock[2]) / 1000)
+
+local entries = redis.call("HGETALL", key)
+local fields, ttls, mapTTL = {}, {}, nil
+
+for i = 1, #entries, 2 do
+	local name = entries[i]
+
+	if name == "\0map-ttl" then
+		mapTTL = tonumber(entries[i + 1])
+	elseif string.sub(name, 1, 5) == "\0ttl\0" then
+		ttls[string.sub(name, 6)] = tonumber(entries[i + 1])
+	elseif string.sub(name, 1, 1) ~= "\0" then
+		table.insert(fields, name)
+	end
+end
+
+if mapTTL ~= nil and mapTTL < now then
+	return {}
+end
+
+local result = {-1}
+
+if mapTTL ~= nil then
+	result[1] = mapTTL - now
+end
+
+for _, name in ipairs(fields) do
+	local ttl = ttls[name]
+
+	if ttl == nil then
+		table.insert(result, name)
+		table.insert(result, -1)
+	elseif ttl >= now then
+		table.insert(result, name)
+		table.insert(result, ttl - now)
+	end
+end
+
+if #result == 1 then
+	return {}
+end
+
+return result
+`)
+
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// checkObjectKey rejects the field names reserved for expirations.
+func checkObjectKey(objectKey string) error {
+	if strings.HasPrefix(objectKey, "\x00") {
+		return errors.New("Object key can not start with a NUL byte")
+	}
+
+	return nil
+}
+
+// mapFields turns the flat list returned by getMapScript into a map.
+func mapFields(result interface{}, err error) (map[string]string, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	entries, ok := result.([]interface{})
+
+	if !ok {
+		return nil, errors.New("Unexpected map reply")
+	}
+
+	fields := map[string]string{}
+
+	for i := 0; i+1 < len(entries); i += 2 {
+		name, _ := entries[i].(string)
+		value, _ := entries[i+1].(string)
+
+		fields[name] = value
+	}
+
+	return fields, nil
+}
+
+// Credentials keys selecting how RedisStorage connects. REDIS_MODE is one
+// of the REDIS_MODE_ values, standalone by default. In the sentinel and
+// cluster modes "host" is a comma separated list of addresses, of the
+// sentinels or of cluster nodes to discover the others from. A cluster has
+// no databases but 0, so "db" may be left out.
+var REDIS_MODE = "mode"
+var REDIS_MASTER_NAME = "mastername"
+var REDIS_SENTINEL_PASSWORD = "sentinelpassword"
+
+var REDIS_MODE_STANDALONE = "standalone"
+var REDIS_MODE_SENTINEL = "sentinel"
+var REDIS_MODE_CLUSTER = "cluster"
+
+// RedisStorage keeps the tables in a Redis server, the master a set of
+// sentinels points to, or a cluster. In a cluster the keys of a table are
+// spread over the nodes, so a transaction is only atomic for keys in the
+// same hash slot, and GetKeys, ScanKeys, Tables and Watch visit every master.
+//
+// A key is stored under "table/key" and a map under the same name followed by
+// redisMapSuffix, so a key and a map of the same name are two Redis keys.
 type RedisStorage struct {
-	client *redis.Client
-	ctx    context.Context
+	client        redis.UniversalClient
+	db            int
+	patternSyntax string
 }
 
 func (rs *RedisStorage) Setup(credentials map[string]string) error {
@@ -41,43 +495,385 @@ func (rs *RedisStorage) Init() error {
 }
 
 func (rs *RedisStorage) Create(credentials map[string]string) error {
+	mode := credentials[REDIS_MODE]
+
+	if mode == "" {
+		mode = REDIS_MODE_STANDALONE
+	}
+
+	var db int64
+	var err error
 
-	db, err := strconv.ParseInt(credentials["db"], 10, 64)
+	if mode != REDIS_MODE_CLUSTER || credentials["db"] != "" {
+		db, err = strconv.ParseInt(credentials["db"], 10, 64)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	poolOptions, err := ParsePoolOptions(credentials)
 
 	if err != nil {
 		return err
 	}
 
-	rs.client = redis.NewClient(&redis.Options{
-		Addr:     credentials["host"],
-		Password: credentials["password"], // no password set
-		DB:       int(db),                 // use default DB
-	})
+	rs.patternSyntax, err = ParsePatternSyntax(credentials)
+
+	if err != nil {
+		return err
+	}
 
-	rs.ctx = context.Background()
+	tlsConfig, err := ParseTLSConfig(credentials)
+
+	if err != nil {
+		return err
+	}
+
+	addrs := strings.Split(credentials["host"], ",")
+
+	for i := range addrs {
+		addrs[i] = strings.TrimSpace(addrs[i])
+	}
+
+	// go-redis has no upper bound for idle connections, so MaxIdleConns is
+	// only honoured by the SQL backends.
+	switch mode {
+	case REDIS_MODE_STANDALONE:
+		rs.client = redis.NewClient(&redis.Options{
+			Addr:       credentials["host"],
+			Password:   credentials["password"], // no password set
+			DB:         int(db),                 // use default DB
+			PoolSize:   poolOptions.MaxOpenConns,
+			MaxConnAge: poolOptions.ConnMaxLifetime,
+			TLSConfig:  tlsConfig,
+		})
+	case REDIS_MODE_SENTINEL:
+		if credentials[REDIS_MASTER_NAME] == "" {
+			return errors.New("Redis sentinel mode needs " + REDIS_MASTER_NAME)
+		}
+
+		rs.client = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       credentials[REDIS_MASTER_NAME],
+			SentinelAddrs:    addrs,
+			SentinelPassword: credentials[REDIS_SENTINEL_PASSWORD],
+			Password:         credentials["password"],
+			DB:               int(db),
+			PoolSize:         poolOptions.MaxOpenConns,
+			MaxConnAge:       poolOptions.ConnMaxLifetime,
+			TLSConfig:        tlsConfig,
+		})
+	case REDIS_MODE_CLUSTER:
+		if db != 0 {
+			return errors.New("Redis cluster mode has no database but 0")
+		}
+
+		rs.client = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:      addrs,
+			Password:   credentials["password"],
+			PoolSize:   poolOptions.MaxOpenConns,
+			MaxConnAge: poolOptions.ConnMaxLifetime,
+			TLSConfig:  tlsConfig,
+		})
+	default:
+		return errors.New("Unknown Redis mode " + strconv.Quote(mode))
+	}
+
+	rs.db = int(db)
 
 	return nil
 }
 
+// masters returns a client of every master of a cluster, or the only client
+// otherwise.
+func (rs *RedisStorage) masters(ctx context.Context) ([]redis.UniversalClient, error) {
+	cluster, ok := rs.client.(*redis.ClusterClient)
+
+	if !ok {
+		return []redis.UniversalClient{rs.client}, nil
+	}
+
+	// ForEachMaster runs fn on the masters concurrently.
+	var mutex sync.Mutex
+
+	masters := []redis.UniversalClient{}
+
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, master *redis.Client) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		masters = append(masters, master)
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return masters, nil
+}
+
 func (rs *RedisStorage) Destroy() error {
+	if rs.client == nil {
+		return nil
+	}
+
 	return rs.client.Close()
 }
 
 func (rs *RedisStorage) GetKeys(table string, pattern string) ([]string, error) {
-	keysInterface, err := rs.client.Do(rs.ctx, "keys", table+"/"+pattern).Result()
+	return rs.GetKeysContext(context.Background(), table, pattern)
+}
+
+func (rs *RedisStorage) GetKeysContext(ctx context.Context, table string, pattern string) ([]string, error) {
+	return collectKeys(rs.ScanKeys(ctx, table, pattern, 0))
+}
+
+func (rs *RedisStorage) ScanKeys(ctx context.Context, table string, pattern string, batchSize int) (KeyIterator, error) {
+	compiled, err := CompilePatternSyntax(pattern, rs.patternSyntax)
+
 	if err != nil {
 		return nil, err
 	}
 
-	keysString := fmt.Sprintf("%v", keysInterface)
-	keysString = keysString[1 : len(keysString)-1]
-	keys := strings.Fields(keysString)
+	// SCAN only narrows the search down, its own glob dialect differs from
+	// ours.
+	prefix := table + "/"
+	match := redisGlobEscaper.Replace(prefix+compiled.Prefix()) + "*"
+	count := int64(scanBatchSize(batchSize))
+
+	masters, err := rs.masters(ctx)
 
-	return keys, nil
+	if err != nil {
+		return nil, err
+	}
+
+	// The masters are scanned one after the other.
+	var cursor uint64
+
+	return newBatchIterator(func() ([]string, bool, error) {
+		if len(masters) == 0 {
+			return nil, false, nil
+		}
+
+		found, next, err := masters[0].Scan(ctx, cursor, match, count).Result()
+
+		if err != nil {
+			return nil, false, err
+		}
+
+		cursor = next
+
+		if cursor == 0 {
+			masters = masters[1:]
+		}
+
+		keys := []string{}
+
+		for _, key := range found {
+			name := strings.TrimSuffix(key, redisMapSuffix)
+
+			if compiled.Match(strings.TrimPrefix(name, prefix)) {
+				keys = append(keys, name)
+			}
+		}
+
+		return keys, len(masters) > 0, nil
+	}), nil
+}
+
+// Tables scans the whole database, on every master of a cluster, skipping
+// keys without a "/" which other applications may keep there.
+func (rs *RedisStorage) Tables(ctx context.Context) ([]string, error) {
+	masters, err := rs.masters(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	found := map[string]bool{}
+
+	for _, master := range masters {
+		var cursor uint64
+
+		for {
+			keys, next, err := master.Scan(ctx, cursor, "*/*", int64(DefaultScanBatchSize)).Result()
+
+			if err != nil {
+				return nil, err
+			}
+
+			for _, key := range keys {
+				found[key[:strings.Index(key, "/")]] = true
+			}
+
+			cursor = next
+
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+
+	tables := []string{}
+
+	for table := range found {
+		tables = append(tables, table)
+	}
+
+	sort.Strings(tables)
+
+	return tables, nil
+}
+
+// redisEventTypes maps the keyspace notifications of the commands the storage
+// runs to events. Other notifications, of EXPIRE or PERSIST for instance,
+// come along with one of these.
+var redisEventTypes = map[string]EventType{
+	"set":     EventSet,
+	"incrby":  EventSet,
+	"hset":    EventSet,
+	"hdel":    EventSet,
+	"del":     EventDelete,
+	"expired": EventExpire,
+	"evicted": EventExpire,
+}
+
+// redisKeyspaceEvents are the notify-keyspace-events classes Watch needs:
+// keyspace notifications of generic, string and hash commands and of
+// expirations.
+var redisKeyspaceEvents = "Kg$hx"
+
+// Watch subscribes to the keyspace notifications of the table, which the
+// server only sends if notify-keyspace-events includes the classes "Kg$hx".
+// Watch checks that with CONFIG GET, unless the server does not allow it.
+// The map scripts write a map more than once, so its events may be repeated,
+// and a field which expires on its own is reported as a set once the next
+// access of the map removes it.
+func (rs *RedisStorage) Watch(ctx context.Context, table string, pattern string) (<-chan Event, error) {
+	filter, err := newWatchFilter(table, pattern, rs.patternSyntax)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := rs.client.ConfigGet(ctx, "notify-keyspace-events").Result()
+
+	if err == nil && len(config) == 2 {
+		flags, _ := config[1].(string)
+
+		if !redisKeyspaceEventsEnabled(flags) {
+			return nil, errors.New("Redis keyspace notifications are disabled, notify-keyspace-events must include " + redisKeyspaceEvents)
+		}
+	}
+
+	masters, err := rs.masters(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Keyspace notifications stay on the node of the key, so every master of
+	// a cluster is subscribed to.
+	prefix := "__keyspace@" + strconv.Itoa(rs.db) + "__:" + table + "/"
+	subscriptions := []*redis.PubSub{}
+
+	for _, master := range masters {
+		pubsub := master.PSubscribe(ctx, redisGlobEscaper.Replace(prefix)+"*")
+		subscriptions = append(subscriptions, pubsub)
+
+		// Wait for the subscription, so that no change made after Watch
+		// returns is missed.
+		_, err = pubsub.Receive(ctx)
+
+		if err != nil {
+			for _, subscription := range subscriptions {
+				subscription.Close()
+			}
+
+			return nil, err
+		}
+	}
+
+	events := make(chan Event, watchBufferSize)
+
+	var wg sync.WaitGroup
+
+	for _, pubsub := range subscriptions {
+		wg.Add(1)
+
+		go func(pubsub *redis.PubSub) {
+			defer wg.Done()
+			defer pubsub.Close()
+
+			forwardKeyspaceEvents(ctx, pubsub, prefix, filter, events)
+		}(pubsub)
+	}
+
+	go func() {
+		wg.Wait()
+		close(events)
+	}()
+
+	return events, nil
+}
+
+// forwardKeyspaceEvents sends the events of the notifications pubsub receives
+// until ctx is done.
+func forwardKeyspaceEvents(ctx context.Context, pubsub *redis.PubSub, prefix string, filter *watchFilter, events chan<- Event) {
+	messages := pubsub.Channel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case message, ok := <-messages:
+			if !ok {
+				return
+			}
+
+			eventType, known := redisEventTypes[message.Payload]
+
+			if !known {
+				continue
+			}
+
+			event := Event{
+				Type:  eventType,
+				Table: filter.table,
+				Key:   strings.TrimSuffix(strings.TrimPrefix(message.Channel, prefix), redisMapSuffix),
+			}
+
+			if filter.match(event) && !sendEvent(ctx, events, event) {
+				return
+			}
+		}
+	}
+}
+
+// redisKeyspaceEventsEnabled reports whether the notify-keyspace-events flags
+// cover what Watch needs, "A" standing for every class.
+func redisKeyspaceEventsEnabled(flags string) bool {
+	for _, class := range redisKeyspaceEvents {
+		if strings.ContainsRune(flags, class) {
+			continue
+		}
+
+		if class == 'K' || !strings.ContainsRune(flags, 'A') {
+			return false
+		}
+	}
+
+	return true
 }
 
 func (rs *RedisStorage) SetKey(table string, key string, value string, expiration time.Duration) error {
-	err := rs.client.Set(table+"/"+key, value, expiration).Err()
+	return rs.SetKeyContext(context.Background(), table, key, value, expiration)
+}
+
+func (rs *RedisStorage) SetKeyContext(ctx context.Context, table string, key string, value string, expiration time.Duration) error {
+	err := rs.client.Set(ctx, table+"/"+key, value, time.Duration(redisMilliseconds(expiration))*time.Millisecond).Err()
 	if err != nil {
 		return err
 	}
@@ -86,10 +882,14 @@ func (rs *RedisStorage) SetKey(table string, key string, value string, expiratio
 }
 
 func (rs *RedisStorage) GetFullKey(key string) (string, error) {
-	val, err := rs.client.Get(key).Result()
+	return rs.GetFullKeyContext(context.Background(), key)
+}
+
+func (rs *RedisStorage) GetFullKeyContext(ctx context.Context, key string) (string, error) {
+	val, err := rs.client.Get(ctx, key).Result()
 
 	if err != nil {
-		if err.Error() == redis.Nil.Error() {
+		if err == redis.Nil {
 			return "", nil
 		}
 
@@ -99,10 +899,14 @@ func (rs *RedisStorage) GetFullKey(key string) (string, error) {
 }
 
 func (rs *RedisStorage) GetKey(table string, key string) (string, error) {
-	val, err := rs.client.Get(table + "/" + key).Result()
+	return rs.GetKeyContext(context.Background(), table, key)
+}
+
+func (rs *RedisStorage) GetKeyContext(ctx context.Context, table string, key string) (string, error) {
+	val, err := rs.client.Get(ctx, table+"/"+key).Result()
 
 	if err != nil {
-		if err.Error() == redis.Nil.Error() {
+		if err == redis.Nil {
 			return "", nil
 		}
 
@@ -111,8 +915,144 @@ func (rs *RedisStorage) GetKey(table string, key string) (string, error) {
 	return val, nil
 }
 
+func (rs *RedisStorage) LookupKey(table string, key string) (string, error) {
+	return rs.LookupKeyContext(context.Background(), table, key)
+}
+
+func (rs *RedisStorage) LookupKeyContext(ctx context.Context, table string, key string) (string, error) {
+	val, err := rs.client.Get(ctx, table+"/"+key).Result()
+
+	if err == redis.Nil {
+		return "", ErrNotFound
+	}
+
+	return val, err
+}
+
+func (rs *RedisStorage) Exists(table string, key string) (bool, error) {
+	return rs.ExistsContext(context.Background(), table, key)
+}
+
+func (rs *RedisStorage) ExistsContext(ctx context.Context, table string, key string) (bool, error) {
+	_, err := rs.TTLContext(ctx, table, key)
+
+	if err == ErrNotFound {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (rs *RedisStorage) TTL(table string, key string) (time.Duration, error) {
+	return rs.TTLContext(context.Background(), table, key)
+}
+
+func (rs *RedisStorage) TTLContext(ctx context.Context, table string, key string) (time.Duration, error) {
+	ttl, err := keyTTLScript.Run(ctx, rs.client, []string{table + "/" + key}).Int64()
+
+	if err != nil {
+		return 0, err
+	}
+
+	switch ttl {
+	case -2:
+		return 0, ErrNotFound
+	case -1:
+		return NoExpiration, nil
+	}
+
+	return time.Duration(ttl) * time.Millisecond, nil
+}
+
+func (rs *RedisStorage) Expire(table string, key string, expiration time.Duration) (bool, error) {
+	return rs.ExpireContext(context.Background(), table, key, expiration)
+}
+
+func (rs *RedisStorage) ExpireContext(ctx context.Context, table string, key string, expiration time.Duration) (bool, error) {
+	found, err := expireKeyScript.Run(ctx, rs.client, []string{table + "/" + key}, redisMilliseconds(expiration)).Int64()
+
+	if err != nil {
+		return false, err
+	}
+
+	return found == 1, nil
+}
+
+func (rs *RedisStorage) Persist(table string, key string) (bool, error) {
+	return rs.PersistContext(context.Background(), table, key)
+}
+
+func (rs *RedisStorage) PersistContext(ctx context.Context, table string, key string) (bool, error) {
+	return rs.ExpireContext(ctx, table, key, 0)
+}
+
+func (rs *RedisStorage) Incr(table string, key string, delta int64, expiration time.Duration) (int64, error) {
+	return rs.IncrContext(context.Background(), table, key, delta, expiration)
+}
+
+func (rs *RedisStorage) IncrContext(ctx context.Context, table string, key string, delta int64, expiration time.Duration) (int64, error) {
+	// The values delta can be added to without overflowing.
+	lower, upper := int64(math.MinInt64), int64(math.MaxInt64)
+
+	if delta > 0 {
+		upper -= delta
+	} else {
+		lower -= delta
+	}
+
+	result, err := incrScript.Run(ctx, rs.client, []string{table + "/" + key}, delta, redisMilliseconds(expiration),
+		strconv.FormatInt(lower, 10), strconv.FormatInt(upper, 10)).Result()
+
+	if err != nil {
+		return 0, err
+	}
+
+	value, _ := result.(string)
+
+	switch value {
+	case redisNotInteger:
+		return 0, ErrNotInteger
+	case redisOverflow:
+		return 0, ErrOverflow
+	}
+
+	incremented, err := strconv.ParseInt(value, 10, 64)
+
+	if err != nil {
+		return 0, errors.New("Unexpected INCRBY reply")
+	}
+
+	return incremented, nil
+}
+
+func (rs *RedisStorage) SetNX(table string, key string, value string, expiration time.Duration) (bool, error) {
+	return rs.SetNXContext(context.Background(), table, key, value, expiration)
+}
+
+func (rs *RedisStorage) SetNXContext(ctx context.Context, table string, key string, value string, expiration time.Duration) (bool, error) {
+	return rs.client.SetNX(ctx, table+"/"+key, value, time.Duration(redisMilliseconds(expiration))*time.Millisecond).Result()
+}
+
+func (rs *RedisStorage) CompareAndSwap(table string, key string, old string, new string) (bool, error) {
+	return rs.CompareAndSwapContext(context.Background(), table, key, old, new)
+}
+
+func (rs *RedisStorage) CompareAndSwapContext(ctx context.Context, table string, key string, old string, new string) (bool, error) {
+	swapped, err := compareAndSwapScript.Run(ctx, rs.client, []string{table + "/" + key}, old, new).Int64()
+
+	if err != nil {
+		return false, err
+	}
+
+	return swapped == 1, nil
+}
+
 func (rs *RedisStorage) DelKey(table string, key string) (int64, error) {
-	deleted, err := rs.client.Del(table + "/" + key).Result()
+	return rs.DelKeyContext(context.Background(), table, key)
+}
+
+func (rs *RedisStorage) DelKeyContext(ctx context.Context, table string, key string) (int64, error) {
+	deleted, err := delKeyScript.Run(ctx, rs.client, []string{table + "/" + key}).Int64()
 
 	if err != nil {
 		return -1, err
@@ -121,45 +1061,206 @@ func (rs *RedisStorage) DelKey(table string, key string) (int64, error) {
 }
 
 func (rs *RedisStorage) AddToMap(table string, key string, objectKey string, object string) error {
-	_, err := rs.client.HSet(table+"/"+key, objectKey, object).Result()
+	return rs.AddToMapContext(context.Background(), table, key, objectKey, object)
+}
+
+func (rs *RedisStorage) AddToMapContext(ctx context.Context, table string, key string, objectKey string, object string) error {
+	return rs.AddToMapWithTTLContext(ctx, table, key, objectKey, object, 0)
+}
+
+func (rs *RedisStorage) AddToMapWithTTL(table string, key string, objectKey string, object string, expiration time.Duration) error {
+	return rs.AddToMapWithTTLContext(context.Background(), table, key, objectKey, object, expiration)
+}
+
+func (rs *RedisStorage) AddToMapWithTTLContext(ctx context.Context, table string, key string, objectKey string, object string, expiration time.Duration) error {
+	err := checkObjectKey(objectKey)
 
 	if err != nil {
-		log.Println("Can not set map")
 		return err
 	}
 
-	return nil
+	return addToMapScript.Run(ctx, rs.client, []string{redisMapName(table, key)}, objectKey, object, redisMilliseconds(expiration)).Err()
+}
+
+// redisMilliseconds converts an expiration for Redis, where zero means none.
+// Negative ones become zero too, since go-redis sends -1 as KEEPTTL.
+func redisMilliseconds(expiration time.Duration) int64 {
+	if expiration.Milliseconds() <= 0 {
+		return 0
+	}
+
+	return expiration.Milliseconds()
+}
+
+func (rs *RedisStorage) CompareAndSwapInMap(table string, key string, objectKey string, old string, new string) (bool, error) {
+	return rs.CompareAndSwapInMapContext(context.Background(), table, key, objectKey, old, new)
+}
+
+func (rs *RedisStorage) CompareAndSwapInMapContext(ctx context.Context, table string, key string, objectKey string, old string, new string) (bool, error) {
+	err := checkObjectKey(objectKey)
+
+	if err != nil {
+		return false, err
+	}
+
+	swapped, err := compareAndSwapInMapScript.Run(ctx, rs.client, []string{redisMapName(table, key)}, objectKey, old, new).Int64()
+
+	if err != nil {
+		return false, err
+	}
+
+	return swapped == 1, nil
+}
+
+func (rs *RedisStorage) ExpireMap(table string, key string, expiration time.Duration) error {
+	return rs.ExpireMapContext(context.Background(), table, key, expiration)
+}
+
+func (rs *RedisStorage) ExpireMapContext(ctx context.Context, table string, key string, expiration time.Duration) error {
+	return expireMapScript.Run(ctx, rs.client, []string{redisMapName(table, key)}, redisMilliseconds(expiration)).Err()
+}
+
+func (rs *RedisStorage) MapTTL(table string, key string) (map[string]time.Duration, time.Duration, error) {
+	return rs.MapTTLContext(context.Background(), table, key)
+}
+
+func (rs *RedisStorage) MapTTLContext(ctx context.Context, table string, key string) (map[string]time.Duration, time.Duration, error) {
+	result, err := mapTTLScript.Run(ctx, rs.client, []string{redisMapName(table, key)}).Result()
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	entries, ok := result.([]interface{})
+
+	if !ok {
+		return nil, 0, errors.New("Unexpected map reply")
+	}
+
+	if len(entries) == 0 {
+		return nil, 0, ErrNotFound
+	}
+
+	remaining := func(entry interface{}) time.Duration {
+		ttl, _ := entry.(int64)
+
+		if ttl < 0 {
+			return NoExpiration
+		}
+
+		return time.Duration(ttl) * time.Millisecond
+	}
+
+	fields := map[string]time.Duration{}
+
+	for i := 1; i+1 < len(entries); i += 2 {
+		name, _ := entries[i].(string)
+
+		fields[name] = remaining(entries[i+1])
+	}
+
+	return fields, remaining(entries[0]), nil
 }
 
 func (rs *RedisStorage) DelFromMap(table string, key string, objectKey string) error {
-	_, err := rs.client.HDel(table+"/"+key, objectKey).Result()
+	return rs.DelFromMapContext(context.Background(), table, key, objectKey)
+}
 
-	return err
+func (rs *RedisStorage) DelFromMapContext(ctx context.Context, table string, key string, objectKey string) error {
+	err := checkObjectKey(objectKey)
+
+	if err != nil {
+		return err
+	}
+
+	return delFromMapScript.Run(ctx, rs.client, []string{redisMapName(table, key)}, objectKey).Err()
 }
 
 func (rs *RedisStorage) GetFromMap(table string, key string, objectKey string) (string, error) {
-	cmdResult, err := rs.client.HGet(table+"/"+key, objectKey).Result()
+	return rs.GetFromMapContext(context.Background(), table, key, objectKey)
+}
+
+func (rs *RedisStorage) GetFromMapContext(ctx context.Context, table string, key string, objectKey string) (string, error) {
+	err := checkObjectKey(objectKey)
 
 	if err != nil {
 		return "", err
 	}
 
-	value := cmdResult
+	fields, err := mapFields(getMapScript.Run(ctx, rs.client, []string{redisMapName(table, key)}, objectKey).Result())
+
+	if err != nil {
+		return "", err
+	}
 
-	return value, nil
+	return fields[objectKey], nil
 }
+
 func (rs *RedisStorage) GetMap(table string, key string) (map[string]string, error) {
-	cmdResult, err := rs.client.HGetAll(table + "/" + key).Result()
+	return rs.GetMapContext(context.Background(), table, key)
+}
+
+func (rs *RedisStorage) GetMapContext(ctx context.Context, table string, key string) (map[string]string, error) {
+	return mapFields(getMapScript.Run(ctx, rs.client, []string{redisMapName(table, key)}).Result())
+}
+
+func (rs *RedisStorage) Begin() (Tx, error) {
+	return rs.BeginContext(context.Background())
+}
+
+func (rs *RedisStorage) BeginContext(ctx context.Context) (Tx, error) {
+	return &redisTx{
+		pipe: rs.client.TxPipeline(),
+		ctx:  ctx,
+	}, nil
+}
+
+// redisTx queues commands client side and sends them wrapped in MULTI/EXEC
+// on Commit.
+type redisTx struct {
+	pipe redis.Pipeliner
+	ctx  context.Context
+}
+
+func (t *redisTx) SetKey(table string, key string, value string, expiration time.Duration) error {
+	return t.pipe.Set(t.ctx, table+"/"+key, value, time.Duration(redisMilliseconds(expiration))*time.Millisecond).Err()
+}
+
+func (t *redisTx) DelKey(table string, key string) error {
+	// EVALSHA cannot fall back to EVAL inside MULTI, so send the script.
+	return delKeyScript.Eval(t.ctx, t.pipe, []string{table + "/" + key}).Err()
+}
+
+func (t *redisTx) AddToMap(table string, key string, objectKey string, object string) error {
+	return t.AddToMapWithTTL(table, key, objectKey, object, 0)
+}
+
+func (t *redisTx) AddToMapWithTTL(table string, key string, objectKey string, object string, expiration time.Duration) error {
+	err := checkObjectKey(objectKey)
 
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	result := map[string]string{}
+	return addToMapScript.Eval(t.ctx, t.pipe, []string{redisMapName(table, key)}, objectKey, object, redisMilliseconds(expiration)).Err()
+}
+
+func (t *redisTx) DelFromMap(table string, key string, objectKey string) error {
+	err := checkObjectKey(objectKey)
 
-	for key, value := range cmdResult {
-		result[key] = value
+	if err != nil {
+		return err
 	}
 
-	return result, nil
+	return delFromMapScript.Eval(t.ctx, t.pipe, []string{redisMapName(table, key)}, objectKey).Err()
+}
+
+func (t *redisTx) Commit() error {
+	_, err := t.pipe.Exec(t.ctx)
+
+	return err
+}
+
+func (t *redisTx) Rollback() error {
+	return t.pipe.Discard()
 }
@@ -0,0 +1,104 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestRedisModes(t *testing.T) {
+	invalid := []map[string]string{
+		{"host": "localhost:6379", REDIS_MODE: "replicated", "db": "0"},
+		{"host": "localhost:26379", REDIS_MODE: REDIS_MODE_SENTINEL, "db": "0"},
+		{"host": "localhost:7000,localhost:7001", REDIS_MODE: REDIS_MODE_CLUSTER, "db": "1"},
+		{"host": "localhost:6379"},
+		{"host": "localhost:6379", "db": "0", TLS: "maybe"},
+	}
+
+	for _, credentials := range invalid {
+		rs := &RedisStorage{}
+
+		if rs.Create(credentials) == nil {
+			rs.Destroy()
+			t.Errorf("Create(%v) succeeded", credentials)
+		}
+	}
+
+	rs := &RedisStorage{}
+
+	err := rs.Create(map[string]string{
+		"host":            "localhost:26379, localhost:26380",
+		REDIS_MODE:        REDIS_MODE_SENTINEL,
+		REDIS_MASTER_NAME: "netclave",
+		"db":              "2",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rs.Destroy()
+
+	if rs.db != 2 {
+		t.Errorf("Sentinel database = %d", rs.db)
+	}
+}
+
+func TestRedisTLS(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := miniredis.RunTLS(&tls.Config{Certificates: []tls.Certificate{certificate}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+
+	storage, err := CreateStorage(map[string]string{
+		"host":      server.Addr(),
+		"db":        "0",
+		TLS_CA_FILE: certFile,
+	}, REDIS_STORAGE, true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer storage.Destroy()
+
+	err = storage.SetKey("table", "key", "value", 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := server.Get("table/key")
+
+	if err != nil || value != "value" {
+		t.Errorf("Stored value = %q, %v", value, err)
+	}
+}
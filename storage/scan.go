@@ -0,0 +1,126 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+// DefaultScanBatchSize is used by ScanKeys when batchSize is zero or less.
+var DefaultScanBatchSize = 1000
+
+// KeyIterator walks over the keys found by ScanKeys, fetching them from the
+// backend a batch at a time:
+//
+//	it, err := storage.ScanKeys(ctx, table, "**", 0)
+//	...
+//	defer it.Close()
+//	for it.Next() {
+//		key := it.Key()
+//	}
+//	err = it.Err()
+type KeyIterator interface {
+	// Next advances to the next key and reports whether there is one.
+	Next() bool
+	// Key returns the current key as "table/key".
+	Key() string
+	// Err returns the error that stopped the iteration, if any.
+	Err() error
+	Close() error
+}
+
+func scanBatchSize(batchSize int) int {
+	if batchSize <= 0 {
+		return DefaultScanBatchSize
+	}
+
+	return batchSize
+}
+
+// collectKeys drains it into a slice for GetKeys. A key can come up more than
+// once, for example when Redis rehashes during a SCAN, so duplicates are
+// dropped.
+func collectKeys(it KeyIterator, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	defer it.Close()
+
+	keys := []string{}
+	seen := map[string]struct{}{}
+
+	for it.Next() {
+		key := it.Key()
+
+		if _, ok := seen[key]; ok {
+			continue
+		}
+
+		seen[key] = struct{}{}
+		keys = append(keys, key)
+	}
+
+	return keys, it.Err()
+}
+
+// batchIterator serves keys from batches returned by fetch until fetch
+// reports that there are no more.
+type batchIterator struct {
+	fetch func() ([]string, bool, error)
+	batch []string
+	key   string
+	more  bool
+	err   error
+}
+
+func newBatchIterator(fetch func() (keys []string, more bool, err error)) *batchIterator {
+	return &batchIterator{
+		fetch: fetch,
+		more:  true,
+	}
+}
+
+func (it *batchIterator) Next() bool {
+	for len(it.batch) == 0 {
+		if !it.more || it.err != nil {
+			return false
+		}
+
+		it.batch, it.more, it.err = it.fetch()
+
+		if it.err != nil {
+			it.batch = nil
+		}
+	}
+
+	it.key = it.batch[0]
+	it.batch = it.batch[1:]
+
+	return true
+}
+
+func (it *batchIterator) Key() string {
+	return it.key
+}
+
+func (it *batchIterator) Err() error {
+	return it.err
+}
+
+func (it *batchIterator) Close() error {
+	it.batch = nil
+	it.more = false
+
+	return nil
+}
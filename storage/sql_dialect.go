@@ -0,0 +1,353 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"strconv"
+	"strings"
+)
+
+// sqlDialect holds everything that differs between the SQL backends when
+// building statements: identifier quoting, bind placeholders, upserts and
+// catalog lookups.
+type sqlDialect interface {
+	Quote(identifier string) string
+	Placeholder(position int) string
+	Upsert(conflictColumns []string, updateColumns []string) string
+	// InsertIgnore returns the clause which makes an INSERT skip rows
+	// conflicting on conflictColumns, so that it affects no rows for them.
+	InsertIgnore(conflictColumns []string) string
+	// TableExists returns a query counting the tables named by its only
+	// placeholder, ColumnExists, IndexExists and TriggerExists ones counting
+	// the columns, indexes and triggers named by the second placeholder on
+	// the table named by the first.
+	TableExists() string
+	ColumnExists() string
+	IndexExists() string
+	TriggerExists() string
+	// MaxKeyLength is the longest table, key or object key in bytes the
+	// schema can store, or 0 if there is no limit.
+	MaxKeyLength() int
+	// DeleteLimit reports whether DELETE takes a LIMIT clause. Without it,
+	// batches are deleted by the ids a limited subquery selects.
+	DeleteLimit() bool
+	// Now returns an expression of the current time in Unix milliseconds,
+	// for triggers, which can not be handed the time of the Go side.
+	Now() string
+	// LockSchema returns the statements taking and releasing a lock of the
+	// session which keeps other sessions from changing the schema until it
+	// is released, or empty strings if there is no such lock.
+	LockSchema() (string, string)
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Quote(identifier string) string {
+	return `"` + identifier + `"`
+}
+
+func (sqliteDialect) Placeholder(position int) string {
+	return "?"
+}
+
+func (d sqliteDialect) Upsert(conflictColumns []string, updateColumns []string) string {
+	return upsertOnConflict(d, conflictColumns, updateColumns)
+}
+
+func (d sqliteDialect) InsertIgnore(conflictColumns []string) string {
+	return doNothingOnConflict(d, conflictColumns)
+}
+
+func (sqliteDialect) TableExists() string {
+	return "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?"
+}
+
+func (sqliteDialect) ColumnExists() string {
+	return "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?"
+}
+
+func (sqliteDialect) IndexExists() string {
+	return "SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND name = ?"
+}
+
+func (sqliteDialect) TriggerExists() string {
+	return "SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND tbl_name = ? AND name = ?"
+}
+
+func (sqliteDialect) MaxKeyLength() int {
+	return 0
+}
+
+func (sqliteDialect) DeleteLimit() bool {
+	return false
+}
+
+func (sqliteDialect) Now() string {
+	return "CAST((julianday('now') - 2440587.5) * 86400000 AS INTEGER)"
+}
+
+// LockSchema has no lock to offer, SQLite runs one write transaction at a
+// time. Another process migrating the same file fails on the version the
+// first one recorded, and finds it migrated when it is started again.
+func (sqliteDialect) LockSchema() (string, string) {
+	return "", ""
+}
+
+type postgreSQLDialect struct{}
+
+func (postgreSQLDialect) Quote(identifier string) string {
+	return `"` + identifier + `"`
+}
+
+func (postgreSQLDialect) Placeholder(position int) string {
+	return "$" + strconv.Itoa(position)
+}
+
+func (d postgreSQLDialect) Upsert(conflictColumns []string, updateColumns []string) string {
+	return upsertOnConflict(d, conflictColumns, updateColumns)
+}
+
+func (d postgreSQLDialect) InsertIgnore(conflictColumns []string) string {
+	return doNothingOnConflict(d, conflictColumns)
+}
+
+func (postgreSQLDialect) TableExists() string {
+	return "SELECT COUNT(*) FROM pg_tables WHERE schemaname = current_schema() AND tablename = $1"
+}
+
+func (postgreSQLDialect) ColumnExists() string {
+	return "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2"
+}
+
+func (postgreSQLDialect) IndexExists() string {
+	return "SELECT COUNT(*) FROM pg_indexes WHERE schemaname = current_schema() AND tablename = $1 AND indexname = $2"
+}
+
+func (postgreSQLDialect) TriggerExists() string {
+	return "SELECT COUNT(*) FROM pg_trigger JOIN pg_class ON pg_class.oid = pg_trigger.tgrelid " +
+		"WHERE pg_class.relnamespace = current_schema()::regnamespace AND pg_class.relname = $1 AND pg_trigger.tgname = $2"
+}
+
+func (postgreSQLDialect) MaxKeyLength() int {
+	return 0
+}
+
+func (postgreSQLDialect) DeleteLimit() bool {
+	return false
+}
+
+// Now reads the clock rather than the start of the transaction, which may
+// have begun long before the change.
+func (postgreSQLDialect) Now() string {
+	return "(EXTRACT(EPOCH FROM clock_timestamp()) * 1000)::BIGINT"
+}
+
+// LockSchema takes an advisory lock, whose key is the hash of the name of the
+// schema version table. Advisory locks belong to a database.
+func (postgreSQLDialect) LockSchema() (string, string) {
+	key := strconv.FormatUint(uint64(CalculateHash(schemaVersionTable)), 10)
+
+	return "SELECT pg_advisory_lock(" + key + ")", "SELECT pg_advisory_unlock(" + key + ")"
+}
+
+type mySQLDialect struct{}
+
+func (mySQLDialect) Quote(identifier string) string {
+	return "`" + identifier + "`"
+}
+
+func (mySQLDialect) Placeholder(position int) string {
+	return "?"
+}
+
+func (d mySQLDialect) Upsert(conflictColumns []string, updateColumns []string) string {
+	updates := []string{}
+
+	for _, column := range updateColumns {
+		updates = append(updates, d.Quote(column)+" = VALUES("+d.Quote(column)+")")
+	}
+
+	return " ON DUPLICATE KEY UPDATE " + strings.Join(updates, ", ")
+}
+
+// InsertIgnore leaves conflicting rows as they are, which MySQL does not
+// count as affected. INSERT IGNORE would also hide other errors.
+func (d mySQLDialect) InsertIgnore(conflictColumns []string) string {
+	return " ON DUPLICATE KEY UPDATE " + d.Quote("id") + " = " + d.Quote("id")
+}
+
+func (mySQLDialect) TableExists() string {
+	return "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?"
+}
+
+func (mySQLDialect) ColumnExists() string {
+	return "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?"
+}
+
+func (mySQLDialect) IndexExists() string {
+	return "SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = ? AND index_name = ?"
+}
+
+func (mySQLDialect) TriggerExists() string {
+	return "SELECT COUNT(*) FROM information_schema.triggers WHERE trigger_schema = DATABASE() AND event_object_table = ? AND trigger_name = ?"
+}
+
+// MaxKeyLength keeps the unique index over table, key and object key of the
+// maps table within the 3072 byte limit of InnoDB.
+func (mySQLDialect) MaxKeyLength() int {
+	return 1024
+}
+
+// DeleteLimit is true because MySQL can neither limit an IN subquery nor
+// select from the table a DELETE removes rows from.
+func (mySQLDialect) DeleteLimit() bool {
+	return true
+}
+
+func (mySQLDialect) Now() string {
+	return "CAST(UNIX_TIMESTAMP(NOW(3)) * 1000 AS SIGNED)"
+}
+
+// LockSchema takes a named lock, which outlives the transactions DDL
+// statements commit. Named locks belong to the server, so the name is the
+// hash of the database and table, within the 64 characters a name may have.
+func (mySQLDialect) LockSchema() (string, string) {
+	name := "SHA1(CONCAT(DATABASE(), '." + schemaVersionTable + "'))"
+
+	return "SELECT GET_LOCK(" + name + ", -1)", "SELECT RELEASE_LOCK(" + name + ")"
+}
+
+func upsertOnConflict(dialect sqlDialect, conflictColumns []string, updateColumns []string) string {
+	conflicts := []string{}
+
+	for _, column := range conflictColumns {
+		conflicts = append(conflicts, dialect.Quote(column))
+	}
+
+	updates := []string{}
+
+	for _, column := range updateColumns {
+		updates = append(updates, dialect.Quote(column)+" = EXCLUDED."+dialect.Quote(column))
+	}
+
+	return " ON CONFLICT(" + strings.Join(conflicts, ", ") + ") DO UPDATE SET " + strings.Join(updates, ", ")
+}
+
+func doNothingOnConflict(dialect sqlDialect, conflictColumns []string) string {
+	conflicts := []string{}
+
+	for _, column := range conflictColumns {
+		conflicts = append(conflicts, dialect.Quote(column))
+	}
+
+	return " ON CONFLICT(" + strings.Join(conflicts, ", ") + ") DO NOTHING"
+}
+
+// sqlStatement accumulates query text together with its arguments, so that
+// data values only ever reach the database through bind placeholders.
+type sqlStatement struct {
+	dialect sqlDialect
+	query   strings.Builder
+	args    []interface{}
+}
+
+func newSQLStatement(dialect sqlDialect) *sqlStatement {
+	return &sqlStatement{
+		dialect: dialect,
+	}
+}
+
+func (st *sqlStatement) Write(parts ...string) *sqlStatement {
+	for _, part := range parts {
+		st.query.WriteString(part)
+	}
+
+	return st
+}
+
+func (st *sqlStatement) Quote(identifier string) string {
+	return st.dialect.Quote(identifier)
+}
+
+// Bind registers value as the next argument and returns its placeholder.
+func (st *sqlStatement) Bind(value interface{}) string {
+	st.args = append(st.args, value)
+
+	return st.dialect.Placeholder(len(st.args))
+}
+
+func (st *sqlStatement) BindList(values []interface{}) string {
+	placeholders := []string{}
+
+	for _, value := range values {
+		placeholders = append(placeholders, st.Bind(value))
+	}
+
+	return strings.Join(placeholders, ", ")
+}
+
+func (st *sqlStatement) QuoteList(identifiers []string) string {
+	quoted := []string{}
+
+	for _, identifier := range identifiers {
+		quoted = append(quoted, st.Quote(identifier))
+	}
+
+	return strings.Join(quoted, ", ")
+}
+
+// WhereKey appends the condition selecting exactly table and key.
+func (st *sqlStatement) WhereKey(table string, key string) *sqlStatement {
+	return st.Write(st.Quote("table"), " = ", st.Bind(table), " AND ", st.Quote("key"), " = ", st.Bind(key))
+}
+
+// WherePrefix appends the condition selecting the keys of table which are
+// prefix itself or lie below it. "/" is followed by "0" in byte order, so the
+// range holds exactly the keys starting with prefix + "/" and can be served
+// by the unique index.
+func (st *sqlStatement) WherePrefix(table string, prefix string) *sqlStatement {
+	st.Write(st.Quote("table"), " = ", st.Bind(table))
+
+	if prefix == "" {
+		return st
+	}
+
+	return st.Write(" AND (", st.Quote("key"), " = ", st.Bind(prefix), " OR (",
+		st.Quote("key"), " >= ", st.Bind(prefix+"/"), " AND ", st.Quote("key"), " < ", st.Bind(prefix+"0"), "))")
+}
+
+// LiveFields appends the condition selecting the map fields which have
+// expired neither on their own nor with their map.
+func (st *sqlStatement) LiveFields(now int64) *sqlStatement {
+	return st.Write(" AND ", st.Quote("ttl"), " >= ", st.Bind(now), " AND map_ttl >= ", st.Bind(now))
+}
+
+func (st *sqlStatement) Upsert(conflictColumns []string, updateColumns []string) *sqlStatement {
+	return st.Write(st.dialect.Upsert(conflictColumns, updateColumns))
+}
+
+func (st *sqlStatement) InsertIgnore(conflictColumns []string) *sqlStatement {
+	return st.Write(st.dialect.InsertIgnore(conflictColumns))
+}
+
+func (st *sqlStatement) String() string {
+	return st.query.String()
+}
+
+func (st *sqlStatement) Args() []interface{} {
+	return st.args
+}
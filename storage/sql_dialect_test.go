@@ -0,0 +1,425 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// sqliteCatalogDialect builds the statements of another dialect but asks the
+// catalog of SQLite, so that the migrations of PostgreSQL and MySQL can run
+// dry against a SQLite database.
+type sqliteCatalogDialect struct {
+	sqlDialect
+}
+
+func (sqliteCatalogDialect) TableExists() string {
+	return sqliteDialect{}.TableExists()
+}
+
+func (sqliteCatalogDialect) ColumnExists() string {
+	return sqliteDialect{}.ColumnExists()
+}
+
+func (sqliteCatalogDialect) IndexExists() string {
+	return sqliteDialect{}.IndexExists()
+}
+
+func (sqliteCatalogDialect) TriggerExists() string {
+	return sqliteDialect{}.TriggerExists()
+}
+
+// newDryRunStorage returns a storage of dialect over a SQLite database
+// created by schema, for dry runs only.
+func newDryRunStorage(t *testing.T, dialect sqlDialect, schema []string) *sqlStorage {
+	dir, err := ioutil.TempDir("", "netclave-storage")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "storage.db"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		db.Close()
+	})
+
+	for _, statement := range schema {
+		_, err = db.Exec(statement)
+
+		if err != nil {
+			t.Fatalf("%s: %v", statement, err)
+		}
+	}
+
+	return &sqlStorage{
+		Connection: db,
+		dialect:    sqliteCatalogDialect{dialect},
+	}
+}
+
+// planMigrations returns the statements of every migration of dialect, by
+// version, over a SQLite database created by schema.
+func planMigrations(t *testing.T, dialect sqlDialect, migrations []sqlMigration, schema []string) map[int][]string {
+	s := newDryRunStorage(t, dialect, schema)
+	s.migrations = migrations
+
+	planned, err := s.MigrateDryRun(context.Background())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statements := map[int][]string{}
+
+	for _, migration := range planned {
+		statements[migration.Version] = migration.Statements
+	}
+
+	return statements
+}
+
+// legacySchema is the layout with hash columns, reduced to what the
+// migrations look at.
+var legacySchema = []string{
+	`CREATE TABLE keys ("id" integer PRIMARY KEY, "table" TEXT, "table_hash" INTEGER, "key" TEXT, "value" TEXT, "ttl" INTEGER)`,
+	`CREATE TABLE maps ("id" integer PRIMARY KEY, "table" TEXT, "table_hash" INTEGER, "key" TEXT, "object_key" TEXT, "value" TEXT)`,
+}
+
+// checkLegacyMigration checks that the legacy tables are renamed, created
+// again with column, then copied and dropped.
+func checkLegacyMigration(t *testing.T, statements []string, d sqlDialect, column string) {
+	quote := d.Quote
+
+	if len(statements) < 6 {
+		t.Fatalf("Legacy migration = %q", statements)
+	}
+
+	renames := []string{
+		"ALTER TABLE " + quote("keys") + " RENAME TO " + quote("keys_legacy"),
+		"ALTER TABLE " + quote("maps") + " RENAME TO " + quote("maps_legacy"),
+	}
+
+	if !reflect.DeepEqual(statements[:2], renames) {
+		t.Errorf("Legacy migration starts with %q, want %q", statements[:2], renames)
+	}
+
+	created := map[string]bool{}
+
+	for _, statement := range statements[2 : len(statements)-4] {
+		for _, table := range legacyTables {
+			if strings.HasPrefix(statement, "CREATE TABLE IF NOT EXISTS "+quote(table)+" (") ||
+				strings.HasPrefix(statement, "CREATE TABLE IF NOT EXISTS "+table+" (") {
+				created[table] = true
+
+				if !strings.Contains(statement, quote("key")+" "+column) {
+					t.Errorf("%s lacks %s keys", statement, column)
+				}
+			}
+		}
+	}
+
+	if len(created) != len(legacyTables) {
+		t.Errorf("Legacy migration created %v", created)
+	}
+
+	copies := func(columns ...string) string {
+		quoted := []string{}
+
+		for _, name := range columns {
+			quoted = append(quoted, quote(name))
+		}
+
+		return strings.Join(quoted, ", ")
+	}
+
+	tail := []string{
+		"INSERT INTO " + quote("keys") + " (" + copies("table", "key", "value", "ttl") + ") SELECT " +
+			copies("table", "key", "value", "ttl") + " FROM " + quote("keys_legacy") + " WHERE 1 = 1" +
+			d.InsertIgnore([]string{"table", "key"}),
+		"DROP TABLE " + quote("keys_legacy"),
+		"INSERT INTO " + quote("maps") + " (" + copies("table", "key", "object_key", "value") + ") SELECT " +
+			copies("table", "key", "object_key", "value") + " FROM " + quote("maps_legacy") + " WHERE 1 = 1" +
+			d.InsertIgnore([]string{"table", "key", "object_key"}),
+		"DROP TABLE " + quote("maps_legacy"),
+	}
+
+	if !reflect.DeepEqual(statements[len(statements)-4:], tail) {
+		t.Errorf("Legacy migration ends with %q, want %q", statements[len(statements)-4:], tail)
+	}
+}
+
+func TestPostgreSQLMigratesLegacyLayoutToCollateC(t *testing.T) {
+	d := postgreSQLDialect{}
+	statements := planMigrations(t, d, postgreSQLMigrations(), legacySchema)
+
+	checkLegacyMigration(t, statements[1], d, `TEXT COLLATE "C" NOT NULL`)
+}
+
+func TestMySQLMigratesLegacyLayoutToVarbinary(t *testing.T) {
+	d := mySQLDialect{}
+	statements := planMigrations(t, d, mySQLMigrations(), legacySchema)
+
+	checkLegacyMigration(t, statements[1], d, "VARBINARY(1024) NOT NULL")
+}
+
+// A key the schema can not store stops the migration before any rename.
+func TestMySQLLegacyMigrationChecksKeyLengths(t *testing.T) {
+	schema := append([]string{}, legacySchema...)
+	schema = append(schema, `INSERT INTO maps ("table", "key", "object_key", "value") VALUES ('table', 'map', '`+strings.Repeat("x", 1025)+`', 'value')`)
+
+	s := newDryRunStorage(t, mySQLDialect{}, schema)
+	s.migrations = mySQLMigrations()
+
+	planned, err := s.MigrateDryRun(context.Background())
+
+	if err == nil || !strings.Contains(err.Error(), "object_key of 1025 bytes") {
+		t.Errorf("MigrateDryRun = %v, %v", planned, err)
+	}
+}
+
+// A migration which failed after renaming the keys table copies the renamed
+// table on the next attempt, without renaming the new one.
+func TestMySQLLegacyMigrationResumes(t *testing.T) {
+	schema := []string{
+		strings.Replace(legacySchema[0], "TABLE keys", "TABLE keys_legacy", 1),
+		legacySchema[1],
+		`CREATE TABLE keys ("id" integer PRIMARY KEY, "table" TEXT, "key" TEXT, "value" TEXT, "ttl" INTEGER)`,
+	}
+
+	d := mySQLDialect{}
+	statements := planMigrations(t, d, mySQLMigrations(), schema)
+
+	renames := 0
+
+	for _, statement := range statements[1] {
+		if strings.Contains(statement, "RENAME") {
+			renames++
+
+			if !strings.Contains(statement, d.Quote("maps")+" RENAME") {
+				t.Errorf("Resumed migration runs %s", statement)
+			}
+		}
+	}
+
+	if renames != 1 {
+		t.Errorf("Resumed migration renames %d tables", renames)
+	}
+
+	checkStatements(t, statements[1], []string{
+		"DROP TABLE " + d.Quote("keys_legacy"),
+		"DROP TABLE " + d.Quote("maps_legacy"),
+	})
+}
+
+func TestSQLMigrationsOfNewDatabases(t *testing.T) {
+	tests := []struct {
+		dialect    sqlDialect
+		migrations []sqlMigration
+	}{
+		{postgreSQLDialect{}, postgreSQLMigrations()},
+		{mySQLDialect{}, mySQLMigrations()},
+	}
+
+	for _, test := range tests {
+		statements := planMigrations(t, test.dialect, test.migrations, nil)
+
+		for _, statement := range statements[1] {
+			if strings.Contains(statement, "RENAME") || strings.Contains(statement, "_legacy") {
+				t.Errorf("%T migrates a new database with %s", test.dialect, statement)
+			}
+		}
+
+		// The tables are planned but not created, so the columns and
+		// indexes of the later migrations are planned too.
+		if len(statements[2]) != 2 || len(statements[3]) != 2 {
+			t.Errorf("%T plans %q and %q", test.dialect, statements[2], statements[3])
+		}
+	}
+}
+
+// planWatchSchema returns the statements watchSchema runs over a SQLite
+// database created by schema.
+func planWatchSchema(t *testing.T, dialect sqlDialect, watchSchema func(ctx context.Context, mt *migrationTx) error, schema []string) []string {
+	s := newDryRunStorage(t, dialect, schema)
+
+	tx, err := s.Connection.Begin()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer tx.Rollback()
+
+	mt := &migrationTx{s: s, tx: tx, dryRun: true}
+
+	err = watchSchema(context.Background(), mt)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return mt.statements
+}
+
+func TestMySQLChangeTriggers(t *testing.T) {
+	statements := planWatchSchema(t, mySQLDialect{}, mySQLWatchSchema(), nil)
+
+	now := "CAST(UNIX_TIMESTAMP(NOW(3)) * 1000 AS SIGNED)"
+
+	expected := []string{
+		"CREATE TRIGGER keys_insert_watch AFTER INSERT ON `keys` FOR EACH ROW " +
+			"INSERT INTO `changelog` (`table`, `key`, `event`, `created_at`) SELECT NEW.`table`, NEW.`key`, 'set', " + now + " FROM DUAL",
+		"CREATE TRIGGER keys_update_watch AFTER UPDATE ON `keys` FOR EACH ROW " +
+			"INSERT INTO `changelog` (`table`, `key`, `event`, `created_at`) SELECT NEW.`table`, NEW.`key`, 'set', " + now + " FROM DUAL" +
+			" WHERE NEW.`value` <> OLD.`value` OR NEW.`ttl` <> OLD.`ttl`",
+		"CREATE TRIGGER keys_delete_watch AFTER DELETE ON `keys` FOR EACH ROW " +
+			"INSERT INTO `changelog` (`table`, `key`, `event`, `created_at`) SELECT OLD.`table`, OLD.`key`, " +
+			"CASE WHEN OLD.`ttl` < " + now + " THEN 'expire' ELSE 'delete' END, " + now + " FROM DUAL",
+	}
+
+	checkStatements(t, statements, expected)
+
+	if len(statements) != len(sqlChangeTriggers(mySQLDialect{}))+1 ||
+		!strings.HasPrefix(statements[0], "CREATE TABLE IF NOT EXISTS `changelog` (") {
+		t.Errorf("Watch schema = %q", statements)
+	}
+}
+
+// Triggers are created only where the catalog lacks them.
+func TestSQLWatchSchemaKeepsTriggers(t *testing.T) {
+	schema := append([]string{}, legacySchema...)
+	schema = append(schema, `CREATE TRIGGER keys_insert_watch AFTER INSERT ON keys FOR EACH ROW BEGIN SELECT 1; END`)
+
+	statements := planWatchSchema(t, mySQLDialect{}, mySQLWatchSchema(), schema)
+
+	for _, statement := range statements {
+		if strings.Contains(statement, "keys_insert_watch") {
+			t.Errorf("Existing trigger created again with %s", statement)
+		}
+	}
+
+	if len(statements) != len(sqlChangeTriggers(mySQLDialect{})) {
+		t.Errorf("Watch schema = %q", statements)
+	}
+}
+
+func TestPostgreSQLChangeTriggers(t *testing.T) {
+	statements := planWatchSchema(t, postgreSQLDialect{}, postgreSQLWatchSchema(), nil)
+
+	expected := []string{
+		"CREATE TRIGGER maps_update_watch AFTER UPDATE ON maps FOR EACH ROW EXECUTE PROCEDURE maps_update_watch()",
+	}
+
+	checkStatements(t, statements, expected)
+
+	function := ""
+
+	for _, statement := range statements {
+		if strings.HasPrefix(statement, "CREATE OR REPLACE FUNCTION maps_update_watch()") {
+			function = statement
+		}
+	}
+
+	parts := []string{
+		"pg_notify('" + watchChannel + "', payload)",
+		`'table', NEW."table"`,
+		`WHERE octet_length(payload) < 8000 AND (NEW."value" <> OLD."value" OR NEW."ttl" <> OLD."ttl" OR NEW."map_ttl" <> OLD."map_ttl")`,
+	}
+
+	for _, part := range parts {
+		if !strings.Contains(function, part) {
+			t.Errorf("Trigger function %q lacks %q", function, part)
+		}
+	}
+}
+
+// checkStatements checks that every expected statement is among statements.
+func checkStatements(t *testing.T, statements []string, expected []string) {
+	planned := map[string]bool{}
+
+	for _, statement := range statements {
+		planned[statement] = true
+	}
+
+	for _, statement := range expected {
+		if !planned[statement] {
+			t.Errorf("Missing statement %s", statement)
+		}
+	}
+}
+
+func TestSQLPurgeStatement(t *testing.T) {
+	tests := []struct {
+		dialect  sqlDialect
+		expected string
+	}{
+		{mySQLDialect{}, "DELETE FROM `maps` WHERE `ttl` < ? OR `map_ttl` < ? LIMIT ?"},
+		{postgreSQLDialect{}, `DELETE FROM "maps" WHERE "id" IN (SELECT "id" FROM "maps" WHERE "ttl" < $1 OR "map_ttl" < $2 LIMIT $3)`},
+		{sqliteDialect{}, `DELETE FROM "maps" WHERE "id" IN (SELECT "id" FROM "maps" WHERE "ttl" < ? OR "map_ttl" < ? LIMIT ?)`},
+	}
+
+	for _, test := range tests {
+		s := &sqlStorage{dialect: test.dialect}
+		st := s.purgeStatement("maps", 1000, 50)
+
+		if st.String() != test.expected {
+			t.Errorf("%T: got %q, want %q", test.dialect, st.String(), test.expected)
+		}
+
+		if !reflect.DeepEqual(st.Args(), []interface{}{int64(1000), int64(1000), 50}) {
+			t.Errorf("%T: unexpected args %v", test.dialect, st.Args())
+		}
+	}
+}
+
+func TestSQLSchemaLocks(t *testing.T) {
+	tests := []struct {
+		dialect sqlDialect
+		lock    string
+		unlock  string
+	}{
+		{sqliteDialect{}, "", ""},
+		{postgreSQLDialect{}, "SELECT pg_advisory_lock(", "SELECT pg_advisory_unlock("},
+		{mySQLDialect{}, "SELECT GET_LOCK(SHA1(CONCAT(DATABASE(), '.schema_version')), -1)",
+			"SELECT RELEASE_LOCK(SHA1(CONCAT(DATABASE(), '.schema_version')))"},
+	}
+
+	for _, test := range tests {
+		lock, unlock := test.dialect.LockSchema()
+
+		if !strings.HasPrefix(lock, test.lock) || !strings.HasPrefix(unlock, test.unlock) ||
+			strings.TrimPrefix(lock, test.lock) != strings.TrimPrefix(unlock, test.unlock) {
+			t.Errorf("%T locks the schema with %q and %q", test.dialect, lock, unlock)
+		}
+	}
+}
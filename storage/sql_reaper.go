@@ -0,0 +1,269 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Credentials keys which tune the background reaper deleting expired rows of
+// the SQL backends. An interval of zero or less disables the reaper.
+var REAPER_INTERVAL = "reaperinterval"
+var REAPER_BATCH_SIZE = "reaperbatchsize"
+
+var DefaultReaperInterval = time.Minute
+var DefaultReaperBatchSize = 1000
+
+type ReaperOptions struct {
+	Interval  time.Duration
+	BatchSize int
+}
+
+// ParseReaperOptions reads the reaper settings from credentials. Missing
+// values get the defaults.
+func ParseReaperOptions(credentials map[string]string) (*ReaperOptions, error) {
+	options := &ReaperOptions{
+		Interval:  DefaultReaperInterval,
+		BatchSize: DefaultReaperBatchSize,
+	}
+
+	var err error
+
+	if value := credentials[REAPER_INTERVAL]; value != "" {
+		options.Interval, err = time.ParseDuration(value)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if value := credentials[REAPER_BATCH_SIZE]; value != "" {
+		options.BatchSize, err = strconv.Atoi(value)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if options.BatchSize <= 0 {
+		options.BatchSize = DefaultReaperBatchSize
+	}
+
+	return options, nil
+}
+
+// ReaperStats counts what the reaper of a SQL storage has done so far, the
+// rows purged by KeysCleanUp and PurgeExpired included.
+type ReaperStats struct {
+	Runs          int64
+	KeysPurged    int64
+	FieldsPurged  int64
+	ChangesPurged int64
+	LastRun       time.Time
+	LastError     error
+}
+
+// sqlReaper periodically deletes the rows of expired keys and map fields.
+// Reads already skip them, so the reaper only keeps the tables from growing,
+// away from the requests.
+type sqlReaper struct {
+	options *ReaperOptions
+	mutex   sync.Mutex
+	stats   ReaperStats
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func (s *sqlStorage) startReaper(credentials map[string]string) error {
+	options, err := ParseReaperOptions(credentials)
+
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s.reaper = &sqlReaper{
+		options: options,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+
+	if options.Interval <= 0 {
+		close(s.reaper.done)
+
+		return nil
+	}
+
+	go s.runReaper(ctx)
+
+	return nil
+}
+
+func (s *sqlStorage) runReaper(ctx context.Context) {
+	defer close(s.reaper.done)
+
+	ticker := time.NewTicker(s.reaper.options.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := s.PurgeExpired(ctx)
+
+			if err != nil && ctx.Err() == nil {
+				log.Println("Can not purge expired rows: " + err.Error())
+			}
+		}
+	}
+}
+
+// stopReaper stops the reaper and waits for a purge in progress to give up.
+func (s *sqlStorage) stopReaper() {
+	if s.reaper == nil {
+		return
+	}
+
+	s.reaper.cancel()
+	<-s.reaper.done
+}
+
+// ReaperStats returns what the reaper of this storage has done so far.
+func (s *sqlStorage) ReaperStats() ReaperStats {
+	if s.reaper == nil {
+		return ReaperStats{}
+	}
+
+	s.reaper.mutex.Lock()
+	defer s.reaper.mutex.Unlock()
+
+	return s.reaper.stats
+}
+
+// KeysCleanUp deletes every expired row right away.
+func (s *sqlStorage) KeysCleanUp() error {
+	return s.PurgeExpired(context.Background())
+}
+
+// PurgeExpired deletes the rows of expired keys and map fields, and changes
+// past their retention, a batch at a time so that no single statement holds
+// locks for long. The reaper calls it on every tick.
+func (s *sqlStorage) PurgeExpired(ctx context.Context) error {
+	batchSize := DefaultReaperBatchSize
+
+	if s.reaper != nil {
+		batchSize = s.reaper.options.BatchSize
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	keys, err := s.purgeTable(ctx, "keys", now, batchSize)
+
+	var fields, changes int64
+
+	if err == nil {
+		fields, err = s.purgeTable(ctx, "maps", now, batchSize)
+	}
+
+	if err == nil && s.changelog {
+		retained := now - s.watchOptions.ChangelogRetention.Milliseconds()
+
+		changes, err = s.purgeTable(ctx, changelogTable, retained, batchSize)
+	}
+
+	if s.reaper != nil {
+		s.reaper.mutex.Lock()
+		s.reaper.stats.Runs++
+		s.reaper.stats.KeysPurged += keys
+		s.reaper.stats.FieldsPurged += fields
+		s.reaper.stats.ChangesPurged += changes
+		s.reaper.stats.LastRun = time.Now()
+		s.reaper.stats.LastError = err
+		s.reaper.mutex.Unlock()
+	}
+
+	return err
+}
+
+func (s *sqlStorage) purgeTable(ctx context.Context, table string, before int64, batchSize int) (int64, error) {
+	var purged int64
+
+	for {
+		result, err := s.exec(ctx, s.purgeStatement(table, before, batchSize))
+
+		if err != nil {
+			return purged, err
+		}
+
+		deleted, err := result.RowsAffected()
+
+		if err != nil {
+			return purged, err
+		}
+
+		purged += deleted
+
+		if deleted < int64(batchSize) {
+			return purged, nil
+		}
+	}
+}
+
+// purgeColumns are the columns of each table holding the time, in Unix
+// milliseconds, after which a row can go.
+var purgeColumns = map[string][]string{
+	"keys":         {"ttl"},
+	"maps":         {"ttl", "map_ttl"},
+	changelogTable: {"created_at"},
+}
+
+// purgeStatement deletes up to limit rows of table whose time ran out before
+// the given Unix millisecond.
+func (s *sqlStorage) purgeStatement(table string, before int64, limit int) *sqlStatement {
+	st := s.statement()
+
+	expired := func() {
+		for i, column := range purgeColumns[table] {
+			if i > 0 {
+				st.Write(" OR ")
+			}
+
+			st.Write(st.Quote(column), " < ", st.Bind(before))
+		}
+	}
+
+	if s.dialect.DeleteLimit() {
+		st.Write("DELETE FROM ", st.Quote(table), " WHERE ")
+		expired()
+		st.Write(" LIMIT ", st.Bind(limit))
+
+		return st
+	}
+
+	st.Write("DELETE FROM ", st.Quote(table), " WHERE ", st.Quote("id"), " IN (SELECT ", st.Quote("id"), " FROM ",
+		st.Quote(table), " WHERE ")
+	expired()
+	st.Write(" LIMIT ", st.Bind(limit), ")")
+
+	return st
+}
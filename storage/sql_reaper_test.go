@@ -0,0 +1,163 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseReaperOptions(t *testing.T) {
+	options, err := ParseReaperOptions(map[string]string{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if options.Interval != DefaultReaperInterval || options.BatchSize != DefaultReaperBatchSize {
+		t.Errorf("unexpected defaults %+v", options)
+	}
+
+	options, err = ParseReaperOptions(map[string]string{
+		REAPER_INTERVAL:   "0",
+		REAPER_BATCH_SIZE: "10",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if options.Interval != 0 || options.BatchSize != 10 {
+		t.Errorf("unexpected options %+v", options)
+	}
+
+	_, err = ParseReaperOptions(map[string]string{REAPER_INTERVAL: "often"})
+
+	if err == nil {
+		t.Error("expected an error for a malformed interval")
+	}
+}
+
+func countRows(t *testing.T, storage *SQLiteStorage, table string) int {
+	var count int
+
+	err := storage.Connection.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return count
+}
+
+func TestSQLiteReaperPurgesExpiredRows(t *testing.T) {
+	storage := newTestSQLiteStorage(t, map[string]string{
+		REAPER_INTERVAL:   "10ms",
+		REAPER_BATCH_SIZE: "2",
+	})
+
+	for i := 0; i < 5; i++ {
+		err := storage.SetKey("table", "expiring"+strconv.Itoa(i), "value", time.Millisecond)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := storage.SetKey("table", "forever", "value", 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		err = storage.AddToMapWithTTL("table", "map", "expiring"+strconv.Itoa(i), "value", time.Millisecond)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = storage.AddToMap("table", "map", "forever", "value")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		stats := storage.ReaperStats()
+
+		if stats.KeysPurged == 5 && stats.FieldsPurged == 3 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("reaper did not purge the expired rows: %+v", stats)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if countRows(t, storage, "keys") != 1 || countRows(t, storage, "maps") != 1 {
+		t.Errorf("expired rows left behind")
+	}
+
+	err = storage.Destroy()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runs := storage.ReaperStats().Runs
+
+	time.Sleep(50 * time.Millisecond)
+
+	if storage.ReaperStats().Runs != runs {
+		t.Error("reaper kept running after Destroy")
+	}
+}
+
+func TestSQLiteReaperCanBeDisabled(t *testing.T) {
+	storage := newTestSQLiteStorage(t, map[string]string{
+		REAPER_INTERVAL: "0",
+	})
+
+	err := storage.SetKey("table", "expiring", "value", time.Millisecond)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if countRows(t, storage, "keys") != 1 || storage.ReaperStats().Runs != 0 {
+		t.Error("disabled reaper purged rows")
+	}
+
+	err = storage.KeysCleanUp()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if countRows(t, storage, "keys") != 0 {
+		t.Error("KeysCleanUp left the expired key behind")
+	}
+}
@@ -0,0 +1,154 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync/atomic"
+)
+
+// REPLICA_PREFIX marks the credentials of a read replica of PostgreSQL and
+// MySQL: "replicahost" for instance replaces "host" for the replica, whose
+// credentials are otherwise those of the primary. Without any such key every
+// query goes to the primary.
+//
+// With a replica, GetKeys, ScanKeys, Tables, GetKey, LookupKey, GetFullKey,
+// Exists, TTL, GetFromMap and GetMap read from it, and may miss the latest
+// writes, see WithReadYourWrites. Writes, transactions, migrations and Watch
+// use the primary.
+var REPLICA_PREFIX = "replica"
+
+// replicaCredentials returns the credentials of the replica, or nil if
+// credentials have none.
+func replicaCredentials(credentials map[string]string) map[string]string {
+	overrides := map[string]string{}
+
+	for name, value := range credentials {
+		if strings.HasPrefix(name, REPLICA_PREFIX) && len(name) > len(REPLICA_PREFIX) {
+			overrides[strings.TrimPrefix(name, REPLICA_PREFIX)] = value
+		}
+	}
+
+	if len(overrides) == 0 {
+		return nil
+	}
+
+	replica := map[string]string{}
+
+	for name, value := range credentials {
+		if !strings.HasPrefix(name, REPLICA_PREFIX) {
+			replica[name] = value
+		}
+	}
+
+	for name, value := range overrides {
+		replica[name] = value
+	}
+
+	return replica
+}
+
+type readYourWritesKey struct{}
+
+// readYourWrites records whether a write was made with a context.
+type readYourWrites struct {
+	wrote int32
+}
+
+// WithReadYourWrites returns a context whose reads go to the primary once a
+// write has been made with it, or with a context derived from it, so that a
+// request sees its own writes despite the replication lag. Reads before the
+// first write, and the reads of other contexts, still go to the replica.
+func WithReadYourWrites(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readYourWritesKey{}, &readYourWrites{})
+}
+
+// markWrite records a write made with ctx, before it is made, so that a read
+// racing with it is not sent to the replica.
+func markWrite(ctx context.Context) {
+	if rw, ok := ctx.Value(readYourWritesKey{}).(*readYourWrites); ok {
+		atomic.StoreInt32(&rw.wrote, 1)
+	}
+}
+
+func wroteWith(ctx context.Context) bool {
+	rw, ok := ctx.Value(readYourWritesKey{}).(*readYourWrites)
+
+	return ok && atomic.LoadInt32(&rw.wrote) == 1
+}
+
+// reader returns the connection pool reads with ctx go to.
+func (s *sqlStorage) reader(ctx context.Context) *sql.DB {
+	if s.replica == nil || wroteWith(ctx) {
+		return s.Connection
+	}
+
+	return s.replica
+}
+
+func (s *sqlStorage) readQuery(ctx context.Context, st *sqlStatement) (*sql.Rows, error) {
+	return s.reader(ctx).QueryContext(ctx, st.String(), st.Args()...)
+}
+
+func (s *sqlStorage) readQueryRow(ctx context.Context, st *sqlStatement) *sql.Row {
+	return s.reader(ctx).QueryRowContext(ctx, st.String(), st.Args()...)
+}
+
+// openReplica opens the replica of credentials, if they have one, with
+// dataSourceName building its data source name.
+func (s *sqlStorage) openReplica(driverName string, credentials map[string]string, dataSourceName func(map[string]string) (string, error)) error {
+	replica := replicaCredentials(credentials)
+
+	if replica == nil {
+		return nil
+	}
+
+	name, err := dataSourceName(replica)
+
+	if err != nil {
+		return err
+	}
+
+	s.replica, err = sql.Open(driverName, name)
+
+	if err != nil {
+		return err
+	}
+
+	return configureDBPool(s.replica, replica)
+}
+
+// closeConnections closes the primary and the replica.
+func (s *sqlStorage) closeConnections() error {
+	var err error
+
+	if s.Connection != nil {
+		err = s.Connection.Close()
+	}
+
+	if s.replica != nil {
+		replicaErr := s.replica.Close()
+
+		if err == nil {
+			err = replicaErr
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestReplicaCredentials(t *testing.T) {
+	if replica := replicaCredentials(map[string]string{"host": "primary", REPLICA_PREFIX: "ignored"}); replica != nil {
+		t.Errorf("replicaCredentials without a replica = %v", replica)
+	}
+
+	replica := replicaCredentials(map[string]string{
+		"host":        "primary",
+		"user":        "netclave",
+		"replicahost": "replica",
+		"replicauser": "reader",
+		"dbname":      "identities",
+	})
+
+	expected := map[string]string{
+		"host":   "replica",
+		"user":   "reader",
+		"dbname": "identities",
+	}
+
+	if !reflect.DeepEqual(replica, expected) {
+		t.Errorf("replicaCredentials = %v, expected %v", replica, expected)
+	}
+}
+
+func TestSQLiteReplicaReads(t *testing.T) {
+	storage := newTestSQLiteStorage(t)
+
+	// Another database stands in for a replica which has not caught up.
+	replica := newTestSQLiteStorage(t)
+	storage.replica = replica.Connection
+
+	err := replica.SetKey("table", "replicated", "old", 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := WithReadYourWrites(context.Background())
+
+	value, err := storage.GetKeyContext(ctx, "table", "replicated")
+
+	if err != nil || value != "old" {
+		t.Errorf("GetKey before a write = %q, %v, expected the replica", value, err)
+	}
+
+	err = storage.SetKeyContext(ctx, "table", "replicated", "new", 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err = storage.GetKey("table", "replicated")
+
+	if err != nil || value != "old" {
+		t.Errorf("GetKey of another context = %q, %v, expected the replica", value, err)
+	}
+
+	value, err = storage.GetKeyContext(ctx, "table", "replicated")
+
+	if err != nil || value != "new" {
+		t.Errorf("GetKey after a write = %q, %v, expected the primary", value, err)
+	}
+
+	found, err := storage.ExistsContext(ctx, "table", "replicated")
+
+	if err != nil || !found {
+		t.Errorf("Exists after a write = %v, %v", found, err)
+	}
+}
+
+func TestMySQLReplica(t *testing.T) {
+	mss := &MySQLStorage{}
+
+	// The driver connects lazily, no server is needed.
+	err := mss.Create(map[string]string{
+		"url":           "@tcp(127.0.0.1:3306)",
+		"replicaurl":    "@tcp(127.0.0.1:3307)",
+		"dbname":        "netclave",
+		REAPER_INTERVAL: "0",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mss.Destroy()
+
+	if mss.replica == nil || mss.reader(context.Background()) != mss.replica {
+		t.Error("Reads do not go to the replica")
+	}
+
+	err = (&MySQLStorage{}).Create(map[string]string{
+		"url":              "@tcp(127.0.0.1:3306)",
+		"dbname":           "netclave",
+		"replicatlscafile": "/nonexistent/ca.pem",
+		REAPER_INTERVAL:    "0",
+	})
+
+	if err == nil {
+		t.Error("Create with a missing replica CA file succeeded")
+	}
+}
@@ -0,0 +1,535 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// The unique indexes over the key text. Rows used to be unique by CRC32 hashes
+// of the table and of each key segment, kept in the table_hash and
+// column_N_hash columns. The names differ from every index of those layouts,
+// which keep their names when their tables are renamed during migration.
+var keysUniqueIndex = "keys_key_index"
+var mapsUniqueIndex = "maps_key_index"
+
+var legacyTables = []string{"keys", "maps"}
+
+// legacyColumns are the columns copied out of each legacy table, and
+// legacyKeyColumns those of them the unique indexes cover.
+var legacyColumns = map[string][]string{
+	"keys": {"table", "key", "value", "ttl"},
+	"maps": {"table", "key", "object_key", "value"},
+}
+
+var legacyKeyColumns = map[string][]string{
+	"keys": {"table", "key"},
+	"maps": {"table", "key", "object_key"},
+}
+
+// mapExpiryIndexes let the reaper find expired map fields without a scan.
+var mapExpiryIndexes = []sqlIndex{
+	{table: "maps", name: "maps_expiry_index", columns: []string{"ttl"}},
+	{table: "maps", name: "maps_map_expiry_index", columns: []string{"map_ttl"}},
+}
+
+// schemaVersionTable records every migration applied to a database, one row
+// per version.
+var schemaVersionTable = "schema_version"
+
+// Migration describes a step of the schema of the SQL backends.
+type Migration struct {
+	Version     int
+	Description string
+	// Statements are the statements the migration ran, or would run in a dry
+	// run.
+	Statements []string
+}
+
+// Migrator is implemented by the backends whose schema is versioned, the SQL
+// ones. Init migrates to the latest version.
+type Migrator interface {
+	// SchemaVersion returns the version of the database, 0 if no migration
+	// was recorded yet.
+	SchemaVersion(ctx context.Context) (int, error)
+	// Migrate applies the migrations the database lacks, in order, and
+	// returns them.
+	Migrate(ctx context.Context) ([]Migration, error)
+	// MigrateDryRun returns the migrations Migrate would apply without
+	// changing the database. The migrations look at the schema to find what
+	// is left to do, and in a dry run the later ones see the schema the
+	// earlier ones have not changed, so they may list statements Migrate
+	// would skip, or miss some it would run.
+	MigrateDryRun(ctx context.Context) ([]Migration, error)
+}
+
+// sqlMigration is a migration of one backend. Databases created before
+// migrations were versioned run them all, so apply must check what is there
+// already rather than assume the previous version.
+type sqlMigration struct {
+	version     int
+	description string
+	apply       func(ctx context.Context, mt *migrationTx) error
+}
+
+// sqlSession is what migrations run on, either the connection pool or one
+// connection of it.
+type sqlSession interface {
+	sqlQueryer
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// schemaMutex keeps the storages of the process from changing a schema at
+// the same time, the lock of the dialect other processes.
+var schemaMutex sync.Mutex
+
+// migrationTx runs the statements of a migration, or only records them in a
+// dry run. Catalog queries always run.
+type migrationTx struct {
+	s          *sqlStorage
+	tx         *sql.Tx
+	dryRun     bool
+	statements []string
+}
+
+func (mt *migrationTx) exec(ctx context.Context, statement string) error {
+	mt.statements = append(mt.statements, statement)
+
+	if mt.dryRun {
+		return nil
+	}
+
+	_, err := mt.tx.ExecContext(ctx, statement)
+
+	if err != nil {
+		return fmt.Errorf("%s: %w", statement, err)
+	}
+
+	return nil
+}
+
+func (mt *migrationTx) count(ctx context.Context, query string, names ...interface{}) (int64, error) {
+	var count int64
+
+	err := mt.tx.QueryRowContext(ctx, query, names...).Scan(&count)
+
+	return count, err
+}
+
+// sqlColumn is a column added to a table after the table was introduced.
+type sqlColumn struct {
+	table      string
+	name       string
+	definition string
+}
+
+// sqlIndex is an index added to a table after the table was introduced.
+type sqlIndex struct {
+	table   string
+	name    string
+	columns []string
+}
+
+// createTables is the first migration of every backend: it runs the
+// statements creating the tables, migrating a legacy layout in place. Its
+// tables are renamed, the current ones created and the rows copied across
+// before the old tables are dropped. Legacy rows are already unique by their
+// text, because equal keys always had equal hashes, and only the columns
+// without hashes are copied, once their keys are known to fit the schema.
+// MySQL commits every rename and drop as it runs it, so a failed migration
+// may leave renamed tables behind. The next attempt copies them again,
+// skipping the rows which made it across already.
+func createTables(schema []string) func(ctx context.Context, mt *migrationTx) error {
+	return func(ctx context.Context, mt *migrationTx) error {
+		sources, err := mt.legacySources(ctx)
+
+		if err != nil {
+			return err
+		}
+
+		if len(sources) > 0 {
+			log.Println("Migrating keys and maps tables to the layout without hash columns")
+		}
+
+		for table, source := range sources {
+			err = mt.checkLegacyKeyLengths(ctx, table, source)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, table := range legacyTables {
+			if sources[table] != table {
+				continue
+			}
+
+			st := mt.s.statement()
+			st.Write("ALTER TABLE ", st.Quote(table), " RENAME TO ", st.Quote(table+"_legacy"))
+
+			err = mt.exec(ctx, st.String())
+
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, statement := range schema {
+			err = mt.exec(ctx, statement)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, table := range legacyTables {
+			if sources[table] == "" {
+				continue
+			}
+
+			// The WHERE clause keeps SQLite from reading the conflict clause
+			// as a join constraint.
+			st := mt.s.statement()
+			st.Write("INSERT INTO ", st.Quote(table), " (", st.QuoteList(legacyColumns[table]), ") SELECT ",
+				st.QuoteList(legacyColumns[table]), " FROM ", st.Quote(table+"_legacy"), " WHERE 1 = 1").
+				InsertIgnore(legacyKeyColumns[table])
+
+			err = mt.exec(ctx, st.String())
+
+			if err != nil {
+				return err
+			}
+
+			st = mt.s.statement()
+			st.Write("DROP TABLE ", st.Quote(table+"_legacy"))
+
+			err = mt.exec(ctx, st.String())
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// addColumns adds the columns the tables do not have yet.
+func addColumns(columns []sqlColumn) func(ctx context.Context, mt *migrationTx) error {
+	return func(ctx context.Context, mt *migrationTx) error {
+		for _, column := range columns {
+			count, err := mt.count(ctx, mt.s.dialect.ColumnExists(), column.table, column.name)
+
+			if err != nil {
+				return err
+			}
+
+			if count > 0 {
+				continue
+			}
+
+			st := mt.s.statement()
+			st.Write("ALTER TABLE ", st.Quote(column.table), " ADD COLUMN ", st.Quote(column.name), " ", column.definition)
+
+			err = mt.exec(ctx, st.String())
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// addIndexes creates the indexes the tables do not have yet. Not every
+// dialect has CREATE INDEX IF NOT EXISTS, so the catalog is asked first.
+func addIndexes(indexes []sqlIndex) func(ctx context.Context, mt *migrationTx) error {
+	return func(ctx context.Context, mt *migrationTx) error {
+		for _, index := range indexes {
+			count, err := mt.count(ctx, mt.s.dialect.IndexExists(), index.table, index.name)
+
+			if err != nil {
+				return err
+			}
+
+			if count > 0 {
+				continue
+			}
+
+			st := mt.s.statement()
+			st.Write("CREATE INDEX ", st.Quote(index.name), " ON ", st.Quote(index.table), " (", st.QuoteList(index.columns), ")")
+
+			err = mt.exec(ctx, st.String())
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// legacySources returns the tables holding the legacy rows of the keys and
+// maps tables: the tables themselves while they have the hash columns, or
+// the copies a failed migration renamed them to.
+func (mt *migrationTx) legacySources(ctx context.Context) (map[string]string, error) {
+	sources := map[string]string{}
+
+	for _, table := range legacyTables {
+		tables, err := mt.count(ctx, mt.s.dialect.TableExists(), table)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if tables > 0 {
+			columns, err := mt.count(ctx, mt.s.dialect.ColumnExists(), table, "table_hash")
+
+			if err != nil {
+				return nil, err
+			}
+
+			if columns > 0 {
+				sources[table] = table
+				continue
+			}
+		}
+
+		leftovers, err := mt.count(ctx, mt.s.dialect.TableExists(), table+"_legacy")
+
+		if err != nil {
+			return nil, err
+		}
+
+		if leftovers > 0 {
+			sources[table] = table + "_legacy"
+		}
+	}
+
+	return sources, nil
+}
+
+// checkLegacyKeyLengths fails if source, the legacy rows of table, holds
+// a key longer than the schema can store, before anything is renamed. MySQL
+// is the only dialect with a limit, and its LENGTH counts bytes.
+func (mt *migrationTx) checkLegacyKeyLengths(ctx context.Context, table string, source string) error {
+	limit := mt.s.dialect.MaxKeyLength()
+
+	if limit <= 0 {
+		return nil
+	}
+
+	for _, column := range legacyKeyColumns[table] {
+		st := mt.s.statement()
+		st.Write("SELECT COALESCE(MAX(LENGTH(", st.Quote(column), ")), 0) FROM ", st.Quote(source))
+
+		length, err := mt.count(ctx, st.String())
+
+		if err != nil {
+			return err
+		}
+
+		if length > int64(limit) {
+			return fmt.Errorf("Table %s has a %s of %d bytes, the schema stores at most %d", source, column, length, limit)
+		}
+	}
+
+	return nil
+}
+
+func (s *sqlStorage) createSchemaVersionTable(ctx context.Context, session sqlSession) error {
+	st := s.statement()
+	st.Write("CREATE TABLE IF NOT EXISTS ", st.Quote(schemaVersionTable), " (",
+		st.Quote("version"), " INTEGER NOT NULL PRIMARY KEY, ",
+		st.Quote("description"), " TEXT, ",
+		st.Quote("applied_at"), " BIGINT NOT NULL)")
+
+	_, err := session.ExecContext(ctx, st.String())
+
+	return err
+}
+
+func (s *sqlStorage) SchemaVersion(ctx context.Context) (int, error) {
+	return s.schemaVersion(ctx, s.Connection)
+}
+
+func (s *sqlStorage) schemaVersion(ctx context.Context, session sqlSession) (int, error) {
+	var tables int64
+
+	err := session.QueryRowContext(ctx, s.dialect.TableExists(), schemaVersionTable).Scan(&tables)
+
+	if err != nil || tables == 0 {
+		return 0, err
+	}
+
+	st := s.statement()
+	st.Write("SELECT COALESCE(MAX(", st.Quote("version"), "), 0) FROM ", st.Quote(schemaVersionTable))
+
+	var version int
+
+	err = session.QueryRowContext(ctx, st.String(), st.Args()...).Scan(&version)
+
+	return version, err
+}
+
+func (s *sqlStorage) Migrate(ctx context.Context) ([]Migration, error) {
+	applied := []Migration{}
+
+	err := s.withSchemaLock(ctx, func(conn *sql.Conn) error {
+		var err error
+
+		applied, err = s.migrate(ctx, conn, false)
+
+		return err
+	})
+
+	return applied, err
+}
+
+func (s *sqlStorage) MigrateDryRun(ctx context.Context) ([]Migration, error) {
+	return s.migrate(ctx, s.Connection, true)
+}
+
+// withSchemaLock runs f on a connection of its own, while no other storage
+// changes the schema, so that storages starting at the same time neither
+// apply a migration twice nor set up Watch twice.
+func (s *sqlStorage) withSchemaLock(ctx context.Context, f func(conn *sql.Conn) error) error {
+	schemaMutex.Lock()
+	defer schemaMutex.Unlock()
+
+	conn, err := s.Connection.Conn(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	lock, unlock := s.dialect.LockSchema()
+
+	if lock != "" {
+		_, err = conn.ExecContext(ctx, lock)
+
+		if err != nil {
+			return fmt.Errorf("Can not lock the schema: %w", err)
+		}
+
+		// The lock belongs to the session, which goes back to the pool.
+		defer conn.ExecContext(context.Background(), unlock)
+	}
+
+	return f(conn)
+}
+
+// migrate applies each pending migration in a transaction of its own, which
+// records its version, on a session holding the schema lock, which reads the
+// version only once it has the lock. MySQL commits DDL statements as it runs
+// them, so a migration which fails there is applied up to the failing
+// statement and runs again on the next attempt. A database newer than the
+// migrations is an error.
+func (s *sqlStorage) migrate(ctx context.Context, session sqlSession, dryRun bool) ([]Migration, error) {
+	version, err := s.schemaVersion(ctx, session)
+
+	if err != nil {
+		return nil, err
+	}
+
+	latest := 0
+
+	if len(s.migrations) > 0 {
+		latest = s.migrations[len(s.migrations)-1].version
+	}
+
+	if version > latest {
+		return nil, fmt.Errorf("Schema version %d is newer than the latest known version %d", version, latest)
+	}
+
+	if !dryRun {
+		err = s.createSchemaVersionTable(ctx, session)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	applied := []Migration{}
+
+	for _, migration := range s.migrations {
+		if migration.version <= version {
+			continue
+		}
+
+		statements, err := s.applyMigration(ctx, session, migration, dryRun)
+
+		if err != nil {
+			return applied, fmt.Errorf("Migration %d (%s): %w", migration.version, migration.description, err)
+		}
+
+		applied = append(applied, Migration{
+			Version:     migration.version,
+			Description: migration.description,
+			Statements:  statements,
+		})
+	}
+
+	return applied, nil
+}
+
+func (s *sqlStorage) applyMigration(ctx context.Context, session sqlSession, migration sqlMigration, dryRun bool) ([]string, error) {
+	tx, err := session.BeginTx(ctx, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	mt := &migrationTx{
+		s:      s,
+		tx:     tx,
+		dryRun: dryRun,
+	}
+
+	err = migration.apply(ctx, mt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		return mt.statements, nil
+	}
+
+	st := s.statement()
+	st.Write("INSERT INTO ", st.Quote(schemaVersionTable), " (", st.QuoteList([]string{"version", "description", "applied_at"}),
+		") VALUES (", st.BindList([]interface{}{migration.version, migration.description, time.Now().Unix()}), ")")
+
+	_, err = tx.ExecContext(ctx, st.String(), st.Args()...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return mt.statements, tx.Commit()
+}
@@ -0,0 +1,537 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// "plumless" and "buckeroo" share the same CRC32.
+var collidingKeys = []string{"plumless", "buckeroo"}
+
+func TestSQLiteKeepsCollidingKeysApart(t *testing.T) {
+	storage := newTestSQLiteStorage(t)
+
+	if CalculateHash(collidingKeys[0]) != CalculateHash(collidingKeys[1]) {
+		t.Fatal("test keys do not collide")
+	}
+
+	for _, key := range collidingKeys {
+		err := storage.SetKey("table", key, "value of "+key, 0)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = storage.AddToMap("table", "map", key, "value of "+key)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, key := range collidingKeys {
+		value, err := storage.GetKey("table", key)
+
+		if err != nil || value != "value of "+key {
+			t.Errorf("GetKey(%q) = %q, %v", key, value, err)
+		}
+	}
+
+	fields, err := storage.GetMap("table", "map")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"plumless": "value of plumless",
+		"buckeroo": "value of buckeroo",
+	}
+
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("GetMap = %q", fields)
+	}
+}
+
+func TestSQLiteMigratesLegacyLayout(t *testing.T) {
+	testSQLiteMigration(t, nil)
+}
+
+// Tables created before the hash columns were dropped already carried
+// unique indexes over the key text.
+func TestSQLiteMigratesTextIndexedLegacyLayout(t *testing.T) {
+	testSQLiteMigration(t, []string{
+		`CREATE UNIQUE INDEX keys_unique_index ON keys("table", "key")`,
+		`CREATE INDEX keys_ttl_index ON keys(ttl)`,
+		`CREATE UNIQUE INDEX maps_unique_index ON maps("table", "key", "object_key")`,
+	})
+}
+
+// A migration which failed after renaming the keys table and copying its
+// rows is resumed, the copied rows are skipped.
+func TestSQLiteResumesLegacyMigration(t *testing.T) {
+	testSQLiteMigration(t, []string{
+		`ALTER TABLE keys RENAME TO keys_legacy`,
+		`CREATE TABLE keys ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT, "table" TEXT NOT NULL, "key" TEXT NOT NULL, "value" TEXT, "ttl" INTEGER)`,
+		`CREATE UNIQUE INDEX ` + keysUniqueIndex + ` ON keys("table", "key")`,
+		`INSERT INTO keys ("table", "key", "value", "ttl") SELECT "table", "key", "value", "ttl" FROM keys_legacy`,
+	})
+}
+
+// testSQLiteMigration opens a database of the legacy layout, with rows, after
+// running statements over it.
+func testSQLiteMigration(t *testing.T, statements []string) {
+	dir, err := ioutil.TempDir("", "netclave-storage")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "storage.db")
+
+	db, err := sql.Open("sqlite3", filename)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hashColumns := ""
+	hashNames := ""
+
+	for i := 1; i <= 10; i++ {
+		hashColumns += `"column_` + strconv.Itoa(i) + `_hash" INTEGER, `
+		hashNames += "column_" + strconv.Itoa(i) + "_hash, "
+	}
+
+	legacy := []string{
+		`CREATE TABLE keys ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT, "table" TEXT, "table_hash" INTEGER, "key" TEXT, ` +
+			hashColumns + `"value" TEXT, "ttl" INTEGER, CONSTRAINT columns_unique_key UNIQUE(` + hashNames + `table_hash))`,
+		`CREATE INDEX table_hash_index ON keys(table_hash)`,
+		`CREATE TABLE maps ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT, "table" TEXT, "table_hash" INTEGER, "key" TEXT, ` +
+			hashColumns + `"value" TEXT, "object_key" TEXT, "object_key_hash" INTEGER, CONSTRAINT map_columns_unique_key UNIQUE(` +
+			hashNames + `table_hash, object_key_hash))`,
+	}
+
+	for _, statement := range legacy {
+		_, err = db.Exec(statement)
+
+		if err != nil {
+			t.Fatalf("%s: %v", statement, err)
+		}
+	}
+
+	rows := []string{
+		`INSERT INTO keys ("table", table_hash, "key", column_1_hash, column_2_hash, "value", "ttl") VALUES ('table', ?, 'a/plumless', ?, ?, 'legacy', ?)`,
+		`INSERT INTO maps ("table", table_hash, "key", column_1_hash, object_key, object_key_hash, "value") VALUES ('table', ?, 'map', ?, 'plumless', ?, 'legacy')`,
+	}
+
+	args := [][]interface{}{
+		{CalculateHash("table"), CalculateHash("a"), CalculateHash("plumless"), int64(1) << 62},
+		{CalculateHash("table"), CalculateHash("map"), CalculateHash("plumless")},
+	}
+
+	for index, statement := range rows {
+		_, err = db.Exec(statement, args[index]...)
+
+		if err != nil {
+			t.Fatalf("%s: %v", statement, err)
+		}
+	}
+
+	for _, statement := range statements {
+		_, err = db.Exec(statement)
+
+		if err != nil {
+			t.Fatalf("%s: %v", statement, err)
+		}
+	}
+
+	db.Close()
+
+	storage, err := CreateStorage(map[string]string{"filename": filename}, SQLITE_STORAGE, true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer storage.Destroy()
+
+	for i := 0; i < 2; i++ {
+		err = storage.Init()
+
+		if err != nil {
+			t.Fatalf("Init %d: %v", i, err)
+		}
+	}
+
+	value, err := storage.GetKey("table", "a/plumless")
+
+	if err != nil || value != "legacy" {
+		t.Errorf("GetKey of a migrated key = %q, %v", value, err)
+	}
+
+	err = storage.SetKey("table", "a/buckeroo", "new", 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storage.AddToMap("table", "map", "buckeroo", "new")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err = storage.GetKey("table", "a/plumless")
+
+	if err != nil || value != "legacy" {
+		t.Errorf("GetKey after a colliding SetKey = %q, %v", value, err)
+	}
+
+	fields, err := storage.GetMap("table", "map")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(fields, map[string]string{"plumless": "legacy", "buckeroo": "new"}) {
+		t.Errorf("GetMap after migration = %q", fields)
+	}
+
+	keys, err := storage.GetKeys("table", "a/*")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(uniqueSorted(keys), []string{"table/a/buckeroo", "table/a/plumless"}) {
+		t.Errorf("GetKeys after migration = %q", keys)
+	}
+}
+
+func TestSQLiteSupportsDeepKeys(t *testing.T) {
+	storage := newTestSQLiteStorage(t)
+
+	parts := []string{}
+
+	for i := 0; i < 25; i++ {
+		parts = append(parts, "part"+strconv.Itoa(i))
+	}
+
+	key := strings.Join(parts, "/")
+
+	err := storage.SetKey("table", key, "deep", 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storage.AddToMap("table", key, "field", "deep")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := storage.GetKey("table", key)
+
+	if err != nil || value != "deep" {
+		t.Errorf("GetKey = %q, %v", value, err)
+	}
+
+	for _, pattern := range []string{"part0/**", "part0/*/part2/**", strings.Join(parts[:20], "/") + "/**", "*/*/*/*/*/*/*/*/*/*/*/*/*/*/*/*/*/*/*/*/part20/**", "**/part24", key} {
+		keys, err := storage.GetKeys("table", pattern)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(keys, []string{"table/" + key}) {
+			t.Errorf("GetKeys(%q) = %q", pattern, keys)
+		}
+	}
+}
+
+func TestSQLitePrefixRange(t *testing.T) {
+	storage := newTestSQLiteStorage(t)
+
+	for _, key := range []string{"a", "a/b", "a.b", "a0", "ab", "a/b/c", "b"} {
+		err := storage.SetKey("table", key, key, 0)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err := storage.GetKeys("table", "a/**")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(uniqueSorted(keys), []string{"table/a", "table/a/b", "table/a/b/c"}) {
+		t.Errorf("GetKeys = %q", keys)
+	}
+}
+
+func TestSQLiteAddsMapExpiryColumns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netclave-storage")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "storage.db")
+
+	db, err := sql.Open("sqlite3", filename)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := []string{
+		`CREATE TABLE maps ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT, "table" TEXT NOT NULL, "key" TEXT NOT NULL, "object_key" TEXT NOT NULL, "value" TEXT)`,
+		`CREATE UNIQUE INDEX ` + mapsUniqueIndex + ` ON maps("table", "key", "object_key")`,
+		`INSERT INTO maps ("table", "key", "object_key", "value") VALUES ('table', 'map', 'field', 'previous')`,
+	}
+
+	for _, statement := range previous {
+		_, err = db.Exec(statement)
+
+		if err != nil {
+			t.Fatalf("%s: %v", statement, err)
+		}
+	}
+
+	db.Close()
+
+	storage, err := CreateStorage(map[string]string{"filename": filename}, SQLITE_STORAGE, true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer storage.Destroy()
+
+	for i := 0; i < 2; i++ {
+		err = storage.Init()
+
+		if err != nil {
+			t.Fatalf("Init %d: %v", i, err)
+		}
+	}
+
+	err = storage.AddToMapWithTTL("table", "map", "expiring", "new", time.Hour)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields, err := storage.GetMap("table", "map")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(fields, map[string]string{"field": "previous", "expiring": "new"}) {
+		t.Errorf("GetMap after adding the columns = %q", fields)
+	}
+}
+
+func TestSQLiteMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netclave-storage")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	gs := &GenericStorage{
+		Credentials: map[string]string{"filename": filepath.Join(dir, "storage.db")},
+		StorageType: SQLITE_STORAGE,
+	}
+
+	defer gs.Close()
+
+	ctx := context.Background()
+
+	planned, err := gs.MigrateDryRun(ctx)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(planned) != 3 || planned[0].Version != 1 || len(planned[0].Statements) == 0 {
+		t.Fatalf("MigrateDryRun = %+v", planned)
+	}
+
+	storage := newTestSQLiteStorage(t, gs.Credentials)
+
+	version, err := storage.SchemaVersion(ctx)
+
+	if err != nil || version != 3 {
+		t.Fatalf("SchemaVersion after Init = %d, %v", version, err)
+	}
+
+	applied, err := gs.Migrate(ctx)
+
+	if err != nil || len(applied) != 0 {
+		t.Errorf("Migrate of a migrated database = %+v, %v", applied, err)
+	}
+
+	planned, err = gs.MigrateDryRun(ctx)
+
+	if err != nil || len(planned) != 0 {
+		t.Errorf("MigrateDryRun of a migrated database = %+v, %v", planned, err)
+	}
+
+	_, err = storage.Connection.Exec(`INSERT INTO schema_version (version, description, applied_at) VALUES (99, 'from the future', 0)`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = gs.Migrate(ctx)
+
+	if err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("Migrate of a newer database: %v", err)
+	}
+}
+
+func TestSQLiteMigrateDryRunChangesNothing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netclave-storage")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	storage, err := CreateStorage(map[string]string{"filename": filepath.Join(dir, "storage.db")}, SQLITE_STORAGE, true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer storage.Destroy()
+
+	migrator := storage.(Migrator)
+
+	planned, err := migrator.MigrateDryRun(context.Background())
+
+	if err != nil || len(planned) != 3 {
+		t.Fatalf("MigrateDryRun = %+v, %v", planned, err)
+	}
+
+	var tables int
+
+	err = storage.(*SQLiteStorage).Connection.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table'`).Scan(&tables)
+
+	if err != nil || tables != 0 {
+		t.Errorf("Tables after a dry run = %d, %v", tables, err)
+	}
+
+	applied, err := migrator.Migrate(context.Background())
+
+	if err != nil || len(applied) != 3 {
+		t.Fatalf("Migrate = %+v, %v", applied, err)
+	}
+
+	// Both runs started from an empty database.
+	for i := range planned {
+		if !reflect.DeepEqual(planned[i].Statements, applied[i].Statements) {
+			t.Errorf("Migration %d ran %q, the dry run planned %q", applied[i].Version, applied[i].Statements, planned[i].Statements)
+		}
+	}
+}
+
+// Storages opening the same database at once apply every migration once.
+func TestSQLiteConcurrentMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netclave-storage")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "storage.db")
+	errs := make(chan error, 5)
+
+	var wait sync.WaitGroup
+
+	for i := 0; i < 5; i++ {
+		db, err := sql.Open("sqlite3", filename)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer db.Close()
+
+		s := &sqlStorage{Connection: db, dialect: sqliteDialect{}, migrations: sqliteMigrations()}
+
+		wait.Add(1)
+
+		go func() {
+			defer wait.Done()
+
+			_, err := s.Migrate(context.Background())
+			errs <- err
+		}()
+	}
+
+	wait.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Concurrent Migrate: %v", err)
+		}
+	}
+
+	db, err := sql.Open("sqlite3", filename)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	var count int
+
+	err = db.QueryRow("SELECT COUNT(*) FROM " + schemaVersionTable).Scan(&count)
+
+	if err != nil || count != 3 {
+		t.Errorf("%d versions recorded, %v", count, err)
+	}
+}
@@ -0,0 +1,1037 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+)
+
+// neverExpires is the ttl, in milliseconds, of rows which do not expire.
+var neverExpires = time.Unix(0, int64(math.MaxInt64)).UnixNano() / int64(time.Millisecond)
+
+// expiresAt returns the ttl of a row stored now for expiration.
+func expiresAt(expiration time.Duration) int64 {
+	if expiration.Milliseconds() <= 0 {
+		return neverExpires
+	}
+
+	return time.Now().Add(expiration).UnixNano() / int64(time.Millisecond)
+}
+
+// sqlQueryer is what statements run on, either the connection pool or a
+// transaction.
+type sqlQueryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// sqlStorage implements the data operations shared by the SQL backends. The
+// backends embed it and only provide their own connection handling and schema.
+type sqlStorage struct {
+	Connection *sql.DB
+	// replica is the pool of a read replica, if the credentials have one.
+	replica      *sql.DB
+	dialect      sqlDialect
+	migrations   []sqlMigration
+	reaper       *sqlReaper
+	watchOptions *WatchOptions
+	// patternSyntax is how GetKeys, ScanKeys and Watch read patterns.
+	patternSyntax string
+	// watchSchema creates the changelog and the triggers of Watch, see
+	// setupWatch.
+	watchSchema func(ctx context.Context, mt *migrationTx) error
+	// changelog is set for the backends whose triggers fill the changelog
+	// table, with WATCH, for the reaper to purge it.
+	changelog bool
+}
+
+func (s *sqlStorage) configurePool(credentials map[string]string) error {
+	return configureDBPool(s.Connection, credentials)
+}
+
+func configureDBPool(db *sql.DB, credentials map[string]string) error {
+	options, err := ParsePoolOptions(credentials)
+
+	if err != nil {
+		return err
+	}
+
+	if options.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(options.MaxOpenConns)
+	}
+
+	if options.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(options.MaxIdleConns)
+	}
+
+	if options.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(options.ConnMaxLifetime)
+	}
+
+	return nil
+}
+
+func (s *sqlStorage) statement() *sqlStatement {
+	return newSQLStatement(s.dialect)
+}
+
+func (s *sqlStorage) query(ctx context.Context, st *sqlStatement) (*sql.Rows, error) {
+	return s.Connection.QueryContext(ctx, st.String(), st.Args()...)
+}
+
+func (s *sqlStorage) queryRow(ctx context.Context, st *sqlStatement) *sql.Row {
+	return s.Connection.QueryRowContext(ctx, st.String(), st.Args()...)
+}
+
+func (s *sqlStorage) exec(ctx context.Context, st *sqlStatement) (sql.Result, error) {
+	markWrite(ctx)
+
+	return s.Connection.ExecContext(ctx, st.String(), st.Args()...)
+}
+
+// begin starts a transaction on the primary, for writes.
+func (s *sqlStorage) begin(ctx context.Context) (*sql.Tx, error) {
+	markWrite(ctx)
+
+	return s.Connection.BeginTx(ctx, nil)
+}
+
+// checkKeyLength rejects names the schema would truncate, which would make
+// distinct keys collide again.
+func (s *sqlStorage) checkKeyLength(names ...string) error {
+	limit := s.dialect.MaxKeyLength()
+
+	for _, name := range names {
+		if limit > 0 && len(name) > limit {
+			return errors.New("Key is longer than " + strconv.Itoa(limit) + " bytes")
+		}
+	}
+
+	return nil
+}
+
+func (s *sqlStorage) GetKeys(table string, pattern string) ([]string, error) {
+	return s.GetKeysContext(context.Background(), table, pattern)
+}
+
+func (s *sqlStorage) GetKeysContext(ctx context.Context, table string, pattern string) ([]string, error) {
+	return collectKeys(s.ScanKeys(ctx, table, pattern, 0))
+}
+
+// ScanKeys pages through the keys of table in key order, resuming every batch
+// after the last key of the previous one, so each batch is a range scan over
+// the unique indexes however far the scan has got.
+func (s *sqlStorage) ScanKeys(ctx context.Context, table string, pattern string, batchSize int) (KeyIterator, error) {
+	compiled, err := CompilePatternSyntax(pattern, s.patternSyntax)
+
+	if err != nil {
+		return nil, err
+	}
+
+	limit := scanBatchSize(batchSize)
+	prefix := compiled.Prefix()
+
+	var after *string
+
+	return newBatchIterator(func() ([]string, bool, error) {
+		st := s.scanKeysStatement(table, prefix, after, limit)
+
+		row, err := s.readQuery(ctx, st)
+
+		if err != nil {
+			return nil, false, err
+		}
+
+		defer row.Close()
+
+		keys := []string{}
+		count := 0
+
+		for row.Next() { // Iterate and fetch the records from result cursor
+			var key string
+			err = row.Scan(&key)
+
+			if err != nil {
+				return nil, false, err
+			}
+
+			count++
+			after = &key
+
+			if compiled.Match(key) {
+				keys = append(keys, table+"/"+key)
+			}
+		}
+
+		return keys, count == limit, row.Err()
+	}), nil
+}
+
+func (s *sqlStorage) Tables(ctx context.Context) ([]string, error) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	st := s.statement()
+	st.Write("SELECT ", st.Quote("table"), " FROM ", st.Quote("keys"), " WHERE ", st.Quote("ttl"), " >= ", st.Bind(now),
+		" UNION SELECT ", st.Quote("table"), " FROM maps WHERE ", st.Quote("ttl"), " >= ", st.Bind(now),
+		" AND map_ttl >= ", st.Bind(now), " ORDER BY 1")
+
+	rows, err := s.readQuery(ctx, st)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	tables := []string{}
+
+	for rows.Next() {
+		var table string
+
+		err = rows.Scan(&table)
+
+		if err != nil {
+			return nil, err
+		}
+
+		tables = append(tables, table)
+	}
+
+	return tables, rows.Err()
+}
+
+// scanKeysStatement selects the next limit distinct names of live keys and
+// maps below prefix that sort after the key after points to, if it is set.
+func (s *sqlStorage) scanKeysStatement(table string, prefix string, after *string, limit int) *sqlStatement {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	st := s.statement()
+
+	where := func() {
+		st.WherePrefix(table, prefix)
+
+		if after != nil {
+			st.Write(" AND ", st.Quote("key"), " > ", st.Bind(*after))
+		}
+	}
+
+	st.Write("SELECT ", st.Quote("key"), " FROM (SELECT ", st.Quote("key"), " FROM ", st.Quote("keys"), " WHERE ")
+	where()
+	st.Write(" AND ", st.Quote("ttl"), " >= ", st.Bind(now), " ORDER BY ", st.Quote("key"), " LIMIT ", st.Bind(limit),
+		") scanned_keys UNION SELECT ", st.Quote("key"), " FROM (SELECT DISTINCT ", st.Quote("key"), " FROM maps WHERE ")
+	where()
+	st.LiveFields(now)
+	st.Write(" ORDER BY ", st.Quote("key"), " LIMIT ", st.Bind(limit), ") scanned_maps ORDER BY ", st.Quote("key"),
+		" LIMIT ", st.Bind(limit))
+
+	return st
+}
+
+func (s *sqlStorage) SetKey(table string, key string, value string, expiration time.Duration) error {
+	return s.SetKeyContext(context.Background(), table, key, value, expiration)
+}
+
+func (s *sqlStorage) SetKeyContext(ctx context.Context, table string, key string, value string, expiration time.Duration) error {
+	st, err := s.setKeyStatement(table, key, value, expiration)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = s.exec(ctx, st)
+
+	return err
+}
+
+func (s *sqlStorage) setKeyStatement(table string, key string, value string, expiration time.Duration) (*sqlStatement, error) {
+	err := s.checkKeyLength(table, key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	st := s.statement()
+	st.Write("INSERT INTO ", st.Quote("keys"), " (", st.QuoteList([]string{"table", "key", "value", "ttl"}), ") VALUES (",
+		st.BindList([]interface{}{table, key, value, expiresAt(expiration)}), ")")
+	st.Upsert([]string{"table", "key"}, []string{"value", "ttl"})
+
+	return st, nil
+}
+
+func (s *sqlStorage) GetFullKey(key string) (string, error) {
+	return s.GetFullKeyContext(context.Background(), key)
+}
+
+func (s *sqlStorage) GetFullKeyContext(ctx context.Context, key string) (string, error) {
+	parts := SplitToParts(key)
+
+	table := parts[0]
+
+	newKey := ""
+
+	partsLen := len(parts)
+
+	for i := 1; i < partsLen; i++ {
+		newKey = newKey + parts[i]
+
+		if i+1 < partsLen {
+			newKey += "/"
+		}
+	}
+
+	return s.GetKeyContext(ctx, table, newKey)
+}
+
+func (s *sqlStorage) GetKey(table string, key string) (string, error) {
+	return s.GetKeyContext(context.Background(), table, key)
+}
+
+func (s *sqlStorage) GetKeyContext(ctx context.Context, table string, key string) (string, error) {
+	value, err := s.LookupKeyContext(ctx, table, key)
+
+	if err == ErrNotFound {
+		return "", nil
+	}
+
+	return value, err
+}
+
+func (s *sqlStorage) LookupKey(table string, key string) (string, error) {
+	return s.LookupKeyContext(context.Background(), table, key)
+}
+
+func (s *sqlStorage) LookupKeyContext(ctx context.Context, table string, key string) (string, error) {
+	st := s.liveKeyStatement("value", table, key)
+
+	var value string
+
+	err := s.readQueryRow(ctx, st).Scan(&value)
+
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+
+	return value, err
+}
+
+// liveKeyStatement selects column of a key which has not expired.
+func (s *sqlStorage) liveKeyStatement(column string, table string, key string) *sqlStatement {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	st := s.statement()
+	st.Write("SELECT ", st.Quote(column), " FROM ", st.Quote("keys"), " WHERE ")
+	st.WhereKey(table, key)
+	st.Write(" AND ", st.Quote("ttl"), " >= ", st.Bind(now))
+
+	return st
+}
+
+func (s *sqlStorage) Exists(table string, key string) (bool, error) {
+	return s.ExistsContext(context.Background(), table, key)
+}
+
+func (s *sqlStorage) ExistsContext(ctx context.Context, table string, key string) (bool, error) {
+	_, err := s.TTLContext(ctx, table, key)
+
+	if err == ErrNotFound {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (s *sqlStorage) TTL(table string, key string) (time.Duration, error) {
+	return s.TTLContext(context.Background(), table, key)
+}
+
+func (s *sqlStorage) TTLContext(ctx context.Context, table string, key string) (time.Duration, error) {
+	st := s.liveKeyStatement("ttl", table, key)
+
+	var ttl int64
+
+	err := s.readQueryRow(ctx, st).Scan(&ttl)
+
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return remainingTTL(ttl, time.Now().UnixNano()/int64(time.Millisecond)), nil
+}
+
+// remainingTTL returns how long a row expiring at ttl has left at now, both
+// in Unix milliseconds, or NoExpiration.
+func remainingTTL(ttl int64, now int64) time.Duration {
+	if ttl == neverExpires {
+		return NoExpiration
+	}
+
+	return time.Duration(ttl-now) * time.Millisecond
+}
+
+func (s *sqlStorage) Expire(table string, key string, expiration time.Duration) (bool, error) {
+	return s.ExpireContext(context.Background(), table, key, expiration)
+}
+
+// ExpireContext looks the key up before updating it, because MySQL only
+// counts the rows an UPDATE actually changed.
+func (s *sqlStorage) ExpireContext(ctx context.Context, table string, key string, expiration time.Duration) (bool, error) {
+	tx, err := s.begin(ctx)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer tx.Rollback()
+
+	st := s.liveKeyStatement("ttl", table, key)
+
+	var ttl int64
+
+	err = tx.QueryRowContext(ctx, st.String(), st.Args()...).Scan(&ttl)
+
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	st = s.statement()
+	st.Write("UPDATE ", st.Quote("keys"), " SET ", st.Quote("ttl"), " = ", st.Bind(expiresAt(expiration)), " WHERE ")
+	st.WhereKey(table, key)
+
+	_, err = tx.ExecContext(ctx, st.String(), st.Args()...)
+
+	if err != nil {
+		return false, err
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s *sqlStorage) Persist(table string, key string) (bool, error) {
+	return s.PersistContext(context.Background(), table, key)
+}
+
+func (s *sqlStorage) PersistContext(ctx context.Context, table string, key string) (bool, error) {
+	return s.ExpireContext(ctx, table, key, 0)
+}
+
+func (s *sqlStorage) Incr(table string, key string, delta int64, expiration time.Duration) (int64, error) {
+	return s.IncrContext(context.Background(), table, key, delta, expiration)
+}
+
+func (s *sqlStorage) IncrContext(ctx context.Context, table string, key string, delta int64, expiration time.Duration) (int64, error) {
+	err := s.checkKeyLength(table, key)
+
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := s.begin(ctx)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback()
+
+	st := s.statement()
+	st.Write("INSERT INTO ", st.Quote("keys"), " (", st.QuoteList([]string{"table", "key", "value", "ttl"}), ") VALUES (",
+		st.BindList([]interface{}{table, key, "0", expiresAt(expiration)}), ")")
+	st.InsertIgnore([]string{"table", "key"})
+
+	_, err = tx.ExecContext(ctx, st.String(), st.Args()...)
+
+	if err != nil {
+		return 0, err
+	}
+
+	current, ttl, err := s.lockKey(ctx, tx, table, key)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if ttl < time.Now().UnixNano()/int64(time.Millisecond) {
+		current = "0"
+		ttl = expiresAt(expiration)
+	}
+
+	value, err := incrValue(current, delta)
+
+	if err != nil {
+		return 0, err
+	}
+
+	st = s.statement()
+	st.Write("UPDATE ", st.Quote("keys"), " SET ", st.Quote("value"), " = ", st.Bind(strconv.FormatInt(value, 10)), ", ",
+		st.Quote("ttl"), " = ", st.Bind(ttl), " WHERE ")
+	st.WhereKey(table, key)
+
+	_, err = tx.ExecContext(ctx, st.String(), st.Args()...)
+
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return value, nil
+}
+
+// lockKey locks the row of a key for the rest of tx with an UPDATE which
+// changes nothing, because SQLite has no SELECT ... FOR UPDATE, and then reads
+// its value and ttl, expired or not. It returns sql.ErrNoRows for a missing
+// key.
+func (s *sqlStorage) lockKey(ctx context.Context, tx *sql.Tx, table string, key string) (string, int64, error) {
+	st := s.statement()
+	st.Write("UPDATE ", st.Quote("keys"), " SET ", st.Quote("ttl"), " = ", st.Quote("ttl"), " WHERE ")
+	st.WhereKey(table, key)
+
+	_, err := tx.ExecContext(ctx, st.String(), st.Args()...)
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	st = s.statement()
+	st.Write("SELECT ", st.Quote("value"), ", ", st.Quote("ttl"), " FROM ", st.Quote("keys"), " WHERE ")
+	st.WhereKey(table, key)
+
+	var value sql.NullString
+	var ttl int64
+
+	err = tx.QueryRowContext(ctx, st.String(), st.Args()...).Scan(&value, &ttl)
+
+	return value.String, ttl, err
+}
+
+func (s *sqlStorage) SetNX(table string, key string, value string, expiration time.Duration) (bool, error) {
+	return s.SetNXContext(context.Background(), table, key, value, expiration)
+}
+
+// SetNXContext removes an expired row of the key first, so that the insert
+// only conflicts with a live one.
+func (s *sqlStorage) SetNXContext(ctx context.Context, table string, key string, value string, expiration time.Duration) (bool, error) {
+	err := s.checkKeyLength(table, key)
+
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := s.begin(ctx)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer tx.Rollback()
+
+	st := s.statement()
+	st.Write("DELETE FROM ", st.Quote("keys"), " WHERE ")
+	st.WhereKey(table, key)
+	st.Write(" AND ", st.Quote("ttl"), " < ", st.Bind(time.Now().UnixNano()/int64(time.Millisecond)))
+
+	_, err = tx.ExecContext(ctx, st.String(), st.Args()...)
+
+	if err != nil {
+		return false, err
+	}
+
+	st = s.statement()
+	st.Write("INSERT INTO ", st.Quote("keys"), " (", st.QuoteList([]string{"table", "key", "value", "ttl"}), ") VALUES (",
+		st.BindList([]interface{}{table, key, value, expiresAt(expiration)}), ")")
+	st.InsertIgnore([]string{"table", "key"})
+
+	result, err := tx.ExecContext(ctx, st.String(), st.Args()...)
+
+	if err != nil {
+		return false, err
+	}
+
+	inserted, err := result.RowsAffected()
+
+	if err != nil {
+		return false, err
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return false, err
+	}
+
+	return inserted > 0, nil
+}
+
+func (s *sqlStorage) CompareAndSwap(table string, key string, old string, new string) (bool, error) {
+	return s.CompareAndSwapContext(context.Background(), table, key, old, new)
+}
+
+// CompareAndSwapContext compares the values in Go, not in the WHERE clause,
+// so that collations which ignore case cannot make different values equal.
+func (s *sqlStorage) CompareAndSwapContext(ctx context.Context, table string, key string, old string, new string) (bool, error) {
+	tx, err := s.begin(ctx)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer tx.Rollback()
+
+	current, ttl, err := s.lockKey(ctx, tx, table, key)
+
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	if ttl < time.Now().UnixNano()/int64(time.Millisecond) || current != old {
+		return false, nil
+	}
+
+	st := s.statement()
+	st.Write("UPDATE ", st.Quote("keys"), " SET ", st.Quote("value"), " = ", st.Bind(new), " WHERE ")
+	st.WhereKey(table, key)
+
+	_, err = tx.ExecContext(ctx, st.String(), st.Args()...)
+
+	if err != nil {
+		return false, err
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s *sqlStorage) DelKey(table string, key string) (int64, error) {
+	return s.DelKeyContext(context.Background(), table, key)
+}
+
+func (s *sqlStorage) DelKeyContext(ctx context.Context, table string, key string) (int64, error) {
+	st, err := s.delKeyStatement(table, key)
+
+	if err != nil {
+		return -1, err
+	}
+
+	res, err := s.exec(ctx, st)
+
+	if err != nil {
+		return -1, err
+	}
+
+	return res.RowsAffected()
+}
+
+func (s *sqlStorage) delKeyStatement(table string, key string) (*sqlStatement, error) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	st := s.statement()
+	st.Write("DELETE FROM ", st.Quote("keys"), " WHERE ")
+	st.WhereKey(table, key)
+	st.Write(" AND ", st.Quote("ttl"), " >= ", st.Bind(now))
+
+	return st, nil
+}
+
+func (s *sqlStorage) AddToMap(table string, key string, objectKey string, object string) error {
+	return s.AddToMapContext(context.Background(), table, key, objectKey, object)
+}
+
+func (s *sqlStorage) AddToMapContext(ctx context.Context, table string, key string, objectKey string, object string) error {
+	return s.AddToMapWithTTLContext(ctx, table, key, objectKey, object, 0)
+}
+
+func (s *sqlStorage) AddToMapWithTTL(table string, key string, objectKey string, object string, expiration time.Duration) error {
+	return s.AddToMapWithTTLContext(context.Background(), table, key, objectKey, object, expiration)
+}
+
+func (s *sqlStorage) AddToMapWithTTLContext(ctx context.Context, table string, key string, objectKey string, object string, expiration time.Duration) error {
+	tx, err := s.begin(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	err = s.addToMap(ctx, tx, table, key, objectKey, object, expiration)
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// addToMap stores a field with its own ttl. Every live field of a map carries
+// the map_ttl set by ExpireMap, so a new field copies it from the others, and
+// a field starting a new map gets none.
+func (s *sqlStorage) addToMap(ctx context.Context, db sqlQueryer, table string, key string, objectKey string, object string, expiration time.Duration) error {
+	err := s.checkKeyLength(table, key, objectKey)
+
+	if err != nil {
+		return err
+	}
+
+	st := s.statement()
+	st.Write("SELECT MIN(map_ttl) FROM maps WHERE ")
+	st.WhereKey(table, key)
+	st.LiveFields(time.Now().UnixNano() / int64(time.Millisecond))
+
+	var mapTTL sql.NullInt64
+
+	err = db.QueryRowContext(ctx, st.String(), st.Args()...).Scan(&mapTTL)
+
+	if err != nil {
+		return err
+	}
+
+	if !mapTTL.Valid {
+		mapTTL.Int64 = neverExpires
+	}
+
+	st = s.statement()
+	st.Write("INSERT INTO maps (", st.QuoteList([]string{"table", "key", "object_key", "value", "ttl", "map_ttl"}), ") VALUES (",
+		st.BindList([]interface{}{table, key, objectKey, object, expiresAt(expiration), mapTTL.Int64}), ")")
+	st.Upsert([]string{"table", "key", "object_key"}, []string{"value", "ttl", "map_ttl"})
+
+	_, err = db.ExecContext(ctx, st.String(), st.Args()...)
+
+	return err
+}
+
+func (s *sqlStorage) CompareAndSwapInMap(table string, key string, objectKey string, old string, new string) (bool, error) {
+	return s.CompareAndSwapInMapContext(context.Background(), table, key, objectKey, old, new)
+}
+
+// CompareAndSwapInMapContext locks the row of the field, as CompareAndSwap
+// does for keys, and only updates its value.
+func (s *sqlStorage) CompareAndSwapInMapContext(ctx context.Context, table string, key string, objectKey string, old string, new string) (bool, error) {
+	tx, err := s.begin(ctx)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer tx.Rollback()
+
+	st := s.statement()
+	st.Write("UPDATE maps SET ", st.Quote("ttl"), " = ", st.Quote("ttl"), " WHERE ")
+	st.WhereKey(table, key)
+	st.Write(" AND object_key = ", st.Bind(objectKey))
+
+	_, err = tx.ExecContext(ctx, st.String(), st.Args()...)
+
+	if err != nil {
+		return false, err
+	}
+
+	st = s.statement()
+	st.Write("SELECT ", st.Quote("value"), " FROM maps WHERE ")
+	st.WhereKey(table, key)
+	st.Write(" AND object_key = ", st.Bind(objectKey))
+	st.LiveFields(time.Now().UnixNano() / int64(time.Millisecond))
+
+	var current string
+
+	err = tx.QueryRowContext(ctx, st.String(), st.Args()...).Scan(&current)
+
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	if current != old {
+		return false, nil
+	}
+
+	st = s.statement()
+	st.Write("UPDATE maps SET ", st.Quote("value"), " = ", st.Bind(new), " WHERE ")
+	st.WhereKey(table, key)
+	st.Write(" AND object_key = ", st.Bind(objectKey))
+
+	_, err = tx.ExecContext(ctx, st.String(), st.Args()...)
+
+	if err != nil {
+		return false, err
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s *sqlStorage) ExpireMap(table string, key string, expiration time.Duration) error {
+	return s.ExpireMapContext(context.Background(), table, key, expiration)
+}
+
+func (s *sqlStorage) ExpireMapContext(ctx context.Context, table string, key string, expiration time.Duration) error {
+	st := s.statement()
+	st.Write("UPDATE maps SET map_ttl = ", st.Bind(expiresAt(expiration)), " WHERE ")
+	st.WhereKey(table, key)
+	st.LiveFields(time.Now().UnixNano() / int64(time.Millisecond))
+
+	_, err := s.exec(ctx, st)
+
+	return err
+}
+
+func (s *sqlStorage) MapTTL(table string, key string) (map[string]time.Duration, time.Duration, error) {
+	return s.MapTTLContext(context.Background(), table, key)
+}
+
+func (s *sqlStorage) MapTTLContext(ctx context.Context, table string, key string) (map[string]time.Duration, time.Duration, error) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	st := s.statement()
+	st.Write("SELECT object_key, ", st.Quote("ttl"), ", map_ttl FROM maps WHERE ")
+	st.WhereKey(table, key)
+	st.LiveFields(now)
+
+	rows, err := s.readQuery(ctx, st)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer rows.Close()
+
+	fields := map[string]time.Duration{}
+
+	// Every field of a map has the same map_ttl.
+	mapTTL := neverExpires
+
+	for rows.Next() {
+		var objectKey string
+		var ttl int64
+
+		err = rows.Scan(&objectKey, &ttl, &mapTTL)
+
+		if err != nil {
+			return nil, 0, err
+		}
+
+		fields[objectKey] = remainingTTL(ttl, now)
+	}
+
+	err = rows.Err()
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(fields) == 0 {
+		return nil, 0, ErrNotFound
+	}
+
+	return fields, remainingTTL(mapTTL, now), nil
+}
+
+func (s *sqlStorage) DelFromMap(table string, key string, objectKey string) error {
+	return s.DelFromMapContext(context.Background(), table, key, objectKey)
+}
+
+func (s *sqlStorage) DelFromMapContext(ctx context.Context, table string, key string, objectKey string) error {
+	st, err := s.delFromMapStatement(table, key, objectKey)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = s.exec(ctx, st)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *sqlStorage) delFromMapStatement(table string, key string, objectKey string) (*sqlStatement, error) {
+	st := s.statement()
+	st.Write("DELETE FROM maps WHERE ")
+	st.WhereKey(table, key)
+	st.Write(" AND object_key = ", st.Bind(objectKey))
+
+	return st, nil
+}
+
+func (s *sqlStorage) GetFromMap(table string, key string, objectKey string) (string, error) {
+	return s.GetFromMapContext(context.Background(), table, key, objectKey)
+}
+
+func (s *sqlStorage) GetFromMapContext(ctx context.Context, table string, key string, objectKey string) (string, error) {
+	st := s.statement()
+	st.Write("SELECT ", st.Quote("value"), " FROM maps WHERE ")
+	st.WhereKey(table, key)
+	st.Write(" AND object_key = ", st.Bind(objectKey))
+	st.LiveFields(time.Now().UnixNano() / int64(time.Millisecond))
+
+	row, err := s.readQuery(ctx, st)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer row.Close()
+	for row.Next() { // Iterate and fetch the records from result cursor
+		var value string
+		err = row.Scan(&value)
+
+		if err != nil {
+			return "", err
+		}
+
+		return value, nil
+	}
+
+	return "", row.Err()
+}
+
+func (s *sqlStorage) GetMap(table string, key string) (map[string]string, error) {
+	return s.GetMapContext(context.Background(), table, key)
+}
+
+func (s *sqlStorage) GetMapContext(ctx context.Context, table string, key string) (map[string]string, error) {
+	result := map[string]string{}
+
+	st := s.statement()
+	st.Write("SELECT object_key, ", st.Quote("value"), " FROM maps WHERE ")
+	st.WhereKey(table, key)
+	st.LiveFields(time.Now().UnixNano() / int64(time.Millisecond))
+
+	row, err := s.readQuery(ctx, st)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer row.Close()
+	for row.Next() { // Iterate and fetch the records from result cursor
+		var value string
+		var objectKey string
+		err = row.Scan(&objectKey, &value)
+
+		if err != nil {
+			return nil, err
+		}
+
+		result[objectKey] = value
+	}
+
+	return result, row.Err()
+}
+
+func (s *sqlStorage) Begin() (Tx, error) {
+	return s.BeginContext(context.Background())
+}
+
+func (s *sqlStorage) BeginContext(ctx context.Context) (Tx, error) {
+	tx, err := s.begin(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqlTx{
+		storage: s,
+		tx:      tx,
+		ctx:     ctx,
+	}, nil
+}
+
+type sqlTx struct {
+	storage *sqlStorage
+	tx      *sql.Tx
+	ctx     context.Context
+}
+
+func (t *sqlTx) exec(st *sqlStatement, err error) error {
+	if err != nil {
+		return err
+	}
+
+	_, err = t.tx.ExecContext(t.ctx, st.String(), st.Args()...)
+
+	return err
+}
+
+func (t *sqlTx) SetKey(table string, key string, value string, expiration time.Duration) error {
+	return t.exec(t.storage.setKeyStatement(table, key, value, expiration))
+}
+
+func (t *sqlTx) DelKey(table string, key string) error {
+	return t.exec(t.storage.delKeyStatement(table, key))
+}
+
+func (t *sqlTx) AddToMap(table string, key string, objectKey string, object string) error {
+	return t.storage.addToMap(t.ctx, t.tx, table, key, objectKey, object, 0)
+}
+
+func (t *sqlTx) AddToMapWithTTL(table string, key string, objectKey string, object string, expiration time.Duration) error {
+	return t.storage.addToMap(t.ctx, t.tx, table, key, objectKey, object, expiration)
+}
+
+func (t *sqlTx) DelFromMap(table string, key string, objectKey string) error {
+	return t.exec(t.storage.delFromMapStatement(table, key, objectKey))
+}
+
+func (t *sqlTx) Commit() error {
+	return t.tx.Commit()
+}
+
+func (t *sqlTx) Rollback() error {
+	return t.tx.Rollback()
+}
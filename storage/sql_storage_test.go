@@ -0,0 +1,277 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+var trickyValues = []string{
+	"plain",
+	"it's",
+	`"double" 'single' ''`,
+	"'); DROP TABLE keys; --",
+	`back\slash\\ \'`,
+	"nul\x00byte",
+	"\x00",
+	"мулти-байт ключ",
+	"日本語のテキスト",
+	"emoji 🔐🗝️",
+	"",
+}
+
+// newTestSQLiteStorage creates a SQLite storage in a temporary file, unless
+// the optional credentials name a file of their own.
+func newTestSQLiteStorage(t *testing.T, extra ...map[string]string) *SQLiteStorage {
+	dir, err := ioutil.TempDir("", "netclave-storage")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	credentials := map[string]string{
+		"filename": filepath.Join(dir, "storage.db"),
+	}
+
+	for _, values := range extra {
+		for key, value := range values {
+			credentials[key] = value
+		}
+	}
+
+	storage, err := CreateStorage(credentials, SQLITE_STORAGE, true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		storage.Destroy()
+	})
+
+	err = storage.Init()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return storage.(*SQLiteStorage)
+}
+
+func TestSQLStatementPlaceholders(t *testing.T) {
+	tests := []struct {
+		dialect  sqlDialect
+		expected string
+	}{
+		{sqliteDialect{}, `SELECT "value" FROM "keys" WHERE "table" = ? AND "key" = ?`},
+		{postgreSQLDialect{}, `SELECT "value" FROM "keys" WHERE "table" = $1 AND "key" = $2`},
+		{mySQLDialect{}, "SELECT `value` FROM `keys` WHERE `table` = ? AND `key` = ?"},
+	}
+
+	for _, test := range tests {
+		st := newSQLStatement(test.dialect)
+		st.Write("SELECT ", st.Quote("value"), " FROM ", st.Quote("keys"),
+			" WHERE ", st.Quote("table"), " = ", st.Bind("t'1"), " AND ", st.Quote("key"), " = ", st.Bind("k'2"))
+
+		if st.String() != test.expected {
+			t.Errorf("%T: got %q, want %q", test.dialect, st.String(), test.expected)
+		}
+
+		if !reflect.DeepEqual(st.Args(), []interface{}{"t'1", "k'2"}) {
+			t.Errorf("%T: unexpected args %v", test.dialect, st.Args())
+		}
+	}
+}
+
+func TestSQLDialectUpsert(t *testing.T) {
+	conflict := []string{"table_hash", "object_key_hash"}
+	update := []string{"value"}
+
+	got := sqliteDialect{}.Upsert(conflict, update)
+	want := ` ON CONFLICT("table_hash", "object_key_hash") DO UPDATE SET "value" = EXCLUDED."value"`
+
+	if got != want {
+		t.Errorf("sqlite upsert: got %q, want %q", got, want)
+	}
+
+	got = mySQLDialect{}.Upsert(conflict, update)
+	want = " ON DUPLICATE KEY UPDATE `value` = VALUES(`value`)"
+
+	if got != want {
+		t.Errorf("mysql upsert: got %q, want %q", got, want)
+	}
+}
+
+func TestSQLiteKeyRoundTrip(t *testing.T) {
+	storage := newTestSQLiteStorage(t)
+
+	for _, value := range trickyValues {
+		key := "key/" + value
+
+		err := storage.SetKey("table's", key, value, 0)
+
+		if err != nil {
+			t.Fatalf("SetKey(%q): %v", value, err)
+		}
+
+		got, err := storage.GetKey("table's", key)
+
+		if err != nil {
+			t.Fatalf("GetKey(%q): %v", value, err)
+		}
+
+		if got != value {
+			t.Errorf("GetKey(%q) = %q", value, got)
+		}
+
+		got, err = storage.GetFullKey("table's/" + key)
+
+		if err != nil {
+			t.Fatalf("GetFullKey(%q): %v", value, err)
+		}
+
+		if got != value {
+			t.Errorf("GetFullKey(%q) = %q", value, got)
+		}
+	}
+
+	keys, err := storage.GetKeys("table's", "key/*")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{}
+
+	for _, value := range trickyValues {
+		expected = append(expected, "table's/key/"+value)
+	}
+
+	sort.Strings(keys)
+	sort.Strings(expected)
+
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("GetKeys = %q, want %q", keys, expected)
+	}
+
+	for _, value := range trickyValues {
+		deleted, err := storage.DelKey("table's", "key/"+value)
+
+		if err != nil {
+			t.Fatalf("DelKey(%q): %v", value, err)
+		}
+
+		if deleted != 1 {
+			t.Errorf("DelKey(%q) deleted %d rows", value, deleted)
+		}
+	}
+}
+
+func TestSQLiteMapRoundTrip(t *testing.T) {
+	storage := newTestSQLiteStorage(t)
+
+	expected := map[string]string{}
+
+	for _, value := range trickyValues {
+		err := storage.AddToMap("maps'", "map\\'key", value, value+value)
+
+		if err != nil {
+			t.Fatalf("AddToMap(%q): %v", value, err)
+		}
+
+		expected[value] = value + value
+
+		got, err := storage.GetFromMap("maps'", "map\\'key", value)
+
+		if err != nil {
+			t.Fatalf("GetFromMap(%q): %v", value, err)
+		}
+
+		if got != value+value {
+			t.Errorf("GetFromMap(%q) = %q", value, got)
+		}
+	}
+
+	got, err := storage.GetMap("maps'", "map\\'key")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("GetMap = %q, want %q", got, expected)
+	}
+
+	for _, value := range trickyValues {
+		err = storage.DelFromMap("maps'", "map\\'key", value)
+
+		if err != nil {
+			t.Fatalf("DelFromMap(%q): %v", value, err)
+		}
+	}
+
+	got, err = storage.GetMap("maps'", "map\\'key")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 0 {
+		t.Errorf("GetMap after DelFromMap = %q", got)
+	}
+}
+
+func TestSQLiteHonoursContext(t *testing.T) {
+	storage := newTestSQLiteStorage(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := storage.SetKeyContext(ctx, "table", "key", "value", 0)
+
+	if err != context.Canceled {
+		t.Errorf("SetKeyContext with a cancelled context returned %v", err)
+	}
+
+	_, err = storage.GetMapContext(ctx, "table", "key")
+
+	if err != context.Canceled {
+		t.Errorf("GetMapContext with a cancelled context returned %v", err)
+	}
+
+	err = storage.SetKeyContext(context.Background(), "table", "key", "value", 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := storage.GetKey("table", "key")
+
+	if err != nil || value != "value" {
+		t.Errorf("GetKey = %q, %v", value, err)
+	}
+}
@@ -0,0 +1,385 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Credentials keys of Watch on the SQL backends. WATCH is "true" to record
+// the changes Watch delivers, which is off by default: Init then creates the
+// triggers recording every write, and on SQLite and MySQL the changelog table
+// they fill. On MySQL with binary logging, creating triggers takes the SUPER
+// privilege or log_bin_trust_function_creators. The triggers stay once
+// created, so every process sharing a database should set WATCH alike, as
+// only those which do purge the changelog.
+//
+// SQLite and MySQL poll the changelog for changes every WATCH_POLL_INTERVAL,
+// and the reaper deletes changes older than the retention.
+var WATCH = "watch"
+var WATCH_POLL_INTERVAL = "watchpollinterval"
+var CHANGELOG_RETENTION = "changelogretention"
+
+var DefaultWatchPollInterval = time.Second
+var DefaultChangelogRetention = time.Hour
+
+type WatchOptions struct {
+	Enabled            bool
+	PollInterval       time.Duration
+	ChangelogRetention time.Duration
+}
+
+// ParseWatchOptions reads the Watch settings from credentials. Missing or
+// non positive values get the defaults.
+func ParseWatchOptions(credentials map[string]string) (*WatchOptions, error) {
+	options := &WatchOptions{
+		PollInterval:       DefaultWatchPollInterval,
+		ChangelogRetention: DefaultChangelogRetention,
+	}
+
+	var err error
+
+	if value := credentials[WATCH]; value != "" {
+		options.Enabled, err = strconv.ParseBool(value)
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s %q: %w", WATCH, value, err)
+		}
+	}
+
+	if value := credentials[WATCH_POLL_INTERVAL]; value != "" {
+		options.PollInterval, err = time.ParseDuration(value)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if value := credentials[CHANGELOG_RETENTION]; value != "" {
+		options.ChangelogRetention, err = time.ParseDuration(value)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if options.PollInterval <= 0 {
+		options.PollInterval = DefaultWatchPollInterval
+	}
+
+	if options.ChangelogRetention <= 0 {
+		options.ChangelogRetention = DefaultChangelogRetention
+	}
+
+	return options, nil
+}
+
+// With WATCH, every change of the keys and maps tables is recorded by
+// triggers, so that writes of other processes and the deletions of the
+// reaper are seen too.
+// SQLite and MySQL insert the changes into the changelog table, PostgreSQL
+// sends them as notifications on watchChannel.
+var changelogTable = "changelog"
+var watchChannel = "netclave_watch"
+
+// changelogSettleTime is how long a change may take to commit after changes
+// with higher ids did. Longer transactions may have their changes missed.
+var changelogSettleTime = 10 * time.Second
+
+// sqlChangeTrigger describes a trigger recording the changes one operation
+// makes to the keys or maps table. event is the SQL expression of the
+// EventType, row the row it is about, NEW or OLD, and condition tells, if
+// set, which rows changed at all.
+type sqlChangeTrigger struct {
+	name      string
+	table     string
+	operation string
+	row       string
+	event     string
+	condition string
+}
+
+// sqlChangeTriggers returns the triggers of the keys and maps tables. A row
+// deleted after its expiration was purged by the reaper, or by SetNX making
+// room, and is reported as expired. Deleting a map field is a change of the
+// map unless no live field is left. Updates which change neither a value nor
+// an expiration, such as the one locking a row, are not changes.
+func sqlChangeTriggers(d sqlDialect) []sqlChangeTrigger {
+	q := d.Quote
+	now := d.Now()
+
+	literal := func(eventType EventType) string {
+		return "'" + string(eventType) + "'"
+	}
+
+	column := func(row string, name string) string {
+		return row + "." + q(name)
+	}
+
+	changed := func(columns ...string) string {
+		condition := ""
+
+		for i, name := range columns {
+			if i > 0 {
+				condition += " OR "
+			}
+
+			condition += column("NEW", name) + " <> " + column("OLD", name)
+		}
+
+		return condition
+	}
+
+	keyDeleted := "CASE WHEN " + column("OLD", "ttl") + " < " + now + " THEN " + literal(EventExpire) +
+		" ELSE " + literal(EventDelete) + " END"
+
+	mapDeleted := "CASE WHEN EXISTS (SELECT 1 FROM " + q("maps") + " WHERE " +
+		q("table") + " = " + column("OLD", "table") + " AND " + q("key") + " = " + column("OLD", "key") +
+		" AND " + q("ttl") + " >= " + now + " AND " + q("map_ttl") + " >= " + now + ") THEN " + literal(EventSet) +
+		" WHEN " + column("OLD", "ttl") + " < " + now + " OR " + column("OLD", "map_ttl") + " < " + now + " THEN " + literal(EventExpire) +
+		" ELSE " + literal(EventDelete) + " END"
+
+	return []sqlChangeTrigger{
+		{name: "keys_insert_watch", table: "keys", operation: "INSERT", row: "NEW", event: literal(EventSet)},
+		{name: "keys_update_watch", table: "keys", operation: "UPDATE", row: "NEW", event: literal(EventSet),
+			condition: changed("value", "ttl")},
+		{name: "keys_delete_watch", table: "keys", operation: "DELETE", row: "OLD", event: keyDeleted},
+		{name: "maps_insert_watch", table: "maps", operation: "INSERT", row: "NEW", event: literal(EventSet)},
+		{name: "maps_update_watch", table: "maps", operation: "UPDATE", row: "NEW", event: literal(EventSet),
+			condition: changed("value", "ttl", "map_ttl")},
+		{name: "maps_delete_watch", table: "maps", operation: "DELETE", row: "OLD", event: mapDeleted},
+	}
+}
+
+// changelogInsert returns the statement of a trigger inserting its change
+// into the changelog table. from completes the SELECT for dialects which want
+// a table, such as " FROM DUAL".
+func (ct sqlChangeTrigger) changelogInsert(d sqlDialect, from string) string {
+	st := newSQLStatement(d)
+	st.Write("INSERT INTO ", st.Quote(changelogTable), " (", st.QuoteList([]string{"table", "key", "event", "created_at"}),
+		") SELECT ", ct.row, ".", st.Quote("table"), ", ", ct.row, ".", st.Quote("key"), ", ", ct.event, ", ", d.Now(), from)
+
+	if ct.condition != "" {
+		st.Write(" WHERE ", ct.condition)
+	}
+
+	return st.String()
+}
+
+var errWatchDisabled = errors.New("Watch is disabled, the credentials must set " + WATCH + " to true")
+
+// createWatchSchema returns the setup of what Watch needs in the database of
+// a dialect. It runs statements, which can run again without harm, then the
+// statements create returns for each change trigger the database lacks.
+// Triggers are not replaced, as MySQL before 8.0.29 could only drop and
+// create them again and miss the changes made in between, so a trigger
+// whose definition changes needs a name of its own.
+func createWatchSchema(statements []string, d sqlDialect, create func(trigger sqlChangeTrigger) []string) func(ctx context.Context, mt *migrationTx) error {
+	return func(ctx context.Context, mt *migrationTx) error {
+		for _, statement := range statements {
+			err := mt.exec(ctx, statement)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, trigger := range sqlChangeTriggers(d) {
+			count, err := mt.count(ctx, mt.s.dialect.TriggerExists(), trigger.table, trigger.name)
+
+			if err != nil {
+				return err
+			}
+
+			if count > 0 {
+				continue
+			}
+
+			for _, statement := range create(trigger) {
+				err = mt.exec(ctx, statement)
+
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+}
+
+// setupWatch creates what Watch needs in the database, in one transaction, if
+// the credentials set WATCH. Init calls it after the migrations.
+func (s *sqlStorage) setupWatch(ctx context.Context) error {
+	if !s.watchOptions.Enabled || s.watchSchema == nil {
+		return nil
+	}
+
+	return s.withSchemaLock(ctx, func(conn *sql.Conn) error {
+		tx, err := conn.BeginTx(ctx, nil)
+
+		if err != nil {
+			return err
+		}
+
+		defer tx.Rollback()
+
+		err = s.watchSchema(ctx, &migrationTx{s: s, tx: tx})
+
+		if err != nil {
+			return fmt.Errorf("Can not set up Watch: %w", err)
+		}
+
+		return tx.Commit()
+	})
+}
+
+// Watch polls the changelog table every WATCH_POLL_INTERVAL. PostgreSQL
+// overrides it with notifications.
+func (s *sqlStorage) Watch(ctx context.Context, table string, pattern string) (<-chan Event, error) {
+	if !s.watchOptions.Enabled {
+		return nil, errWatchDisabled
+	}
+
+	filter, err := newWatchFilter(table, pattern, s.patternSyntax)
+
+	if err != nil {
+		return nil, err
+	}
+
+	st := s.statement()
+	st.Write("SELECT COALESCE(MAX(", st.Quote("id"), "), 0) FROM ", st.Quote(changelogTable))
+
+	var cursor int64
+
+	err = s.queryRow(ctx, st).Scan(&cursor)
+
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan Event, watchBufferSize)
+
+	go s.pollChangelog(ctx, filter, cursor, events)
+
+	return events, nil
+}
+
+// changelogEntry is a row of the changelog table.
+type changelogEntry struct {
+	id    int64
+	event Event
+}
+
+// pollChangelog delivers the changes after cursor. Ids are handed out when the
+// changes are made, not when they are committed, so a change may show up
+// after others with higher ids. The cursor therefore only passes changes
+// read at least changelogSettleTime ago, and those above it which were
+// delivered already are remembered.
+func (s *sqlStorage) pollChangelog(ctx context.Context, filter *watchFilter, cursor int64, events chan<- Event) {
+	defer close(events)
+
+	ticker := time.NewTicker(s.watchOptions.PollInterval)
+	defer ticker.Stop()
+
+	delivered := map[int64]time.Time{}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		entries, err := s.readChangelog(ctx, filter.table, cursor)
+
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Println("Can not read changelog: " + err.Error())
+			}
+
+			continue
+		}
+
+		now := time.Now()
+
+		for _, entry := range entries {
+			if _, ok := delivered[entry.id]; ok {
+				continue
+			}
+
+			delivered[entry.id] = now
+
+			if filter.match(entry.event) && !sendEvent(ctx, events, entry.event) {
+				return
+			}
+		}
+
+		for id, read := range delivered {
+			if id > cursor && now.Sub(read) >= changelogSettleTime {
+				cursor = id
+			}
+		}
+
+		for id := range delivered {
+			if id <= cursor {
+				delete(delivered, id)
+			}
+		}
+	}
+}
+
+func (s *sqlStorage) readChangelog(ctx context.Context, table string, cursor int64) ([]changelogEntry, error) {
+	st := s.statement()
+	st.Write("SELECT ", st.QuoteList([]string{"id", "key", "event"}), " FROM ", st.Quote(changelogTable),
+		" WHERE ", st.Quote("id"), " > ", st.Bind(cursor), " AND ", st.Quote("table"), " = ", st.Bind(table),
+		" ORDER BY ", st.Quote("id"))
+
+	rows, err := s.query(ctx, st)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	entries := []changelogEntry{}
+
+	for rows.Next() {
+		entry := changelogEntry{
+			event: Event{
+				Table: table,
+			},
+		}
+
+		err = rows.Scan(&entry.id, &entry.event.Key, &entry.event.Type)
+
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
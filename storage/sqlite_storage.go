@@ -17,20 +17,16 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
-	"errors"
-	"fmt"
-	"log"
-	"math"
 	"os"
 	"strconv"
-	"time"
 
 	_ "github.com/mattn/go-sqlite3" // Import go-sqlite3 library
 )
 
 type SQLiteStorage struct {
-	Connection *sql.DB
+	sqlStorage
 }
 
 func fileExists(filename string) bool {
@@ -56,551 +52,113 @@ func (ss *SQLiteStorage) Setup(credentials map[string]string) error {
 }
 
 func (ss *SQLiteStorage) Init() error {
-	keysTableSQL := `CREATE TABLE IF NOT EXISTS keys (
-		"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,		
-		"table" TEXT,
-		"table_hash" INTEGER,
-		"key" TEXT,
-		`
+	_, err := ss.Migrate(context.Background())
 
-	keysUniqueIndexValues := ""
-
-	for i := 1; i <= NumberOfColumns; i++ {
-		keysTableSQL += `"column_` + strconv.Itoa(i) + `_hash" INTEGER,
-		`
-
-		keysUniqueIndexValues = keysUniqueIndexValues + "column_" + strconv.Itoa(i) + "_hash"
-
-		if i != NumberOfColumns {
-			keysUniqueIndexValues = keysUniqueIndexValues + ", "
-		}
-	}
-
-	keysUniqueIndexValues += ", table_hash"
-
-	keysTableSQL += `"value" TEXT,
-		"ttl" INTEGER,		
-	   CONSTRAINT columns_unique_key UNIQUE(` + keysUniqueIndexValues + `));
-	  ` // SQL Statement for Create Table
-
-	keysTableSQL = keysTableSQL + `CREATE INDEX IF NOT EXISTS table_hash_index ON keys(table_hash);
-	`
-
-	for i := 1; i <= NumberOfColumns; i++ {
-		keysTableSQL = keysTableSQL + `CREATE INDEX IF NOT EXISTS column_` + strconv.Itoa(i) + `_hash_index ON keys(column_` + strconv.Itoa(i) + `_hash);
-		`
-	}
-
-	keysTableSQL = keysTableSQL + `CREATE INDEX IF NOT EXISTS ttl_index ON keys(ttl);
-	`
-
-	//keysTableSQL = keysTableSQL + `CREATE UNIQUE INDEX IF NOT EXISTS update_index ON keys(` + keysUniqueIndexValues + `);
-	//`
-
-	//log.Println(keysTableSQL)
-
-	//log.Println("Create keys table...")
-	statement, err := ss.Connection.Prepare(keysTableSQL) // Prepare SQL Statement
 	if err != nil {
 		return err
 	}
 
-	_, err = statement.Exec()
+	return ss.setupWatch(context.Background())
+}
 
-	if err != nil {
-		return err
+// sqliteMigrations lists the schema changes of SQLiteStorage, oldest first.
+func sqliteMigrations() []sqlMigration {
+	tables := []string{`CREATE TABLE IF NOT EXISTS keys (
+		"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"table" TEXT NOT NULL,
+		"key" TEXT NOT NULL,
+		"value" TEXT,
+		"ttl" INTEGER)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS ` + keysUniqueIndex + ` ON keys("table", "key")`,
+		`CREATE INDEX IF NOT EXISTS keys_expiry_index ON keys(ttl)`,
+		`CREATE TABLE IF NOT EXISTS maps (
+		"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"table" TEXT NOT NULL,
+		"key" TEXT NOT NULL,
+		"object_key" TEXT NOT NULL,
+		"value" TEXT)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS ` + mapsUniqueIndex + ` ON maps("table", "key", "object_key")`,
 	}
 
-	mapsTableSQL := `CREATE TABLE IF NOT EXISTS maps (
-		"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,		
-		"table" TEXT,
-		"table_hash" INTEGER,
-		"key" TEXT,
-		`
-
-	mapKeysUniqueIndexValues := ""
-
-	for i := 1; i <= NumberOfColumns; i++ {
-		mapsTableSQL += `"column_` + strconv.Itoa(i) + `_hash" INTEGER,
-		`
-
-		mapKeysUniqueIndexValues = mapKeysUniqueIndexValues + "column_" + strconv.Itoa(i) + "_hash"
-
-		if i != NumberOfColumns {
-			mapKeysUniqueIndexValues = mapKeysUniqueIndexValues + ", "
-		}
+	mapExpiry := []sqlColumn{
+		{table: "maps", name: "ttl", definition: "INTEGER NOT NULL DEFAULT " + strconv.FormatInt(neverExpires, 10)},
+		{table: "maps", name: "map_ttl", definition: "INTEGER NOT NULL DEFAULT " + strconv.FormatInt(neverExpires, 10)},
 	}
 
-	mapKeysUniqueIndexValues += ", table_hash"
-	mapKeysUniqueIndexValues += ", object_key_hash"
-
-	mapsTableSQL += `"value" TEXT,
-		"object_key" TEXT,		
-		"object_key_hash" INTEGER,		
-	   CONSTRAINT map_columns_unique_key UNIQUE(` + mapKeysUniqueIndexValues + `));
-	  ` // SQL Statement for Create Table
-
-	mapsTableSQL = mapsTableSQL + `CREATE INDEX IF NOT EXISTS table_hash_index ON maps(table_hash);
-	`
-
-	for i := 1; i <= NumberOfColumns; i++ {
-		mapsTableSQL = mapsTableSQL + `CREATE INDEX IF NOT EXISTS column_` + strconv.Itoa(i) + `_hash_index ON maps(column_` + strconv.Itoa(i) + `_hash);
-		`
+	return []sqlMigration{
+		{version: 1, description: "create keys and maps tables", apply: createTables(tables)},
+		{version: 2, description: "add expiration of map fields", apply: addColumns(mapExpiry)},
+		{version: 3, description: "index expiration of map fields", apply: addIndexes(mapExpiryIndexes)},
 	}
+}
 
-	mapsTableSQL = mapsTableSQL + `CREATE INDEX IF NOT EXISTS object_key_hash_index ON maps(object_key_hash);
-	`
-
-	//keysTableSQL = keysTableSQL + `CREATE UNIQUE INDEX IF NOT EXISTS update_index ON keys(` + keysUniqueIndexValues + `);
-	//`
-
-	//log.Println(mapsTableSQL)
-
-	//log.Println("Create keys table...")
-	statementMap, err := ss.Connection.Prepare(mapsTableSQL) // Prepare SQL Statement
-	if err != nil {
-		return err
-	}
-
-	_, err = statementMap.Exec()
-
-	if err != nil {
-		return err
+// sqliteWatchSchema creates the changelog table and the triggers filling it.
+func sqliteWatchSchema() func(ctx context.Context, mt *migrationTx) error {
+	changelog := []string{`CREATE TABLE IF NOT EXISTS ` + changelogTable + ` (
+		"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"table" TEXT NOT NULL,
+		"key" TEXT NOT NULL,
+		"event" TEXT NOT NULL,
+		"created_at" INTEGER NOT NULL)`,
+		`CREATE INDEX IF NOT EXISTS changelog_created_index ON ` + changelogTable + `(created_at)`,
 	}
 
-	LastTruncate = 0
-
-	return nil
+	return createWatchSchema(changelog, sqliteDialect{}, func(trigger sqlChangeTrigger) []string {
+		return []string{"CREATE TRIGGER IF NOT EXISTS " + trigger.name + " AFTER " + trigger.operation +
+			" ON " + trigger.table + " FOR EACH ROW BEGIN " + trigger.changelogInsert(sqliteDialect{}, "") + "; END"}
+	})
 }
 
 func (ss *SQLiteStorage) Create(credentials map[string]string) error {
 	var err error
 
-	ss.Connection, err = sql.Open("sqlite3", credentials["filename"]) // Open the created SQLite File
-
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (ss *SQLiteStorage) Destroy() error {
-	return ss.Connection.Close() // Defer Closing the database
-}
-
-func (ss *SQLiteStorage) GetKeys(table string, pattern string) ([]string, error) {
-	err := ss.KeysCleanUp()
-
-	if err != nil {
-		return nil, err
-	}
-
-	keys := []string{}
-
-	columns := SplitToParts(pattern)
-
-	if len(columns) > NumberOfColumns {
-		return nil, errors.New("Too many data columns")
-	}
-
-	hashes := CalculateHashesOfColumns(columns)
-	tableHash := CalculateHash(table)
+	ss.dialect = sqliteDialect{}
+	ss.migrations = sqliteMigrations()
+	ss.watchSchema = sqliteWatchSchema()
 
-	clause := CreateWhereClause(columns, hashes)
-
-	sql := "SELECT `table`, `key`, ttl FROM keys WHERE table_hash = " + fmt.Sprint(tableHash)
-
-	if clause != "" {
-		sql += " AND " + clause
-	}
-
-	now := time.Now().UnixNano() / int64(time.Millisecond)
-
-	row, err := ss.Connection.Query(sql)
-
-	if err != nil {
-		return nil, err
-	}
-
-	defer row.Close()
-	for row.Next() { // Iterate and fetch the records from result cursor
-		var table string
-		var key string
-		var ttl int64
-		row.Scan(&table, &key, &ttl)
-
-		if ttl >= now {
-			keys = append(keys, table+"/"+key)
-		}
-	}
-
-	sql = "SELECT `table`, `key` FROM maps WHERE table_hash = " + fmt.Sprint(tableHash)
-
-	if clause != "" {
-		sql += " AND " + clause
-	}
-
-	now = time.Now().UnixNano() / int64(time.Millisecond)
-
-	row, err = ss.Connection.Query(sql)
-
-	if err != nil {
-		return nil, err
-	}
-
-	defer row.Close()
-	for row.Next() { // Iterate and fetch the records from result cursor
-		var table string
-		var key string
-		row.Scan(&table, &key)
-
-		keys = append(keys, table+"/"+key)
-	}
-
-	return keys, nil
-}
-
-func (ss *SQLiteStorage) SetKey(table string, key string, value string, expiration time.Duration) error {
-	err := ss.KeysCleanUp()
+	ss.watchOptions, err = ParseWatchOptions(credentials)
 
 	if err != nil {
 		return err
 	}
 
-	columns := SplitToParts(key)
-
-	if len(columns) > NumberOfColumns {
-		return errors.New("Too many data columns")
-	}
-
-	hashes := CalculateHashesOfColumns(columns)
-	tableHash := CalculateHash(table)
-
-	sql := "INSERT INTO keys (`table`, table_hash, key,"
-
-	keysUniqueIndexValues := ""
-
-	for i := 1; i <= NumberOfColumns; i++ {
-		sql += " column_" + strconv.Itoa(i) + "_hash,"
-	}
-
-	sql += " value, ttl) VALUES ('" + table + "', " + fmt.Sprint(tableHash) + ", '" + key + "',"
-
-	hashesLen := len(hashes)
-
-	for i := 1; i <= NumberOfColumns; i++ {
-		if i <= hashesLen {
-			sql += " " + fmt.Sprint(hashes[i-1]) + ","
-		} else {
-			sql += " 0,"
-		}
-
-		keysUniqueIndexValues = keysUniqueIndexValues + "column_" + strconv.Itoa(i) + "_hash"
-
-		if i != NumberOfColumns {
-			keysUniqueIndexValues = keysUniqueIndexValues + ", "
-		}
-	}
-
-	keysUniqueIndexValues += ", table_hash"
-
-	until := time.Now().Add(expiration)
-
-	if expiration.Milliseconds() <= 0 {
-		until = time.Unix(0, int64(math.MaxInt64))
-	}
-
-	untilMilliseconds := until.UnixNano() / int64(time.Millisecond)
-
-	sql += " '" + value + "', " + strconv.FormatInt(untilMilliseconds, 10) + ")"
-
-	sql += " ON CONFLICT(" + keysUniqueIndexValues + ") DO UPDATE SET value = EXCLUDED.value, ttl = EXCLUDED.ttl"
-
-	//log.Println(sql)
-
-	_, err = ss.Connection.Exec(sql)
-
-	return err
-}
-
-func (ss *SQLiteStorage) GetFullKey(key string) (string, error) {
-	parts := SplitToParts(key)
-
-	table := parts[0]
-
-	newKey := ""
-
-	partsLen := len(parts)
-
-	for i := 1; i < partsLen; i++ {
-		newKey = newKey + parts[i]
-
-		if i+1 < partsLen {
-			newKey += "/"
-		}
-	}
-
-	return ss.GetKey(table, newKey)
-}
-
-func (ss *SQLiteStorage) GetKey(table string, key string) (string, error) {
-	err := ss.KeysCleanUp()
-
-	if err != nil {
-		return "", err
-	}
-
-	columns := SplitToParts(key)
-
-	if len(columns) > NumberOfColumns {
-		return "", errors.New("Too many data columns")
-	}
-
-	hashes := CalculateHashesOfColumns(columns)
-	tableHash := CalculateHash(table)
-
-	clause := CreateWhereClause(columns, hashes)
-
-	sql := "SELECT `value`, `ttl` FROM keys WHERE table_hash = " + fmt.Sprint(tableHash)
-
-	if clause != "" {
-		sql += " AND " + clause
-	}
-
-	now := time.Now().UnixNano() / int64(time.Millisecond)
+	ss.changelog = ss.watchOptions.Enabled
 
-	row, err := ss.Connection.Query(sql)
+	ss.patternSyntax, err = ParsePatternSyntax(credentials)
 
 	if err != nil {
-		return "", err
-	}
-
-	defer row.Close()
-	for row.Next() { // Iterate and fetch the records from result cursor
-		var value string
-		var ttl int64
-		row.Scan(&value, &ttl)
-
-		if ttl >= now {
-			return value, nil
-		}
-	}
-
-	return "", nil
-}
-
-func (ss *SQLiteStorage) KeysCleanUp() error {
-	now := time.Now().UnixNano() / int64(time.Millisecond)
-
-	if (now - LastTruncate) > TruncateInterval {
-		nowStr := fmt.Sprint(now)
-
-		log.Println(nowStr)
-
-		sql := "DELETE FROM keys WHERE ttl < " + nowStr
-
-		result, err := ss.Connection.Exec(sql)
-
-		if err != nil {
-			return err
-		}
-
-		truncatedRows, err := result.RowsAffected()
-
-		if err != nil {
-			return err
-		}
-
-		log.Printf("%d rows truncated\n", truncatedRows)
-
-		LastTruncate = now
+		return err
 	}
 
-	return nil
-}
-
-func (ss *SQLiteStorage) DelKey(table string, key string) (int64, error) {
-	err := ss.KeysCleanUp()
+	ss.Connection, err = sql.Open("sqlite3", credentials["filename"]) // Open the created SQLite File
 
 	if err != nil {
-		return 0, err
-	}
-
-	columns := SplitToParts(key)
-
-	if len(columns) > NumberOfColumns {
-		return -1, errors.New("Too many data columns")
-	}
-
-	hashes := CalculateHashesOfColumns(columns)
-	tableHash := CalculateHash(table)
-
-	clause := CreateWhereClause(columns, hashes)
-
-	sql := "DELETE FROM keys WHERE table_hash = " + fmt.Sprint(tableHash)
-
-	if clause != "" {
-		sql += " AND " + clause
+		return err
 	}
 
-	res, err := ss.Connection.Exec(sql)
+	err = ss.configurePool(credentials)
 
 	if err != nil {
-		return -1, err
-	}
-
-	return res.RowsAffected()
-}
-
-func (ss *SQLiteStorage) AddToMap(table string, key string, objectKey string, object string) error {
-	columns := SplitToParts(key)
-
-	if len(columns) > NumberOfColumns {
-		return errors.New("Too many data columns")
-	}
-
-	hashes := CalculateHashesOfColumns(columns)
-	tableHash := CalculateHash(table)
-	objectKeyHash := CalculateHash(objectKey)
-
-	sql := "INSERT INTO maps (`table`, table_hash, key, object_key, object_key_hash,"
-
-	keysUniqueIndexValues := ""
-
-	for i := 1; i <= NumberOfColumns; i++ {
-		sql += " column_" + strconv.Itoa(i) + "_hash,"
-	}
-
-	sql += " value) VALUES ('" + table + "', " + fmt.Sprint(tableHash) + ", '" + key + "', '" + objectKey + "', " + fmt.Sprint(objectKeyHash) + ", "
-
-	hashesLen := len(hashes)
-
-	for i := 1; i <= NumberOfColumns; i++ {
-		if i <= hashesLen {
-			sql += " " + fmt.Sprint(hashes[i-1]) + ","
-		} else {
-			sql += " 0,"
-		}
-
-		keysUniqueIndexValues = keysUniqueIndexValues + "column_" + strconv.Itoa(i) + "_hash"
-
-		if i != NumberOfColumns {
-			keysUniqueIndexValues = keysUniqueIndexValues + ", "
-		}
-	}
-
-	keysUniqueIndexValues += ", table_hash"
-	keysUniqueIndexValues += ", object_key_hash"
-
-	sql += " '" + object + "')"
-
-	sql += " ON CONFLICT(" + keysUniqueIndexValues + ") DO UPDATE SET value = EXCLUDED.value"
-
-	//log.Println(sql)
-
-	_, err := ss.Connection.Exec(sql)
-
-	return err
-}
-
-func (ss *SQLiteStorage) DelFromMap(table string, key string, objectKey string) error {
-	columns := SplitToParts(key)
-
-	if len(columns) > NumberOfColumns {
-		return errors.New("Too many data columns")
-	}
-
-	hashes := CalculateHashesOfColumns(columns)
-	tableHash := CalculateHash(table)
-	objectKeyHash := CalculateHash(objectKey)
-
-	clause := CreateWhereClause(columns, hashes)
-
-	sql := "DELETE FROM maps WHERE table_hash = " + fmt.Sprint(tableHash) + " AND object_key_hash = " + fmt.Sprint(objectKeyHash)
-
-	if clause != "" {
-		sql += " AND " + clause
+		ss.Connection.Close()
+		return err
 	}
 
-	_, err := ss.Connection.Exec(sql)
+	err = ss.startReaper(credentials)
 
 	if err != nil {
+		ss.Connection.Close()
 		return err
 	}
 
 	return nil
 }
 
-func (ss *SQLiteStorage) GetFromMap(table string, key string, objectKey string) (string, error) {
-	columns := SplitToParts(key)
-
-	if len(columns) > NumberOfColumns {
-		return "", errors.New("Too many data columns")
-	}
-
-	hashes := CalculateHashesOfColumns(columns)
-	tableHash := CalculateHash(table)
-	objectKeyHash := CalculateHash(objectKey)
-
-	clause := CreateWhereClause(columns, hashes)
-
-	sql := "SELECT `value` FROM maps WHERE table_hash = " + fmt.Sprint(tableHash) + " AND object_key_hash = " + fmt.Sprint(objectKeyHash)
-
-	if clause != "" {
-		sql += " AND " + clause
-	}
-
-	row, err := ss.Connection.Query(sql)
-
-	if err != nil {
-		return "", err
-	}
-
-	defer row.Close()
-	for row.Next() { // Iterate and fetch the records from result cursor
-		var value string
-		row.Scan(&value)
-
-		return value, nil
-	}
-
-	return "", nil
-}
-func (ss *SQLiteStorage) GetMap(table string, key string) (map[string]string, error) {
-	result := map[string]string{}
-
-	columns := SplitToParts(key)
-
-	if len(columns) > NumberOfColumns {
-		return nil, errors.New("Too many data columns")
-	}
-
-	hashes := CalculateHashesOfColumns(columns)
-	tableHash := CalculateHash(table)
-
-	clause := CreateWhereClause(columns, hashes)
-
-	sql := "SELECT object_key, `value` FROM maps WHERE table_hash = " + fmt.Sprint(tableHash)
-
-	if clause != "" {
-		sql += " AND " + clause
-	}
-
-	row, err := ss.Connection.Query(sql)
-
-	if err != nil {
-		return nil, err
-	}
-
-	defer row.Close()
-	for row.Next() { // Iterate and fetch the records from result cursor
-		var value string
-		var objectKey string
-		row.Scan(&objectKey, &value)
+func (ss *SQLiteStorage) Destroy() error {
+	ss.stopReaper()
 
-		result[objectKey] = value
+	if ss.Connection == nil {
+		return nil
 	}
 
-	return result, nil
+	return ss.Connection.Close() // Defer Closing the database
 }
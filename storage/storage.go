@@ -17,9 +17,10 @@
 package storage
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"hash/crc32"
+	"math"
 	"strconv"
 	"strings"
 	"time"
@@ -29,25 +30,133 @@ var REDIS_STORAGE = "redis"
 var SQLITE_STORAGE = "sqlite"
 var POSTGRE_SQL_STORAGE = "postgresql"
 var MY_SQL_STORAGE = "mysql"
-var LastTruncate = int64(0)
+var MEMORY_STORAGE = "memory"
 
-const NumberOfColumns = 10
-const TruncateInterval = 60 * 1000
+// ErrNotFound is returned by LookupKey, TTL and the typed getters of
+// GenericStorage for keys which do not exist or have expired.
+var ErrNotFound = errors.New("Key not found")
+
+// ErrNotInteger is returned by Incr for a key holding something else than an
+// integer.
+var ErrNotInteger = errors.New("Value is not an integer")
+
+// ErrOverflow is returned by Incr when the result would not fit in an int64.
+var ErrOverflow = errors.New("Increment would overflow")
+
+// NoExpiration is the TTL of keys which never expire.
+const NoExpiration = time.Duration(-1)
 
 type Storage interface {
 	Setup(credentials map[string]string) error
 	Init() error
 	Create(credentials map[string]string) error
 	Destroy() error
+	// GetKeys returns "table/key" for every key and map of table matching
+	// pattern, see Pattern for the dialect and PATTERN_SYNTAX for its syntax.
 	GetKeys(table string, pattern string) ([]string, error)
+	// ScanKeys streams the keys GetKeys would return, fetching up to
+	// batchSize of them from the backend at a time.
+	ScanKeys(ctx context.Context, table string, pattern string, batchSize int) (KeyIterator, error)
+	// Tables returns the names of the tables holding live keys or maps,
+	// sorted.
+	Tables(ctx context.Context) ([]string, error)
+	// Watch delivers the changes of the keys and maps of table matching
+	// pattern until ctx is done, when the channel is closed. Changes made
+	// before Watch returns are not delivered, and events may be delayed,
+	// repeated or, while a backend reconnects, lost, so watchers which must
+	// not miss anything still read the data again now and then. The SQL
+	// backends only record changes if the credentials set WATCH.
+	Watch(ctx context.Context, table string, pattern string) (<-chan Event, error)
 	SetKey(table string, key string, value string, expiration time.Duration) error
 	GetFullKey(key string) (string, error)
 	GetKey(table string, key string) (string, error)
+	// LookupKey is GetKey, but returns ErrNotFound instead of "" for a key
+	// which does not exist, so that it can be told apart from an empty value.
+	LookupKey(table string, key string) (string, error)
+	// Exists reports whether a key, not a map, is stored and has not expired.
+	Exists(table string, key string) (bool, error)
+	// TTL returns how long a key has left before it expires, or NoExpiration.
+	TTL(table string, key string) (time.Duration, error)
+	// Expire makes a key expire after expiration, or never if expiration is
+	// zero or less as with SetKey. It reports whether there was such a key.
+	Expire(table string, key string, expiration time.Duration) (bool, error)
+	// Persist makes a key never expire and reports whether there was one.
+	Persist(table string, key string) (bool, error)
 	DelKey(table string, key string) (int64, error)
+	// Incr atomically adds delta to the integer stored in a key and returns
+	// the result. A missing or expired key counts as 0 and is created to
+	// expire after expiration, or never if that is zero or less, while an
+	// existing key keeps its expiration, so a counter counts within a fixed
+	// window. Incrementing a value which is not an integer is an error, as
+	// is an increment beyond the range of int64, which leaves the key alone.
+	Incr(table string, key string, delta int64, expiration time.Duration) (int64, error)
+	// SetNX stores a key like SetKey, but only if there is no live key of
+	// that name, and reports whether it did. A map of that name is left
+	// alone.
+	SetNX(table string, key string, value string, expiration time.Duration) (bool, error)
+	// CompareAndSwap replaces the value of a live key with new if it is old
+	// and reports whether it did. The expiration of the key is kept.
+	CompareAndSwap(table string, key string, old string, new string) (bool, error)
+	// AddToMap stores a field that does not expire by itself, replacing any
+	// expiration the field had. An expiration of the map still applies.
 	AddToMap(table string, key string, objectKey string, object string) error
+	// AddToMapWithTTL stores a field that expires on its own after
+	// expiration, or never if expiration is zero or less.
+	AddToMapWithTTL(table string, key string, objectKey string, object string, expiration time.Duration) error
+	// CompareAndSwapInMap replaces the value of a live field of a map with
+	// new if it is old and reports whether it did. The expirations of the
+	// field and of the map are kept.
+	CompareAndSwapInMap(table string, key string, objectKey string, old string, new string) (bool, error)
+	// ExpireMap makes the whole map, including fields added later, expire
+	// after expiration, the way EXPIRE does in Redis. An expiration of zero or
+	// less cancels it. A map is gone once its last field has expired, and a
+	// map created anew does not inherit the expiration.
+	ExpireMap(table string, key string, expiration time.Duration) error
+	// MapTTL returns how long each live field of a map has left before it
+	// expires on its own, or NoExpiration, and how long the whole map has
+	// left, or NoExpiration if it has no expiration of its own. A map without
+	// live fields is ErrNotFound.
+	MapTTL(table string, key string) (map[string]time.Duration, time.Duration, error)
 	DelFromMap(table string, key string, objectKey string) error
 	GetFromMap(table string, key string, objectKey string) (string, error)
 	GetMap(table string, key string) (map[string]string, error)
+
+	GetKeysContext(ctx context.Context, table string, pattern string) ([]string, error)
+	SetKeyContext(ctx context.Context, table string, key string, value string, expiration time.Duration) error
+	GetFullKeyContext(ctx context.Context, key string) (string, error)
+	GetKeyContext(ctx context.Context, table string, key string) (string, error)
+	LookupKeyContext(ctx context.Context, table string, key string) (string, error)
+	ExistsContext(ctx context.Context, table string, key string) (bool, error)
+	TTLContext(ctx context.Context, table string, key string) (time.Duration, error)
+	ExpireContext(ctx context.Context, table string, key string, expiration time.Duration) (bool, error)
+	PersistContext(ctx context.Context, table string, key string) (bool, error)
+	DelKeyContext(ctx context.Context, table string, key string) (int64, error)
+	IncrContext(ctx context.Context, table string, key string, delta int64, expiration time.Duration) (int64, error)
+	SetNXContext(ctx context.Context, table string, key string, value string, expiration time.Duration) (bool, error)
+	CompareAndSwapContext(ctx context.Context, table string, key string, old string, new string) (bool, error)
+	AddToMapContext(ctx context.Context, table string, key string, objectKey string, object string) error
+	AddToMapWithTTLContext(ctx context.Context, table string, key string, objectKey string, object string, expiration time.Duration) error
+	CompareAndSwapInMapContext(ctx context.Context, table string, key string, objectKey string, old string, new string) (bool, error)
+	ExpireMapContext(ctx context.Context, table string, key string, expiration time.Duration) error
+	MapTTLContext(ctx context.Context, table string, key string) (map[string]time.Duration, time.Duration, error)
+	DelFromMapContext(ctx context.Context, table string, key string, objectKey string) error
+	GetFromMapContext(ctx context.Context, table string, key string, objectKey string) (string, error)
+	GetMapContext(ctx context.Context, table string, key string) (map[string]string, error)
+
+	Begin() (Tx, error)
+	BeginContext(ctx context.Context) (Tx, error)
+}
+
+// Tx queues writes which are applied atomically by Commit. It has no reads,
+// because a Redis MULTI only returns results once EXEC has run.
+type Tx interface {
+	SetKey(table string, key string, value string, expiration time.Duration) error
+	DelKey(table string, key string) error
+	AddToMap(table string, key string, objectKey string, object string) error
+	AddToMapWithTTL(table string, key string, objectKey string, object string, expiration time.Duration) error
+	DelFromMap(table string, key string, objectKey string) error
+	Commit() error
+	Rollback() error
 }
 
 func SplitToParts(key string) []string {
@@ -60,53 +169,27 @@ func CalculateHash(data string) uint32 {
 	return crc32InUint32
 }
 
-func CalculateHashesOfColumns(columns []string) []uint32 {
-	result := []uint32{}
-
-	for _, column := range columns {
-		hash := CalculateHash(column)
-
-		result = append(result, hash)
+func CheckTableName(table string) error {
+	if strings.Contains(table, "/") {
+		return errors.New("Table can not contains '/' in its name")
 	}
 
-	return result
+	return nil
 }
 
-func CreateWhereClause(columns []string, hashes []uint32) string {
-	result := ""
-
-	hashesLen := len(hashes)
-
-	for hashesLen-1 >= 0 && columns[hashesLen-1] == "*" {
-		hashesLen--
-	}
-
-	for index := 0; index < hashesLen; index++ {
-		hash := hashes[index]
-
-		if columns[index] == "*" {
-			continue
-		}
-
-		hashStr := fmt.Sprint(hash)
-		columnName := "column_" + strconv.Itoa(index+1) + "_hash"
-
-		result += columnName + " = " + hashStr
+// incrValue adds delta to the integer value of a key for Incr.
+func incrValue(value string, delta int64) (int64, error) {
+	current, err := strconv.ParseInt(value, 10, 64)
 
-		if index+1 < hashesLen {
-			result += " AND "
-		}
+	if err != nil {
+		return 0, ErrNotInteger
 	}
 
-	return result
-}
-
-func CheckTableName(table string) error {
-	if strings.Contains(table, "/") {
-		return errors.New("Table can not contains '/' in its name")
+	if delta > 0 && current > math.MaxInt64-delta || delta < 0 && current < math.MinInt64-delta {
+		return 0, ErrOverflow
 	}
 
-	return nil
+	return current + delta, nil
 }
 
 func CreateStorage(credentials map[string]string, storageType string, setup bool) (Storage, error) {
@@ -142,6 +225,14 @@ func CreateStorage(credentials map[string]string, storageType string, setup bool
 		}
 		err := storage.Create(credentials)
 
+		return storage, err
+	case MEMORY_STORAGE:
+		storage := &MemoryStorage{}
+		if setup == true {
+			storage.Setup(credentials)
+		}
+		err := storage.Create(credentials)
+
 		return storage, err
 
 	default:
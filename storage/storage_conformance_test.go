@@ -0,0 +1,264 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage_test
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/netclave/common/storage"
+	"github.com/netclave/common/storage/storagetest"
+)
+
+func createStorage(t *testing.T, credentials map[string]string, storageType string) storage.Storage {
+	s, err := storage.CreateStorage(credentials, storageType, true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		s.Destroy()
+	})
+
+	err = s.Init()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// patternSyntaxes are the syntaxes the SQLite and memory suites run with.
+var patternSyntaxes = []string{storage.PATTERN_SYNTAX_PREFIX, storage.PATTERN_SYNTAX_GLOB}
+
+func TestSQLiteConformance(t *testing.T) {
+	for _, syntax := range patternSyntaxes {
+		syntax := syntax
+
+		t.Run(syntax, func(t *testing.T) {
+			runSQLiteConformance(t, syntax)
+		})
+	}
+}
+
+func runSQLiteConformance(t *testing.T, syntax string) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		dir, err := ioutil.TempDir("", "storagetest")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Cleanup(func() {
+			os.RemoveAll(dir)
+		})
+
+		credentials := map[string]string{
+			"filename":                  filepath.Join(dir, "storage.db"),
+			storage.WATCH:               "true",
+			storage.WATCH_POLL_INTERVAL: "20ms",
+			storage.PATTERN_SYNTAX:      syntax,
+		}
+
+		return createStorage(t, credentials, storage.SQLITE_STORAGE)
+	}, storagetest.WithPatternSyntax(syntax))
+}
+
+// Environment variables with the credentials of the PostgreSQL and MySQL
+// servers the conformance suites run against, as space separated key=value
+// pairs, for instance "host=localhost port=5432 user=netclave
+// password=secret dbname=netclave sslmode=disable". Their suites are skipped
+// without them. The keys and maps tables of the database are emptied before
+// every test.
+var testPostgreSQLCredentials = "NETCLAVE_TEST_POSTGRESQL"
+var testMySQLCredentials = "NETCLAVE_TEST_MYSQL"
+
+func TestPostgreSQLConformance(t *testing.T) {
+	runServerConformance(t, testPostgreSQLCredentials, storage.POSTGRE_SQL_STORAGE)
+}
+
+func TestMySQLConformance(t *testing.T) {
+	runServerConformance(t, testMySQLCredentials, storage.MY_SQL_STORAGE)
+}
+
+func runServerConformance(t *testing.T, variable string, storageType string) {
+	value := os.Getenv(variable)
+
+	if value == "" {
+		t.Skip(variable + " is not set")
+	}
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		credentials := map[string]string{
+			storage.WATCH:               "true",
+			storage.WATCH_POLL_INTERVAL: "20ms",
+		}
+
+		for _, pair := range strings.Fields(value) {
+			parts := strings.SplitN(pair, "=", 2)
+
+			if len(parts) != 2 {
+				t.Fatalf("Invalid %s pair %q", variable, pair)
+			}
+
+			credentials[parts[0]] = parts[1]
+		}
+
+		s := createStorage(t, credentials, storageType)
+
+		var connection *sql.DB
+
+		switch backend := s.(type) {
+		case *storage.PostgreSQLStorage:
+			connection = backend.Connection
+		case *storage.MySQLStorage:
+			connection = backend.Connection
+		}
+
+		for _, table := range []string{"keys", "maps"} {
+			_, err := connection.Exec("DELETE FROM " + table)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return s
+	})
+}
+
+func TestMemoryConformance(t *testing.T) {
+	for _, syntax := range patternSyntaxes {
+		syntax := syntax
+
+		t.Run(syntax, func(t *testing.T) {
+			storagetest.Run(t, func(t *testing.T) storage.Storage {
+				t.Cleanup(func() {
+					storage.DropMemoryStorage(t.Name())
+				})
+
+				credentials := map[string]string{
+					"name":                 t.Name(),
+					storage.PATTERN_SYNTAX: syntax,
+				}
+
+				return createStorage(t, credentials, storage.MEMORY_STORAGE)
+			}, storagetest.WithPatternSyntax(syntax))
+		})
+	}
+}
+
+// nopTracer checks that spans are ended once and only once.
+type nopTracer struct {
+	t *testing.T
+}
+
+type nopSpan struct {
+	t     *testing.T
+	ended bool
+}
+
+func (nt nopTracer) Start(ctx context.Context, name string) (context.Context, storage.Span) {
+	return ctx, &nopSpan{t: nt.t}
+}
+
+func (ns *nopSpan) SetStringAttribute(key string, value string) {}
+
+func (ns *nopSpan) SetIntAttribute(key string, value int64) {}
+
+func (ns *nopSpan) RecordError(err error) {}
+
+func (ns *nopSpan) End() {
+	if ns.ended {
+		ns.t.Error("Span ended twice")
+	}
+
+	ns.ended = true
+}
+
+func TestMiddlewareConformance(t *testing.T) {
+	metrics := storage.NewMetrics()
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		t.Cleanup(func() {
+			storage.DropMemoryStorage(t.Name())
+		})
+
+		backend := createStorage(t, map[string]string{"name": t.Name()}, storage.MEMORY_STORAGE)
+
+		return storage.Wrap(backend, metrics.Middleware(), storage.Tracing(nopTracer{t: t}))
+	})
+}
+
+func TestRedisConformance(t *testing.T) {
+	runRedisConformance(t, map[string]string{"db": "0", storage.PATTERN_SYNTAX: storage.PATTERN_SYNTAX_GLOB})
+}
+
+// miniredis answers CLUSTER SLOTS as a single node cluster, enough for the
+// cluster client and the scans over its masters.
+func TestRedisClusterConformance(t *testing.T) {
+	runRedisConformance(t, map[string]string{storage.REDIS_MODE: storage.REDIS_MODE_CLUSTER})
+}
+
+func runRedisConformance(t *testing.T, credentials map[string]string) {
+	server, err := miniredis.Run()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+
+	credentials["host"] = server.Addr()
+
+	// Key expirations follow FastForward, while the map scripts read the
+	// clock set by SetTime, so sleeping moves both.
+	clock := time.Now()
+
+	sleep := func(duration time.Duration) {
+		clock = clock.Add(duration)
+		server.SetTime(clock)
+		server.FastForward(duration)
+	}
+
+	factory := func(t *testing.T) storage.Storage {
+		server.FlushAll()
+
+		clock = time.Now()
+		server.SetTime(clock)
+
+		return createStorage(t, credentials, storage.REDIS_STORAGE)
+	}
+
+	options := []storagetest.Option{storagetest.WithSleep(sleep), storagetest.WithoutWatch()}
+
+	if syntax := credentials[storage.PATTERN_SYNTAX]; syntax != "" {
+		options = append(options, storagetest.WithPatternSyntax(syntax))
+	}
+
+	// miniredis sends no keyspace notifications, see TestRedisWatch instead.
+	storagetest.Run(t, factory, options...)
+}
@@ -0,0 +1,1319 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package storagetest is a conformance suite for storage.Storage
+// implementations. Every backend is expected to behave as follows:
+//
+//   - Keys and maps live in tables. A key may contain "/" separated segments,
+//     but a key name must not be used for a plain key and a map at once.
+//   - GetKey, GetFullKey and GetFromMap return "" and no error for anything
+//     that does not exist or has expired. GetMap returns an empty, non nil
+//     map for a missing map.
+//   - SetKey with an expiration of zero or less never expires. Expired keys
+//     are invisible to every read, including GetKeys.
+//   - LookupKey and TTL return storage.ErrNotFound for a key which does not
+//     exist or has expired, Exists returns false. TTL returns
+//     storage.NoExpiration for a key which never expires. Expire and Persist
+//     change the expiration of an existing key and report whether there was
+//     one. None of them sees maps.
+//   - Incr, SetNX, CompareAndSwap and CompareAndSwapInMap are atomic. Incr treats a missing or
+//     expired key as 0, sets the expiration only when it creates the key,
+//     fails with storage.ErrNotInteger for other values, including integers
+//     outside int64, and with storage.ErrOverflow for a result outside int64,
+//     leaving the key alone. SetNX replaces an
+//     expired key and stores the key next to a map of the same name.
+//     CompareAndSwap keeps the expiration of the key, and CompareAndSwapInMap
+//     those of the field and of the map.
+//   - DelKey returns the number of live keys it removed, 0 or 1. It never
+//     removes maps.
+//   - GetKeys returns "table/key" for every live key and every non empty map
+//     matching the pattern, each exactly once and in no particular order.
+//     Patterns follow the dialect of storage.Pattern, in the syntax the
+//     credentials ask for, and a malformed pattern is an error. Keys may contain any bytes but NUL.
+//   - ScanKeys yields the same keys as GetKeys, whatever the batch size, but
+//     may yield a key twice if the data changes during the scan.
+//   - Tables lists every table with a live key or map once, sorted.
+//   - Watch delivers the changes of the matching keys and maps of one table
+//     made after it returned, in order: a set for every write, a delete for
+//     a deleted key or a map whose last field was deleted, and an expire for
+//     a key the backend removed after it expired, by the time it was purged.
+//     A malformed pattern is an error, and the channel is closed once the
+//     context is done.
+//   - A map disappears once its last field is removed or has expired.
+//   - A field stored by AddToMapWithTTL expires on its own, one stored by
+//     AddToMap never does. ExpireMap expires the whole map, including fields
+//     added later, and an expiration of zero or less cancels it. A map
+//     created anew after expiring does not inherit the expiration.
+//   - MapTTL returns the time left of every live field, storage.NoExpiration
+//     for those stored by AddToMap, and of the map, storage.NoExpiration
+//     without ExpireMap. A map without live fields is storage.ErrNotFound.
+//   - Writes made through a Tx become visible only after Commit and are
+//     discarded by Rollback.
+//   - Every Context method fails once its context has been cancelled.
+package storagetest
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/netclave/common/storage"
+)
+
+// Factory returns a new, initialised and empty storage for a single subtest.
+type Factory func(t *testing.T) storage.Storage
+
+type config struct {
+	sleep         func(time.Duration)
+	noWatch       bool
+	patternSyntax string
+}
+
+type Option func(*config)
+
+// WithSleep replaces time.Sleep for backends whose clock is not the wall
+// clock, such as an in-process Redis stand-in.
+func WithSleep(sleep func(time.Duration)) Option {
+	return func(c *config) {
+		c.sleep = sleep
+	}
+}
+
+// WithoutWatch skips Watch, for servers which can not deliver events, such as
+// an in-process Redis stand-in without keyspace notifications.
+func WithoutWatch() Option {
+	return func(c *config) {
+		c.noWatch = true
+	}
+}
+
+// WithPatternSyntax tells the suite the storages of the factory read patterns
+// with syntax, see storage.PATTERN_SYNTAX. The default is
+// storage.PATTERN_SYNTAX_PREFIX.
+func WithPatternSyntax(syntax string) Option {
+	return func(c *config) {
+		c.patternSyntax = syntax
+	}
+}
+
+var testValues = []string{
+	"plain",
+	"it's \"quoted\"",
+	`back\slash`,
+	"with space",
+	"мулти-байт 日本語 🔐",
+	"",
+}
+
+// Run executes the whole suite as subtests of t.
+func Run(t *testing.T, factory Factory, options ...Option) {
+	c := &config{
+		sleep:         time.Sleep,
+		patternSyntax: storage.PATTERN_SYNTAX_PREFIX,
+	}
+
+	for _, option := range options {
+		option(c)
+	}
+
+	tests := []struct {
+		name string
+		test func(t *testing.T, s storage.Storage, c *config)
+	}{
+		{"KeyRoundTrip", testKeyRoundTrip},
+		{"MissingKeys", testMissingKeys},
+		{"DelKey", testDelKey},
+		{"Expiration", testExpiration},
+		{"KeyExpirationControl", testKeyExpirationControl},
+		{"Incr", testIncr},
+		{"SetNX", testSetNX},
+		{"CompareAndSwap", testCompareAndSwap},
+		{"GetKeys", testGetKeys},
+		{"ScanKeys", testScanKeys},
+		{"Tables", testTables},
+		{"Watch", testWatch},
+		{"Maps", testMaps},
+		{"MissingMaps", testMissingMaps},
+		{"MapFieldExpiration", testMapFieldExpiration},
+		{"ExpireMap", testExpireMap},
+		{"CompareAndSwapInMap", testCompareAndSwapInMap},
+		{"MapTTL", testMapTTL},
+		{"TxCommit", testTxCommit},
+		{"TxRollback", testTxRollback},
+		{"CancelledContext", testCancelledContext},
+	}
+
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, factory(t), c)
+		})
+	}
+}
+
+func sorted(values []string) []string {
+	result := append([]string{}, values...)
+	sort.Strings(result)
+
+	return result
+}
+
+func mustSetKey(t *testing.T, s storage.Storage, table string, key string, value string, expiration time.Duration) {
+	t.Helper()
+
+	err := s.SetKey(table, key, value, expiration)
+
+	if err != nil {
+		t.Fatalf("SetKey(%q, %q): %v", table, key, err)
+	}
+}
+
+func mustAddToMap(t *testing.T, s storage.Storage, table string, key string, objectKey string, object string) {
+	t.Helper()
+
+	err := s.AddToMap(table, key, objectKey, object)
+
+	if err != nil {
+		t.Fatalf("AddToMap(%q, %q, %q): %v", table, key, objectKey, err)
+	}
+}
+
+func expectKey(t *testing.T, s storage.Storage, table string, key string, expected string) {
+	t.Helper()
+
+	value, err := s.GetKey(table, key)
+
+	if err != nil {
+		t.Fatalf("GetKey(%q, %q): %v", table, key, err)
+	}
+
+	if value != expected {
+		t.Errorf("GetKey(%q, %q) = %q, want %q", table, key, value, expected)
+	}
+}
+
+func expectKeys(t *testing.T, s storage.Storage, table string, pattern string, expected []string) {
+	t.Helper()
+
+	keys, err := s.GetKeys(table, pattern)
+
+	if err != nil {
+		t.Fatalf("GetKeys(%q, %q): %v", table, pattern, err)
+	}
+
+	if !reflect.DeepEqual(sorted(keys), sorted(expected)) {
+		t.Errorf("GetKeys(%q, %q) = %q, want %q", table, pattern, sorted(keys), sorted(expected))
+	}
+}
+
+func expectMap(t *testing.T, s storage.Storage, table string, key string, expected map[string]string) {
+	t.Helper()
+
+	fields, err := s.GetMap(table, key)
+
+	if err != nil {
+		t.Fatalf("GetMap(%q, %q): %v", table, key, err)
+	}
+
+	if fields == nil {
+		t.Errorf("GetMap(%q, %q) returned a nil map", table, key)
+	}
+
+	if len(fields) != 0 || len(expected) != 0 {
+		if !reflect.DeepEqual(fields, expected) {
+			t.Errorf("GetMap(%q, %q) = %q, want %q", table, key, fields, expected)
+		}
+	}
+}
+
+func expectFromMap(t *testing.T, s storage.Storage, table string, key string, objectKey string, expected string) {
+	t.Helper()
+
+	value, err := s.GetFromMap(table, key, objectKey)
+
+	if err != nil {
+		t.Fatalf("GetFromMap(%q, %q, %q): %v", table, key, objectKey, err)
+	}
+
+	if value != expected {
+		t.Errorf("GetFromMap(%q, %q, %q) = %q, want %q", table, key, objectKey, value, expected)
+	}
+}
+
+func testKeyRoundTrip(t *testing.T, s storage.Storage, c *config) {
+	for index, value := range testValues {
+		key := "round/" + string(rune('a'+index))
+
+		mustSetKey(t, s, "table", key, value, 0)
+		expectKey(t, s, "table", key, value)
+
+		full, err := s.GetFullKey("table/" + key)
+
+		if err != nil {
+			t.Fatalf("GetFullKey: %v", err)
+		}
+
+		if full != value {
+			t.Errorf("GetFullKey(%q) = %q, want %q", "table/"+key, full, value)
+		}
+	}
+
+	mustSetKey(t, s, "table", "key", "first", 0)
+	mustSetKey(t, s, "table", "key", "second", 0)
+	expectKey(t, s, "table", "key", "second")
+
+	mustSetKey(t, s, "other", "key", "other table", 0)
+	expectKey(t, s, "table", "key", "second")
+	expectKey(t, s, "other", "key", "other table")
+}
+
+func testMissingKeys(t *testing.T, s storage.Storage, c *config) {
+	expectKey(t, s, "table", "missing", "")
+
+	full, err := s.GetFullKey("table/missing")
+
+	if err != nil || full != "" {
+		t.Errorf("GetFullKey of a missing key = %q, %v", full, err)
+	}
+
+	mustSetKey(t, s, "table", "parent/child", "child", 0)
+
+	expectKey(t, s, "table", "parent", "")
+	expectKey(t, s, "other", "parent/child", "")
+}
+
+func testDelKey(t *testing.T, s storage.Storage, c *config) {
+	mustSetKey(t, s, "table", "parent", "parent", 0)
+	mustSetKey(t, s, "table", "parent/child", "child", 0)
+
+	deleted, err := s.DelKey("table", "parent")
+
+	if err != nil || deleted != 1 {
+		t.Errorf("DelKey of a live key = %d, %v", deleted, err)
+	}
+
+	expectKey(t, s, "table", "parent", "")
+	expectKey(t, s, "table", "parent/child", "child")
+
+	deleted, err = s.DelKey("table", "parent")
+
+	if err != nil || deleted != 0 {
+		t.Errorf("DelKey of a missing key = %d, %v", deleted, err)
+	}
+
+	mustAddToMap(t, s, "table", "map", "field", "value")
+
+	deleted, err = s.DelKey("table", "map")
+
+	if err != nil || deleted != 0 {
+		t.Errorf("DelKey of a map = %d, %v", deleted, err)
+	}
+
+	expectMap(t, s, "table", "map", map[string]string{"field": "value"})
+}
+
+func testExpiration(t *testing.T, s storage.Storage, c *config) {
+	mustSetKey(t, s, "table", "short", "short", 50*time.Millisecond)
+	mustSetKey(t, s, "table", "long", "long", time.Hour)
+	mustSetKey(t, s, "table", "forever", "forever", 0)
+	mustSetKey(t, s, "table", "negative", "negative", -time.Second)
+
+	expectKey(t, s, "table", "short", "short")
+
+	c.sleep(150 * time.Millisecond)
+
+	expectKey(t, s, "table", "short", "")
+	expectKey(t, s, "table", "long", "long")
+	expectKey(t, s, "table", "forever", "forever")
+	expectKey(t, s, "table", "negative", "negative")
+	expectKeys(t, s, "table", "**", []string{"table/long", "table/forever", "table/negative"})
+
+	deleted, err := s.DelKey("table", "short")
+
+	if err != nil || deleted != 0 {
+		t.Errorf("DelKey of an expired key = %d, %v", deleted, err)
+	}
+
+	mustSetKey(t, s, "table", "short", "again", 0)
+	expectKey(t, s, "table", "short", "again")
+
+	// NoExpiration is negative too, and must not keep the previous one.
+	mustSetKey(t, s, "table", "long", "persisted", storage.NoExpiration)
+	expectKey(t, s, "table", "long", "persisted")
+
+	ttl, err := s.TTL("table", "long")
+
+	if err != nil || ttl != storage.NoExpiration {
+		t.Errorf("TTL after SetKey with NoExpiration = %v, %v", ttl, err)
+	}
+}
+
+func expectExists(t *testing.T, s storage.Storage, table string, key string, expected bool) {
+	t.Helper()
+
+	exists, err := s.Exists(table, key)
+
+	if err != nil {
+		t.Fatalf("Exists(%q, %q): %v", table, key, err)
+	}
+
+	if exists != expected {
+		t.Errorf("Exists(%q, %q) = %v, want %v", table, key, exists, expected)
+	}
+}
+
+func testKeyExpirationControl(t *testing.T, s storage.Storage, c *config) {
+	mustSetKey(t, s, "table", "empty", "", 0)
+	mustSetKey(t, s, "table", "expiring", "expiring", time.Hour)
+	mustSetKey(t, s, "table", "shortened", "shortened", time.Hour)
+	mustSetKey(t, s, "table", "persisted", "persisted", 50*time.Millisecond)
+	mustSetKey(t, s, "table", "extended", "extended", 50*time.Millisecond)
+	mustSetKey(t, s, "table", "short", "short", 50*time.Millisecond)
+	mustAddToMap(t, s, "table", "map", "field", "value")
+
+	value, err := s.LookupKey("table", "empty")
+
+	if err != nil || value != "" {
+		t.Errorf("LookupKey of an empty value = %q, %v", value, err)
+	}
+
+	value, err = s.LookupKey("table", "missing")
+
+	if err != storage.ErrNotFound {
+		t.Errorf("LookupKey of a missing key = %q, %v", value, err)
+	}
+
+	expectExists(t, s, "table", "empty", true)
+	expectExists(t, s, "table", "missing", false)
+	expectExists(t, s, "table", "map", false)
+
+	ttl, err := s.TTL("table", "empty")
+
+	if err != nil || ttl != storage.NoExpiration {
+		t.Errorf("TTL of a key without expiration = %v, %v", ttl, err)
+	}
+
+	ttl, err = s.TTL("table", "expiring")
+
+	if err != nil || ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Errorf("TTL of an expiring key = %v, %v", ttl, err)
+	}
+
+	for _, key := range []string{"missing", "map"} {
+		ttl, err = s.TTL("table", key)
+
+		if err != storage.ErrNotFound {
+			t.Errorf("TTL(%q) = %v, %v", key, ttl, err)
+		}
+	}
+
+	for _, change := range []struct {
+		key        string
+		expiration time.Duration
+		found      bool
+	}{
+		{"shortened", 50 * time.Millisecond, true},
+		{"extended", time.Hour, true},
+		{"empty", -time.Second, true},
+		{"missing", time.Hour, false},
+		{"map", time.Hour, false},
+	} {
+		found, err := s.Expire("table", change.key, change.expiration)
+
+		if err != nil || found != change.found {
+			t.Errorf("Expire(%q) = %v, %v", change.key, found, err)
+		}
+	}
+
+	found, err := s.Persist("table", "persisted")
+
+	if err != nil || !found {
+		t.Errorf("Persist of an expiring key = %v, %v", found, err)
+	}
+
+	found, err = s.Persist("table", "missing")
+
+	if err != nil || found {
+		t.Errorf("Persist of a missing key = %v, %v", found, err)
+	}
+
+	ttl, err = s.TTL("table", "persisted")
+
+	if err != nil || ttl != storage.NoExpiration {
+		t.Errorf("TTL after Persist = %v, %v", ttl, err)
+	}
+
+	c.sleep(150 * time.Millisecond)
+
+	expectExists(t, s, "table", "shortened", false)
+	expectExists(t, s, "table", "short", false)
+	expectExists(t, s, "table", "extended", true)
+	expectExists(t, s, "table", "persisted", true)
+	expectExists(t, s, "table", "empty", true)
+	expectMap(t, s, "table", "map", map[string]string{"field": "value"})
+
+	value, err = s.LookupKey("table", "short")
+
+	if err != storage.ErrNotFound {
+		t.Errorf("LookupKey of an expired key = %q, %v", value, err)
+	}
+
+	found, err = s.Expire("table", "short", time.Hour)
+
+	if err != nil || found {
+		t.Errorf("Expire of an expired key = %v, %v", found, err)
+	}
+}
+
+func testIncr(t *testing.T, s storage.Storage, c *config) {
+	for _, step := range []struct {
+		delta    int64
+		expected int64
+	}{
+		{1, 1},
+		{41, 42},
+		{-50, -8},
+	} {
+		value, err := s.Incr("table", "counter", step.delta, 0)
+
+		if err != nil || value != step.expected {
+			t.Errorf("Incr by %d = %d, %v, want %d", step.delta, value, err, step.expected)
+		}
+	}
+
+	expectKey(t, s, "table", "counter", "-8")
+
+	value, err := s.Incr("table", "window", 1, 50*time.Millisecond)
+
+	if err != nil || value != 1 {
+		t.Errorf("Incr of a new window = %d, %v", value, err)
+	}
+
+	value, err = s.Incr("table", "window", 1, time.Hour)
+
+	if err != nil || value != 2 {
+		t.Errorf("Incr within the window = %d, %v", value, err)
+	}
+
+	mustSetKey(t, s, "table", "text", "text", 0)
+
+	_, err = s.Incr("table", "text", 1, 0)
+
+	if err != storage.ErrNotInteger {
+		t.Errorf("Incr of a text value: %v", err)
+	}
+
+	expectKey(t, s, "table", "text", "text")
+
+	mustSetKey(t, s, "table", "huge", "9223372036854775808", 0)
+
+	_, err = s.Incr("table", "huge", -1, 0)
+
+	if err != storage.ErrNotInteger {
+		t.Errorf("Incr of a value outside int64: %v", err)
+	}
+
+	expectKey(t, s, "table", "huge", "9223372036854775808")
+
+	for _, limit := range []struct {
+		key   string
+		start string
+		delta int64
+		last  string
+	}{
+		{"max", "9223372036854775806", 1, "9223372036854775807"},
+		{"min", "-9223372036854775807", -1, "-9223372036854775808"},
+	} {
+		mustSetKey(t, s, "table", limit.key, limit.start, 0)
+
+		value, err = s.Incr("table", limit.key, limit.delta, 0)
+
+		if err != nil || strconv.FormatInt(value, 10) != limit.last {
+			t.Errorf("Incr up to %s = %d, %v", limit.last, value, err)
+		}
+
+		_, err = s.Incr("table", limit.key, limit.delta, 0)
+
+		if err != storage.ErrOverflow {
+			t.Errorf("Incr beyond %s: %v", limit.last, err)
+		}
+
+		_, err = s.Incr("table", limit.key, 2*limit.delta, 0)
+
+		if err != storage.ErrOverflow {
+			t.Errorf("Incr far beyond %s: %v", limit.last, err)
+		}
+
+		expectKey(t, s, "table", limit.key, limit.last)
+	}
+
+	c.sleep(150 * time.Millisecond)
+
+	value, err = s.Incr("table", "window", 1, 0)
+
+	if err != nil || value != 1 {
+		t.Errorf("Incr after the window expired = %d, %v", value, err)
+	}
+
+	ttl, err := s.TTL("table", "window")
+
+	if err != nil || ttl != storage.NoExpiration {
+		t.Errorf("TTL of a counter recreated without expiration = %v, %v", ttl, err)
+	}
+
+	var wait sync.WaitGroup
+
+	errs := make(chan error, 100)
+
+	for i := 0; i < 10; i++ {
+		wait.Add(1)
+
+		go func() {
+			defer wait.Done()
+
+			for j := 0; j < 10; j++ {
+				_, err := s.Incr("table", "concurrent", 1, 0)
+
+				if err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+
+	wait.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("concurrent Incr: %v", err)
+	}
+
+	expectKey(t, s, "table", "concurrent", "100")
+}
+
+func testSetNX(t *testing.T, s storage.Storage, c *config) {
+	for _, attempt := range []struct {
+		value string
+		set   bool
+	}{
+		{"first", true},
+		{"second", false},
+	} {
+		set, err := s.SetNX("table", "key", attempt.value, 50*time.Millisecond)
+
+		if err != nil || set != attempt.set {
+			t.Errorf("SetNX(%q) = %v, %v, want %v", attempt.value, set, err, attempt.set)
+		}
+	}
+
+	expectKey(t, s, "table", "key", "first")
+
+	c.sleep(150 * time.Millisecond)
+
+	expectKey(t, s, "table", "key", "")
+
+	set, err := s.SetNX("table", "key", "third", 0)
+
+	if err != nil || !set {
+		t.Errorf("SetNX of an expired key = %v, %v", set, err)
+	}
+
+	expectKey(t, s, "table", "key", "third")
+
+	var wait sync.WaitGroup
+	var mutex sync.Mutex
+
+	winners := 0
+
+	for i := 0; i < 10; i++ {
+		wait.Add(1)
+
+		go func() {
+			defer wait.Done()
+
+			set, err := s.SetNX("table", "lock", "owner", 0)
+
+			if err != nil {
+				t.Errorf("concurrent SetNX: %v", err)
+			}
+
+			if set {
+				mutex.Lock()
+				winners++
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	wait.Wait()
+
+	if winners != 1 {
+		t.Errorf("%d concurrent SetNX calls succeeded, want 1", winners)
+	}
+
+	mustAddToMap(t, s, "table", "map", "field", "value")
+
+	set, err = s.SetNX("table", "map", "key", 0)
+
+	if err != nil || !set {
+		t.Errorf("SetNX on the name of a map = %v, %v", set, err)
+	}
+
+	expectKey(t, s, "table", "map", "key")
+	expectMap(t, s, "table", "map", map[string]string{"field": "value"})
+
+	value, err := s.Incr("table", "map", 1, 0)
+
+	if err != storage.ErrNotInteger {
+		t.Errorf("Incr of a key next to a map = %d, %v", value, err)
+	}
+
+	mustSetKey(t, s, "table", "map", "1", 0)
+
+	value, err = s.Incr("table", "map", 1, 0)
+
+	if err != nil || value != 2 {
+		t.Errorf("Incr of a key next to a map = %d, %v", value, err)
+	}
+
+	expectMap(t, s, "table", "map", map[string]string{"field": "value"})
+}
+
+func testCompareAndSwap(t *testing.T, s storage.Storage, c *config) {
+	mustSetKey(t, s, "table", "key", "old", time.Hour)
+	mustSetKey(t, s, "table", "short", "old", 50*time.Millisecond)
+
+	for _, swap := range []struct {
+		key     string
+		old     string
+		new     string
+		swapped bool
+	}{
+		{"key", "OLD", "new", false},
+		{"key", "old", "new", true},
+		{"key", "old", "newer", false},
+		{"key", "new", "new", true},
+		{"missing", "", "new", false},
+	} {
+		swapped, err := s.CompareAndSwap("table", swap.key, swap.old, swap.new)
+
+		if err != nil || swapped != swap.swapped {
+			t.Errorf("CompareAndSwap(%q, %q, %q) = %v, %v, want %v", swap.key, swap.old, swap.new, swapped, err, swap.swapped)
+		}
+	}
+
+	expectKey(t, s, "table", "key", "new")
+	expectKey(t, s, "table", "missing", "")
+
+	ttl, err := s.TTL("table", "key")
+
+	if err != nil || ttl <= 59*time.Minute {
+		t.Errorf("TTL after CompareAndSwap = %v, %v", ttl, err)
+	}
+
+	c.sleep(150 * time.Millisecond)
+
+	swapped, err := s.CompareAndSwap("table", "short", "old", "new")
+
+	if err != nil || swapped {
+		t.Errorf("CompareAndSwap of an expired key = %v, %v", swapped, err)
+	}
+
+	expectKey(t, s, "table", "short", "")
+}
+
+func testGetKeys(t *testing.T, s storage.Storage, c *config) {
+	for _, key := range []string{"a", "a/b", "a/b/c", "a/x/c", "ab", "b/b", "with space/b", "user-1/key.pem", "q*/b"} {
+		mustSetKey(t, s, "table", key, key, 0)
+	}
+
+	mustSetKey(t, s, "other", "a/b", "other", 0)
+	mustAddToMap(t, s, "table", "m/1", "first", "1")
+	mustAddToMap(t, s, "table", "m/1", "second", "2")
+
+	all := []string{"table/a", "table/a/b", "table/a/b/c", "table/a/x/c", "table/ab", "table/b/b",
+		"table/with space/b", "table/user-1/key.pem", "table/q*/b", "table/m/1"}
+
+	below := []string{"table/a", "table/a/b", "table/a/b/c", "table/a/x/c"}
+
+	tests := []struct {
+		pattern string
+		glob    []string
+		prefix  []string
+	}{
+		{"**", all, all},
+		{"*", []string{"table/a", "table/ab"}, all},
+		{"a", []string{"table/a"}, below},
+		{"a*", []string{"table/a", "table/ab"}, append([]string{"table/ab"}, below...)},
+		{"a/*", []string{"table/a/b"}, below},
+		{"a/**", below, below},
+		{"a/*/c", []string{"table/a/b/c", "table/a/x/c"}, []string{"table/a/b/c", "table/a/x/c"}},
+		{"*/b", []string{"table/a/b", "table/b/b", "table/with space/b", "table/q*/b"},
+			[]string{"table/a/b", "table/a/b/c", "table/b/b", "table/with space/b", "table/q*/b"}},
+		{"**/c", []string{"table/a/b/c", "table/a/x/c"}, []string{"table/a/b/c", "table/a/x/c"}},
+		{"a/[bc]/?", []string{"table/a/b/c"}, []string{"table/a/b/c"}},
+		{"a/[^b]/c", []string{"table/a/x/c"}, []string{"table/a/x/c"}},
+		{"user-*/*.pem", []string{"table/user-1/key.pem"}, []string{"table/user-1/key.pem"}},
+		{`q\*/b`, []string{"table/q*/b"}, []string{"table/q*/b"}},
+		{"m/*", []string{"table/m/1"}, []string{"table/m/1"}},
+		{"missing", []string{}, []string{}},
+	}
+
+	for _, test := range tests {
+		if c.patternSyntax == storage.PATTERN_SYNTAX_GLOB {
+			expectKeys(t, s, "table", test.pattern, test.glob)
+		} else {
+			expectKeys(t, s, "table", test.pattern, test.prefix)
+		}
+	}
+
+	expectKeys(t, s, "empty", "**", []string{})
+
+	_, err := s.GetKeys("table", "a/[b")
+
+	if err == nil {
+		t.Error("GetKeys accepted a malformed pattern")
+	}
+}
+
+func testScanKeys(t *testing.T, s storage.Storage, c *config) {
+	expected := []string{}
+
+	for i := 0; i < 25; i++ {
+		key := "scan/" + string(rune('a'+i))
+
+		if i%3 == 0 {
+			mustAddToMap(t, s, "table", key, "first", "1")
+			mustAddToMap(t, s, "table", key, "second", "2")
+		} else {
+			mustSetKey(t, s, "table", key, key, 0)
+		}
+
+		expected = append(expected, "table/"+key)
+	}
+
+	for _, key := range []string{"scan/with space", "scan/line\nbreak", "scan/tab\there", "scan/\u00e9"} {
+		mustSetKey(t, s, "table", key, key, 0)
+		expected = append(expected, "table/"+key)
+	}
+
+	mustSetKey(t, s, "table", "other/a", "other", 0)
+	mustSetKey(t, s, "table", "scan/expired", "expired", 10*time.Millisecond)
+
+	c.sleep(50 * time.Millisecond)
+
+	for _, batchSize := range []int{0, 1, 2, 7, 1000} {
+		it, err := s.ScanKeys(context.Background(), "table", "scan/*", batchSize)
+
+		if err != nil {
+			t.Fatalf("ScanKeys with batch size %d: %v", batchSize, err)
+		}
+
+		keys := []string{}
+
+		for it.Next() {
+			keys = append(keys, it.Key())
+		}
+
+		if err := it.Err(); err != nil {
+			t.Fatalf("ScanKeys with batch size %d: %v", batchSize, err)
+		}
+
+		it.Close()
+
+		if !reflect.DeepEqual(sorted(keys), sorted(expected)) {
+			t.Errorf("ScanKeys with batch size %d = %q, want %q", batchSize, sorted(keys), sorted(expected))
+		}
+	}
+
+	// A key next to a map of the same name is still one name.
+	mustSetKey(t, s, "table", "scan/a", "next to the map", 0)
+
+	expectKeys(t, s, "table", "scan/*", expected)
+
+	_, err := s.ScanKeys(context.Background(), "table", "[", 0)
+
+	if err == nil {
+		t.Error("ScanKeys accepted a malformed pattern")
+	}
+}
+
+func testTables(t *testing.T, s storage.Storage, c *config) {
+	tables, err := s.Tables(context.Background())
+
+	if err != nil || tables == nil || len(tables) != 0 {
+		t.Fatalf("Tables of an empty storage = %q, %v", tables, err)
+	}
+
+	mustSetKey(t, s, "keys", "a/b", "value", 0)
+	mustSetKey(t, s, "keys", "c", "value", 0)
+	mustAddToMap(t, s, "maps", "map", "field", "value")
+	mustSetKey(t, s, "expired", "key", "value", 10*time.Millisecond)
+	mustAddToMap(t, s, "emptied", "map", "field", "value")
+
+	err = s.DelFromMap("emptied", "map", "field")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.sleep(50 * time.Millisecond)
+
+	tables, err = s.Tables(context.Background())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(tables, []string{"keys", "maps"}) {
+		t.Errorf("Tables = %q", tables)
+	}
+}
+
+// purger is implemented by the backends which delete expired data in the
+// background.
+type purger interface {
+	PurgeExpired(ctx context.Context) error
+}
+
+// expectEvent waits for the next event, which must be expected.
+func expectEvent(t *testing.T, events <-chan storage.Event, expected storage.Event) {
+	t.Helper()
+
+	select {
+	case event, ok := <-events:
+		if !ok || event != expected {
+			t.Fatalf("Event = %+v, %v, expected %+v", event, ok, expected)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("No event, expected %+v", expected)
+	}
+}
+
+func testWatch(t *testing.T, s storage.Storage, c *config) {
+	if c.noWatch {
+		t.Skip("Watch is not supported")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := s.Watch(ctx, "watched", "[")
+
+	if err == nil {
+		t.Error("Watch with a malformed pattern succeeded")
+	}
+
+	events, err := s.Watch(ctx, "watched", "a/*")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Neither is watched.
+	mustSetKey(t, s, "watched", "b", "value", 0)
+	mustSetKey(t, s, "other", "a/key", "value", 0)
+
+	mustSetKey(t, s, "watched", "a/key", "value", 0)
+	expectEvent(t, events, storage.Event{Type: storage.EventSet, Table: "watched", Key: "a/key"})
+
+	_, err = s.DelKey("watched", "a/key")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectEvent(t, events, storage.Event{Type: storage.EventDelete, Table: "watched", Key: "a/key"})
+
+	mustAddToMap(t, s, "watched", "a/map", "field", "value")
+	expectEvent(t, events, storage.Event{Type: storage.EventSet, Table: "watched", Key: "a/map"})
+
+	err = s.DelFromMap("watched", "a/map", "field")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectEvent(t, events, storage.Event{Type: storage.EventDelete, Table: "watched", Key: "a/map"})
+
+	mustSetKey(t, s, "watched", "a/expiring", "value", 100*time.Millisecond)
+	expectEvent(t, events, storage.Event{Type: storage.EventSet, Table: "watched", Key: "a/expiring"})
+
+	c.sleep(200 * time.Millisecond)
+
+	// The SQL backends report expired rows once the reaper deletes them.
+	if p, ok := s.(purger); ok {
+		err = p.PurgeExpired(context.Background())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectEvent(t, events, storage.Event{Type: storage.EventExpire, Table: "watched", Key: "a/expiring"})
+
+	cancel()
+
+	for range events {
+	}
+}
+
+func testMaps(t *testing.T, s storage.Storage, c *config) {
+	expected := map[string]string{}
+
+	for index, value := range testValues {
+		field := value + string(rune('a'+index))
+
+		mustAddToMap(t, s, "table", "map/key", field, value)
+
+		expected[field] = value
+
+		got, err := s.GetFromMap("table", "map/key", field)
+
+		if err != nil || got != value {
+			t.Errorf("GetFromMap(%q) = %q, %v", field, got, err)
+		}
+	}
+
+	expectMap(t, s, "table", "map/key", expected)
+
+	mustAddToMap(t, s, "table", "map/key", "plaina", "overwritten")
+	expected["plaina"] = "overwritten"
+
+	expectMap(t, s, "table", "map/key", expected)
+	expectMap(t, s, "table", "map", map[string]string{})
+	expectMap(t, s, "other", "map/key", map[string]string{})
+
+	for field := range expected {
+		err := s.DelFromMap("table", "map/key", field)
+
+		if err != nil {
+			t.Fatalf("DelFromMap(%q): %v", field, err)
+		}
+	}
+
+	expectMap(t, s, "table", "map/key", map[string]string{})
+	expectKeys(t, s, "table", "**", []string{})
+}
+
+func testMissingMaps(t *testing.T, s storage.Storage, c *config) {
+	value, err := s.GetFromMap("table", "missing", "field")
+
+	if err != nil || value != "" {
+		t.Errorf("GetFromMap of a missing map = %q, %v", value, err)
+	}
+
+	mustAddToMap(t, s, "table", "map", "field", "value")
+
+	value, err = s.GetFromMap("table", "map", "missing")
+
+	if err != nil || value != "" {
+		t.Errorf("GetFromMap of a missing field = %q, %v", value, err)
+	}
+
+	expectMap(t, s, "table", "missing", map[string]string{})
+
+	err = s.DelFromMap("table", "missing", "field")
+
+	if err != nil {
+		t.Errorf("DelFromMap of a missing map: %v", err)
+	}
+
+	err = s.DelFromMap("table", "map", "missing")
+
+	if err != nil {
+		t.Errorf("DelFromMap of a missing field: %v", err)
+	}
+
+	expectMap(t, s, "table", "map", map[string]string{"field": "value"})
+}
+
+func mustAddToMapWithTTL(t *testing.T, s storage.Storage, table string, key string, objectKey string, object string, expiration time.Duration) {
+	t.Helper()
+
+	err := s.AddToMapWithTTL(table, key, objectKey, object, expiration)
+
+	if err != nil {
+		t.Fatalf("AddToMapWithTTL(%q, %q, %q): %v", table, key, objectKey, err)
+	}
+}
+
+func mustExpireMap(t *testing.T, s storage.Storage, table string, key string, expiration time.Duration) {
+	t.Helper()
+
+	err := s.ExpireMap(table, key, expiration)
+
+	if err != nil {
+		t.Fatalf("ExpireMap(%q, %q): %v", table, key, err)
+	}
+}
+
+func testMapFieldExpiration(t *testing.T, s storage.Storage, c *config) {
+	mustAddToMapWithTTL(t, s, "table", "map", "short", "short", 50*time.Millisecond)
+	mustAddToMapWithTTL(t, s, "table", "map", "long", "long", time.Hour)
+	mustAddToMapWithTTL(t, s, "table", "map", "forever", "forever", 0)
+	mustAddToMapWithTTL(t, s, "table", "map", "renewed", "renewed", 50*time.Millisecond)
+	mustAddToMap(t, s, "table", "map", "renewed", "persisted")
+	mustAddToMapWithTTL(t, s, "table", "gone", "field", "value", 50*time.Millisecond)
+
+	tx, err := s.Begin()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = tx.AddToMapWithTTL("table", "tx", "field", "value", 50*time.Millisecond)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectFromMap(t, s, "table", "map", "short", "short")
+	expectMap(t, s, "table", "tx", map[string]string{"field": "value"})
+
+	c.sleep(150 * time.Millisecond)
+
+	expectFromMap(t, s, "table", "map", "short", "")
+	expectMap(t, s, "table", "map", map[string]string{"long": "long", "forever": "forever", "renewed": "persisted"})
+	expectMap(t, s, "table", "gone", map[string]string{})
+	expectMap(t, s, "table", "tx", map[string]string{})
+	expectKeys(t, s, "table", "**", []string{"table/map"})
+
+	mustAddToMap(t, s, "table", "gone", "field", "again")
+	expectMap(t, s, "table", "gone", map[string]string{"field": "again"})
+}
+
+func testExpireMap(t *testing.T, s storage.Storage, c *config) {
+	mustAddToMap(t, s, "table", "map", "field", "value")
+	mustAddToMapWithTTL(t, s, "table", "map", "long", "long", time.Hour)
+	mustExpireMap(t, s, "table", "map", 50*time.Millisecond)
+	mustAddToMap(t, s, "table", "map", "later", "later")
+
+	mustAddToMap(t, s, "table", "cancelled", "field", "value")
+	mustExpireMap(t, s, "table", "cancelled", 50*time.Millisecond)
+	mustExpireMap(t, s, "table", "cancelled", 0)
+
+	mustAddToMap(t, s, "table", "short", "field", "value")
+	mustExpireMap(t, s, "table", "short", time.Hour)
+	mustAddToMapWithTTL(t, s, "table", "short", "field", "value", 50*time.Millisecond)
+
+	mustExpireMap(t, s, "table", "missing", 50*time.Millisecond)
+	mustAddToMap(t, s, "table", "missing", "field", "new")
+
+	expectMap(t, s, "table", "map", map[string]string{"field": "value", "long": "long", "later": "later"})
+
+	c.sleep(150 * time.Millisecond)
+
+	expectMap(t, s, "table", "map", map[string]string{})
+	expectFromMap(t, s, "table", "map", "field", "")
+	expectMap(t, s, "table", "cancelled", map[string]string{"field": "value"})
+	expectMap(t, s, "table", "short", map[string]string{})
+	expectMap(t, s, "table", "missing", map[string]string{"field": "new"})
+	expectKeys(t, s, "table", "**", []string{"table/cancelled", "table/missing"})
+
+	mustAddToMap(t, s, "table", "map", "field", "again")
+
+	c.sleep(150 * time.Millisecond)
+
+	expectMap(t, s, "table", "map", map[string]string{"field": "again"})
+}
+
+func testCompareAndSwapInMap(t *testing.T, s storage.Storage, c *config) {
+	mustAddToMap(t, s, "table", "map", "field", "old")
+	mustAddToMapWithTTL(t, s, "table", "map", "short", "old", 50*time.Millisecond)
+	mustAddToMap(t, s, "table", "expiring", "field", "old")
+	mustExpireMap(t, s, "table", "expiring", 50*time.Millisecond)
+
+	tests := []struct {
+		key      string
+		field    string
+		old      string
+		expected bool
+	}{
+		{"map", "field", "other", false},
+		{"map", "field", "old", true},
+		{"map", "field", "old", false},
+		{"map", "short", "old", true},
+		{"map", "missing", "", false},
+		{"missing", "field", "", false},
+		{"expiring", "field", "old", true},
+	}
+
+	for _, test := range tests {
+		swapped, err := s.CompareAndSwapInMap("table", test.key, test.field, test.old, "new")
+
+		if err != nil || swapped != test.expected {
+			t.Errorf("CompareAndSwapInMap(%q, %q, %q) = %v, %v", test.key, test.field, test.old, swapped, err)
+		}
+	}
+
+	expectMap(t, s, "table", "map", map[string]string{"field": "new", "short": "new"})
+	expectMap(t, s, "table", "missing", map[string]string{})
+
+	c.sleep(150 * time.Millisecond)
+
+	expectMap(t, s, "table", "map", map[string]string{"field": "new"})
+	expectMap(t, s, "table", "expiring", map[string]string{})
+
+	swapped, err := s.CompareAndSwapInMap("table", "map", "short", "new", "newer")
+
+	if err != nil || swapped {
+		t.Errorf("CompareAndSwapInMap of an expired field = %v, %v", swapped, err)
+	}
+}
+
+func testMapTTL(t *testing.T, s storage.Storage, c *config) {
+	mustAddToMap(t, s, "table", "map", "field", "value")
+	mustAddToMapWithTTL(t, s, "table", "map", "long", "value", time.Hour)
+	mustAddToMapWithTTL(t, s, "table", "map", "short", "value", 50*time.Millisecond)
+	mustAddToMapWithTTL(t, s, "table", "gone", "field", "value", 50*time.Millisecond)
+	mustSetKey(t, s, "table", "key", "value", 0)
+
+	c.sleep(150 * time.Millisecond)
+
+	within := func(ttl time.Duration, expected time.Duration) bool {
+		return ttl <= expected && ttl > expected-time.Minute
+	}
+
+	fields, mapTTL, err := s.MapTTL("table", "map")
+
+	if err != nil || len(fields) != 2 || fields["field"] != storage.NoExpiration || !within(fields["long"], time.Hour) ||
+		mapTTL != storage.NoExpiration {
+		t.Errorf("MapTTL = %v, %v, %v", fields, mapTTL, err)
+	}
+
+	mustExpireMap(t, s, "table", "map", 30*time.Minute)
+
+	fields, mapTTL, err = s.MapTTL("table", "map")
+
+	if err != nil || len(fields) != 2 || !within(mapTTL, 30*time.Minute) {
+		t.Errorf("MapTTL after ExpireMap = %v, %v, %v", fields, mapTTL, err)
+	}
+
+	for _, key := range []string{"gone", "missing", "key"} {
+		_, _, err = s.MapTTL("table", key)
+
+		if err != storage.ErrNotFound {
+			t.Errorf("MapTTL(%q) = %v, want ErrNotFound", key, err)
+		}
+	}
+}
+
+func testTxCommit(t *testing.T, s storage.Storage, c *config) {
+	mustSetKey(t, s, "table", "deleted", "deleted", 0)
+	mustAddToMap(t, s, "table", "map", "deleted", "deleted")
+
+	tx, err := s.Begin()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []error{
+		tx.SetKey("table", "key", "value", 0),
+		tx.DelKey("table", "deleted"),
+		tx.AddToMap("table", "map", "field", "value"),
+		tx.DelFromMap("table", "map", "deleted"),
+	}
+
+	for _, err := range steps {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectKey(t, s, "table", "key", "")
+
+	err = tx.Commit()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectKey(t, s, "table", "key", "value")
+	expectKey(t, s, "table", "deleted", "")
+	expectMap(t, s, "table", "map", map[string]string{"field": "value"})
+}
+
+func testTxRollback(t *testing.T, s storage.Storage, c *config) {
+	mustSetKey(t, s, "table", "kept", "kept", 0)
+
+	tx, err := s.Begin()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []error{
+		tx.SetKey("table", "key", "value", 0),
+		tx.DelKey("table", "kept"),
+		tx.AddToMap("table", "map", "field", "value"),
+	}
+
+	for _, err := range steps {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = tx.Rollback()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectKey(t, s, "table", "key", "")
+	expectKey(t, s, "table", "kept", "kept")
+	expectMap(t, s, "table", "map", map[string]string{})
+}
+
+func testCancelledContext(t *testing.T, s storage.Storage, c *config) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := s.SetKeyContext(ctx, "table", "key", "value", 0); err == nil {
+		t.Error("SetKeyContext succeeded with a cancelled context")
+	}
+
+	if _, err := s.GetKeyContext(ctx, "table", "key"); err == nil {
+		t.Error("GetKeyContext succeeded with a cancelled context")
+	}
+
+	if _, err := s.GetKeysContext(ctx, "table", "**"); err == nil {
+		t.Error("GetKeysContext succeeded with a cancelled context")
+	}
+
+	if err := s.AddToMapContext(ctx, "table", "map", "field", "value"); err == nil {
+		t.Error("AddToMapContext succeeded with a cancelled context")
+	}
+
+	if _, err := s.GetMapContext(ctx, "table", "map"); err == nil {
+		t.Error("GetMapContext succeeded with a cancelled context")
+	}
+
+	expectKey(t, s, "table", "key", "")
+}
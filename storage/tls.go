@@ -0,0 +1,107 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+)
+
+// Credentials keys of TLS connections to the servers. TLS is "true" to
+// connect with TLS, which setting any of the files implies too. The files are
+// PEM encoded: the certificate authorities the server certificate is checked
+// against, in place of the system ones, and a client certificate with its
+// key.
+var TLS = "tls"
+var TLS_CA_FILE = "tlscafile"
+var TLS_CERT_FILE = "tlscertfile"
+var TLS_KEY_FILE = "tlskeyfile"
+var TLS_SERVER_NAME = "tlsservername"
+var TLS_INSECURE_SKIP_VERIFY = "tlsinsecureskipverify"
+
+// ParseTLSConfig builds the TLS configuration credentials ask for, or returns
+// nil if they do not ask for TLS. Files which can not be read or parsed are
+// reported right away rather than on the first connection.
+func ParseTLSConfig(credentials map[string]string) (*tls.Config, error) {
+	enabled := false
+
+	if value := credentials[TLS]; value != "" {
+		var err error
+
+		enabled, err = strconv.ParseBool(value)
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s %q: %w", TLS, value, err)
+		}
+	}
+
+	caFile := credentials[TLS_CA_FILE]
+	certFile := credentials[TLS_CERT_FILE]
+	keyFile := credentials[TLS_KEY_FILE]
+
+	if !enabled && caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		ServerName: credentials[TLS_SERVER_NAME],
+	}
+
+	if value := credentials[TLS_INSECURE_SKIP_VERIFY]; value != "" {
+		skip, err := strconv.ParseBool(value)
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s %q: %w", TLS_INSECURE_SKIP_VERIFY, value, err)
+		}
+
+		config.InsecureSkipVerify = skip
+	}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+
+		if err != nil {
+			return nil, fmt.Errorf("Can not read %s: %w", TLS_CA_FILE, err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificate found in %s %s", TLS_CA_FILE, caFile)
+		}
+	}
+
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New(TLS_CERT_FILE + " and " + TLS_KEY_FILE + " must be set together")
+	}
+
+	if certFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+
+		if err != nil {
+			return nil, fmt.Errorf("Can not load the client certificate: %w", err)
+		}
+
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,224 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// writeTestCertificate writes a self signed certificate for 127.0.0.1, which
+// serves as its own certificate authority, and its key to a temporary
+// directory.
+func writeTestCertificate(t *testing.T) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "netclave test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "netclave-tls")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestParseTLSConfig(t *testing.T) {
+	config, err := ParseTLSConfig(map[string]string{TLS: "false"})
+
+	if config != nil || err != nil {
+		t.Errorf("ParseTLSConfig without TLS = %v, %v", config, err)
+	}
+
+	config, err = ParseTLSConfig(map[string]string{TLS: "true", TLS_SERVER_NAME: "db.example.com"})
+
+	if err != nil || config == nil || config.ServerName != "db.example.com" || config.RootCAs != nil {
+		t.Errorf("ParseTLSConfig = %+v, %v", config, err)
+	}
+
+	certFile, keyFile := writeTestCertificate(t)
+
+	config, err = ParseTLSConfig(map[string]string{
+		TLS_CA_FILE:   certFile,
+		TLS_CERT_FILE: certFile,
+		TLS_KEY_FILE:  keyFile,
+	})
+
+	if err != nil || config == nil || config.RootCAs == nil || len(config.Certificates) != 1 {
+		t.Errorf("ParseTLSConfig with files = %+v, %v", config, err)
+	}
+
+	invalid := []map[string]string{
+		{TLS: "maybe"},
+		{TLS: "true", TLS_INSECURE_SKIP_VERIFY: "maybe"},
+		{TLS_CA_FILE: filepath.Join(filepath.Dir(certFile), "missing.pem")},
+		{TLS_CA_FILE: keyFile},
+		{TLS_CERT_FILE: certFile},
+		{TLS_CERT_FILE: keyFile, TLS_KEY_FILE: keyFile},
+	}
+
+	for _, credentials := range invalid {
+		_, err = ParseTLSConfig(credentials)
+
+		if err == nil {
+			t.Errorf("ParseTLSConfig(%v) succeeded", credentials)
+		}
+	}
+}
+
+func TestPostgreSQLSSLOptions(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+
+	valid := []struct {
+		credentials map[string]string
+		options     string
+	}{
+		{map[string]string{}, " sslmode="},
+		{map[string]string{"sslmode": "disable"}, " sslmode=disable"},
+		{map[string]string{TLS: "true"}, " sslmode=verify-full"},
+		{map[string]string{TLS: "true", TLS_INSECURE_SKIP_VERIFY: "true"}, " sslmode=require"},
+		{map[string]string{"sslmode": "verify-ca", TLS_CA_FILE: certFile, TLS_CERT_FILE: certFile, TLS_KEY_FILE: keyFile},
+			" sslmode=verify-ca sslrootcert='" + certFile + "' sslcert='" + certFile + "' sslkey='" + keyFile + "'"},
+	}
+
+	for _, test := range valid {
+		options, err := postgreSQLSSLOptions(test.credentials)
+
+		if err != nil || options != test.options {
+			t.Errorf("postgreSQLSSLOptions(%v) = %q, %v, expected %q", test.credentials, options, err, test.options)
+		}
+	}
+
+	invalid := []map[string]string{
+		{"sslmode": "prefer"},
+		{"sslmode": "disable", TLS: "true"},
+		{"sslmode": "verify-full", TLS: "true", TLS_INSECURE_SKIP_VERIFY: "true"},
+		{TLS: "true", TLS_SERVER_NAME: "db.example.com"},
+		{TLS_CERT_FILE: certFile},
+	}
+
+	for _, credentials := range invalid {
+		_, err := postgreSQLSSLOptions(credentials)
+
+		if err == nil {
+			t.Errorf("postgreSQLSSLOptions(%v) succeeded", credentials)
+		}
+	}
+}
+
+func TestMySQLTLSConfig(t *testing.T) {
+	certFile, _ := writeTestCertificate(t)
+
+	mss := &MySQLStorage{}
+
+	// The driver connects lazily, no server is needed.
+	err := mss.Create(map[string]string{
+		"url":           "@tcp(127.0.0.1:3306)",
+		"dbname":        "netclave",
+		REAPER_INTERVAL: "0",
+		TLS_CA_FILE:     certFile,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mss.tlsConfigNames) != 1 {
+		t.Fatalf("TLS configurations registered = %v", mss.tlsConfigNames)
+	}
+
+	name := mss.tlsConfigNames[0]
+
+	mss.Destroy()
+
+	config, err := mysql.ParseDSN("@tcp(127.0.0.1:3306)/netclave?tls=" + name)
+
+	if err == nil {
+		t.Errorf("TLS configuration %s left registered: %+v", name, config)
+	}
+
+	err = (&MySQLStorage{}).Create(map[string]string{
+		"url":       "@tcp(127.0.0.1:3306)",
+		"dbname":    "netclave",
+		TLS_CA_FILE: filepath.Join(filepath.Dir(certFile), "missing.pem"),
+	})
+
+	if err == nil {
+		t.Error("Create with a missing CA file succeeded")
+	}
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+)
+
+// Tracer starts the spans of Tracing. It has the shape of an OpenTelemetry
+// tracer, which a few lines adapt to it:
+//
+//	type otelTracer struct{ tracer trace.Tracer }
+//
+//	func (t otelTracer) Start(ctx context.Context, name string) (context.Context, storage.Span) {
+//		ctx, span := t.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+//		return ctx, otelSpan{span}
+//	}
+//
+// with otelSpan calling SetAttributes with attribute.String and
+// attribute.Int64, RecordError and SetStatus(codes.Error, ...), and End.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	SetStringAttribute(key string, value string)
+	SetIntAttribute(key string, value int64)
+	// RecordError records err and marks the span as failed.
+	RecordError(err error)
+	End()
+}
+
+// Attributes of the spans of Tracing, from the OpenTelemetry semantic
+// conventions of database client spans.
+var spanOperationAttribute = "db.operation.name"
+var spanTableAttribute = "db.collection.name"
+var spanRowsAttribute = "db.response.returned_rows"
+
+// Tracing returns a Middleware running every operation observed by Observe
+// in a span of tracer, named after the operation and the table, such as
+// "GetKey publickeys". Backends run with the context of the span, so that
+// spans of their own nest in it. ErrNotFound does not fail a span.
+func Tracing(tracer Tracer) Middleware {
+	return Observe(ObserverFunc(func(ctx context.Context, op Operation) (context.Context, func(rows int, err error)) {
+		name := op.Name
+
+		if op.Table != "" {
+			name += " " + op.Table
+		}
+
+		ctx, span := tracer.Start(ctx, name)
+
+		span.SetStringAttribute(spanOperationAttribute, op.Name)
+
+		if op.Table != "" {
+			span.SetStringAttribute(spanTableAttribute, op.Table)
+		}
+
+		return ctx, func(rows int, err error) {
+			if rows > 0 {
+				span.SetIntAttribute(spanRowsAttribute, int64(rows))
+			}
+
+			if err != nil && err != ErrNotFound {
+				span.RecordError(err)
+			}
+
+			span.End()
+		}
+	}))
+}
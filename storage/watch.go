@@ -0,0 +1,87 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+)
+
+// EventType tells what happened to a key or map.
+type EventType string
+
+const (
+	// EventSet is a key or map written, including a change of its
+	// expiration or of a single field of a map.
+	EventSet EventType = "set"
+	// EventDelete is a key deleted, or a map whose last field was.
+	EventDelete EventType = "delete"
+	// EventExpire is a key or map removed because it expired. Backends
+	// report it when they remove it, which may be some time later.
+	EventExpire EventType = "expire"
+)
+
+// Event is a change delivered by Watch. Maps are reported as a whole, Key is
+// the name of the map and not of a field.
+type Event struct {
+	Type  EventType `json:"type"`
+	Table string    `json:"table"`
+	Key   string    `json:"key"`
+}
+
+// watchBufferSize is the capacity of the channels Watch returns. A watcher
+// which falls further behind holds up the delivery of its own events only.
+var watchBufferSize = 64
+
+// watchFilter selects the events of a single Watch.
+type watchFilter struct {
+	table   string
+	pattern *Pattern
+}
+
+func newWatchFilter(table string, pattern string, syntax string) (*watchFilter, error) {
+	err := CheckTableName(table)
+
+	if err != nil {
+		return nil, err
+	}
+
+	compiled, err := CompilePatternSyntax(pattern, syntax)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &watchFilter{
+		table:   table,
+		pattern: compiled,
+	}, nil
+}
+
+func (wf *watchFilter) match(event Event) bool {
+	return event.Table == wf.table && wf.pattern.Match(event.Key)
+}
+
+// sendEvent hands event to events unless ctx is done first, and reports
+// whether it did.
+func sendEvent(ctx context.Context, events chan<- Event, event Event) bool {
+	select {
+	case events <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,229 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestParseWatchOptions(t *testing.T) {
+	options, err := ParseWatchOptions(map[string]string{})
+
+	if err != nil || options.Enabled || options.PollInterval != DefaultWatchPollInterval || options.ChangelogRetention != DefaultChangelogRetention {
+		t.Errorf("ParseWatchOptions of no credentials = %+v, %v", options, err)
+	}
+
+	options, err = ParseWatchOptions(map[string]string{
+		WATCH:               "true",
+		WATCH_POLL_INTERVAL: "100ms",
+		CHANGELOG_RETENTION: "0",
+	})
+
+	if err != nil || !options.Enabled || options.PollInterval != 100*time.Millisecond || options.ChangelogRetention != DefaultChangelogRetention {
+		t.Errorf("ParseWatchOptions = %+v, %v", options, err)
+	}
+
+	_, err = ParseWatchOptions(map[string]string{WATCH_POLL_INTERVAL: "often"})
+
+	if err == nil {
+		t.Error("ParseWatchOptions of a malformed interval succeeded")
+	}
+
+	_, err = ParseWatchOptions(map[string]string{WATCH: "sometimes"})
+
+	if err == nil {
+		t.Error("ParseWatchOptions of a malformed watch succeeded")
+	}
+}
+
+func TestSQLiteWatchIsOptIn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netclave-storage")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	credentials := map[string]string{"filename": filepath.Join(dir, "storage.db")}
+
+	storage := newTestSQLiteStorage(t, credentials)
+
+	countSchema := func() (int, int) {
+		var triggers, tables int
+
+		err := storage.Connection.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger'").Scan(&triggers)
+
+		if err == nil {
+			err = storage.Connection.QueryRow(sqliteDialect{}.TableExists(), changelogTable).Scan(&tables)
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return triggers, tables
+	}
+
+	if triggers, tables := countSchema(); triggers != 0 || tables != 0 {
+		t.Errorf("Triggers and changelog tables without %s = %d, %d", WATCH, triggers, tables)
+	}
+
+	_, err = storage.Watch(context.Background(), "table", "**")
+
+	if err == nil {
+		t.Errorf("Watch without %s succeeded", WATCH)
+	}
+
+	credentials[WATCH] = "true"
+
+	watched := newTestSQLiteStorage(t, credentials)
+
+	// Init sets up Watch again without harm.
+	err = watched.Init()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if triggers, tables := countSchema(); triggers != len(sqlChangeTriggers(sqliteDialect{})) || tables != 1 {
+		t.Errorf("Triggers and changelog tables with %s = %d, %d", WATCH, triggers, tables)
+	}
+}
+
+func TestSQLiteChangelog(t *testing.T) {
+	storage := newTestSQLiteStorage(t, map[string]string{
+		WATCH:               "true",
+		REAPER_INTERVAL:     "0",
+		CHANGELOG_RETENTION: "1ms",
+	})
+
+	storage.SetKey("table", "key", "value", 0)
+
+	// Locks the row without changing it.
+	storage.CompareAndSwap("table", "key", "other", "new")
+
+	if count := countRows(t, storage, changelogTable); count != 1 {
+		t.Errorf("Changes recorded = %d, expected 1", count)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	err := storage.PurgeExpired(context.Background())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count := countRows(t, storage, changelogTable); count != 0 {
+		t.Errorf("Changes after the retention = %d", count)
+	}
+}
+
+func TestRedisWatch(t *testing.T) {
+	server, err := miniredis.Run()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+
+	storage, err := CreateStorage(map[string]string{"host": server.Addr(), "db": "0"}, REDIS_STORAGE, true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer storage.Destroy()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := storage.Watch(ctx, "watched", "a/*")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// miniredis has no keyspace notifications, send them as Redis would.
+	notifications := []struct {
+		channel string
+		event   string
+	}{
+		{"__keyspace@0__:watched/b", "set"},
+		{"__keyspace@0__:watched/a/key", "expire"},
+		{"__keyspace@0__:watched/a/key", "set"},
+		{"__keyspace@0__:watched/a/map" + redisMapSuffix, "hdel"},
+		{"__keyspace@0__:watched/a/map" + redisMapSuffix, "del"},
+		{"__keyspace@0__:watched/a/key", "expired"},
+	}
+
+	for _, notification := range notifications {
+		server.Publish(notification.channel, notification.event)
+	}
+
+	expected := []Event{
+		{Type: EventSet, Table: "watched", Key: "a/key"},
+		{Type: EventSet, Table: "watched", Key: "a/map"},
+		{Type: EventDelete, Table: "watched", Key: "a/map"},
+		{Type: EventExpire, Table: "watched", Key: "a/key"},
+	}
+
+	for _, expectedEvent := range expected {
+		select {
+		case event := <-events:
+			if event != expectedEvent {
+				t.Errorf("Event = %+v, expected %+v", event, expectedEvent)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No event, expected %+v", expectedEvent)
+		}
+	}
+
+	cancel()
+
+	for range events {
+	}
+}
+
+func TestRedisKeyspaceEventsEnabled(t *testing.T) {
+	flags := map[string]bool{
+		"":       false,
+		"Ex":     false,
+		"Kg$h":   false,
+		"Kg$hx":  true,
+		"Kx$gh":  true,
+		"KA":     true,
+		"AKE":    true,
+		"A":      false,
+		"KEg$hx": true,
+	}
+
+	for value, expected := range flags {
+		if redisKeyspaceEventsEnabled(value) != expected {
+			t.Errorf("redisKeyspaceEventsEnabled(%q) = %v", value, !expected)
+		}
+	}
+}
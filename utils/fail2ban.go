@@ -43,19 +43,19 @@ func CreateSimpleEvent(remoteAddress string) (*Event, error) {
 }
 
 func StoreBannedIP(dataStorage *storage.GenericStorage, event *Event, ttl int64) error {
-	err := dataStorage.SetKey(FAILED_IPS_TABLE, event.IP, event.IP, time.Duration(ttl)*time.Millisecond)
+	return dataStorage.WithTx(func(tx *storage.GenericTx) error {
+		expiration := time.Duration(ttl) * time.Millisecond
 
-	if err != nil {
-		return err
-	}
+		err := tx.SetKey(FAILED_IPS_TABLE, event.IP, event.IP, expiration)
 
-	err = dataStorage.AddToMap(FAILED_EVENTS_TABLE, event.IP, event.ID, event)
-
-	if err != nil {
-		return err
-	}
+		if err != nil {
+			return err
+		}
 
-	return nil
+		// The events go away with the ban instead of piling up until
+		// LogBannedIPs notices it has expired.
+		return tx.AddToMapWithTTL(FAILED_EVENTS_TABLE, event.IP, event.ID, event, expiration)
+	})
 }
 
 func LogBannedIPs(dataStorage *storage.GenericStorage) error {